@@ -52,6 +52,24 @@ func main() {
     return
   }
 
+  // Handlers that take a context can get at the process, the thread and the
+  // breakpoint itself, e.g. to look at the stack or to remove the breakpoint
+  // after a few hits.
+  _, err := p.SetBreakpoint("foo.c:bar", func (ctx *grace.BreakpointContext) grace.Action {
+    if frames, err := ctx.Process.Backtrace(ctx.Thread.Tid); err == nil && len(frames) > 1 {
+      fmt.Printf("bar called from %v\n", frames[1])
+    }
+    if ctx.Breakpoint.HitCount == 3 {
+      ctx.Process.RemoveBreakpoint(ctx.Breakpoint)
+    }
+    return grace.CONTINUE
+  })
+
+  if err != nil {
+    fmt.Printf("Failed setting breakpoint: %v\n", err)
+    return
+  }
+
   // Start the proces and the event loop
   p.StartProcess()
 }
@@ -0,0 +1,344 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/binary"
+  "unicode/utf16"
+)
+
+// cstringChunk is how much ReadCString asks for at a time. Reads never cross
+// a page boundary, so a string that ends just before an unmapped page can
+// still be read.
+const cstringChunk = 256
+const pageSize = 4096
+
+const errNegativeLength = TracerError("negative length")
+
+func (p *Process) byteOrder() binary.ByteOrder {
+  if p.ByteOrder == nil {
+    return binary.LittleEndian
+  }
+  return p.ByteOrder
+}
+
+func (p *Process) pointerSize() int {
+  if p.PointerSize == 0 {
+    return wordSize
+  }
+  return p.PointerSize
+}
+
+// readFull reads exactly size bytes at addr.
+func (p *Process) readFull(addr uint64, size int) ([]byte, error) {
+  buf := make([]byte, size)
+  if _, err := p.ReadMemory(addr, buf); err != nil {
+    return nil, err
+  }
+  return buf, nil
+}
+
+// ReadU8 reads a single byte from the target.
+func (p *Process) ReadU8(addr uint64) (uint8, error) {
+  buf, err := p.readFull(addr, 1)
+  if err != nil {
+    return 0, err
+  }
+  return buf[0], nil
+}
+
+// ReadU16 reads a 16-bit integer in the target's byte order.
+func (p *Process) ReadU16(addr uint64) (uint16, error) {
+  buf, err := p.readFull(addr, 2)
+  if err != nil {
+    return 0, err
+  }
+  return p.byteOrder().Uint16(buf), nil
+}
+
+// ReadU32 reads a 32-bit integer in the target's byte order.
+func (p *Process) ReadU32(addr uint64) (uint32, error) {
+  buf, err := p.readFull(addr, 4)
+  if err != nil {
+    return 0, err
+  }
+  return p.byteOrder().Uint32(buf), nil
+}
+
+// ReadU64 reads a 64-bit integer in the target's byte order.
+func (p *Process) ReadU64(addr uint64) (uint64, error) {
+  buf, err := p.readFull(addr, 8)
+  if err != nil {
+    return 0, err
+  }
+  return p.byteOrder().Uint64(buf), nil
+}
+
+// ReadI8 reads a signed byte from the target.
+func (p *Process) ReadI8(addr uint64) (int8, error) {
+  v, err := p.ReadU8(addr)
+  return int8(v), err
+}
+
+// ReadI16 reads a signed 16-bit integer in the target's byte order.
+func (p *Process) ReadI16(addr uint64) (int16, error) {
+  v, err := p.ReadU16(addr)
+  return int16(v), err
+}
+
+// ReadI32 reads a signed 32-bit integer in the target's byte order.
+func (p *Process) ReadI32(addr uint64) (int32, error) {
+  v, err := p.ReadU32(addr)
+  return int32(v), err
+}
+
+// ReadI64 reads a signed 64-bit integer in the target's byte order.
+func (p *Process) ReadI64(addr uint64) (int64, error) {
+  v, err := p.ReadU64(addr)
+  return int64(v), err
+}
+
+// ReadPointer reads a pointer-sized value, widened to 64 bits.
+func (p *Process) ReadPointer(addr uint64) (uint64, error) {
+  if p.pointerSize() == 4 {
+    v, err := p.ReadU32(addr)
+    return uint64(v), err
+  }
+  return p.ReadU64(addr)
+}
+
+// ReadCString reads a NUL-terminated string of at most max bytes. If no
+// terminator is found within max bytes, the first max bytes are returned.
+func (p *Process) ReadCString(addr uint64, max int) (string, error) {
+  var str []byte
+
+  for len(str) < max {
+    // Stay within the current page so an unmapped neighbor doesn't fail a
+    // string that ends before it.
+    size := cstringChunk
+    if left := pageSize - int(addr % pageSize); left < size {
+      size = left
+    }
+    if left := max - len(str); left < size {
+      size = left
+    }
+
+    chunk, err := p.readFull(addr, size)
+    if err != nil {
+      return string(str), err
+    }
+    if i := bytes.IndexByte(chunk, 0); i >= 0 {
+      return string(append(str, chunk[:i]...)), nil
+    }
+    str = append(str, chunk...)
+    addr += uint64(size)
+  }
+
+  return string(str), nil
+}
+
+// ReadWString reads a NUL-terminated wchar_t string of at most max
+// characters. wchar_t is 4 bytes (UTF-32) on Linux; use ReadUTF16String for
+// UTF-16 data such as Windows-style wide strings.
+func (p *Process) ReadWString(addr uint64, max int) (string, error) {
+  runes := []rune{}
+  for len(runes) < max {
+    c, err := p.ReadU32(addr)
+    if err != nil {
+      return string(runes), err
+    }
+    if c == 0 {
+      break
+    }
+    runes = append(runes, rune(c))
+    addr += 4
+  }
+  return string(runes), nil
+}
+
+// ReadUTF16String reads a NUL-terminated UTF-16 string of at most max code
+// units, decoding surrogate pairs.
+func (p *Process) ReadUTF16String(addr uint64, max int) (string, error) {
+  units := []uint16{}
+  var err error
+  for len(units) < max {
+    var c uint16
+    if c, err = p.ReadU16(addr); err != nil || c == 0 {
+      break
+    }
+    units = append(units, c)
+    addr += 2
+  }
+  return string(utf16.Decode(units)), err
+}
+
+// ReadStruct decodes the target memory at addr into v, which must be a
+// pointer to a fixed-size value as understood by encoding/binary. Fields are
+// read back to back, so any padding the target's compiler inserts must be
+// spelled out as explicit fields (e.g. _ [4]byte).
+func (p *Process) ReadStruct(addr uint64, v interface{}) error {
+  size := binary.Size(v)
+  if size < 0 {
+    return TracerError("ReadStruct: value does not have a fixed size")
+  }
+  buf, err := p.readFull(addr, size)
+  if err != nil {
+    return err
+  }
+  return binary.Read(bytes.NewReader(buf), p.byteOrder(), v)
+}
+
+// Cursor reads a sequence of values from consecutive addresses, as when
+// walking a packed record or an array of them. The first error stops all
+// further reads and is kept for Err, so a record can be decoded in one go and
+// checked once at the end:
+//
+//   c := p.NewCursor(addr)
+//   kind, length := c.U16(), c.U32()
+//   name := c.CString(64)
+//   if c.Err() != nil { ... }
+type Cursor struct {
+  // Addr is the address of the next value to be read
+  Addr  uint64
+  proc *Process
+  err   error
+}
+
+// NewCursor returns a Cursor positioned at addr.
+func (p *Process) NewCursor(addr uint64) *Cursor {
+  return &Cursor{Addr: addr, proc: p}
+}
+
+// Err returns the first error encountered by the cursor, if any.
+func (c *Cursor) Err() error {
+  return c.err
+}
+
+// Bytes returns the next n bytes.
+func (c *Cursor) Bytes(n int) []byte {
+  if n < 0 {
+    if c.err == nil {
+      c.err = errNegativeLength
+    }
+    return nil
+  }
+  if c.err != nil {
+    return make([]byte, n)
+  }
+  buf, err := c.proc.readFull(c.Addr, n)
+  if err != nil {
+    c.err = err
+    return make([]byte, n)
+  }
+  c.Addr += uint64(n)
+  return buf
+}
+
+// Skip advances the cursor by n bytes without reading them.
+func (c *Cursor) Skip(n int) {
+  c.Addr += uint64(n)
+}
+
+// Align advances the cursor to the next multiple of n, which must be a power
+// of two.
+func (c *Cursor) Align(n int) {
+  c.Addr = (c.Addr + uint64(n-1)) &^ uint64(n-1)
+}
+
+func (c *Cursor) U8() uint8 {
+  return c.Bytes(1)[0]
+}
+
+func (c *Cursor) U16() uint16 {
+  return c.proc.byteOrder().Uint16(c.Bytes(2))
+}
+
+func (c *Cursor) U32() uint32 {
+  return c.proc.byteOrder().Uint32(c.Bytes(4))
+}
+
+func (c *Cursor) U64() uint64 {
+  return c.proc.byteOrder().Uint64(c.Bytes(8))
+}
+
+func (c *Cursor) I8() int8 {
+  return int8(c.U8())
+}
+
+func (c *Cursor) I16() int16 {
+  return int16(c.U16())
+}
+
+func (c *Cursor) I32() int32 {
+  return int32(c.U32())
+}
+
+func (c *Cursor) I64() int64 {
+  return int64(c.U64())
+}
+
+// Pointer reads a pointer-sized value, widened to 64 bits.
+func (c *Cursor) Pointer() uint64 {
+  if c.proc.pointerSize() == 4 {
+    return uint64(c.U32())
+  }
+  return c.U64()
+}
+
+// CString reads a NUL-terminated string of at most max bytes and leaves the
+// cursor just past the terminator.
+func (c *Cursor) CString(max int) string {
+  if c.err != nil {
+    return ""
+  }
+  s, err := c.proc.ReadCString(c.Addr, max)
+  if err != nil {
+    c.err = err
+    return ""
+  }
+  c.Addr += uint64(len(s))
+  if len(s) < max {
+    c.Addr += 1
+  }
+  return s
+}
+
+// Struct decodes the next binary.Size(v) bytes into v. See ReadStruct.
+func (c *Cursor) Struct(v interface{}) {
+  if c.err != nil {
+    return
+  }
+  if err := c.proc.ReadStruct(c.Addr, v); err != nil {
+    c.err = err
+    return
+  }
+  c.Addr += uint64(binary.Size(v))
+}
@@ -0,0 +1,175 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "encoding/binary"
+  "testing"
+)
+
+func TestReadCString(t *testing.T) {
+  const base = 0x10000
+  data := make([]byte, 2*pageSize)
+  copy(data, "hello\x00")
+  // Across the boundary between the two pages
+  copy(data[pageSize-3:], "page\x00")
+  // Right up to the end of what's mapped
+  copy(data[2*pageSize-5:], "last\x00")
+  // Running off the end
+  copy(data[2*pageSize-16:], "unterminate")
+  p := &Process{target: &memBackend{base, data}}
+
+  tests := []struct {
+    addr  uint64
+    max   int
+    str   string
+    fail  bool
+  }{
+    {base, 100, "hello", false},
+    {base, 3, "hel", false},
+    {base, 0, "", false},
+    {base + pageSize - 3, 100, "page", false},
+    {base + 2*pageSize - 5, 1000, "last", false},
+    {base + 2*pageSize - 16, 1000, "unterminatelast", false},
+    {base + 2*pageSize - 4, 1000, "ast", false},
+    {base + 2*pageSize, 10, "", true},
+  }
+  for _, test := range tests {
+    str, err := p.ReadCString(test.addr, test.max)
+    if str != test.str || (err != nil) != test.fail {
+      t.Errorf("ReadCString(0x%x, %d) = %q, %v, want %q", test.addr, test.max, str, err, test.str)
+    }
+  }
+
+  // A string that runs into unmapped memory comes back as far as it got
+  data[len(data)-1] = 'x'
+  str, err := p.ReadCString(base + 2*pageSize - 5, 1000)
+  if str != "lastx" || err == nil {
+    t.Errorf("unterminated string = %q, %v", str, err)
+  }
+}
+
+func TestReadUTF16String(t *testing.T) {
+  const base = 0x10000
+  data := []byte{'h', 0, 'i', 0, 0x3d, 0xd8, 0x00, 0xde, 0, 0, '!', 0}
+  p := &Process{target: &memBackend{base, data}}
+
+  tests := []struct {
+    addr  uint64
+    max   int
+    str   string
+    fail  bool
+  }{
+    {base, 10, "hi\U0001f600", false},
+    {base, 1, "h", false},
+    // A surrogate pair cut in half
+    {base, 3, "hi�", false},
+    {base + 10, 10, "!", true},
+  }
+  for _, test := range tests {
+    str, err := p.ReadUTF16String(test.addr, test.max)
+    if str != test.str || (err != nil) != test.fail {
+      t.Errorf("ReadUTF16String(0x%x, %d) = %q, %v, want %q", test.addr, test.max, str, err, test.str)
+    }
+  }
+}
+
+func TestCursor(t *testing.T) {
+  const base = 0x10000
+  data := []byte{
+    0x01,
+    0x02, 0x03,
+    0x04, 0x05, 0x06, 0x07,
+    'a', 'b', 0,
+    0xff, 0xff, 0xff,
+    0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88,
+    0xfe, 0xff,
+  }
+  p := &Process{target: &memBackend{base, data}}
+  c := p.NewCursor(base)
+
+  if v := c.U8(); v != 0x01 {
+    t.Errorf("U8 = 0x%x", v)
+  }
+  if v := c.U16(); v != 0x0302 {
+    t.Errorf("U16 = 0x%x", v)
+  }
+  if v := c.U32(); v != 0x07060504 {
+    t.Errorf("U32 = 0x%x", v)
+  }
+  if s := c.CString(10); s != "ab" || c.Addr != base + 10 {
+    t.Errorf("CString = %q, now at 0x%x", s, c.Addr)
+  }
+  c.Skip(1)
+  c.Align(4)
+  if c.Addr != base + 12 {
+    t.Errorf("aligned to 0x%x", c.Addr)
+  }
+  c.Skip(1)
+  if v := c.Pointer(); v != 0x8877665544332211 {
+    t.Errorf("Pointer = 0x%x", v)
+  }
+  if v := c.I16(); v != -2 {
+    t.Errorf("I16 = %d", v)
+  }
+  if c.Err() != nil {
+    t.Fatal(c.Err())
+  }
+
+  // Reading past the end stops the cursor where it was
+  end := c.Addr
+  if v := c.U32(); v != 0 || c.Err() == nil || c.Addr != end {
+    t.Errorf("U32 past the end = 0x%x, %v, at 0x%x", v, c.Err(), c.Addr)
+  }
+  c = p.NewCursor(base)
+  var record struct {
+    A  uint8
+    B  uint16
+  }
+  c.Struct(&record)
+  if record.A != 1 || record.B != 0x0302 || c.Addr != base + 3 {
+    t.Errorf("Struct = %+v, now at 0x%x", record, c.Addr)
+  }
+
+  c = p.NewCursor(base)
+  if b := c.Bytes(-1); b != nil || c.Err() != errNegativeLength {
+    t.Errorf("Bytes(-1) = %v, %v", b, c.Err())
+  }
+  if v := c.U8(); v != 0 || c.Addr != base {
+    t.Errorf("U8 after an error = 0x%x, at 0x%x", v, c.Addr)
+  }
+
+  // Pointers are 4 bytes for 32-bit targets, in their byte order
+  p.PointerSize, p.ByteOrder = 4, binary.BigEndian
+  c = p.NewCursor(base + 3)
+  if v := c.Pointer(); v != 0x04050607 {
+    t.Errorf("32-bit Pointer = 0x%x", v)
+  }
+}
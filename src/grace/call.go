@@ -0,0 +1,269 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import "syscall"
+
+// Calling functions in the target, on one of its threads
+
+const errCallInterrupted = TracerError("the call was interrupted")
+const errNoEntry = TracerError("can't find the entry point of the executable")
+const errTooManyArgs = TracerError("too many arguments")
+const errNoStoppedThread = TracerError("no thread is stopped to do it on")
+
+// Call calls the function at symbol in the target with up to six integer or
+// pointer arguments, and returns what it returned. It runs on the thread
+// whose stop is being handled, or the main thread, whose registers are put
+// back afterwards; the others run meanwhile. It may be called from a
+// breakpoint handler, or while the process is stopped.
+func (p *Process) Call(symbol string, args ...uint64) (uint64, error) {
+  addr, err := p.resolveLoaded(symbol)
+  if err != nil {
+    return 0, err
+  }
+  t, err := p.callThread()
+  if err != nil {
+    return 0, err
+  }
+  return p.callFunction(t, addr, args...)
+}
+
+// Mmap maps size bytes of anonymous private memory into the target, with
+// protection prot, e.g. syscall.PROT_READ|syscall.PROT_WRITE, and returns
+// its address. It makes the system call itself, so it works before libc is
+// loaded.
+func (p *Process) Mmap(size uint64, prot int) (uint64, error) {
+  addr, err := p.mmap(0, size, prot, syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS)
+  if err == nil {
+    p.Memory.Refresh()
+  }
+  return addr, err
+}
+
+// Munmap unmaps memory from the target, e.g. what Mmap returned.
+func (p *Process) Munmap(addr, size uint64) error {
+  t, err := p.callThread()
+  if err != nil {
+    return err
+  }
+  ret, err := p.remoteSyscall(t, syscall.SYS_MUNMAP, addr, size)
+  if err != nil {
+    return err
+  }
+  if ret != 0 {
+    return syscall.Errno(-ret)
+  }
+  p.Memory.Refresh()
+  return nil
+}
+
+// mmap is mmap(2) in the target.
+func (p *Process) mmap(addr, size uint64, prot, flags int) (uint64, error) {
+  t, err := p.callThread()
+  if err != nil {
+    return 0, err
+  }
+  ret, err := p.remoteSyscall(t, syscall.SYS_MMAP, addr, size, uint64(prot),
+                              uint64(flags), ^uint64(0), 0)
+  if err != nil {
+    return 0, err
+  }
+  if ret > ^uint64(0) - 4095 {
+    return 0, syscall.Errno(-ret)
+  }
+  return ret, nil
+}
+
+// callThread returns the thread to call functions on: the current one or the
+// main one, or else any that is stopped.
+func (p *Process) callThread() (*Thread, error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  t := p.Threads[p.stoppedTid()]
+  if t == nil || ! t.stopped {
+    return nil, errNoStoppedThread
+  }
+  return t, nil
+}
+
+// argRegs are where the System V AMD64 ABI passes integer arguments
+var argRegs = []func(*RegisterState) *uint64{
+  func(r *RegisterState) *uint64 { return &r.Rdi },
+  func(r *RegisterState) *uint64 { return &r.Rsi },
+  func(r *RegisterState) *uint64 { return &r.Rdx },
+  func(r *RegisterState) *uint64 { return &r.Rcx },
+  func(r *RegisterState) *uint64 { return &r.R8 },
+  func(r *RegisterState) *uint64 { return &r.R9 },
+}
+
+// callFunction runs the function at addr on thread t, which must be stopped,
+// and returns what it left in RAX. Everything but the stack below the red
+// zone is as it was afterwards. The call returns to the executable's entry
+// point, which nothing runs once the program has started.
+func (p *Process) callFunction(t *Thread, addr uint64, args ...uint64) (uint64, error) {
+  if len(args) > len(argRegs) {
+    return 0, errTooManyArgs
+  }
+  ret, err := p.entryPoint()
+  if err != nil {
+    return 0, err
+  }
+  saved, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return 0, err
+  }
+
+  regs := *saved
+  for i, arg := range args {
+    *argRegs[i](&regs) = arg
+  }
+  // Leave the red zone alone, and keep the stack aligned as it would be
+  // after a call instruction
+  sp := (saved.Rsp - 128) &^ 15 - 8
+  buf := make([]byte, 8)
+  p.byteOrder().PutUint64(buf, ret)
+  if _, err := p.WriteMemory(sp, buf); err != nil {
+    return 0, err
+  }
+  regs.Rsp = sp
+  regs.Rax = 0
+  regs.Orig_rax = ^uint64(0)
+  regs.SetPC(addr)
+  if err := p.backend().setRegisters(t.Tid, &regs); err != nil {
+    return 0, err
+  }
+
+  // Resuming for the call mustn't take t past a breakpoint it's been left on
+  hold, over := p.holdStops, t.resumeOver
+  p.holdStops, t.resumeOver = true, nil
+  res, err := p.runTo(t, ret, sp + 8, 0)
+  p.holdStops, t.resumeOver = hold, over
+  if _, ok := p.Threads[t.Tid]; ! ok {
+    return 0, errCallInterrupted
+  }
+  p.current = t
+  if err == nil && res != nil {
+    err = errCallInterrupted
+  }
+
+  var result uint64
+  if after, e := p.backend().getRegisters(t.Tid); e == nil {
+    result = after.Rax
+  }
+  if e := p.backend().setRegisters(t.Tid, saved); e != nil && err == nil {
+    err = e
+  }
+  return result, err
+}
+
+// syscallArgRegs are where the kernel takes system call arguments
+var syscallArgRegs = []func(*RegisterState) *uint64{
+  func(r *RegisterState) *uint64 { return &r.Rdi },
+  func(r *RegisterState) *uint64 { return &r.Rsi },
+  func(r *RegisterState) *uint64 { return &r.Rdx },
+  func(r *RegisterState) *uint64 { return &r.R10 },
+  func(r *RegisterState) *uint64 { return &r.R8 },
+  func(r *RegisterState) *uint64 { return &r.R9 },
+}
+
+// remoteSyscall makes system call nr on thread t, which must be stopped, and
+// returns its result. It needs nothing from libc: a syscall instruction is
+// put at the entry point for t to step over.
+func (p *Process) remoteSyscall(t *Thread, nr int, args ...uint64) (uint64, error) {
+  if len(args) > len(syscallArgRegs) {
+    return 0, errTooManyArgs
+  }
+  at, err := p.entryPoint()
+  if err != nil {
+    return 0, err
+  }
+  saved, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return 0, err
+  }
+
+  regs := *saved
+  for i, arg := range args {
+    *syscallArgRegs[i](&regs) = arg
+  }
+  regs.Rax = uint64(nr)
+  regs.Orig_rax = ^uint64(0)
+  regs.SetPC(at)
+
+  code := []byte{0x0f, 0x05}
+  if err := p.SwapBytesText(at, code); err != nil {
+    return 0, err
+  }
+  defer p.SwapBytesText(at, code)
+  defer p.backend().setRegisters(t.Tid, saved)
+  if err := p.backend().setRegisters(t.Tid, &regs); err != nil {
+    return 0, err
+  }
+
+  // A signal can get in first, in which case it's left for the event loop
+  // and the step is tried again
+  for {
+    status, err := p.stepThread(t)
+    if err != nil {
+      return 0, err
+    }
+    if ! status.Stopped() {
+      p.exited(t, t, status)
+      return 0, errCallInterrupted
+    }
+    after, err := p.backend().getRegisters(t.Tid)
+    if err != nil {
+      return 0, err
+    }
+    if after.PC() != at {
+      return after.Rax, nil
+    }
+    switch sig := status.StopSignal(); {
+    case sig == syscall.SIGSTOP && p.ownStop(t):
+    case sig != syscall.SIGTRAP:
+      p.pending = append(p.pending, threadEvent{t.Tid, status})
+    }
+  }
+}
+
+// entryPoint returns where the executable starts running.
+func (p *Process) entryPoint() (uint64, error) {
+  m := p.MainModule()
+  if m == nil {
+    return 0, errNoEntry
+  }
+  f, err := m.open()
+  if err != nil {
+    return 0, err
+  }
+  defer f.Close()
+  return f.Entry + m.Bias, nil
+}
@@ -0,0 +1,327 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "path"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Tracing calls, in the manner of ltrace or uftrace. Every traced function
+// gets a breakpoint on entry, and each place one of them returns to gets one
+// too, the first time a call is seen from there. The stack pointer tells
+// which calls a return ends, so longjmp and tail calls don't confuse it.
+
+// CallTraceOptions say what TraceCalls traces and records.
+type CallTraceOptions struct {
+  // Functions is a glob the names of the functions to trace must match, e.g.
+  // "str*". Empty means all of them.
+  Functions    string
+  // MaxDepth leaves out calls nested deeper than that, if it's set
+  MaxDepth     int
+  // MinDuration leaves out calls that took less time than that from
+  // WriteTree
+  MinDuration  time.Duration
+  // CallerModules, if set, only records calls made from code in those
+  // modules, given as paths or base names
+  CallerModules []string
+}
+
+// CallTrace is the calls traced by TraceCalls.
+type CallTrace struct {
+  // Calls are the outermost calls recorded, in the order they were made
+  Calls     []*TracedCall
+  // Start is when tracing started
+  Start     time.Time
+
+  callTracker
+  opts      CallTraceOptions
+  entries   map[uint64]string
+}
+
+// TracedCall is one call of a traced function.
+type TracedCall struct {
+  Thread    int
+  Function  string
+  Address   uint64
+  // CallSite is where the function was called from, i.e. the return address
+  CallSite  uint64
+  Depth     int
+  Start     time.Time
+  // End is only set if the return was seen
+  End       time.Time
+  Calls     []*TracedCall
+}
+
+// Duration returns how long the call took, or zero if it hasn't returned.
+func (c *TracedCall) Duration() time.Duration {
+  if c.End.IsZero() {
+    return 0
+  }
+  return c.End.Sub(c.Start)
+}
+
+// callTracker is what CallTrace and LibraryTrace have in common: their
+// breakpoints, on the functions traced and on the places those return to,
+// and the calls each thread is in.
+type callTracker struct {
+  proc      *Process
+  bps     []*Breakpoint
+  returns   map[uint64]bool
+  stacks    map[int][]callFrame
+}
+
+// callFrame is a call a thread is in, with what the trace keeps for it, if
+// anything.
+type callFrame struct {
+  call  interface{}
+  sp    uint64    // the stack pointer on entry, where the return address is
+}
+
+func newCallTracker(p *Process) callTracker {
+  return callTracker{proc: p, returns: make(map[uint64]bool),
+                     stacks: make(map[int][]callFrame)}
+}
+
+// setBreakpoint puts one of the trace's breakpoints at addr.
+func (ct *callTracker) setBreakpoint(addr uint64, h BreakpointHandler) error {
+  bp, err := ct.proc.setBreakpointAt(addr, h, true)
+  if err == nil {
+    ct.bps = append(ct.bps, bp)
+  }
+  return err
+}
+
+// push records that thread tid called a function with its stack pointer at
+// sp, which returns to ret. The first call seen to return there sets a
+// breakpoint on ret with returned as the handler.
+func (ct *callTracker) push(tid int, sp, ret uint64, call interface{},
+                            returned BreakpointHandler) {
+  ct.stacks[tid] = append(ct.stacks[tid], callFrame{call, sp})
+  if ! ct.returns[ret] {
+    ct.returns[ret] = true
+    ct.setBreakpoint(ret, returned)
+  }
+}
+
+// unwind drops the calls of thread tid that have returned, or been left by
+// longjmp, by the time its stack pointer is sp, and returns the rest.
+func (ct *callTracker) unwind(tid int, sp uint64) []callFrame {
+  stack := ct.stacks[tid]
+  for len(stack) > 0 && stack[len(stack)-1].sp < sp {
+    stack = stack[:len(stack)-1]
+  }
+  ct.stacks[tid] = stack
+  return stack
+}
+
+// pop is unwind for a return of thread tid, which leaves its stack pointer
+// at sp. It returns the calls that ended, innermost first.
+func (ct *callTracker) pop(tid int, sp uint64) []callFrame {
+  stack := ct.stacks[tid]
+  rest := ct.unwind(tid, sp)
+  ended := []callFrame{}
+  for i := len(stack) - 1; i >= len(rest); i-- {
+    ended = append(ended, stack[i])
+  }
+  return ended
+}
+
+// Stop removes the breakpoints of the trace. What was recorded stays.
+func (ct *callTracker) Stop() error {
+  var err error
+  for _, bp := range ct.bps {
+    if e := ct.proc.RemoveBreakpoint(bp); e != nil && e != errNoBreakpoint && err == nil {
+      err = e
+    }
+  }
+  ct.bps = nil
+  return err
+}
+
+// TraceCalls traces calls to the functions of the module named, given as a
+// path or a base name, or of the executable if it's empty. Functions the
+// symbol table doesn't give a size for, or that already have a breakpoint,
+// are left out.
+func (p *Process) TraceCalls(module string, opts CallTraceOptions) (*CallTrace, error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  p.Memory.Refresh()
+  m := p.MainModule()
+  if module != "" {
+    m = p.FindModule(module)
+  }
+  if m == nil {
+    return nil, errNoModule
+  }
+  for _, name := range opts.CallerModules {
+    if p.FindModule(name) == nil {
+      return nil, errNoModule
+    }
+  }
+
+  c := &CallTrace{Start: time.Now(), callTracker: newCallTracker(p), opts: opts,
+                  entries: make(map[uint64]string)}
+  for _, sym := range m.Symbols() {
+    if ! sym.Func || sym.Size == 0 || c.entries[sym.Address] != "" {
+      continue
+    }
+    if opts.Functions != "" {
+      if ok, err := path.Match(opts.Functions, sym.Name); err != nil {
+        return nil, err
+      } else if ! ok {
+        continue
+      }
+    }
+    if c.setBreakpoint(sym.Address, c.entered) == nil {
+      c.entries[sym.Address] = sym.Name
+    }
+  }
+  return c, nil
+}
+
+// entered is the handler of the entry breakpoints.
+func (c *CallTrace) entered(ctx *BreakpointContext) Action {
+  p := ctx.Process
+  tid, sp := ctx.Thread.Tid, ctx.Regs.Rsp
+  ret, err := p.ReadU64(sp)
+  if err != nil {
+    return CONTINUE
+  }
+
+  // Calls left by longjmp or the like are over
+  stack := c.unwind(tid, sp)
+  var parent *TracedCall
+  depth := 0
+  for i := len(stack) - 1; i >= 0; i-- {
+    if call := stack[i].call.(*TracedCall); call != nil {
+      parent = call
+      depth = parent.Depth + 1
+      break
+    }
+  }
+
+  var call *TracedCall
+  if c.records(depth, ret) {
+    call = &TracedCall{Thread: tid, Function: c.entries[ctx.Breakpoint.Address],
+                       Address: ctx.Breakpoint.Address, CallSite: ret, Depth: depth,
+                       Start: ctx.Time}
+    if parent != nil {
+      parent.Calls = append(parent.Calls, call)
+    } else {
+      c.Calls = append(c.Calls, call)
+    }
+  }
+  c.push(tid, sp, ret, call, c.returned)
+  return CONTINUE
+}
+
+// returned is the handler of the breakpoints on return addresses.
+func (c *CallTrace) returned(ctx *BreakpointContext) Action {
+  tid := ctx.Thread.Tid
+  for _, frame := range c.pop(tid, ctx.Regs.Rsp) {
+    if call := frame.call.(*TracedCall); call != nil {
+      call.End = ctx.Time
+      if call.Duration() >= c.opts.MinDuration {
+        c.proc.recorder.span(tid, call.Function, "call", call.Start, call.End,
+                             map[string]interface{}{"caller": c.proc.Symbolize(call.CallSite)})
+      }
+    }
+  }
+  return CONTINUE
+}
+
+// records reports whether a call at depth from ret is to be recorded.
+func (c *CallTrace) records(depth int, ret uint64) bool {
+  if c.opts.MaxDepth > 0 && depth >= c.opts.MaxDepth {
+    return false
+  }
+  if len(c.opts.CallerModules) == 0 {
+    return true
+  }
+  m := c.proc.ModuleAt(ret)
+  if m == nil {
+    return false
+  }
+  for _, name := range c.opts.CallerModules {
+    if m.Path == name || m.Name() == name {
+      return true
+    }
+  }
+  return false
+}
+
+// WriteTree writes the calls of each thread as an indented tree, with when
+// each was made relative to the start of the trace and how long it took:
+//
+//   thread 4242
+//       0.000112s  main  1.204ms
+//       0.000131s    square  3.1µs
+func (c *CallTrace) WriteTree(w io.Writer) error {
+  byThread := make(map[int][]*TracedCall)
+  tids := []int{}
+  for _, call := range c.Calls {
+    if _, ok := byThread[call.Thread]; ! ok {
+      tids = append(tids, call.Thread)
+    }
+    byThread[call.Thread] = append(byThread[call.Thread], call)
+  }
+  sort.Ints(tids)
+
+  bw := bufio.NewWriter(w)
+  for _, tid := range tids {
+    fmt.Fprintf(bw, "thread %d\n", tid)
+    for _, call := range byThread[tid] {
+      c.writeCall(bw, call, 0)
+    }
+  }
+  return bw.Flush()
+}
+
+func (c *CallTrace) writeCall(w io.Writer, call *TracedCall, indent int) {
+  took := "(no return)"
+  if ! call.End.IsZero() {
+    if call.Duration() < c.opts.MinDuration {
+      return
+    }
+    took = call.Duration().String()
+  }
+  fmt.Fprintf(w, "  %12.6fs  %s%s  %s\n", call.Start.Sub(c.Start).Seconds(),
+              strings.Repeat("  ", indent), call.Function, took)
+  for _, child := range call.Calls {
+    c.writeCall(w, child, indent + 1)
+  }
+}
@@ -0,0 +1,157 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/binary"
+  "testing"
+  "time"
+)
+
+// callEvent is a call made by a thread, or with fn zero, a return
+type callEvent struct {
+  tid   int
+  fn    uint64
+  ret   uint64
+  at    time.Duration
+}
+
+// replayCalls runs the handlers of c as the events happen. Each thread's
+// stack starts at the top of its own page of stack.
+func replayCalls(c *CallTrace, events []callEvent) {
+  backend := c.proc.target.(*memBackend)
+  sps := make(map[int]uint64)
+  for _, e := range events {
+    sp, ok := sps[e.tid]
+    if ! ok {
+      sp = backend.base + uint64(e.tid) * 0x1000
+    }
+    ctx := &BreakpointContext{Process: c.proc, Thread: &Thread{Tid: e.tid},
+                              Regs: &RegisterState{}, Time: c.Start.Add(e.at)}
+    if e.fn != 0 {
+      sp -= 8
+      binary.LittleEndian.PutUint64(backend.data[sp-backend.base:], e.ret)
+      ctx.Regs.Rsp = sp
+      ctx.Breakpoint = &Breakpoint{Address: e.fn}
+      c.entered(ctx)
+    } else {
+      sp += 8
+      ctx.Regs.Rsp = sp
+      c.returned(ctx)
+    }
+    sps[e.tid] = sp
+  }
+}
+
+func TestCallTraceTree(t *testing.T) {
+  const (
+    main, leaf, deep, callback = 0x400100, 0x400200, 0x400300, 0x400400
+    fromStart, fromMain, fromLeaf, fromLibc = 0x400010, 0x400110, 0x400210, 0x7f0000000100
+  )
+  ms := time.Millisecond
+  events := []callEvent{
+    {1, main, fromStart, 0},
+    {1, leaf, fromMain, 1*ms},
+    {1, deep, fromLeaf, 2*ms},
+    {1, 0, 0, 3*ms},
+    {2, leaf, fromMain, 4*ms},
+    {1, 0, 0, 5*ms},
+    {1, callback, fromLibc, 6*ms},
+    {1, 0, 0, 7*ms},
+    {2, 0, 0, 8*ms},
+    {1, 0, 0, 10*ms},
+    {2, deep, fromLeaf, 11*ms},
+  }
+
+  tests := []struct {
+    name  string
+    opts  CallTraceOptions
+    want  string
+  }{
+    {"all", CallTraceOptions{},
+     "thread 1\n" +
+     "      0.000000s  main  10ms\n" +
+     "      0.001000s    leaf  4ms\n" +
+     "      0.002000s      deep  1ms\n" +
+     "      0.006000s    callback  1ms\n" +
+     "thread 2\n" +
+     "      0.004000s  leaf  4ms\n" +
+     "      0.011000s  deep  (no return)\n"},
+    {"max depth", CallTraceOptions{MaxDepth: 2},
+     "thread 1\n" +
+     "      0.000000s  main  10ms\n" +
+     "      0.001000s    leaf  4ms\n" +
+     "      0.006000s    callback  1ms\n" +
+     "thread 2\n" +
+     "      0.004000s  leaf  4ms\n" +
+     "      0.011000s  deep  (no return)\n"},
+    {"min duration", CallTraceOptions{MinDuration: 2*ms},
+     "thread 1\n" +
+     "      0.000000s  main  10ms\n" +
+     "      0.001000s    leaf  4ms\n" +
+     "thread 2\n" +
+     "      0.004000s  leaf  4ms\n" +
+     "      0.011000s  deep  (no return)\n"},
+    {"callers in the executable", CallTraceOptions{CallerModules: []string{"app"}},
+     "thread 1\n" +
+     "      0.000000s  main  10ms\n" +
+     "      0.001000s    leaf  4ms\n" +
+     "      0.002000s      deep  1ms\n" +
+     "thread 2\n" +
+     "      0.004000s  leaf  4ms\n" +
+     "      0.011000s  deep  (no return)\n"},
+    {"callers in libc", CallTraceOptions{CallerModules: []string{"/lib/libc.so.6"}},
+     "thread 1\n" +
+     "      0.006000s  callback  1ms\n"},
+  }
+
+  memory := &MemoryMap{}
+  modules := []*Module{
+    {Path: "/bin/app", Start: 0x400000, End: 0x401000, loaded: true},
+    {Path: "/lib/libc.so.6", Start: 0x7f0000000000, End: 0x7f0000001000, loaded: true},
+  }
+  for _, test := range tests {
+    p := &Process{Memory: memory, modules: modules, modulesMap: memory,
+                  target: &memBackend{0x7000, make([]byte, 0x3000)}}
+    c := &CallTrace{Start: time.Unix(1000, 0), callTracker: newCallTracker(p), opts: test.opts,
+                    entries: map[uint64]string{main: "main", leaf: "leaf", deep: "deep",
+                                               callback: "callback"}}
+    replayCalls(c, events)
+
+    var buf bytes.Buffer
+    if err := c.WriteTree(&buf); err != nil {
+      t.Fatal(err)
+    }
+    if got := buf.String(); got != test.want {
+      t.Errorf("%s: WriteTree wrote\n%s\nwant\n%s", test.name, got, test.want)
+    }
+  }
+}
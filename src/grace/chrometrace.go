@@ -0,0 +1,197 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "io"
+  "syscall"
+  "time"
+)
+
+// Recording what happens to the target as Chrome trace events, which
+// chrome://tracing and the Perfetto UI open.
+
+// RecordOptions say what a TraceRecorder records on top of breakpoint hits,
+// signals and the calls of CallTraces and LibraryTraces.
+type RecordOptions struct {
+  // Syscalls records every system call as a span, which means stopping
+  // twice for each
+  Syscalls  bool
+}
+
+// TraceRecorder collects events from a process.
+type TraceRecorder struct {
+  proc      *Process
+  opts      RecordOptions
+  start     time.Time
+  events  []chromeEvent
+  names     map[uint64]string
+  syscalls  map[int]pendingSyscall
+}
+
+// pendingSyscall is a system call a thread is in
+type pendingSyscall struct {
+  number  int
+  args    [6]uint64
+  start   time.Time
+}
+
+// chromeEvent is an event in the Chrome trace event format. Times are in
+// microseconds.
+type chromeEvent struct {
+  Name   string                  `json:"name"`
+  Cat    string                  `json:"cat,omitempty"`
+  Ph     string                  `json:"ph"`
+  Ts     float64                 `json:"ts"`
+  Dur    float64                 `json:"dur,omitempty"`
+  Pid    int                     `json:"pid"`
+  Tid    int                     `json:"tid"`
+  Scope  string                  `json:"s,omitempty"`
+  Args   map[string]interface{}  `json:"args,omitempty"`
+}
+
+// RecordTrace starts recording events from the process, until Stop is
+// called. Only one recorder can be active at a time; this replaces any other.
+func (p *Process) RecordTrace(opts RecordOptions) *TraceRecorder {
+  r := &TraceRecorder{proc: p, opts: opts, start: time.Now(), names: make(map[uint64]string),
+                      syscalls: make(map[int]pendingSyscall)}
+  p.recorder = r
+  return r
+}
+
+// Stop stops recording. What was recorded can still be written.
+func (r *TraceRecorder) Stop() {
+  if r.proc.recorder == r {
+    r.proc.recorder = nil
+  }
+}
+
+// WriteChromeTrace writes the events recorded as Chrome trace event JSON.
+func (r *TraceRecorder) WriteChromeTrace(w io.Writer) error {
+  events := []chromeEvent{{Name: "process_name", Ph: "M", Pid: r.proc.Pid,
+                           Args: map[string]interface{}{"name": r.proc.Filename}}}
+  seen := make(map[int]bool)
+  for _, ev := range r.events {
+    if ! seen[ev.Tid] {
+      seen[ev.Tid] = true
+      events = append(events, chromeEvent{Name: "thread_name", Ph: "M", Pid: r.proc.Pid,
+          Tid: ev.Tid, Args: map[string]interface{}{"name": fmt.Sprintf("thread %d", ev.Tid)}})
+    }
+  }
+  events = append(events, r.events...)
+
+  bw := bufio.NewWriter(w)
+  enc := json.NewEncoder(bw)
+  if err := enc.Encode(struct {
+    TraceEvents      []chromeEvent  `json:"traceEvents"`
+    DisplayTimeUnit  string         `json:"displayTimeUnit"`
+  }{events, "ns"}); err != nil {
+    return err
+  }
+  return bw.Flush()
+}
+
+// micros returns how long after the start of the recording t is.
+func (r *TraceRecorder) micros(t time.Time) float64 {
+  return float64(t.Sub(r.start).Nanoseconds()) / 1000
+}
+
+// name returns what to call the code at addr.
+func (r *TraceRecorder) name(addr uint64) string {
+  name, ok := r.names[addr]
+  if ! ok {
+    name = r.proc.Symbolize(addr)
+    r.names[addr] = name
+  }
+  return name
+}
+
+// instant records something that happened to thread tid at t.
+func (r *TraceRecorder) instant(tid int, name, cat string, t time.Time, args map[string]interface{}) {
+  if r == nil {
+    return
+  }
+  r.events = append(r.events, chromeEvent{Name: name, Cat: cat, Ph: "i", Ts: r.micros(t),
+                                          Pid: r.proc.Pid, Tid: tid, Scope: "t", Args: args})
+}
+
+// span records something thread tid did from start to end.
+func (r *TraceRecorder) span(tid int, name, cat string, start, end time.Time, args map[string]interface{}) {
+  if r == nil {
+    return
+  }
+  r.events = append(r.events, chromeEvent{Name: name, Cat: cat, Ph: "X", Ts: r.micros(start),
+                                          Dur: r.micros(end) - r.micros(start),
+                                          Pid: r.proc.Pid, Tid: tid, Args: args})
+}
+
+// breakpointHit records a hit of bp by thread tid.
+func (r *TraceRecorder) breakpointHit(tid int, bp *Breakpoint, t time.Time) {
+  if r == nil {
+    return
+  }
+  r.instant(tid, r.name(bp.Address), "breakpoint", t,
+            map[string]interface{}{"address": fmt.Sprintf("0x%x", bp.Address), "hits": bp.HitCount})
+}
+
+// signal records sig being delivered to thread tid.
+func (r *TraceRecorder) signal(tid int, sig syscall.Signal) {
+  if r == nil {
+    return
+  }
+  r.instant(tid, signalName(sig), "signal", time.Now(), map[string]interface{}{"signo": int(sig)})
+}
+
+// syscallEntered and syscallExited record a system call of thread tid as a
+// span.
+func (r *TraceRecorder) syscallEntered(tid, number int, args [6]uint64) {
+  if r == nil || ! r.opts.Syscalls {
+    return
+  }
+  r.syscalls[tid] = pendingSyscall{number, args, time.Now()}
+}
+
+func (r *TraceRecorder) syscallExited(tid int, ret uint64) {
+  if r == nil {
+    return
+  }
+  call, ok := r.syscalls[tid]
+  if ! ok {
+    return
+  }
+  delete(r.syscalls, tid)
+  name := syscallName(call.number)
+  r.span(tid, name, "syscall", call.start, time.Now(), map[string]interface{}{
+    "args": fmt.Sprintf("0x%x, 0x%x, 0x%x", call.args[0], call.args[1], call.args[2]),
+    "return": int64(ret)})
+}
@@ -0,0 +1,140 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/json"
+  "syscall"
+  "testing"
+  "time"
+)
+
+func TestWriteChromeTrace(t *testing.T) {
+  p := &Process{Pid: 100, Filename: "/bin/target", Memory: &MemoryMap{}}
+  start := time.Now()
+  r := &TraceRecorder{proc: p, start: start, names: make(map[uint64]string),
+                      syscalls: make(map[int]pendingSyscall)}
+  r.breakpointHit(101, &Breakpoint{Address: 0x401000, HitCount: 2}, start.Add(1500 * time.Nanosecond))
+  r.span(100, "main", "call", start.Add(2 * time.Microsecond), start.Add(5 * time.Microsecond), nil)
+  r.instant(101, "SIGSEGV", "signal", start.Add(7 * time.Microsecond),
+            map[string]interface{}{"signo": int(syscall.SIGSEGV)})
+
+  var buf bytes.Buffer
+  if err := r.WriteChromeTrace(&buf); err != nil {
+    t.Fatal(err)
+  }
+  var trace struct {
+    TraceEvents      []map[string]interface{}  `json:"traceEvents"`
+    DisplayTimeUnit  string                    `json:"displayTimeUnit"`
+  }
+  if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+    t.Fatalf("%v in %s", err, buf.String())
+  }
+  if trace.DisplayTimeUnit != "ns" {
+    t.Errorf("displayTimeUnit %q", trace.DisplayTimeUnit)
+  }
+
+  tests := []struct {
+    name  string
+    ph    string
+    ts    float64
+    dur   float64
+    tid   float64
+    s     string
+    arg   string
+    val   interface{}
+  }{
+    {"process_name", "M", 0, 0, 0, "", "name", "/bin/target"},
+    {"thread_name", "M", 0, 0, 101, "", "name", "thread 101"},
+    {"thread_name", "M", 0, 0, 100, "", "name", "thread 100"},
+    {"0x401000", "i", 1.5, 0, 101, "t", "hits", float64(2)},
+    {"main", "X", 2, 3, 100, "", "", nil},
+    {"SIGSEGV", "i", 7, 0, 101, "t", "signo", float64(syscall.SIGSEGV)},
+  }
+  if len(trace.TraceEvents) != len(tests) {
+    t.Fatalf("%d events, want %d: %v", len(trace.TraceEvents), len(tests), trace.TraceEvents)
+  }
+  for i, test := range tests {
+    ev := trace.TraceEvents[i]
+    if ev["name"] != test.name || ev["ph"] != test.ph || ev["pid"] != float64(100) ||
+       ev["tid"] != test.tid {
+      t.Errorf("event %d is %v, want %s %s in thread %v", i, ev, test.name, test.ph, test.tid)
+    }
+    ts, _ := ev["ts"].(float64)
+    dur, _ := ev["dur"].(float64)
+    s, _ := ev["s"].(string)
+    if ts != test.ts || dur != test.dur || s != test.s {
+      t.Errorf("event %d at %v for %v, scope %q; want %v for %v, scope %q", i, ts, dur, s,
+               test.ts, test.dur, test.s)
+    }
+    if test.arg != "" {
+      args, _ := ev["args"].(map[string]interface{})
+      if args[test.arg] != test.val {
+        t.Errorf("event %d args %v, want %s %v", i, args, test.arg, test.val)
+      }
+    }
+  }
+}
+
+func TestTraceRecorderNil(t *testing.T) {
+  var r *TraceRecorder
+  r.breakpointHit(1, &Breakpoint{}, time.Now())
+  r.signal(1, syscall.SIGINT)
+  r.syscallEntered(1, syscall.SYS_READ, [6]uint64{})
+  r.syscallExited(1, 0)
+}
+
+func TestTraceRecorderSyscalls(t *testing.T) {
+  p := &Process{Pid: 100}
+  for _, syscalls := range []bool{false, true} {
+    r := p.RecordTrace(RecordOptions{Syscalls: syscalls})
+    r.syscallEntered(100, syscall.SYS_READ, [6]uint64{3, 0x1000, 16})
+    r.syscallExited(100, 16)
+    r.Stop()
+    if p.recorder != nil {
+      t.Errorf("recorder still set after Stop")
+    }
+    if ! syscalls {
+      if len(r.events) != 0 {
+        t.Errorf("system calls recorded without Syscalls: %v", r.events)
+      }
+      continue
+    }
+    if len(r.events) != 1 {
+      t.Fatalf("%d events, want 1", len(r.events))
+    }
+    ev := r.events[0]
+    if ev.Name != "read" || ev.Cat != "syscall" || ev.Ph != "X" || ev.Tid != 100 ||
+       ev.Args["args"] != "0x3, 0x1000, 0x10" || ev.Args["return"] != int64(16) {
+      t.Errorf("read recorded as %+v", ev)
+    }
+  }
+}
@@ -0,0 +1,432 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bufio"
+  "bytes"
+  "debug/elf"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "syscall"
+  "unsafe"
+)
+
+// Note types that debug/elf doesn't define
+const (
+  ntPrstatus  = 1
+  ntFpregset  = 2
+  ntPrpsinfo  = 3
+  ntAuxv      = 6
+  ntFile      = 0x46494c45
+)
+
+// pnXnum in e_phnum means the real count is in the sh_info of section 0
+const pnXnum = 0xffff
+
+// ptraceGetFPRegs is PTRACE_GETFPREGS, returning the raw user_fpregs_struct.
+func ptraceGetFPRegs(tid int) ([]byte, error) {
+  regs := make([]byte, 512)
+  _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GETFPREGS,
+                                  uintptr(tid), 0,
+                                  uintptr(unsafe.Pointer(&regs[0])), 0, 0)
+  if errno != 0 {
+    return nil, errno
+  }
+  return regs, nil
+}
+
+// procStat is the part of /proc/pid/stat that goes into a core file.
+type procStat struct {
+  state                      byte
+  ppid, pgrp, sid            int32
+  flags                      uint64
+  nice                       int8
+  utime, stime               uint64
+  cutime, cstime             uint64
+}
+
+func readProcStat(path string) (st procStat, err error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return
+  }
+  // The command name is in parentheses and may itself contain them
+  end := bytes.LastIndexByte(data, ')')
+  if end < 0 {
+    return st, fmt.Errorf("malformed %s", path)
+  }
+  fields := strings.Fields(string(data[end+1:]))
+  if len(fields) < 17 {
+    return st, fmt.Errorf("malformed %s", path)
+  }
+
+  num := func(i int) int64 {
+    v, _ := strconv.ParseInt(fields[i], 10, 64)
+    return v
+  }
+  st.state = fields[0][0]
+  st.ppid, st.pgrp, st.sid = int32(num(1)), int32(num(2)), int32(num(3))
+  st.flags = uint64(num(6))
+  st.utime, st.stime = uint64(num(11)), uint64(num(12))
+  st.cutime, st.cstime = uint64(num(13)), uint64(num(14))
+  st.nice = int8(num(16))
+  return st, nil
+}
+
+// readProcStatus returns the fields of /proc/pid/status as a map.
+func readProcStatus(path string) map[string]string {
+  status := make(map[string]string)
+  f, err := os.Open(path)
+  if err != nil {
+    return status
+  }
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    if kv := strings.SplitN(scanner.Text(), ":", 2); len(kv) == 2 {
+      status[kv[0]] = strings.TrimSpace(kv[1])
+    }
+  }
+  return status
+}
+
+// putTimeval stores clock ticks as a struct timeval, assuming USER_HZ is 100.
+func putTimeval(b []byte, ticks uint64) {
+  binary.LittleEndian.PutUint64(b, ticks / 100)
+  binary.LittleEndian.PutUint64(b[8:], (ticks % 100) * 10000)
+}
+
+// prstatus builds an x86-64 struct elf_prstatus for one thread.
+func prstatus(pid, tid int, regs *RegisterState, fpvalid bool) []byte {
+  b := make([]byte, 336)
+  le := binary.LittleEndian
+
+  st, _ := readProcStat(fmt.Sprintf("/proc/%d/task/%d/stat", pid, tid))
+  status := readProcStatus(fmt.Sprintf("/proc/%d/task/%d/status", pid, tid))
+  sigpend, _ := strconv.ParseUint(status["SigPnd"], 16, 64)
+  sighold, _ := strconv.ParseUint(status["SigBlk"], 16, 64)
+
+  le.PutUint64(b[16:], sigpend)
+  le.PutUint64(b[24:], sighold)
+  le.PutUint32(b[32:], uint32(tid))
+  le.PutUint32(b[36:], uint32(st.ppid))
+  le.PutUint32(b[40:], uint32(st.pgrp))
+  le.PutUint32(b[44:], uint32(st.sid))
+  putTimeval(b[48:], st.utime)
+  putTimeval(b[64:], st.stime)
+  putTimeval(b[80:], st.cutime)
+  putTimeval(b[96:], st.cstime)
+
+  // elf_gregset_t has the same layout as user_regs_struct
+  var gregs bytes.Buffer
+  binary.Write(&gregs, le, &regs.PtraceRegs)
+  copy(b[112:328], gregs.Bytes())
+
+  if fpvalid {
+    le.PutUint32(b[328:], 1)
+  }
+  return b
+}
+
+// procStates maps the state letters of /proc/pid/stat to pr_state, which the
+// kernel sets to the number of the lowest task state bit plus one. Anything
+// else is taken as running.
+var procStates = map[byte]byte{'R': 0, 'S': 1, 'D': 2, 'I': 2, 'T': 3, 't': 4, 'X': 5,
+                                'Z': 6, 'P': 7}
+
+// prpsinfo builds an x86-64 struct elf_prpsinfo for the process.
+func prpsinfo(pid int) []byte {
+  b := make([]byte, 136)
+  le := binary.LittleEndian
+
+  st, _ := readProcStat(fmt.Sprintf("/proc/%d/stat", pid))
+  status := readProcStatus(fmt.Sprintf("/proc/%d/status", pid))
+
+  b[0] = procStates[st.state]
+  b[1] = st.state
+  if st.state == 'Z' {
+    b[2] = 1
+  }
+  b[3] = byte(st.nice)
+  le.PutUint64(b[8:], st.flags)
+
+  uid, _ := strconv.Atoi(strings.Fields(status["Uid"] + " 0")[0])
+  gid, _ := strconv.Atoi(strings.Fields(status["Gid"] + " 0")[0])
+  le.PutUint32(b[16:], uint32(uid))
+  le.PutUint32(b[20:], uint32(gid))
+  le.PutUint32(b[24:], uint32(pid))
+  le.PutUint32(b[28:], uint32(st.ppid))
+  le.PutUint32(b[32:], uint32(st.pgrp))
+  le.PutUint32(b[36:], uint32(st.sid))
+
+  comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+  copy(b[40:55], bytes.TrimSpace(comm))
+
+  cmdline, _ := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+  cmdline = bytes.TrimRight(cmdline, "\x00")
+  cmdline = bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})
+  copy(b[56:135], cmdline)
+  return b
+}
+
+// fileNote builds the NT_FILE note, listing the file behind each mapping.
+func fileNote(regions []MemoryRegion) []byte {
+  var entries, names bytes.Buffer
+  le := binary.LittleEndian
+  count := 0
+  for _, r := range regions {
+    if r.Kind != File {
+      continue
+    }
+    binary.Write(&entries, le, [3]uint64{r.Address, r.End(), r.Offset / pageSize})
+    names.WriteString(r.Pathname)
+    names.WriteByte(0)
+    count++
+  }
+
+  var b bytes.Buffer
+  binary.Write(&b, le, [2]uint64{uint64(count), pageSize})
+  b.Write(entries.Bytes())
+  b.Write(names.Bytes())
+  return b.Bytes()
+}
+
+// appendNote adds an ELF note named "CORE" to buf.
+func appendNote(buf *bytes.Buffer, kind uint32, desc []byte) {
+  name := []byte("CORE\x00\x00\x00\x00")
+  binary.Write(buf, binary.LittleEndian, [3]uint32{5, uint32(len(desc)), kind})
+  buf.Write(name)
+  buf.Write(desc)
+  for buf.Len() % 4 != 0 {
+    buf.WriteByte(0)
+  }
+}
+
+// dumpable reports whether a region's contents go into the core file.
+// Anything else is described by its program header alone.
+func dumpable(r MemoryRegion) bool {
+  return r.Perms & PermRead != 0 && r.Kind != Vvar
+}
+
+// threadRegisters returns the registers of t, backing the program counter up
+// over a breakpoint it has just hit so the core shows where it really is.
+func (p *Process) threadRegisters(t *Thread) (*RegisterState, error) {
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return nil, err
+  }
+  for _, bp := range p.Breakpoints {
+    if bp.Active && bp.Address+1 == regs.PC() {
+      regs.SetPC(bp.Address)
+    }
+  }
+  return regs, nil
+}
+
+// WriteCore writes an ELF core file of the process to path, in the format
+// the kernel uses, so it can be loaded by gdb and friends. All threads are
+// stopped while the core is written and resumed afterwards; the process
+// carries on as if nothing happened. Breakpoints don't show up in the dumped
+// memory.
+func (p *Process) WriteCore(path string) error {
+  if ! p.IsLive() {
+    return errNotLive
+  }
+  stopped := p.stopAll()
+  defer p.resumeStopped(stopped)
+
+  if _, err := p.Memory.Refresh(); err != nil {
+    return err
+  }
+  regions := p.Memory.Regions
+
+  // Notes: the first thread carries the process-wide ones, like the kernel
+  // does it
+  var notes bytes.Buffer
+  for i, t := range p.threadList() {
+    regs, err := p.threadRegisters(t)
+    if err != nil {
+      continue
+    }
+    fpregs, fperr := ptraceGetFPRegs(t.Tid)
+
+    appendNote(&notes, ntPrstatus, prstatus(p.Pid, t.Tid, regs, fperr == nil))
+    if i == 0 {
+      appendNote(&notes, ntPrpsinfo, prpsinfo(p.Pid))
+      if auxv, err := os.ReadFile(fmt.Sprintf("/proc/%d/auxv", p.Pid)); err == nil {
+        appendNote(&notes, ntAuxv, auxv)
+      }
+      appendNote(&notes, ntFile, fileNote(regions))
+    }
+    if fperr == nil {
+      appendNote(&notes, ntFpregset, fpregs)
+    }
+  }
+
+  // Layout: header, program headers, notes, then page-aligned segments
+  phnum := 1 + len(regions)
+  notesOff := uint64(64 + 56*phnum)
+  dataOff := (notesOff + uint64(notes.Len()) + pageSize-1) &^ (pageSize-1)
+
+  header, extnum := coreHeader(phnum)
+
+  progs := []elf.Prog64{{
+    Type:   uint32(elf.PT_NOTE),
+    Off:    notesOff,
+    Filesz: uint64(notes.Len()),
+    Align:  4,
+  }}
+  off := dataOff
+  for _, r := range regions {
+    prog := elf.Prog64{
+      Type:  uint32(elf.PT_LOAD),
+      Off:   off,
+      Vaddr: r.Address,
+      Memsz: r.Size,
+      Align: pageSize,
+    }
+    if r.Perms & PermRead != 0 {
+      prog.Flags |= uint32(elf.PF_R)
+    }
+    if r.Perms & PermWrite != 0 {
+      prog.Flags |= uint32(elf.PF_W)
+    }
+    if r.Perms & PermExec != 0 {
+      prog.Flags |= uint32(elf.PF_X)
+    }
+    if dumpable(r) {
+      prog.Filesz = r.Size
+      off += r.Size
+    }
+    progs = append(progs, prog)
+  }
+  if extnum != nil {
+    header.Shoff = off
+  }
+
+  f, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  w := bufio.NewWriter(f)
+  binary.Write(w, binary.LittleEndian, &header)
+  binary.Write(w, binary.LittleEndian, progs)
+  w.Write(notes.Bytes())
+  w.Write(make([]byte, dataOff - notesOff - uint64(notes.Len())))
+  for _, r := range regions {
+    if dumpable(r) {
+      if err := p.dumpRegion(w, r); err != nil {
+        return err
+      }
+    }
+  }
+  if extnum != nil {
+    binary.Write(w, binary.LittleEndian, extnum)
+  }
+  if err := w.Flush(); err != nil {
+    return err
+  }
+  return f.Close()
+}
+
+// coreHeader returns the ELF header of a core with phnum program headers.
+// When there are too many for e_phnum, the count goes in the sh_info of a
+// lone section header instead, as the kernel does it; that header is
+// returned too and goes at e_shoff, which is left to be set.
+func coreHeader(phnum int) (elf.Header64, *elf.Section64) {
+  header := elf.Header64{
+    Type:      uint16(elf.ET_CORE),
+    Machine:   uint16(elf.EM_X86_64),
+    Version:   uint32(elf.EV_CURRENT),
+    Phoff:     64,
+    Ehsize:    64,
+    Phentsize: 56,
+    Phnum:     uint16(phnum),
+  }
+  copy(header.Ident[:], elf.ELFMAG)
+  header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+  header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+  header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+  if phnum < pnXnum {
+    return header, nil
+  }
+  header.Phnum = pnXnum
+  header.Shentsize = 64
+  header.Shnum = 1
+  return header, &elf.Section64{Size: 1, Info: uint32(phnum)}
+}
+
+// dumpRegion copies a region's memory to w a chunk at a time. Pages that
+// can't be read are written as zeroes, and the original instructions are put
+// back where there are breakpoints.
+func (p *Process) dumpRegion(w io.Writer, r MemoryRegion) error {
+  buf := make([]byte, searchChunk)
+  for addr := r.Address; addr < r.End(); {
+    size := r.End() - addr
+    if size > uint64(len(buf)) {
+      size = uint64(len(buf))
+    }
+    chunk := buf[:size]
+
+    for done := 0; done < len(chunk); {
+      n, err := p.ReadMemory(addr + uint64(done), chunk[done:])
+      done += n
+      if err != nil {
+        // Zero-fill to the next page and try again from there
+        next := (addr + uint64(done) + pageSize) &^ (pageSize-1)
+        end := int(next - addr)
+        if end > len(chunk) {
+          end = len(chunk)
+        }
+        for i := done; i < end; i++ {
+          chunk[i] = 0
+        }
+        done = end
+      }
+    }
+
+    p.hideBreakpoints(addr, chunk)
+
+    if _, err := w.Write(chunk); err != nil {
+      return err
+    }
+    addr += size
+  }
+  return nil
+}
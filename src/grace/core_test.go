@@ -0,0 +1,168 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "debug/elf"
+  "encoding/binary"
+  "fmt"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "syscall"
+  "testing"
+  "time"
+)
+
+func TestCoreHeaderExtendedNumbering(t *testing.T) {
+  for _, phnum := range []int{3, pnXnum - 1, pnXnum, 70000} {
+    header, extnum := coreHeader(phnum)
+    if (extnum != nil) != (phnum >= pnXnum) {
+      t.Errorf("%d segments: extended numbering is %v", phnum, extnum != nil)
+    }
+    progs := make([]elf.Prog64, phnum)
+    for i := range progs {
+      progs[i] = elf.Prog64{Type: uint32(elf.PT_LOAD), Vaddr: uint64(i) * pageSize, Memsz: pageSize}
+    }
+    if extnum != nil {
+      header.Shoff = uint64(64 + 56*phnum)
+    }
+
+    var buf bytes.Buffer
+    binary.Write(&buf, binary.LittleEndian, &header)
+    binary.Write(&buf, binary.LittleEndian, progs)
+    if extnum != nil {
+      binary.Write(&buf, binary.LittleEndian, extnum)
+    }
+    f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+    if err != nil {
+      t.Errorf("%d segments: %v", phnum, err)
+      continue
+    }
+    if len(f.Progs) != phnum {
+      t.Errorf("%d segments read back as %d", phnum, len(f.Progs))
+    } else if last := f.Progs[phnum-1]; last.Vaddr != uint64(phnum-1) * pageSize {
+      t.Errorf("%d segments: last one at 0x%x", phnum, last.Vaddr)
+    }
+  }
+}
+
+func TestPrpsinfoState(t *testing.T) {
+  if b := prpsinfo(os.Getpid()); b[0] != 0 || b[1] != 'R' {
+    t.Errorf("running: pr_state %d, pr_sname %q", b[0], b[1])
+  }
+
+  cmd := exec.Command("sleep", "10")
+  if err := cmd.Start(); err != nil {
+    t.Skip(err)
+  }
+  defer cmd.Wait()
+  defer cmd.Process.Kill()
+  syscall.Kill(cmd.Process.Pid, syscall.SIGSTOP)
+  for i := 0; i < 100; i++ {
+    st, _ := readProcStat(fmt.Sprintf("/proc/%d/stat", cmd.Process.Pid))
+    if st.state == 'T' {
+      break
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  if b := prpsinfo(cmd.Process.Pid); b[0] != 3 || b[1] != 'T' {
+    t.Errorf("stopped: pr_state %d, pr_sname %q", b[0], b[1])
+  }
+
+  for state, want := range map[byte]byte{'t': 4, 'Z': 6, '?': 0} {
+    if procStates[state] != want {
+      t.Errorf("state %q is pr_state %d, want %d", state, procStates[state], want)
+    }
+  }
+}
+
+func TestWriteCoreRoundTrip(t *testing.T) {
+  exe := buildTarget(t, "#include <unistd.h>\nint main(void) { for (;;) pause(); }\n")
+  cmd := exec.Command(exe)
+  if err := cmd.Start(); err != nil {
+    t.Fatal(err)
+  }
+  defer cmd.Wait()
+  defer cmd.Process.Kill()
+  time.Sleep(50 * time.Millisecond)
+
+  p, err := Attach(cmd.Process.Pid)
+  if err != nil {
+    t.Skip(err)
+  }
+  regs, err := p.GetRegisters()
+  if err != nil {
+    t.Fatal(err)
+  }
+  stack := make([]byte, 64)
+  if _, err := p.ReadMemory(regs.Rsp, stack); err != nil {
+    t.Fatal(err)
+  }
+  live, _ := p.Backtrace(0)
+  path := filepath.Join(t.TempDir(), "core")
+  err = p.WriteCore(path)
+  p.Detach()
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  c, err := OpenCore(path, exe)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer c.Detach()
+  if c.Pid != cmd.Process.Pid || len(c.Threads) != 1 {
+    t.Errorf("pid %d with %d threads", c.Pid, len(c.Threads))
+  }
+  got, err := c.GetRegisters()
+  if err != nil || got.PtraceRegs != regs.PtraceRegs {
+    t.Errorf("registers %v, %v; want %v", got, err, regs)
+  }
+  buf := make([]byte, len(stack))
+  if _, err := c.ReadMemory(regs.Rsp, buf); err != nil || ! bytes.Equal(buf, stack) {
+    t.Errorf("stack %x, %v; want %x", buf, err, stack)
+  }
+
+  frames, err := c.Backtrace(0)
+  if err != nil || len(frames) != len(live) {
+    t.Fatalf("backtrace %v, %v; live %v", frames, err, live)
+  }
+  for i := range frames {
+    if frames[i].PC != live[i].PC || frames[i].Function != live[i].Function {
+      t.Errorf("frame %d is %v, live %v", i, frames[i], live[i])
+    }
+  }
+  if ! strings.Contains(fmt.Sprint(frames), "main") {
+    t.Errorf("main not in backtrace %v", frames)
+  }
+}
@@ -0,0 +1,395 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bufio"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "sort"
+)
+
+// Basic block coverage. The functions of a module are disassembled to find
+// where their blocks start, and each gets an int3 that's taken out the first
+// time it's hit, so a block costs one trap at most.
+
+const (
+  errCoverageRunning = TracerError("coverage is already being collected")
+  errNoModule        = TracerError("no such module")
+)
+
+// Coverage is the coverage being collected for a set of modules.
+type Coverage struct {
+  Modules  []*Module
+  // Blocks are sorted by address
+  Blocks   []*CoverageBlock
+
+  proc     *Process
+  blocks   map[uint64]*CoverageBlock
+}
+
+// CoverageBlock is a basic block of a function.
+type CoverageBlock struct {
+  Module   *Module
+  Address  uint64
+  Size     uint64
+  Hit      bool
+
+  armed    bool
+  saved    byte
+}
+
+// Offset returns where the block is relative to the start of its module.
+func (b *CoverageBlock) Offset() uint64 {
+  return b.Address - b.Module.Start
+}
+
+// StartCoverage starts recording which basic blocks of the modules named,
+// given as paths or base names, are run. With none, that's the executable.
+// Blocks are only found in functions the symbol table knows the size of, and
+// targets of indirect jumps that start no other block are missed. A block
+// under a breakpoint counts as hit when the breakpoint is, while one under an
+// instrument is given up.
+func (p *Process) StartCoverage(modules ...string) (*Coverage, error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  if p.coverage != nil {
+    return nil, errCoverageRunning
+  }
+
+  p.Memory.Refresh()
+  c := &Coverage{proc: p, blocks: make(map[uint64]*CoverageBlock)}
+  if len(modules) == 0 {
+    if m := p.MainModule(); m != nil {
+      c.Modules = append(c.Modules, m)
+    }
+  }
+  for _, name := range modules {
+    m := p.FindModule(name)
+    if m == nil {
+      return nil, errNoModule
+    }
+    c.Modules = append(c.Modules, m)
+  }
+  if len(c.Modules) == 0 {
+    return nil, errNoModule
+  }
+
+  stopped := p.stopAll()
+  defer p.resumeStopped(stopped)
+  for _, m := range c.Modules {
+    seen := make(map[uint64]bool)
+    for _, sym := range m.Symbols() {
+      if ! sym.Func || sym.Size == 0 || seen[sym.Address] {
+        continue
+      }
+      seen[sym.Address] = true
+      if err := c.addFunction(m, sym.Address, sym.Size); err != nil {
+        c.Stop()
+        return nil, err
+      }
+    }
+  }
+  sort.Slice(c.Blocks, func(i, j int) bool {
+    return c.Blocks[i].Address < c.Blocks[j].Address
+  })
+  p.coverage = c
+  return c, nil
+}
+
+// addFunction finds the blocks of the size bytes of code at start and arms
+// them.
+func (c *Coverage) addFunction(m *Module, start, size uint64) error {
+  p := c.proc
+  raw := make([]byte, size)
+  if _, err := p.ReadMemory(start, raw); err != nil {
+    // Not all of a symbol's range need be mapped
+    return nil
+  }
+  code := append([]byte{}, raw...)
+  p.hideBreakpoints(start, code)
+  // Symbols can overlap, so some blocks may be armed already
+  for i := range code {
+    if b := c.blocks[start + uint64(i)]; b != nil && b.armed {
+      code[i] = b.saved
+    }
+  }
+
+  // Blocks start at the entry, at the targets of branches, and after
+  // anything that transfers control
+  starts := map[uint64]bool{start: true}
+  leaders := map[uint64]bool{start: true}
+  end := start
+  for end < start + size {
+    inst, err := Decode(code[end - start:], end)
+    if err != nil {
+      break
+    }
+    end += uint64(inst.Len())
+    starts[end] = true
+    if inst.HasTarget && inst.relOffset != 0 && inst.Target >= start &&
+       inst.Target < start + size {
+      leaders[inst.Target] = true
+    }
+    if inst.Flow != FlowNone {
+      leaders[end] = true
+    }
+  }
+
+  addrs := []uint64{}
+  for addr := range leaders {
+    if starts[addr] && addr < end {
+      addrs = append(addrs, addr)
+    }
+  }
+  sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+  patched := false
+  for i, addr := range addrs {
+    if c.blocks[addr] != nil || p.instrumentAt(addr) != nil || p.instrumentedWithin(addr) != nil {
+      continue
+    }
+    b := &CoverageBlock{Module: m, Address: addr, saved: code[addr - start]}
+    if i + 1 < len(addrs) {
+      b.Size = addrs[i+1] - addr
+    } else {
+      b.Size = end - addr
+    }
+    c.Blocks = append(c.Blocks, b)
+    c.blocks[addr] = b
+    if p.breakpointAt(addr) != nil {
+      continue
+    }
+    b.armed = true
+    raw[addr - start] = INT3
+    patched = true
+  }
+  if ! patched {
+    return nil
+  }
+  _, err := p.WriteMemory(start, raw)
+  return err
+}
+
+// Stop takes out the int3s of the blocks that haven't been hit. The results
+// stay available.
+func (c *Coverage) Stop() error {
+  var err error
+  for _, b := range c.Blocks {
+    if e := c.disarm(b); e != nil && err == nil {
+      err = e
+    }
+  }
+  if c.proc.coverage == c {
+    c.proc.coverage = nil
+  }
+  return err
+}
+
+// Covered returns how many blocks have been hit.
+func (c *Coverage) Covered() int {
+  n := 0
+  for _, b := range c.Blocks {
+    if b.Hit {
+      n++
+    }
+  }
+  return n
+}
+
+func (c *Coverage) disarm(b *CoverageBlock) error {
+  if ! b.armed {
+    return nil
+  }
+  b.armed = false
+  _, err := c.proc.WriteMemory(b.Address, []byte{b.saved})
+  return err
+}
+
+// coverageReached records that the block at addr, if there's one, is about to
+// run, and takes out its int3.
+func (p *Process) coverageReached(addr uint64) {
+  if p.coverage == nil {
+    return
+  }
+  if b := p.coverage.blocks[addr]; b != nil {
+    b.Hit = true
+    p.coverage.disarm(b)
+  }
+}
+
+// coverageTrap handles a SIGTRAP of thread t if it's from the int3 of a
+// block, and moves it back to the start of the block. Another thread may
+// have taken the int3 out already.
+func (p *Process) coverageTrap(t *Thread) bool {
+  if p.coverage == nil {
+    return false
+  }
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return false
+  }
+  addr := regs.PC() - 1
+  if p.coverage.blocks[addr] == nil {
+    return false
+  }
+  p.coverageReached(addr)
+  regs.SetPC(addr)
+  p.backend().setRegisters(t.Tid, regs)
+  return true
+}
+
+// coverageDisarm takes the int3 out from the blocks in [addr, end), for
+// patching the code there some other way.
+func (p *Process) coverageDisarm(addr, end uint64) {
+  if p.coverage == nil {
+    return
+  }
+  for a := addr; a < end; a++ {
+    if b := p.coverage.blocks[a]; b != nil {
+      p.coverage.disarm(b)
+    }
+  }
+}
+
+// hideCoverage puts the original instructions back into buf, which holds
+// target memory read from addr, wherever a block's int3 is.
+func (p *Process) hideCoverage(addr uint64, buf []byte) {
+  if p.coverage == nil {
+    return
+  }
+  blocks := p.coverage.Blocks
+  i := sort.Search(len(blocks), func(i int) bool { return blocks[i].Address >= addr })
+  for ; i < len(blocks) && blocks[i].Address < addr + uint64(len(buf)); i++ {
+    if blocks[i].armed {
+      buf[blocks[i].Address - addr] = blocks[i].saved
+    }
+  }
+}
+
+// WriteDrcov writes the blocks that were hit in the drcov format, which
+// Lighthouse and other tools read.
+func (c *Coverage) WriteDrcov(w io.Writer) error {
+  bw := bufio.NewWriter(w)
+  fmt.Fprintf(bw, "DRCOV VERSION: 2\nDRCOV FLAVOR: drcov\n")
+  fmt.Fprintf(bw, "Module Table: version 2, count %d\n", len(c.Modules))
+  fmt.Fprintf(bw, "Columns: id, base, end, entry, checksum, timestamp, path\n")
+  ids := make(map[*Module]int)
+  for i, m := range c.Modules {
+    ids[m] = i
+    fmt.Fprintf(bw, "%d, 0x%016x, 0x%016x, 0x%016x, 0x%08x, 0x%08x, %s\n",
+                i, m.Start, m.End, 0, 0, 0, m.Path)
+  }
+
+  fmt.Fprintf(bw, "BB Table: %d bbs\n", c.Covered())
+  entry := make([]byte, 8)
+  for _, b := range c.Blocks {
+    if ! b.Hit {
+      continue
+    }
+    size := b.Size
+    if size > 0xffff {
+      size = 0xffff
+    }
+    binary.LittleEndian.PutUint32(entry[0:], uint32(b.Offset()))
+    binary.LittleEndian.PutUint16(entry[4:], uint16(size))
+    binary.LittleEndian.PutUint16(entry[6:], uint16(ids[b.Module]))
+    bw.Write(entry)
+  }
+  return bw.Flush()
+}
+
+// WriteLcov writes line coverage in the lcov tracefile format, for the blocks
+// that DWARF maps to source lines. A line's count is how many of its blocks
+// were hit.
+func (c *Coverage) WriteLcov(w io.Writer) error {
+  type fileLine struct {
+    file  string
+    line  int
+  }
+  counts := make(map[string]map[int]int)
+  for _, b := range c.Blocks {
+    t := b.Module.lineTable()
+    start, end := b.Address - b.Module.Bias, b.Address + b.Size - b.Module.Bias
+    i, ok := t.find(start)
+    if ! ok {
+      continue
+    }
+    // A line can have several rows in a block, which counts once for it
+    seen := make(map[fileLine]bool)
+    for ; i < len(t.rows) && t.rows[i].Address < end; i++ {
+      row := t.rows[i]
+      if row.End || row.Line == 0 || seen[fileLine{row.File, row.Line}] {
+        continue
+      }
+      seen[fileLine{row.File, row.Line}] = true
+      lines := counts[row.File]
+      if lines == nil {
+        lines = make(map[int]int)
+        counts[row.File] = lines
+      }
+      n := lines[row.Line]
+      if b.Hit {
+        n++
+      }
+      lines[row.Line] = n
+    }
+  }
+
+  files := []string{}
+  for file := range counts {
+    files = append(files, file)
+  }
+  sort.Strings(files)
+
+  bw := bufio.NewWriter(w)
+  fmt.Fprintf(bw, "TN:\n")
+  for _, file := range files {
+    lines := []int{}
+    for line := range counts[file] {
+      lines = append(lines, line)
+    }
+    sort.Ints(lines)
+
+    fmt.Fprintf(bw, "SF:%s\n", file)
+    hit := 0
+    for _, line := range lines {
+      n := counts[file][line]
+      if n > 0 {
+        hit++
+      }
+      fmt.Fprintf(bw, "DA:%d,%d\n", line, n)
+    }
+    fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+  }
+  return bw.Flush()
+}
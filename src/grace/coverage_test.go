@@ -0,0 +1,112 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestWriteDrcov(t *testing.T) {
+  app := &Module{Path: "/bin/app", Start: 0x400000, End: 0x401000}
+  libc := &Module{Path: "/lib/libc.so.6", Start: 0x7f0000000000, End: 0x7f0000200000}
+  c := &Coverage{
+    Modules: []*Module{app, libc},
+    Blocks: []*CoverageBlock{
+      {Module: app, Address: 0x400010, Size: 5, Hit: true},
+      {Module: app, Address: 0x400020, Size: 3},
+      // Sizes are clamped to what fits the table
+      {Module: libc, Address: 0x7f0000001000, Size: 0x12345, Hit: true},
+    },
+  }
+
+  want := "DRCOV VERSION: 2\n" +
+    "DRCOV FLAVOR: drcov\n" +
+    "Module Table: version 2, count 2\n" +
+    "Columns: id, base, end, entry, checksum, timestamp, path\n" +
+    "0, 0x0000000000400000, 0x0000000000401000, 0x0000000000000000, 0x00000000, 0x00000000, /bin/app\n" +
+    "1, 0x00007f0000000000, 0x00007f0000200000, 0x0000000000000000, 0x00000000, 0x00000000, /lib/libc.so.6\n" +
+    "BB Table: 2 bbs\n" +
+    "\x10\x00\x00\x00" + "\x05\x00" + "\x00\x00" +
+    "\x00\x10\x00\x00" + "\xff\xff" + "\x01\x00"
+
+  var buf bytes.Buffer
+  if err := c.WriteDrcov(&buf); err != nil {
+    t.Fatal(err)
+  }
+  if got := buf.String(); got != want {
+    t.Errorf("WriteDrcov wrote\n%q\nwant\n%q", got, want)
+  }
+}
+
+func TestWriteLcov(t *testing.T) {
+  m := &Module{Path: "/bin/app", Start: 0x400000, End: 0x401000, Bias: 0x400000}
+  m.lines = &lineTable{rows: []lineRow{
+    {Address: 0x10, File: "a.c", Line: 3},
+    {Address: 0x11, File: "a.c", Line: 3, Stmt: true},
+    {Address: 0x13, File: "a.c", Line: 4},
+    {Address: 0x15, File: "b.c", Line: 7},
+    {Address: 0x18, End: true},
+    {Address: 0x20, File: "a.c", Line: 4},
+    {Address: 0x22, File: "a.c", Line: 0},
+    {Address: 0x23, End: true},
+  }}
+  c := &Coverage{
+    Modules: []*Module{m},
+    Blocks: []*CoverageBlock{
+      {Module: m, Address: 0x400010, Size: 5, Hit: true},
+      {Module: m, Address: 0x400015, Size: 3},
+      {Module: m, Address: 0x400020, Size: 3, Hit: true},
+      // No lines for this one
+      {Module: m, Address: 0x400030, Size: 4, Hit: true},
+    },
+  }
+
+  want := "TN:\n" +
+    "SF:a.c\n" +
+    "DA:3,1\n" +
+    "DA:4,2\n" +
+    "LF:2\n" +
+    "LH:2\n" +
+    "end_of_record\n" +
+    "SF:b.c\n" +
+    "DA:7,0\n" +
+    "LF:1\n" +
+    "LH:0\n" +
+    "end_of_record\n"
+
+  var buf bytes.Buffer
+  if err := c.WriteLcov(&buf); err != nil {
+    t.Fatal(err)
+  }
+  if got := buf.String(); got != want {
+    t.Errorf("WriteLcov wrote\n%s\nwant\n%s", got, want)
+  }
+}
@@ -0,0 +1,400 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "io"
+  "syscall"
+  "time"
+  "unsafe"
+)
+
+// crashContext is how many bytes of code before the PC go into a report; as
+// many again follow it.
+const crashContext = 32
+
+// SignalInfo is the part of siginfo_t a crash report cares about
+type SignalInfo struct {
+  Signo  int32
+  Errno  int32
+  Code   int32
+  // Addr is the faulting address for SIGSEGV, SIGBUS, SIGILL and SIGFPE
+  Addr   uint64
+}
+
+// getSignalInfo is PTRACE_GETSIGINFO for the signal tid is stopped with.
+func getSignalInfo(tid int) (*SignalInfo, error) {
+  var raw [128]byte
+  _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_GETSIGINFO,
+                                  uintptr(tid), 0,
+                                  uintptr(unsafe.Pointer(&raw[0])), 0, 0)
+  if errno != 0 {
+    return nil, errno
+  }
+  return &SignalInfo{
+    Signo: int32(binary.LittleEndian.Uint32(raw[0:])),
+    Errno: int32(binary.LittleEndian.Uint32(raw[4:])),
+    Code:  int32(binary.LittleEndian.Uint32(raw[8:])),
+    Addr:  binary.LittleEndian.Uint64(raw[16:]),
+  }, nil
+}
+
+// FromKernel tells whether the signal was raised by a fault rather than sent
+// by kill(), raise() or abort(), in which case Addr means nothing.
+func (s *SignalInfo) FromKernel() bool {
+  return s.Code > 0 && s.Code < 0x80
+}
+
+// CodeName returns the symbolic si_code, such as SEGV_MAPERR.
+func (s *SignalInfo) CodeName() string {
+  names := map[syscall.Signal][]string{
+    syscall.SIGSEGV: {"SEGV_MAPERR", "SEGV_ACCERR", "SEGV_BNDERR", "SEGV_PKUERR"},
+    syscall.SIGBUS:  {"BUS_ADRALN", "BUS_ADRERR", "BUS_OBJERR", "BUS_MCEERR_AR",
+                      "BUS_MCEERR_AO"},
+    syscall.SIGFPE:  {"FPE_INTDIV", "FPE_INTOVF", "FPE_FLTDIV", "FPE_FLTOVF",
+                      "FPE_FLTUND", "FPE_FLTRES", "FPE_FLTINV", "FPE_FLTSUB"},
+    syscall.SIGILL:  {"ILL_ILLOPC", "ILL_ILLOPN", "ILL_ILLADR", "ILL_ILLTRP",
+                      "ILL_PRVOPC", "ILL_PRVREG", "ILL_COPROC", "ILL_BADSTK"},
+  }
+  switch s.Code {
+  case 0: return "SI_USER"
+  case 0x80: return "SI_KERNEL"
+  case -1: return "SI_QUEUE"
+  case -6: return "SI_TKILL"
+  }
+  if list := names[syscall.Signal(s.Signo)]; s.Code > 0 && int(s.Code) <= len(list) {
+    return list[s.Code-1]
+  }
+  return fmt.Sprintf("%d", s.Code)
+}
+
+// fatalSignal tells whether sig is one a crash report is made for.
+func fatalSignal(sig syscall.Signal) bool {
+  switch sig {
+  case syscall.SIGSEGV, syscall.SIGABRT, syscall.SIGBUS, syscall.SIGFPE, syscall.SIGILL:
+    return true
+  }
+  return false
+}
+
+// ThreadReport is the stack of one thread at the time of a crash
+type ThreadReport struct {
+  Tid     int
+  Frames  []Frame
+  Error   string `json:",omitempty"`
+}
+
+// CrashRegion is a memory region as it appears in a crash report
+type CrashRegion struct {
+  Start, End  uint64
+  Perms       string
+  Kind        string
+  Path        string `json:",omitempty"`
+}
+
+// CrashReport describes the state of a process that received a fatal signal
+type CrashReport struct {
+  Time          time.Time
+  Pid           int
+  // Tid is the thread that received the signal
+  Tid           int
+  Executable    string
+  Signal        string
+  SignalNumber  int
+  Code          string
+  // FaultAddress is only meaningful when the kernel raised the signal
+  FaultAddress  uint64
+  FromKernel    bool
+  PC            uint64
+  Location      string
+  Registers    *RegisterState
+  // Code around the PC, starting at CodeAddress
+  CodeAddress   uint64
+  CodeBytes     []byte
+  // Disassembly decodes CodeBytes, lined up on the PC
+  Disassembly   []*Instruction `json:",omitempty"`
+  Threads       []ThreadReport
+  Memory        []CrashRegion
+  Triage       *Triage
+}
+
+// OnCrash has fn called with a report whenever a thread receives a fatal
+// signal during StartProcess. The signal is delivered once fn returns.
+func (p *Process) OnCrash(fn func(*CrashReport)) {
+  p.crashHandler = fn
+}
+
+// crashReport gathers the state of the process after thread t stopped with
+// the fatal signal sig. Other threads are stopped while this happens.
+func (p *Process) crashReport(t *Thread, sig syscall.Signal) *CrashReport {
+  stopped := p.stopAll()
+  defer p.resumeStopped(stopped)
+
+  r := &CrashReport{
+    Time:         time.Now(),
+    Pid:          p.Pid,
+    Tid:          t.Tid,
+    Executable:   p.Filename,
+    Signal:       signalName(sig),
+    SignalNumber: int(sig),
+  }
+
+  if info, err := getSignalInfo(t.Tid); err == nil {
+    r.Code = info.CodeName()
+    r.FromKernel = info.FromKernel()
+    if r.FromKernel {
+      r.FaultAddress = info.Addr
+    }
+  }
+
+  // Libraries loaded since the last refresh hold code to read
+  p.Memory.Refresh()
+  if regs, err := p.backend().getRegisters(t.Tid); err == nil {
+    r.Registers = regs
+    r.PC = regs.PC()
+    r.Location = p.Symbolize(r.PC)
+    r.CodeAddress, r.CodeBytes = p.codeAround(r.PC)
+  }
+
+  for _, region := range p.Memory.Regions {
+    r.Memory = append(r.Memory, CrashRegion{region.Address, region.End(),
+                                            region.Perms.String(),
+                                            region.Kind.String(),
+                                            region.Pathname})
+  }
+
+  for _, thread := range p.threadList() {
+    tr := ThreadReport{Tid: thread.Tid}
+    frames, err := p.Backtrace(thread.Tid)
+    tr.Frames = frames
+    if err != nil {
+      tr.Error = err.Error()
+    }
+    // The crashing thread goes first
+    if thread == t {
+      r.Threads = append([]ThreadReport{tr}, r.Threads...)
+    } else {
+      r.Threads = append(r.Threads, tr)
+    }
+  }
+
+  r.Disassembly = p.disassembleReport(r)
+  r.Triage = Classify(r)
+  return r
+}
+
+// disassembleReport decodes the code of a report, starting from the
+// crashing function when it begins in range.
+func (p *Process) disassembleReport(r *CrashReport) []*Instruction {
+  addr, code := r.CodeAddress, r.CodeBytes
+  if len(r.Threads) > 0 && len(r.Threads[0].Frames) > 0 {
+    f := r.Threads[0].Frames[0]
+    if start := f.PC - f.Offset; f.Function != "" && start >= addr && start <= r.PC {
+      addr, code = start, code[start - addr:]
+    }
+  }
+
+  insts := decodeAround(addr, code, r.PC)
+  for _, inst := range insts {
+    p.symbolizeTarget(inst)
+  }
+  return insts
+}
+
+// codeAround reads what it can of the code surrounding pc, which may be near
+// the edge of a mapping or not mapped at all.
+func (p *Process) codeAround(pc uint64) (uint64, []byte) {
+  start := pc - crashContext
+  if pc < crashContext {
+    start = 0
+  }
+  for ; start <= pc; start++ {
+    if region := p.Memory.Find(start); region != nil && region.Perms&PermRead != 0 {
+      break
+    }
+  }
+  if start > pc {
+    return pc, nil
+  }
+
+  buf := make([]byte, pc - start + crashContext)
+  n, _ := p.ReadMemory(start, buf)
+  p.hideBreakpoints(start, buf[:n])
+  return start, buf[:n]
+}
+
+// signalName returns the conventional name of sig, e.g. SIGSEGV.
+func signalName(sig syscall.Signal) string {
+  switch sig {
+  case syscall.SIGSEGV: return "SIGSEGV"
+  case syscall.SIGABRT: return "SIGABRT"
+  case syscall.SIGBUS: return "SIGBUS"
+  case syscall.SIGFPE: return "SIGFPE"
+  case syscall.SIGILL: return "SIGILL"
+  case syscall.SIGTRAP: return "SIGTRAP"
+  case syscall.SIGKILL: return "SIGKILL"
+  case syscall.SIGTERM: return "SIGTERM"
+  case syscall.SIGINT: return "SIGINT"
+  case syscall.SIGSTOP: return "SIGSTOP"
+  case syscall.SIGPIPE: return "SIGPIPE"
+  case syscall.SIGCHLD: return "SIGCHLD"
+  case syscall.SIGHUP: return "SIGHUP"
+  case syscall.SIGQUIT: return "SIGQUIT"
+  case syscall.SIGUSR1: return "SIGUSR1"
+  case syscall.SIGUSR2: return "SIGUSR2"
+  case syscall.SIGALRM: return "SIGALRM"
+  case syscall.SIGCONT: return "SIGCONT"
+  case syscall.SIGWINCH: return "SIGWINCH"
+  case syscall.SIGIO: return "SIGIO"
+  case syscall.SIGPROF: return "SIGPROF"
+  case syscall.SIGVTALRM: return "SIGVTALRM"
+  }
+  return fmt.Sprintf("signal %d", int(sig))
+}
+
+// JSON returns the report as indented JSON.
+func (r *CrashReport) JSON() ([]byte, error) {
+  return json.MarshalIndent(r, "", "  ")
+}
+
+// WriteText writes the report in a human readable form.
+func (r *CrashReport) WriteText(w io.Writer) error {
+  var b bytes.Buffer
+
+  fmt.Fprintf(&b, "Process %d (%s) received %s (%s) in thread %d\n", r.Pid,
+              r.Executable, r.Signal, r.Code, r.Tid)
+  if r.FromKernel {
+    fmt.Fprintf(&b, "Fault address: 0x%x\n", r.FaultAddress)
+  }
+  fmt.Fprintf(&b, "PC: 0x%x in %s\n", r.PC, r.Location)
+  if t := r.Triage; t != nil {
+    fmt.Fprintf(&b, "Classification: %s (%s), %s access to %s memory\n",
+                t.Bucket, t.Rating, t.Access, t.Address)
+    if t.Instruction != "" {
+      fmt.Fprintf(&b, "Faulting instruction: %s\n", t.Instruction)
+    }
+    fmt.Fprintf(&b, "Crash hash: %s\n", t.Hash)
+  }
+
+  if regs := r.Registers; regs != nil {
+    b.WriteString("\nRegisters:\n")
+    names := []string{"rax", "rbx", "rcx", "rdx", "rsi", "rdi", "rbp", "rsp",
+                      "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15",
+                      "rip", "eflags"}
+    values := []uint64{regs.Rax, regs.Rbx, regs.Rcx, regs.Rdx, regs.Rsi,
+                       regs.Rdi, regs.Rbp, regs.Rsp, regs.R8, regs.R9, regs.R10,
+                       regs.R11, regs.R12, regs.R13, regs.R14, regs.R15,
+                       regs.Rip, regs.Eflags}
+    for i, name := range names {
+      fmt.Fprintf(&b, "  %-6s 0x%016x", name, values[i])
+      if i % 3 == 2 || i == len(names)-1 {
+        b.WriteString("\n")
+      }
+    }
+  }
+
+  if len(r.Disassembly) > 0 {
+    b.WriteString("\nCode:\n")
+    for _, inst := range r.Disassembly {
+      marker := "  "
+      if inst.Address == r.PC {
+        marker = "=>"
+      }
+      fmt.Fprintf(&b, "%s %016x  %-30s %s\n", marker, inst.Address,
+                  fmt.Sprintf("% x", inst.Bytes), inst)
+    }
+  } else if len(r.CodeBytes) > 0 {
+    b.WriteString("\nCode:\n")
+    for off := 0; off < len(r.CodeBytes); off += 16 {
+      addr := r.CodeAddress + uint64(off)
+      fmt.Fprintf(&b, "  %016x ", addr)
+      for i := off; i < off + 16 && i < len(r.CodeBytes); i++ {
+        if r.CodeAddress + uint64(i) == r.PC {
+          fmt.Fprintf(&b, "<%02x>", r.CodeBytes[i])
+        } else {
+          fmt.Fprintf(&b, " %02x", r.CodeBytes[i])
+        }
+      }
+      b.WriteString("\n")
+    }
+  }
+
+  for _, t := range r.Threads {
+    fmt.Fprintf(&b, "\nThread %d:\n", t.Tid)
+    for i, f := range t.Frames {
+      fmt.Fprintf(&b, "  #%-2d %s\n", i, f)
+    }
+    if t.Error != "" {
+      fmt.Fprintf(&b, "  (unwinding stopped: %s)\n", t.Error)
+    }
+  }
+
+  b.WriteString("\nMemory map:\n")
+  for _, m := range r.Memory {
+    fmt.Fprintf(&b, "  %016x-%016x %s %-8s %s\n", m.Start, m.End, m.Perms,
+                m.Kind, m.Path)
+  }
+
+  _, err := w.Write(b.Bytes())
+  return err
+}
+
+func (r *CrashReport) String() string {
+  var b bytes.Buffer
+  r.WriteText(&b)
+  return b.String()
+}
+
+// RunCrashReporter runs binaryName with args under the tracer, leaving it
+// alone until it receives a fatal signal. Each such signal gets a report
+// written to w, as JSON if asJSON is set, before it is delivered. It returns
+// the program's exit status.
+func RunCrashReporter(binaryName string, args []string, w io.Writer,
+                      asJSON bool) (int, error) {
+  p, err := LoadExecutable(binaryName, args)
+  if p == nil {
+    return -1, err
+  }
+
+  p.OnCrash(func(r *CrashReport) {
+    if asJSON {
+      if data, err := r.JSON(); err == nil {
+        w.Write(append(data, '\n'))
+      }
+    } else {
+      r.WriteText(w)
+    }
+  })
+  return p.StartProcess(), nil
+}
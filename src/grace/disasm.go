@@ -0,0 +1,1278 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "strings"
+)
+
+// maxInstruction is the longest an x86 instruction can be
+const maxInstruction = 15
+
+const (
+  errBadInstruction = TracerError("invalid instruction")
+  errTruncated      = TracerError("truncated instruction")
+  errBadCount       = TracerError("negative instruction count")
+)
+
+// FlowKind says how an instruction affects control flow
+type FlowKind int
+const (
+  FlowNone FlowKind = iota
+  // FlowJump is an unconditional jump
+  FlowJump
+  // FlowBranch is a conditional jump, including loop and jrcxz
+  FlowBranch
+  FlowCall
+  FlowReturn
+  FlowSyscall
+  // FlowTrap is an instruction that always traps, like int3, ud2 or hlt
+  FlowTrap
+)
+
+func (f FlowKind) String() string {
+  switch f {
+  case FlowJump: return "jump"
+  case FlowBranch: return "branch"
+  case FlowCall: return "call"
+  case FlowReturn: return "return"
+  case FlowSyscall: return "syscall"
+  case FlowTrap: return "trap"
+  }
+  return "none"
+}
+
+// Instruction is a decoded x86-64 instruction, with operands in Intel syntax
+type Instruction struct {
+  Address    uint64
+  Bytes      []byte
+  // Prefix holds prefixes that are shown as part of the mnemonic, such as
+  // lock or rep
+  Prefix     string
+  Mnemonic   string
+  Operands   []string
+  Flow       FlowKind
+  // Indirect is set for calls and jumps through a register or memory
+  Indirect   bool
+  // Target is the destination of a direct branch, or the address a
+  // RIP-relative operand refers to, when HasTarget is set
+  Target     uint64
+  HasTarget  bool
+  // Symbol describes Target, if it's known
+  Symbol     string
+  // MemRead and MemWrite tell how the instruction accesses its memory
+  // operands, leaving out the stack accesses of push, pop, call and ret
+  MemRead    bool
+  MemWrite   bool
+
+  // ripOffset is where the displacement of a RIP-relative operand sits in
+  // Bytes, if there is one, and relOffset and relSize locate the
+  // displacement of a relative branch
+  ripOffset  int
+  relOffset  int
+  relSize    int
+}
+
+// Len returns the length of the instruction in bytes.
+func (i *Instruction) Len() int {
+  return len(i.Bytes)
+}
+
+func (i *Instruction) String() string {
+  s := i.Mnemonic
+  if i.Prefix != "" {
+    s = i.Prefix + " " + s
+  }
+  if len(i.Operands) > 0 {
+    s += " " + strings.Join(i.Operands, ", ")
+  }
+  if i.Symbol != "" {
+    s += " <" + i.Symbol + ">"
+  }
+  return s
+}
+
+func (i *Instruction) MarshalJSON() ([]byte, error) {
+  return json.Marshal(struct {
+    Address   uint64
+    Bytes     string
+    Text      string
+    Target    uint64 `json:",omitempty"`
+    Symbol    string `json:",omitempty"`
+  }{i.Address, hex.EncodeToString(i.Bytes), i.String(), i.Target, i.Symbol})
+}
+
+var (
+  regs64 = []string{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi"}
+  regs32 = []string{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi"}
+  regs16 = []string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"}
+  regs8 = []string{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil"}
+  regs8Legacy = []string{"al", "cl", "dl", "bl", "ah", "ch", "dh", "bh"}
+  segments = []string{"es", "cs", "ss", "ds", "fs", "gs", "?", "?"}
+)
+
+// regName names general purpose register n of the given size in bytes. rex
+// tells whether a REX prefix is present, which selects spl and friends over
+// ah and friends.
+func regName(n, size int, rex bool) string {
+  if n >= 8 {
+    suffix := map[int]string{1: "b", 2: "w", 4: "d"}[size]
+    return fmt.Sprintf("r%d%s", n, suffix)
+  }
+  switch size {
+  case 1:
+    if rex {
+      return regs8[n]
+    }
+    return regs8Legacy[n]
+  case 2: return regs16[n]
+  case 4: return regs32[n]
+  }
+  return regs64[n]
+}
+
+func ptrName(size int) string {
+  switch size {
+  case 1: return "byte"
+  case 2: return "word"
+  case 4: return "dword"
+  case 6: return "fword"
+  case 8: return "qword"
+  case 10: return "tbyte"
+  case 16: return "xmmword"
+  case 32: return "ymmword"
+  case 64: return "zmmword"
+  }
+  return ""
+}
+
+// decoder holds the state of decoding one instruction
+type decoder struct {
+  code   []byte
+  pos    int
+  err    error
+  inst  *Instruction
+  op     byte
+  // key identifies the opcode by map and value, e.g. 0x0f10
+  key    int
+
+  opsize, adsize, lock  bool
+  // rep is the last F2 or F3 prefix, unless it was part of the opcode
+  rep    byte
+  seg    string
+  rex    byte
+  // data16 counts the 66 prefixes after the first, which do nothing
+  data16  int
+  // ignoredSeg is a segment override that does nothing in 64-bit mode
+  ignoredSeg  string
+
+  vex, evex  bool
+  pp         int
+  vecLen     int
+  vvvv       int
+  broadcast  bool
+  mask       int
+  zeroing    bool
+  // regHigh and rmHigh are the extra register bits of EVEX
+  regHigh, rmHigh  int
+
+  modrm           bool
+  mod, reg, rm    int
+  base, index     int
+  scale           int
+  disp            int64
+  hasDisp, disp8  bool
+  ripRel          bool
+
+  imms     []int64
+  lastImm  int64
+  rel      int64
+  moffs    uint64
+}
+
+func (d *decoder) u8() byte {
+  if d.pos >= len(d.code) {
+    if d.err == nil {
+      d.err = errTruncated
+    }
+    // Still move on, so stepping back after a peek stays in bounds
+    d.pos++
+    return 0
+  }
+  b := d.code[d.pos]
+  d.pos++
+  return b
+}
+
+// imm reads a little-endian value of n bytes, sign extending it.
+func (d *decoder) imm(n int) int64 {
+  var v uint64
+  for i := 0; i < n; i++ {
+    v |= uint64(d.u8()) << (8 * uint(i))
+  }
+  shift := uint(64 - 8*n)
+  return int64(v << shift) >> shift
+}
+
+func (d *decoder) rexW() bool {
+  return d.rex&8 != 0
+}
+
+func (d *decoder) opSize(flags int) int {
+  switch {
+  case d.rexW():
+    return 8
+  case d.opsize:
+    return 2
+  case flags&opDefault64 != 0:
+    return 8
+  }
+  return 4
+}
+
+// size turns an operand size suffix into bytes.
+func (d *decoder) size(s string, flags int) int {
+  switch s {
+  case "b": return 1
+  case "w": return 2
+  case "d", "ss": return 4
+  case "q", "sd": return 8
+  case "t": return 10
+  case "dq": return 16
+  case "qq": return 32
+  case "x": return d.vecLen
+  case "v": return d.opSize(flags)
+  case "p": return d.opSize(0) + 2
+  case "z":
+    if d.opsize {
+      return 2
+    }
+    return 4
+  case "y":
+    if d.rexW() {
+      return 8
+    }
+    return 4
+  }
+  return 0
+}
+
+func (d *decoder) readModrm() {
+  if d.modrm {
+    return
+  }
+  d.modrm = true
+  m := d.u8()
+  d.mod, d.reg, d.rm = int(m >> 6), int(m >> 3) & 7, int(m & 7)
+  if d.mod == 3 {
+    return
+  }
+
+  rexB, rexX := int(d.rex & 1) << 3, int(d.rex & 2) << 2
+  switch {
+  case d.rm == 4:
+    sib := d.u8()
+    d.scale = 1 << (sib >> 6)
+    if index := int(sib >> 3) & 7 | rexX; index != 4 {
+      d.index = index
+    }
+    if base := int(sib & 7); base == 5 && d.mod == 0 {
+      d.disp, d.hasDisp = d.imm(4), true
+    } else {
+      d.base = base | rexB
+    }
+  case d.rm == 5 && d.mod == 0:
+    d.ripRel = true
+    d.inst.ripOffset = d.pos
+    d.disp, d.hasDisp = d.imm(4), true
+  default:
+    d.base = d.rm | rexB
+  }
+
+  switch d.mod {
+  case 1:
+    d.disp, d.hasDisp, d.disp8 = d.imm(1), true, true
+  case 2:
+    d.disp, d.hasDisp = d.imm(4), true
+  }
+}
+
+// mandatory picks the form of an instruction selected by its mandatory
+// prefix, consuming the prefix. A prefix that doesn't select a form keeps its
+// usual meaning.
+func (d *decoder) mandatory(forms [4]opcode) (opcode, bool) {
+  idx := 0
+  switch {
+  case d.vex || d.evex:
+    idx = d.pp
+  case d.rep == 0xf3:
+    idx = 2
+  case d.rep == 0xf2:
+    idx = 3
+  case d.opsize:
+    idx = 1
+  }
+
+  if forms[idx].mn == "" {
+    if d.vex || d.evex || forms[0].mn == "" {
+      return opcode{}, false
+    }
+    return forms[0], true
+  }
+  switch idx {
+  case 1:
+    d.opsize = false
+  case 2, 3:
+    d.rep = 0
+  }
+  return forms[idx], true
+}
+
+func (d *decoder) group(key int) (opcode, bool) {
+  d.readModrm()
+  e := groups[key][d.reg]
+  return e, e.mn != ""
+}
+
+// decode reads prefixes and the opcode, returning the instruction form.
+func (d *decoder) decode() (opcode, bool) {
+  prefixes:
+  for {
+    switch b := d.u8(); b {
+    case 0x66:
+      if d.opsize {
+        d.data16++
+      }
+      d.opsize = true
+    case 0x67: d.adsize = true
+    case 0xf0: d.lock = true
+    case 0xf2, 0xf3: d.rep = b
+    case 0x26: d.seg = "es"
+    case 0x2e: d.seg = "cs"
+    case 0x36: d.seg = "ss"
+    case 0x3e: d.seg = "ds"
+    case 0x64: d.seg = "fs"
+    case 0x65: d.seg = "gs"
+    default:
+      d.pos--
+      break prefixes
+    }
+  }
+  if b := d.u8(); b & 0xf0 == 0x40 {
+    d.rex = b
+  } else {
+    d.pos--
+  }
+
+  b := d.u8()
+  d.op, d.key = b, int(b)
+  switch {
+  case d.err != nil:
+    return opcode{}, false
+  case b == 0x0f:
+    return d.twoByte()
+  case b == 0x9b && d.pos < len(d.code) && d.code[d.pos] & 0xf8 == 0xd8:
+    // fwait followed by a no-wait x87 control instruction is its waiting form
+    saved := *d
+    if e, ok := d.x87(d.u8()); ok && strings.HasPrefix(e.mn, "fn") {
+      e.mn = "f" + e.mn[2:]
+      return e, true
+    }
+    *d = saved
+  case (b == 0xc4 || b == 0xc5) && d.rex == 0:
+    return d.vexPrefix(b)
+  case b == 0x62 && d.rex == 0:
+    return d.evexPrefix()
+  case b >= 0xd8 && b <= 0xdf:
+    return d.x87(b)
+  }
+
+  if _, ok := groups[int(b)]; ok {
+    e, ok := d.group(int(b))
+    switch {
+    case b == 0xc6 && d.mod == 3 && d.reg == 7 && d.rm == 0:
+      return opcode{"xabort", "Ib", 0}, true
+    case b == 0xc7 && d.mod == 3 && d.reg == 7 && d.rm == 0:
+      return opcode{"xbegin", "Jz", 0}, true
+    }
+    return e, ok
+  }
+
+  e, ok := oneByte[b]
+  switch {
+  case b == 0x90 && d.rep == 0xf3:
+    d.rep = 0
+    return opcode{"pause", "", 0}, true
+  case b == 0x90 && (d.rex & 1 != 0 || d.opsize):
+    return opcode{"xchg", "Zv,rAX", 0}, true
+  case b == 0x98:
+    e.mn = map[int]string{2: "cbw", 4: "cwde", 8: "cdqe"}[d.opSize(0)]
+  case b == 0x99:
+    e.mn = map[int]string{2: "cwd", 4: "cdq", 8: "cqo"}[d.opSize(0)]
+  case b == 0xcf && d.rexW():
+    e.mn = "iretq"
+  case b >= 0xb8 && b <= 0xbf && d.rexW():
+    e.mn = "movabs"
+  }
+  return e, ok
+}
+
+func (d *decoder) twoByte() (opcode, bool) {
+  b := d.u8()
+  d.op, d.key = b, 0x0f00 | int(b)
+
+  switch b {
+  case 0x38:
+    return d.map38(d.u8())
+  case 0x3a:
+    return d.map3a(d.u8())
+  case 0x01:
+    if d.readModrm(); d.mod == 3 {
+      mn, ok := system01[d.code[d.pos-1]]
+      return opcode{mn, "", 0}, ok
+    }
+  case 0x1e:
+    if d.rep == 0xf3 && d.pos < len(d.code) && (d.code[d.pos] == 0xfa || d.code[d.pos] == 0xfb) {
+      d.rep = 0
+      d.readModrm()
+      if d.rm == 2 {
+        return opcode{"endbr64", "", 0}, true
+      }
+      return opcode{"endbr32", "", 0}, true
+    }
+  case 0x71, 0x72, 0x73:
+    e, ok := d.group(d.key)
+    if ! ok || d.mod != 3 {
+      return e, false
+    }
+    if d.opsize {
+      d.opsize = false
+      e.args = "Ux,Ib"
+    } else if e.mn == "psrldq" || e.mn == "pslldq" {
+      return e, false
+    }
+    return e, true
+  case 0xae:
+    if d.readModrm(); d.mod == 3 {
+      if d.rep == 0xf3 && d.reg < 4 {
+        d.rep = 0
+        names := []string{"rdfsbase", "rdgsbase", "wrfsbase", "wrgsbase"}
+        return opcode{names[d.reg], "Ry", 0}, true
+      }
+      names := []string{"", "", "", "", "", "lfence", "mfence", "sfence"}
+      return opcode{names[d.reg], "", 0}, names[d.reg] != ""
+    }
+    if d.opsize && d.reg >= 6 {
+      d.opsize = false
+      return opcode{[]string{"clwb", "clflushopt"}[d.reg-6], "Mb", opNoMem}, true
+    }
+  case 0xc7:
+    e, ok := d.group(d.key)
+    switch {
+    case d.mod == 3 && d.reg == 7 && d.rep == 0xf3:
+      d.rep = 0
+      return opcode{"rdpid", "Rq", 0}, true
+    case (d.mod == 3) != (d.reg >= 6):
+      return e, false
+    }
+    return e, ok
+  }
+
+  if forms, ok := sseOps[b]; ok {
+    return d.mandatory(forms)
+  }
+  if _, ok := groups[d.key]; ok {
+    return d.group(d.key)
+  }
+  e, ok := twoByte[b]
+  return e, ok
+}
+
+func (d *decoder) map38(b byte) (opcode, bool) {
+  d.op, d.key = b, 0x0200 | int(b)
+  if d.vex && b >= 0xf0 {
+    if b == 0xf3 {
+      return d.group(0x38f3)
+    }
+    forms, ok := bmiOps[b]
+    if ! ok {
+      return opcode{}, false
+    }
+    return d.mandatory(forms)
+  }
+  forms, ok := sse38[b]
+  if ! ok {
+    return opcode{}, false
+  }
+  return d.mandatory(forms)
+}
+
+func (d *decoder) map3a(b byte) (opcode, bool) {
+  d.op, d.key = b, 0x0300 | int(b)
+  e, ok := map3a[b]
+  switch {
+  case ! ok:
+    return e, false
+  case b == 0xf0:
+    return e, d.vex && d.pp == 3
+  case e.flags & opNoVex != 0 && strings.Contains(e.args, ",L") && d.rexW():
+    // VEX.W swaps the register and memory sources of FMA4
+    specs := strings.Split(e.args, ",")
+    specs[2], specs[3] = specs[3], specs[2]
+    e.args = strings.Join(specs, ",")
+    return e, d.pp == 1
+  case d.vex || d.evex:
+    return e, d.pp == 1
+  case d.opsize:
+    d.opsize = false
+    return e, true
+  case b == 0x0f:
+    return opcode{"palignr", "Pq,Qq,Ib", 0}, true
+  case b == 0xcc:
+    return e, true
+  }
+  return e, false
+}
+
+func (d *decoder) vexPrefix(b byte) (opcode, bool) {
+  d.vex = true
+  b1 := d.u8()
+  var w byte
+  if b == 0xc5 {
+    d.rex = 0x40 | (^b1 >> 5) & 4
+    d.key = 0x0100
+    d.vvvv = int(^b1 >> 3) & 15
+    d.vecLen = 16 << ((b1 >> 2) & 1)
+    d.pp = int(b1 & 3)
+  } else {
+    b2 := d.u8()
+    w = b2 >> 7
+    d.rex = 0x40 | w << 3 | (^b1 >> 5) & 7
+    d.key = int(b1 & 0x1f) << 8
+    d.vvvv = int(^b2 >> 3) & 15
+    d.vecLen = 16 << ((b2 >> 2) & 1)
+    d.pp = int(b2 & 3)
+  }
+  return d.vexOpcode(d.key >> 8, d.u8())
+}
+
+func (d *decoder) evexPrefix() (opcode, bool) {
+  d.evex = true
+  p0, p1, p2 := d.u8(), d.u8(), d.u8()
+  d.rex = 0x40 | (p1 >> 7) << 3 | (^p0 >> 5) & 7
+  if p0 & 0x10 == 0 {
+    d.regHigh = 16
+  }
+  if p0 & 0x40 == 0 {
+    d.rmHigh = 16
+  }
+  d.vvvv = int(^p1 >> 3) & 15
+  if p2 & 8 == 0 {
+    d.vvvv |= 16
+  }
+  d.pp = int(p1 & 3)
+  d.zeroing = p2 & 0x80 != 0
+  d.vecLen = 16 << ((p2 >> 5) & 3)
+  if d.vecLen > 64 {
+    d.vecLen = 64
+  }
+  d.broadcast = p2 & 0x10 != 0
+  d.mask = int(p2 & 7)
+
+  vmap := int(p0 & 7)
+  op := d.u8()
+  if forms, ok := evexOps[vmap << 8 | int(op)]; ok {
+    d.op, d.key = op, vmap << 8 | int(op)
+    d.readModrm()
+    e, ok := d.mandatory(forms)
+    e.flags |= opNoVex
+    return e, ok
+  }
+  return d.vexOpcode(vmap, op)
+}
+
+// vexOpcode looks up an instruction in the VEX (and EVEX) opcode maps, which
+// mostly mirror the legacy ones.
+func (d *decoder) vexOpcode(vmap int, op byte) (opcode, bool) {
+  d.op, d.key = op, vmap << 8 | int(op)
+  switch vmap {
+  case 2:
+    return d.map38(op)
+  case 3:
+    return d.map3a(op)
+  case 1:
+  default:
+    return opcode{}, false
+  }
+
+  switch {
+  case op == 0x77:
+    if d.vecLen == 16 {
+      return opcode{"vzeroupper", "", opNoVex}, true
+    }
+    return opcode{"vzeroall", "", opNoVex}, true
+  case op >= 0x71 && op <= 0x73:
+    e, ok := d.group(0x0f00 | int(op))
+    if op == 0x72 && d.evex && d.reg < 2 {
+      names := []string{"vprord|vprorq", "vprold|vprolq"}
+      return opcode{names[d.reg], "Hx,Wx,Ib", opNoVex}, d.pp == 1
+    }
+    e.args = "Hx,Ux,Ib"
+    return e, ok && d.mod == 3 && d.pp == 1
+  case op == 0xae:
+    d.readModrm()
+    switch {
+    case d.mod != 3 && d.reg == 2:
+      return opcode{"ldmxcsr", "Md", 0}, true
+    case d.mod != 3 && d.reg == 3:
+      return opcode{"stmxcsr", "Md", opStore|opWrite}, true
+    }
+    return opcode{}, false
+  }
+
+  if e, ok := maskOps[op]; ok && d.vex {
+    e.mn += d.maskSuffix(op)
+    e.flags |= opNoVex
+    return e, true
+  }
+  if forms, ok := sseOps[op]; ok {
+    return d.mandatory(forms)
+  }
+  return opcode{}, false
+}
+
+// maskSuffix gives the operand size suffix of an opmask instruction.
+func (d *decoder) maskSuffix(op byte) string {
+  w := 0
+  if d.rexW() {
+    w = 1
+  }
+  switch {
+  case op == 0x4b:
+    return [2][2]string{{"wd", "dq"}, {"bw", ""}}[d.pp & 1][w]
+  case (op == 0x92 || op == 0x93) && d.pp == 3:
+    return []string{"d", "q"}[w]
+  case op == 0x92 || op == 0x93:
+    return []string{"w", "b"}[d.pp & 1]
+  }
+  return [2][2]string{{"w", "q"}, {"b", "d"}}[d.pp & 1][w]
+}
+
+func (d *decoder) x87(b byte) (opcode, bool) {
+  d.readModrm()
+  if d.mod != 3 {
+    e := x87Memory[b - 0xd8][d.reg]
+    flags := 0
+    switch e.mn {
+    case "fst", "fstp", "fist", "fistp", "fisttp", "fnstcw", "fnstenv",
+         "fnsave", "fnstsw", "fbstp":
+      flags = opStore | opWrite
+    }
+    return opcode{e.mn, "M" + e.size, flags}, e.mn != ""
+  }
+
+  modrm := d.code[d.pos-1]
+  if mn, ok := x87Fixed[uint16(b) << 8 | uint16(modrm)]; ok {
+    if mn == "fnstsw" {
+      return opcode{mn, "ax", 0}, true
+    }
+    return opcode{mn, "", 0}, true
+  }
+  e := x87Register[b - 0xd8][d.reg]
+  return e, e.mn != ""
+}
+
+func needsModrm(spec string) bool {
+  switch spec[0] {
+  case 'E', 'G', 'M', 'S', 'R', 'C', 'D', 'V', 'W', 'U', 'N', 'P', 'Q':
+    return true
+  case 'K':
+    return spec[1] != 'H'
+  }
+  return false
+}
+
+// immediates reads the immediate operands and branch displacements.
+func (d *decoder) immediates(specs []string, flags int) {
+  for _, s := range specs {
+    switch s[0] {
+    case 'I':
+      n := 1
+      switch s {
+      case "Iw": n = 2
+      case "Iz": n = d.size("z", flags)
+      case "Iv": n = d.opSize(flags)
+      }
+      d.imms = append(d.imms, d.imm(n))
+      d.lastImm = d.imms[len(d.imms)-1]
+    case 'L':
+      d.imms = append(d.imms, d.imm(1))
+    case 'J':
+      n := 4
+      if s == "Jb" {
+        n = 1
+      }
+      d.inst.relOffset, d.inst.relSize = d.pos, n
+      d.rel = d.imm(n)
+    case 'O':
+      n := 8
+      if d.adsize {
+        n = 4
+      }
+      d.moffs = uint64(d.imm(n))
+      if n == 4 {
+        d.moffs &= 0xffffffff
+      }
+    }
+  }
+}
+
+// vreg names vector register n, of the vector length for operands of size
+// x and otherwise of 16 bytes.
+func (d *decoder) vreg(n int, size string) string {
+  if size == "qq" {
+    return fmt.Sprintf("ymm%d", n)
+  }
+  if size == "x" {
+    switch d.vecLen {
+    case 32: return fmt.Sprintf("ymm%d", n)
+    case 64: return fmt.Sprintf("zmm%d", n)
+    }
+  }
+  return fmt.Sprintf("xmm%d", n)
+}
+
+func (d *decoder) addrReg(n int) string {
+  if d.adsize {
+    return regName(n, 4, true)
+  }
+  return regName(n, 8, true)
+}
+
+// mem formats the memory operand of the ModRM byte.
+func (d *decoder) mem(size int) string {
+  ptr := " ptr "
+  if d.evex && d.broadcast {
+    // A single element is broadcast to the whole vector
+    size, ptr = 4, " bcst "
+    if d.rexW() {
+      size = 8
+    }
+  }
+  var b strings.Builder
+  if name := ptrName(size); name != "" {
+    b.WriteString(name + ptr)
+  }
+
+  disp := d.disp
+  if d.evex && d.disp8 {
+    // EVEX scales 8-bit displacements by the size of the access
+    n := size
+    if n == 0 {
+      n = 4
+    }
+    disp *= int64(n)
+  }
+
+  if d.base < 0 && d.index < 0 && ! d.ripRel {
+    seg := d.seg
+    if seg == "" {
+      seg = "ds"
+    }
+    addr := uint64(disp)
+    if d.adsize {
+      addr &= 0xffffffff
+    }
+    b.WriteString(fmt.Sprintf("%s:0x%x", seg, addr))
+    return b.String()
+  }
+
+  if d.seg != "" {
+    b.WriteString(d.seg + ":")
+  }
+  b.WriteString("[")
+  if d.ripRel {
+    // Relative to the next instruction, whose address is known by now
+    d.inst.Target = d.inst.Address + uint64(d.pos) + uint64(disp)
+    d.inst.HasTarget = true
+  }
+  switch {
+  case d.ripRel && d.adsize:
+    b.WriteString("eip")
+  case d.ripRel:
+    b.WriteString("rip")
+  case d.base >= 0:
+    b.WriteString(d.addrReg(d.base))
+  }
+  if d.index >= 0 {
+    if d.base >= 0 {
+      b.WriteString("+")
+    }
+    b.WriteString(fmt.Sprintf("%s*%d", d.addrReg(d.index), d.scale))
+  }
+  if d.hasDisp {
+    if disp < 0 {
+      b.WriteString(fmt.Sprintf("-0x%x", uint64(-disp)))
+    } else {
+      b.WriteString(fmt.Sprintf("+0x%x", uint64(disp)))
+    }
+  }
+  b.WriteString("]")
+  return b.String()
+}
+
+// stringMem formats the implicit operands of string instructions.
+func (d *decoder) stringMem(size int, dest bool) string {
+  reg, seg := d.addrReg(6), d.seg
+  if seg == "" {
+    seg = "ds"
+  }
+  if dest {
+    reg, seg = d.addrReg(7), "es"
+  }
+  return fmt.Sprintf("%s ptr %s:[%s]", ptrName(size), seg, reg)
+}
+
+// operand formats one operand. isMem reports whether it refers to memory.
+func (d *decoder) operand(s string, flags int) (text string, isMem bool) {
+  rexR, rexB := int(d.rex & 4) << 1, int(d.rex & 1) << 3
+  rex := d.rex != 0
+  size := d.size(s[1:], flags)
+
+  switch s {
+  case "rAX":
+    return regName(0, d.opSize(flags), rex), false
+  case "eAX":
+    return regName(0, d.size("z", 0), rex), false
+  case "sti":
+    return fmt.Sprintf("st(%d)", d.rm), false
+  }
+  if s[0] >= 'a' && s[0] <= 'z' || s[0] == '1' {
+    return s, false
+  }
+
+  switch s[0] {
+  case 'E':
+    if len(s) == 3 && s[2] == 'd' {
+      // Registers are named by their 32 bit form, memory by its access size
+      if d.mod == 3 {
+        return regName(d.rm | rexB, 4, rex), false
+      }
+      return d.mem(d.size(s[1:2], flags)), true
+    }
+    if d.mod == 3 {
+      return regName(d.rm | rexB, size, rex), false
+    }
+    return d.mem(size), true
+  case 'M':
+    return d.mem(size), true
+  case 'G':
+    return regName(d.reg | rexR, size, rex), false
+  case 'R':
+    return regName(d.rm | rexB, size, rex), false
+  case 'B':
+    return regName(d.vvvv & 15, size, true), false
+  case 'Z':
+    return regName(int(d.op & 7) | rexB, size, rex), false
+  case 'S':
+    return segments[d.reg], false
+  case 'C':
+    return fmt.Sprintf("cr%d", d.reg | rexR), false
+  case 'D':
+    return fmt.Sprintf("dr%d", d.reg | rexR), false
+  case 'V':
+    return d.vreg(d.reg | rexR | d.regHigh, s[1:]), false
+  case 'H':
+    return d.vreg(d.vvvv, s[1:]), false
+  case 'U':
+    return d.vreg(d.rm | rexB | d.rmHigh, s[1:]), false
+  case 'L':
+    v := d.imms[0]
+    d.imms = d.imms[1:]
+    return d.vreg(int(v >> 4) & 15, "x"), false
+  case 'W':
+    if d.mod == 3 {
+      return d.vreg(d.rm | rexB | d.rmHigh, s[1:]), false
+    }
+    return d.mem(size), true
+  case 'P':
+    return fmt.Sprintf("mm%d", d.reg), false
+  case 'N':
+    return fmt.Sprintf("mm%d", d.rm), false
+  case 'Q':
+    if d.mod == 3 {
+      return fmt.Sprintf("mm%d", d.rm), false
+    }
+    return d.mem(8), true
+  case 'K':
+    switch {
+    case s[1] == 'G':
+      return fmt.Sprintf("k%d", d.reg), false
+    case s[1] == 'H':
+      return fmt.Sprintf("k%d", d.vvvv & 7), false
+    case d.mod == 3:
+      return fmt.Sprintf("k%d", d.rm), false
+    }
+    return d.mem(0), true
+  case 'X':
+    return d.stringMem(size, false), true
+  case 'Y':
+    return d.stringMem(size, true), true
+  case 'O':
+    seg := d.seg
+    if seg == "" {
+      seg = "ds"
+    }
+    return fmt.Sprintf("%s:0x%x", seg, d.moffs), true
+  case 'I':
+    v := d.imms[0]
+    d.imms = d.imms[1:]
+    switch s {
+    case "Ibs", "Iz":
+      opsize := d.opSize(flags)
+      if s == "Iz" && opsize < 8 {
+        opsize = d.size("z", flags)
+      }
+      return fmt.Sprintf("0x%x", uint64(v) & (^uint64(0) >> uint(64 - 8*opsize))), false
+    case "Iv":
+      return fmt.Sprintf("0x%x", uint64(v) & (^uint64(0) >> uint(64 - 8*size))), false
+    case "Iw":
+      return fmt.Sprintf("0x%x", uint16(v)), false
+    }
+    return fmt.Sprintf("0x%x", uint8(v)), false
+  case 'J':
+    target := d.inst.Address + uint64(d.pos) + uint64(d.rel)
+    d.inst.Target, d.inst.HasTarget = target, true
+    return fmt.Sprintf("0x%x", target), false
+  }
+  return s, false
+}
+
+// vexArgs adapts the operands of a legacy form to its VEX encoding, which
+// usually takes VEX.vvvv as an extra source after the destination.
+func (d *decoder) vexArgs(args string) string {
+  specs := strings.Split(args, ",")
+  if len(specs) < 2 || specs[0][0] != 'V' && specs[0][0] != 'W' {
+    return args
+  }
+
+  extra := ! noVvvv[d.key]
+  switch d.key {
+  case 0x0110, 0x0111:
+    // Scalar moves only take it between registers
+    extra = d.pp >= 2 && d.mod == 3
+  case 0x0112, 0x0116:
+    extra = d.pp < 2
+  case 0x0151, 0x0152, 0x0153, 0x015a:
+    extra = d.pp >= 2
+  }
+  if ! extra || specs[0][0] == 'W' && d.key != 0x0111 {
+    return args
+  }
+  return specs[0] + ",Hx," + strings.Join(specs[1:], ",")
+}
+
+func (d *decoder) prefixes(mn string, flow FlowKind) string {
+  var list []string
+  for i := 0; i < d.data16; i++ {
+    list = append(list, "data16")
+  }
+  if d.ignoredSeg != "" {
+    list = append(list, d.ignoredSeg)
+  }
+  if d.lock {
+    list = append(list, "lock")
+  }
+  switch {
+  case d.rep == 0:
+  case mn == "cmps" || mn == "scas":
+    list = append(list, map[byte]string{0xf3: "repz", 0xf2: "repnz"}[d.rep])
+  case mn == "movs" || mn == "stos" || mn == "lods" || mn == "ins" || mn == "outs":
+    list = append(list, "rep")
+  case d.rep == 0xf2 && flow != FlowNone:
+    list = append(list, "bnd")
+  case d.rep == 0xf3:
+    list = append(list, "repz")
+  default:
+    list = append(list, "repnz")
+  }
+  return strings.Join(list, " ")
+}
+
+// cmpPredicates name the comparisons of cmpps and friends. Legacy encodings
+// only have the first eight.
+var cmpPredicates = []string{
+  "eq", "lt", "le", "unord", "neq", "nlt", "nle", "ord",
+  "eq_uq", "nge", "ngt", "false", "neq_oq", "ge", "gt", "true",
+  "eq_os", "lt_oq", "le_oq", "unord_s", "neq_us", "nlt_uq", "nle_uq", "ord_s",
+  "eq_us", "nge_uq", "ngt_uq", "false_os", "neq_os", "ge_oq", "gt_oq", "true_us",
+}
+
+// intPredicates name the integer comparisons of vpcmp
+var intPredicates = []string{"eq", "lt", "le", "false", "neq", "nlt", "nle", "true"}
+
+// predicateName folds the immediate of a compare into its mnemonic the way
+// assemblers write it, so cmpsd xmm0, xmm1, 0x1 becomes cmpltsd xmm0, xmm1.
+func predicateName(mn string, imm int64, vex bool) (string, bool) {
+  names, prefix := cmpPredicates[:8], "cmp"
+  switch {
+  case strings.HasPrefix(mn, "v"):
+    mn = mn[1:]
+    prefix = "vcmp"
+    names = cmpPredicates
+  }
+  switch mn {
+  case "cmpps", "cmppd", "cmpss", "cmpsd":
+  case "pcmpb", "pcmpw", "pcmpd", "pcmpq", "pcmpub", "pcmpuw", "pcmpud", "pcmpuq":
+    names, prefix = intPredicates, "vpcmp"
+    mn = mn[1:]
+  default:
+    return "", false
+  }
+  if imm < 0 || int(imm) >= len(names) || ! vex && prefix != "cmp" {
+    return "", false
+  }
+  return prefix + names[imm] + mn[3:], true
+}
+
+func flowOf(mn string) FlowKind {
+  switch mn {
+  case "jmp":
+    return FlowJump
+  case "call":
+    return FlowCall
+  case "ret", "retf", "iret", "iretq":
+    return FlowReturn
+  case "syscall", "sysenter":
+    return FlowSyscall
+  case "int3", "int", "int1", "ud0", "ud1", "ud2", "hlt":
+    return FlowTrap
+  case "loop", "loope", "loopne", "jrcxz":
+    return FlowBranch
+  }
+  if mn[0] == 'j' {
+    return FlowBranch
+  }
+  return FlowNone
+}
+
+// Decode decodes the instruction at the start of code, which is located at
+// addr in the target.
+func Decode(code []byte, addr uint64) (*Instruction, error) {
+  if len(code) > maxInstruction {
+    code = code[:maxInstruction]
+  }
+  inst := &Instruction{Address: addr}
+  d := &decoder{code: code, inst: inst, vecLen: 16, base: -1, index: -1}
+
+  e, ok := d.decode()
+  if d.err != nil {
+    return nil, d.err
+  }
+  if ! ok || e.mn == "" {
+    return nil, errBadInstruction
+  }
+
+  args := e.args
+  if (d.vex || d.evex) && e.flags & opNoVex == 0 {
+    if d.readModrm(); d.err == nil {
+      args = d.vexArgs(args)
+    }
+  }
+  var specs []string
+  if args != "" {
+    specs = strings.Split(args, ",")
+  }
+  for _, s := range specs {
+    if needsModrm(s) {
+      d.readModrm()
+      break
+    }
+  }
+  d.immediates(specs, e.flags)
+  if d.err != nil {
+    return nil, d.err
+  }
+  inst.Bytes = code[:d.pos]
+
+  // The register forms of movlps and movhps are different instructions
+  switch {
+  case e.mn == "movlps" && d.mod == 3:
+    e.mn = "movhlps"
+  case e.mn == "movhps" && d.mod == 3:
+    e.mn = "movlhps"
+  }
+
+  mn := e.mn
+  if i := strings.IndexByte(mn, '|'); i >= 0 {
+    if d.rexW() {
+      mn = mn[i+1:]
+    } else {
+      mn = mn[:i]
+    }
+  }
+  if (d.vex || d.evex) && e.flags & opNoVex == 0 {
+    mn = "v" + mn
+  }
+  inst.Mnemonic = mn
+  inst.Flow = flowOf(mn)
+
+  // A DS prefix on an indirect branch is CET's notrack
+  notrack := false
+  if (inst.Flow == FlowJump || inst.Flow == FlowCall) && d.seg == "ds" &&
+     len(specs) > 0 && specs[0][0] != 'J' {
+    notrack, d.seg = true, ""
+  }
+  // Other than FS and GS, segment overrides are ignored, and shown as
+  // prefixes the way objdump does it. String instructions keep theirs.
+  switch d.seg {
+  case "cs", "ds", "es", "ss":
+    stringOp := false
+    for _, s := range specs {
+      stringOp = stringOp || s[0] == 'X' || s[0] == 'Y'
+    }
+    if ! stringOp {
+      d.ignoredSeg, d.seg = d.seg, ""
+    }
+  }
+
+  for i, s := range specs {
+    text, isMem := d.operand(s, e.flags)
+    if i == 0 && d.evex && d.mask != 0 {
+      text += fmt.Sprintf("{k%d}", d.mask)
+      if d.zeroing {
+        text += "{z}"
+      }
+    }
+    inst.Operands = append(inst.Operands, text)
+
+    if ! isMem || e.flags & opNoMem != 0 {
+      continue
+    }
+    written := i == 0 && (len(specs) > 1 && e.flags & opRead == 0 ||
+                          e.flags & opWrite != 0)
+    if written {
+      inst.MemWrite = true
+    }
+    if ! written || e.flags & opStore == 0 {
+      inst.MemRead = true
+    }
+  }
+
+  if name, ok := predicateName(inst.Mnemonic, d.lastImm, d.vex || d.evex); ok {
+    inst.Mnemonic = name
+    inst.Operands = inst.Operands[:len(inst.Operands)-1]
+  }
+
+  if (inst.Flow == FlowJump || inst.Flow == FlowCall) && len(specs) > 0 {
+    inst.Indirect = specs[0][0] != 'J'
+  }
+  inst.Prefix = d.prefixes(mn, inst.Flow)
+  if notrack {
+    inst.Prefix = strings.TrimSpace("notrack " + inst.Prefix)
+  }
+  return inst, nil
+}
+
+// Disassemble decodes n instructions starting at addr. Breakpoints are
+// hidden, so the original instructions show. Bytes that don't decode become
+// one byte "(bad)" instructions, and decoding stops early at the end of
+// readable memory.
+func (p *Process) Disassemble(addr uint64, n int) ([]*Instruction, error) {
+  if n < 0 {
+    return nil, errBadCount
+  }
+  buf := make([]byte, n * maxInstruction)
+  count, err := p.ReadMemory(addr, buf)
+  if count == 0 {
+    return nil, err
+  }
+  buf = buf[:count]
+  p.hideBreakpoints(addr, buf)
+
+  insts := []*Instruction{}
+  for off := 0; off < len(buf) && len(insts) < n; {
+    inst, err := Decode(buf[off:], addr + uint64(off))
+    if err == errTruncated && count < n * maxInstruction {
+      break
+    }
+    if err != nil {
+      inst = &Instruction{Address: addr + uint64(off), Bytes: buf[off:off+1],
+                          Mnemonic: "(bad)"}
+    }
+    p.symbolizeTarget(inst)
+    insts = append(insts, inst)
+    off += inst.Len()
+  }
+  return insts, nil
+}
+
+// symbolizeTarget names what an instruction refers to, when it's covered by
+// a symbol.
+func (p *Process) symbolizeTarget(inst *Instruction) {
+  if ! inst.HasTarget {
+    return
+  }
+  if m := p.ModuleAt(inst.Target); m != nil {
+    if _, _, ok := m.SymbolAt(inst.Target); ok {
+      inst.Symbol = p.Symbolize(inst.Target)
+    }
+  }
+}
+
+// decodeAround decodes code, which was read from addr, so that an instruction
+// starts at pc. Instructions can't be decoded backwards, so each starting
+// point before pc is tried in turn until one lines up with it. Decoding stops
+// at the first invalid instruction, which may be the one at pc.
+func decodeAround(addr uint64, code []byte, pc uint64) []*Instruction {
+  if pc < addr || pc >= addr + uint64(len(code)) {
+    return nil
+  }
+  target := int(pc - addr)
+
+  for start := 0; start <= target; start++ {
+    insts, off := []*Instruction{}, start
+    for off < len(code) {
+      inst, err := Decode(code[off:], addr + uint64(off))
+      if err != nil || off < target && off + inst.Len() > target {
+        break
+      }
+      insts = append(insts, inst)
+      off += inst.Len()
+    }
+    if off >= target {
+      return insts
+    }
+  }
+  return nil
+}
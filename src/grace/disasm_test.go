@@ -0,0 +1,234 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "encoding/hex"
+  "strings"
+  "testing"
+)
+
+func decodeHex(t *testing.T, s string, addr uint64) (*Instruction, error) {
+  code, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+  if err != nil {
+    t.Fatalf("bad test bytes %q", s)
+  }
+  return Decode(code, addr)
+}
+
+// The expected text is what objdump -M intel shows, in lower case.
+func TestDecode(t *testing.T) {
+  tests := []struct {
+    code  string
+    text  string
+  }{
+    {"90", "nop"},
+    {"66 90", "xchg ax, ax"},
+    {"66 66 90", "data16 xchg ax, ax"},
+    {"f3 90", "pause"},
+    {"41 90", "xchg r8d, eax"},
+    {"87 c0", "xchg eax, eax"},
+    {"0f 1f 00", "nop dword ptr [rax]"},
+    {"0f 1f 40 00", "nop dword ptr [rax+0x0]"},
+    {"0f 1f 44 00 00", "nop dword ptr [rax+rax*1+0x0]"},
+    {"66 0f 1f 44 00 00", "nop word ptr [rax+rax*1+0x0]"},
+    {"0f 1f 80 00 00 00 00", "nop dword ptr [rax+0x0]"},
+    {"66 0f 1f 84 00 00 00 00 00", "nop word ptr [rax+rax*1+0x0]"},
+    {"66 2e 0f 1f 84 00 00 00 00 00", "cs nop word ptr [rax+rax*1+0x0]"},
+    {"66 66 2e 0f 1f 84 00 00 00 00 00", "data16 cs nop word ptr [rax+rax*1+0x0]"},
+    {"66 66 66 2e 0f 1f 84 00 00 00 00 00", "data16 data16 cs nop word ptr [rax+rax*1+0x0]"},
+    {"66 66 89 c8", "data16 mov ax, cx"},
+    {"2e 8b 00", "cs mov eax, dword ptr [rax]"},
+    {"64 8b 00", "mov eax, dword ptr fs:[rax]"},
+    {"64 48 8b 04 25 28 00 00 00", "mov rax, qword ptr fs:0x28"},
+    {"3e 74 10", "ds je 0x1013"},
+    {"3e ff e0", "notrack jmp rax"},
+    {"f3 a4", "rep movs byte ptr es:[rdi], byte ptr ds:[rsi]"},
+    {"f3 0f 1e fa", "endbr64"},
+    {"f2 ff 25 fa 0f 00 00", "bnd jmp qword ptr [rip+0xffa]"},
+    {"55", "push rbp"},
+    {"48 89 e5", "mov rbp, rsp"},
+    {"48 83 ec 10", "sub rsp, 0x10"},
+    {"48 8b 45 f8", "mov rax, qword ptr [rbp-0x8]"},
+    {"41 8b 04 88", "mov eax, dword ptr [r8+rcx*4]"},
+    {"48 b8 88 77 66 55 44 33 22 11", "movabs rax, 0x1122334455667788"},
+    {"c7 05 10 00 00 00 01 00 00 00", "mov dword ptr [rip+0x10], 0x1"},
+    {"f0 48 0f b1 0f", "lock cmpxchg qword ptr [rdi], rcx"},
+    {"0f c7 64 24 40", "xsavec [rsp+0x40]"},
+    {"48 0f c7 64 24 40", "xsavec64 [rsp+0x40]"},
+    {"c5 f9 6f 07", "vmovdqa xmm0, xmmword ptr [rdi]"},
+    {"c3", "ret"},
+    {"cc", "int3"},
+    {"0f 05", "syscall"},
+  }
+  for _, test := range tests {
+    inst, err := decodeHex(t, test.code, 0x1000)
+    if err != nil {
+      t.Errorf("%s: %v", test.code, err)
+      continue
+    }
+    if want := (len(test.code) + 1) / 3; inst.Len() != want {
+      t.Errorf("%s: length %d, want %d", test.code, inst.Len(), want)
+    }
+    if got := inst.String(); got != test.text {
+      t.Errorf("%s: %q, want %q", test.code, got, test.text)
+    }
+  }
+}
+
+// Relocating code depends on where the displacements are, so they're checked
+// along with the targets they give.
+func TestDecodeTargets(t *testing.T) {
+  tests := []struct {
+    code       string
+    flow       FlowKind
+    indirect   bool
+    target     uint64
+    ripOffset  int
+    relOffset  int
+    relSize    int
+  }{
+    {"e8 00 01 00 00", FlowCall, false, 0x1105, 0, 1, 4},
+    {"e8 fb ef ff ff", FlowCall, false, 0x0, 0, 1, 4},
+    {"eb fe", FlowJump, false, 0x1000, 0, 1, 1},
+    {"e9 00 00 00 80", FlowJump, false, 0xffffffff80001005, 0, 1, 4},
+    {"74 10", FlowBranch, false, 0x1012, 0, 1, 1},
+    {"3e 74 10", FlowBranch, false, 0x1013, 0, 2, 1},
+    {"0f 84 00 01 00 00", FlowBranch, false, 0x1106, 0, 2, 4},
+    {"e3 fe", FlowBranch, false, 0x1000, 0, 1, 1},
+    {"48 8b 05 10 00 00 00", FlowNone, false, 0x1017, 3, 0, 0},
+    {"4c 8d 3d ec f2 ff ff", FlowNone, false, 0x1007 - 0xd14, 3, 0, 0},
+    {"ff 25 fa 0f 00 00", FlowJump, true, 0x2000, 2, 0, 0},
+    {"f2 ff 25 fa 0f 00 00", FlowJump, true, 0x2001, 3, 0, 0},
+    {"ff 15 fa 0f 00 00", FlowCall, true, 0x2000, 2, 0, 0},
+    // The displacement is relative to the end, past the immediate
+    {"c7 05 10 00 00 00 01 00 00 00", FlowNone, false, 0x101a, 2, 0, 0},
+    {"80 3d 10 00 00 00 00", FlowNone, false, 0x1017, 2, 0, 0},
+    {"66 0f 1f 84 00 00 00 00 00", FlowNone, false, 0, 0, 0, 0},
+    {"ff e0", FlowJump, true, 0, 0, 0, 0},
+  }
+  for _, test := range tests {
+    inst, err := decodeHex(t, test.code, 0x1000)
+    if err != nil {
+      t.Errorf("%s: %v", test.code, err)
+      continue
+    }
+    if inst.Flow != test.flow || inst.Indirect != test.indirect {
+      t.Errorf("%s: flow %s indirect %v, want %s %v", test.code, inst.Flow, inst.Indirect,
+               test.flow, test.indirect)
+    }
+    hasTarget := test.target != 0 || test.relSize != 0
+    if inst.HasTarget != hasTarget || inst.Target != test.target {
+      t.Errorf("%s: target 0x%x (%v), want 0x%x", test.code, inst.Target, inst.HasTarget, test.target)
+    }
+    if inst.ripOffset != test.ripOffset || inst.relOffset != test.relOffset ||
+       inst.relSize != test.relSize {
+      t.Errorf("%s: rip at %d, rel at %d size %d; want %d, %d size %d", test.code,
+               inst.ripOffset, inst.relOffset, inst.relSize,
+               test.ripOffset, test.relOffset, test.relSize)
+    }
+  }
+}
+
+func TestDecodeMemoryAccess(t *testing.T) {
+  tests := []struct {
+    code         string
+    read, write  bool
+  }{
+    {"48 8b 00", true, false},
+    {"48 89 00", false, true},
+    {"48 01 00", true, true},
+    {"48 39 00", true, false},
+    {"48 8d 00", false, false},
+    {"c6 00 01", false, true},
+    {"ff 10", true, false},
+    {"0f 1f 00", false, false},
+    {"55", false, false},
+    {"f0 48 0f b1 0f", true, true},
+  }
+  for _, test := range tests {
+    inst, err := decodeHex(t, test.code, 0)
+    if err != nil {
+      t.Errorf("%s: %v", test.code, err)
+      continue
+    }
+    if inst.MemRead != test.read || inst.MemWrite != test.write {
+      t.Errorf("%s (%s): read %v write %v, want %v %v", test.code, inst,
+               inst.MemRead, inst.MemWrite, test.read, test.write)
+    }
+  }
+}
+
+func TestDecodeErrors(t *testing.T) {
+  tests := []struct {
+    code  string
+    err   error
+  }{
+    {"", errTruncated},
+    {"e8 00 01", errTruncated},
+    {"48 8b", errTruncated},
+    {"48 8b 05 10 00", errTruncated},
+    {"66 66 66 66 66 66 66 66 66 66 66 66 66 66 66 90", errTruncated},
+    {"0f 04", errBadInstruction},
+    {"0f c7 c8", errBadInstruction},
+  }
+  for _, test := range tests {
+    if inst, err := decodeHex(t, test.code, 0); err != test.err {
+      t.Errorf("%q: got %v, %v; want %v", test.code, inst, err, test.err)
+    }
+  }
+}
+
+func TestDisassemble(t *testing.T) {
+  code, _ := hex.DecodeString("554889e5c3488b")
+  p := &Process{Memory: &MemoryMap{}, target: &memBackend{0x1000, code}}
+  tests := []struct {
+    n          int
+    addresses  []uint64
+    err        error
+  }{
+    {2, []uint64{0x1000, 0x1001}, nil},
+    {10, []uint64{0x1000, 0x1001, 0x1004}, nil},
+    {0, []uint64{}, nil},
+    {-1, nil, errBadCount},
+  }
+  for _, test := range tests {
+    insts, err := p.Disassemble(0x1000, test.n)
+    if err != test.err || len(insts) != len(test.addresses) {
+      t.Errorf("%d instructions: got %v, %v", test.n, insts, err)
+      continue
+    }
+    for i, inst := range insts {
+      if inst.Address != test.addresses[i] {
+        t.Errorf("%d instructions: instruction %d at 0x%x", test.n, i, inst.Address)
+      }
+    }
+  }
+}
@@ -34,11 +34,13 @@ import (
   "unsafe"
   "os"
   "fmt"
+  "time"
 )
 
-// SetRegisters is a wrapper for ptrace(PTRACE_SETREGS)
+// SetRegisters is a wrapper for ptrace(PTRACE_SETREGS). Like GetRegisters, it
+// applies to the thread whose stop is being handled, or the main thread.
 func (p *Process) SetRegisters(regs *RegisterState) bool {
-  err := syscall.PtraceSetRegs(p.Pid, &regs.PtraceRegs)
+  err := p.backend().setRegisters(p.tid(), regs)
   if err != nil {
     return false
   }
@@ -47,12 +49,7 @@ func (p *Process) SetRegisters(regs *RegisterState) bool {
 
 // GetRegisters is a wrapper for ptrace(PTRACE_GETREGS)
 func (p *Process) GetRegisters() (*RegisterState, error) {
-  registers := &RegisterState{}
-  err := syscall.PtraceGetRegs(p.Pid, &registers.PtraceRegs)
-  if err != nil {
-    return nil, err
-  }
-  return registers, nil
+  return p.backend().getRegisters(p.tid())
 }
 
 // ensureNotRunning panics when the current process that is being traced is
@@ -64,82 +61,81 @@ func (p *Process) ensureNotRunning() {
   }
 }
 
-// writeMemoryAligned is a wrapper for ptrace(PTRACE_POKETEXT) that attempts to
-// make all calls wordsize-aligned. For some reason, this is completely
-// different from readMemoryAligned and they should be merged.
-func (p *Process) writeMemoryAligned(where uint64, bytes []byte) (count int, err error) {
-  wordsize := int(unsafe.Sizeof(uintptr(0)))
-  rem := len(bytes) % wordsize
+const wordSize = int(unsafe.Sizeof(uintptr(0)))
 
-  if rem > 0 {
-    pad := make([]byte, wordsize)
-    syscall.PtracePokeText(p.Pid, uintptr(where+uint64(len(bytes)-rem)), pad)
-    bytes = append(bytes, pad[rem:]...)
-  }
+// errRunning is reported by the memory accessors when the target has not
+// stopped; ptrace refuses to touch a running tracee.
+const errRunning = TracerError("target process is running")
 
-  for offset := 0; offset < len(bytes); offset += wordsize {
-    toWrite := bytes[offset:offset+wordsize]
-    cnt, err := syscall.PtracePokeText(p.Pid, uintptr(where+uint64(offset)), toWrite)
-    if err != nil {
-      return cnt, err
-    }
-    count += cnt
-  }
-
-  return
+// MemoryError describes a failed access to the target's address space. Addr
+// is the first byte that could not be read or written, which may lie past the
+// start of the requested range when part of the access succeeded.
+type MemoryError struct {
+  Op    string
+  Addr  uint64
+  Err   error
 }
 
+func (e *MemoryError) Error() string {
+  return fmt.Sprintf("%s memory at 0x%x: %v", e.Op, e.Addr, e.Err)
+}
 
-// readMemoryAligned is a wrapper for ptrace(PTRACE_PEEKTEXT) that attempts to
-// make all calls wordsize-aligned. (See comment from writeMemoryAligned)
-func (p *Process) readMemoryAligned(where uint64, bytes []byte) (count int, err error) {
-  p.ensureNotRunning()
-
-  wordSize := int(unsafe.Sizeof(uintptr(0)))
-  whereAligned := where & uint64(^(wordSize-1))
-  firstWordOffset := int(where - whereAligned)
-  lenBytes := len(bytes)
-  total := 0
-
-  wordRead := make([]byte, wordSize)
-  for i := 0; i < lenBytes; {
-    cnt, err := syscall.PtracePeekText(p.Pid, uintptr(whereAligned), wordRead)
+func (e *MemoryError) Unwrap() error {
+  return e.Err
+}
 
-    if err != nil || cnt != wordSize {
-      panic(err.Error())
-      return total, err
-    }
+// ReadMemory fills buf with the contents of the target's memory starting at
+// addr. Neither addr nor len(buf) need to be word aligned. Large reads go
+// through process_vm_readv or /proc/pid/mem and fall back to ptrace for
+// whatever those can't reach. On failure, count is the number of leading
+// bytes of buf that were filled in and err is a *MemoryError naming the first
+// address that could not be read.
+func (p *Process) ReadMemory(addr uint64, buf []byte) (count int, err error) {
+  if p.isRunning {
+    return 0, &MemoryError{"read", addr, errRunning}
+  }
 
-    i += copy(bytes[i:lenBytes], wordRead[firstWordOffset:])
+  count, err = p.backend().readMemory(addr, buf)
+  if err != nil {
+    return count, &MemoryError{"read", addr + uint64(count), err}
+  }
+  return count, nil
+}
 
-    firstWordOffset = 0
-    total = i
+// WriteMemory copies buf into the target's memory starting at addr. Bytes
+// around an unaligned range are preserved. Pages the faster paths refuse to
+// write, such as read-only text, are written with PTRACE_POKETEXT. On failure,
+// count is the number of leading bytes of buf that were written and err is a
+// *MemoryError.
+func (p *Process) WriteMemory(addr uint64, buf []byte) (count int, err error) {
+  if p.isRunning {
+    return 0, &MemoryError{"write", addr, errRunning}
   }
 
-  return total, nil
+  count, err = p.backend().writeMemory(addr, buf)
+  if err != nil {
+    return count, &MemoryError{"write", addr + uint64(count), err}
+  }
+  return count, nil
 }
 
 // SwapBytesText simple writes the slice 'what' to the location 'where' in the
 // target process, returning the content that used to be at that address in
 // the 'what' slice.
-func (p *Process) SwapBytesText(where uint64, what []byte) bool {
+func (p *Process) SwapBytesText(where uint64, what []byte) error {
   p.ensureNotRunning()
 
   saved := make([]byte, len(what))
-  //cnt, err := syscall.PtracePeekText(p.Pid, uintptr(where), saved)
-  cnt, err := p.readMemoryAligned(where, saved)
-  if cnt != len(what) || err != nil {
-    return false
+  if _, err := p.ReadMemory(where, saved); err != nil {
+    return err
   }
 
-  cnt, err = syscall.PtracePokeText(p.Pid, uintptr(where), what)
-  if cnt != len(what) || err != nil {
-    fmt.Printf("failed writing")
-    return false
+  if _, err := p.WriteMemory(where, what); err != nil {
+    return err
   }
 
   copy(what, saved)
-  return true
+  return nil
 }
 
 type PtraceError string
@@ -150,51 +146,160 @@ func (p PtraceError) Error() string {
 // ToggleBreakpoint should be clear, but needs more work.
 // TODO: this function is very asymetrical with Deactivate..
 func (p *Process) ToggleBreakpoint(bp *Breakpoint) bool {
-  if ! p.SwapBytesText(bp.Address, bp.savedInstr) {
+  if err := p.SwapBytesText(bp.Address, bp.savedInstr); err != nil {
     return false
   }
   bp.Active = !bp.Active
   return true
 }
 
-// handleBreakpoint gets called when the event loop gets a signal from the
-// traced process.
-func (proc *Process) handleBreakpoint(bp *Breakpoint) {
+// hideBreakpoints puts the original instructions back into buf, which holds
+// target memory read from addr, wherever an active breakpoint, an instrument
+// or coverage patched it.
+func (p *Process) hideBreakpoints(addr uint64, buf []byte) {
+  for _, bp := range p.Breakpoints {
+    if bp.Active && bp.Address >= addr && bp.Address < addr + uint64(len(buf)) {
+      copy(buf[bp.Address - addr:], bp.savedInstr)
+    }
+  }
+  p.hideInstruments(addr, buf)
+  p.hideCoverage(addr, buf)
+}
+
+// handleBreakpoint gets called when the current thread has stopped on bp,
+// and returns what the handler asked for. The handler sees the registers as
+// of the breakpoint, with the PC moved back onto it, and whatever it changes
+// in them is written back. Unless the handler moved the PC elsewhere, the
+// original instruction is then stepped over and the breakpoint re-armed.
+// Actions that concern the whole process are left to the event loop.
+func (proc *Process) handleBreakpoint(bp *Breakpoint) Action {
+  t := proc.current
   regs, err := proc.GetRegisters()
   if err != nil {
-    return
+    return CONTINUE
   }
+  regs.SetPC(bp.Address)
+  if ! proc.SetRegisters(regs) {
+    return CONTINUE
+  }
+  bp.HitCount = bp.HitCount + 1
+  proc.coverageReached(bp.Address)
 
-  // restore original instruction
-  /*ok := */ proc.SwapBytesText(bp.Address, bp.savedInstr)
-  /*
-    if ! ok {
-      fmt.Printf("!!! NO1 !!!\n")
+  ctx := &BreakpointContext{Process: proc, Thread: t, Breakpoint: bp, Regs: regs,
+                            Time: time.Now()}
+  if ! bp.quiet {
+    proc.recorder.breakpointHit(t.Tid, bp, ctx.Time)
+  }
+  result := proc.runHandler(ctx)
+
+  for result == SINGLE_STEP_MODE {
+    if res := proc.stepPast(t); res != nil {
+      return CONTINUE
+    }
+    proc.resumeOthers(t)
+    regs, err := proc.GetRegisters()
+    if err != nil || proc.breakpointAt(regs.PC()) != nil {
+      // Let it be hit as usual
+      return CONTINUE
     }
-  */
+    ctx = &BreakpointContext{Process: proc, Thread: t, Breakpoint: bp, Regs: regs,
+                             Time: time.Now(), Stepping: true}
+    result = proc.runHandler(ctx)
+  }
 
-  // restore original instruction
-  regs.SetPC(bp.Address)
-  proc.SetRegisters(regs)
+  switch result {
+  case REMOVE:
+    proc.RemoveBreakpoint(bp)
+  case DISABLE:
+    proc.DisableBreakpoint(bp)
+  case SKIP_FUNCTION:
+    proc.skipFunction(ctx.Return)
+  case STOP:
+    t.resumeOver = bp
+    return result
+  case DETACH, KILL_TARGET, ABORT:
+    return result
+  }
 
-  // single step
-  proc.SingleStep()
+  after, err := proc.GetRegisters()
+  if err == nil && after.PC() == bp.Address && bp.Active {
+    proc.stepPast(t)
+  }
+  // The handler may have stopped them, e.g. to call a function
+  proc.resumeOthers(t)
+  return result
+}
 
-  // Invoke the callback
-  switch result := bp.Callback(regs); result {
-    case ABORT: os.Exit(0) // TODO: Not very graceful
-    case CONTINUE:
+// runHandler invokes the breakpoint's handler. It may also have set the
+// registers itself, so they're only written back if it changed ctx.Regs.
+func (proc *Process) runHandler(ctx *BreakpointContext) Action {
+  before := *ctx.Regs
+  var result Action
+  switch bp := ctx.Breakpoint; {
+  case bp.Handler != nil:
+    result = bp.Handler(ctx)
+  case bp.Callback != nil:
+    result = bp.Callback(ctx.Regs)
+  }
+  if *ctx.Regs != before {
+    proc.SetRegisters(ctx.Regs)
   }
+  return result
+}
 
-  // restore again
-  proc.SwapBytesText(bp.Address, bp.savedInstr)
+// stepPast moves thread t over one instruction. If that means lifting a
+// breakpoint, the other threads are held meanwhile so they can't slip past
+// it. Whatever happens to them is left for the event loop.
+func (proc *Process) stepPast(t *Thread) *StepResult {
+  if regs, err := proc.backend().getRegisters(t.Tid); err == nil &&
+     proc.breakpointAt(regs.PC()) != nil {
+    proc.stopAll()
+  }
+  proc.holdStops = true
+  _, res, _ := proc.stepInstruction(t, false)
+  proc.holdStops = false
+  if _, ok := proc.Threads[t.Tid]; ok {
+    proc.current = t
+  }
+  return res
+}
 
-  bp.HitCount = bp.HitCount + 1
+// resumeOthers lets every thread but t go again, except for any with a stop
+// still to handle. The event loop resumes t itself.
+func (proc *Process) resumeOthers(t *Thread) {
+  for _, th := range proc.Threads {
+    if th != t && th.stopped && ! proc.hasPending(th) {
+      proc.resumeThread(th, 0)
+    }
+  }
+}
+
+// skipFunction makes the current thread, which is on the first instruction of
+// a function, return from it with value.
+func (proc *Process) skipFunction(value uint64) error {
+  regs, err := proc.GetRegisters()
+  if err != nil {
+    return err
+  }
+  buf := make([]byte, 8)
+  if _, err := proc.ReadMemory(regs.Rsp, buf); err != nil {
+    return err
+  }
+  regs.SetPC(proc.byteOrder().Uint64(buf))
+  regs.Rsp += 8
+  regs.Rax = value
+  if ! proc.SetRegisters(regs) {
+    return errNotLive
+  }
+  return nil
 }
 
 // SingleStep is a wrapper for ptrace(PTRACE_STEP)
 func (p *Process) SingleStep() bool {
-  err := syscall.PtraceSingleStep(p.Pid)
+  if ! p.IsLive() {
+    return false
+  }
+  err := syscall.PtraceSingleStep(p.tid())
   return err == nil
 }
 
@@ -203,23 +308,103 @@ func (p *Process) SingleStep() bool {
 // the address 'where' and registers 'fun' as the callback to be invoked every
 // time it's hit.
 func (p *Process) AddBreakpoint(where string, fun BpCallback) bool {
-  address, err := p.resolveSymbol(where)
+  bp, err := p.SetBreakpoint(where, nil)
   if err != nil {
     return false
   }
+  bp.Callback = fun
+  return true
+}
+
+// CallbackHandler adapts a BpCallback to the BreakpointHandler form.
+func CallbackHandler(fun BpCallback) BreakpointHandler {
+  return func(ctx *BreakpointContext) Action {
+    return fun(ctx.Regs)
+  }
+}
+
+const errBreakpointExists = TracerError("there already is a breakpoint at that address")
+const errNoBreakpoint = TracerError("no such breakpoint")
+
+// SetBreakpoint installs a breakpoint at 'where', which is resolved like for
+// AddBreakpoint, with h as its handler.
+func (p *Process) SetBreakpoint(where string, h BreakpointHandler) (*Breakpoint, error) {
+  address, err := p.resolveSymbol(where)
+  if err != nil {
+    return nil, err
+  }
+  return p.setBreakpointAt(address, h, false)
+}
+
+// setBreakpointAt installs a breakpoint at address with h as its handler.
+// quiet ones are the tracer's own, whose hits aren't recorded.
+func (p *Process) setBreakpointAt(address uint64, h BreakpointHandler, quiet bool) (*Breakpoint, error) {
+  if p.breakpointAt(address) != nil {
+    return nil, errBreakpointExists
+  }
+  if p.instrumentedWithin(address) != nil {
+    return nil, errInstrumented
+  }
+  // The block gets counted when the breakpoint is hit instead
+  p.coverageDisarm(address, address + 1)
 
   // TODO: make the bp instruction/instruction sequence settable by the user
   savedInstr := []byte{INT3}
-  if ok := p.SwapBytesText(address, savedInstr); ok {
-    p.Breakpoints = append(p.Breakpoints, &Breakpoint{address, savedInstr,
-                                                      true, fun, 0})
-    return true
+  if err := p.SwapBytesText(address, savedInstr); err != nil {
+    return nil, err
+  }
+  bp := &Breakpoint{Address: address, savedInstr: savedInstr, Active: true, Handler: h,
+                    quiet: quiet}
+  p.Breakpoints = append(p.Breakpoints, bp)
+  return bp, nil
+}
+
+// RemoveBreakpoint puts back the original instruction under bp and forgets
+// about it. It may be called from a handler, including bp's own.
+func (p *Process) RemoveBreakpoint(bp *Breakpoint) error {
+  for i, b := range p.Breakpoints {
+    if b != bp {
+      continue
+    }
+    if err := p.DisableBreakpoint(bp); err != nil {
+      return err
+    }
+    p.Breakpoints = append(p.Breakpoints[:i], p.Breakpoints[i+1:]...)
+    return nil
   }
-  return false
+  return errNoBreakpoint
+}
+
+// DisableBreakpoint puts back the original instruction under bp, but keeps
+// it around to be enabled again.
+func (p *Process) DisableBreakpoint(bp *Breakpoint) error {
+  if ! bp.Active {
+    return nil
+  }
+  if err := p.SwapBytesText(bp.Address, bp.savedInstr); err != nil {
+    return err
+  }
+  bp.Active = false
+  return nil
+}
+
+// EnableBreakpoint re-arms a disabled breakpoint.
+func (p *Process) EnableBreakpoint(bp *Breakpoint) error {
+  if bp.Active {
+    return nil
+  }
+  if err := p.SwapBytesText(bp.Address, bp.savedInstr); err != nil {
+    return err
+  }
+  bp.Active = true
+  return nil
 }
 
 // Kill sends SIGKILL to the target process, in a currently roundabout way.
 func (p *Process) Kill() {
+  if ! p.IsLive() {
+    return
+  }
   // TODO: Clean up this hack
   proc, _ := os.FindProcess(p.Pid)
   proc.Kill()
@@ -0,0 +1,256 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "encoding/json"
+  "os"
+  "strconv"
+  "syscall"
+  "unsafe"
+)
+
+// Making system calls fail on purpose. With a fault in place, threads are
+// resumed with PTRACE_SYSCALL. A call that is to fail has its number swapped
+// for an invalid one as it enters the kernel, so it does nothing, and its
+// return value is set as it comes back out. Calls made while a thread is
+// being single-stepped go through untouched.
+
+const errUnknownSyscall = TracerError("no such system call")
+const errUnknownErrno = TracerError("no such error number")
+const errNoFault = TracerError("no such fault")
+
+// syscallStop is the stop signal of a system call stop, with
+// PTRACE_O_TRACESYSGOOD set
+const syscallStop = syscall.SIGTRAP | 0x80
+
+// SyscallFault is a rule for making some system calls fail. Only the calls
+// that match Syscall and Args count towards Every.
+type SyscallFault struct {
+  // Syscall is the name of the call, e.g. "write"
+  Syscall    string
+  // Args are the values the call's arguments must have, by position, e.g.
+  // {0: 5} for calls on file descriptor 5
+  Args       map[int]uint64
+  // Every makes only every Every-th matching call fail. Zero is the same as 1.
+  Every      uint64
+  // Errno is the error the call fails with
+  Errno      syscall.Errno
+  // Return is what the call returns instead when Errno is zero
+  Return     int64
+  // Predicate, if set, gets the final say on whether a call fails
+  Predicate  func(*SyscallContext) bool
+
+  // Calls is how many calls have matched so far, and Injected how many of
+  // them were made to fail
+  Calls      uint64
+  Injected   uint64
+
+  number     int
+}
+
+// SyscallContext describes a system call about to be made, for a
+// SyscallFault's Predicate.
+type SyscallContext struct {
+  Process  *Process
+  Thread   *Thread
+  Number   int
+  Args     [6]uint64
+}
+
+// faultSpec is how a SyscallFault is written in a fault file
+type faultSpec struct {
+  Syscall  string            `json:"syscall"`
+  Args     map[int]uint64    `json:"args"`
+  Every    uint64            `json:"every"`
+  Error    string            `json:"error"`
+  Return   int64             `json:"return"`
+}
+
+// LoadFaults reads a list of faults from a JSON file, for InjectFault. Errors
+// go by name or number, and arguments by position:
+//
+//   [{"syscall": "write", "args": {"0": 5}, "every": 3, "error": "EIO"},
+//    {"syscall": "connect", "error": "ECONNREFUSED"}]
+func LoadFaults(path string) ([]*SyscallFault, error) {
+  data, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  specs := []faultSpec{}
+  if err := json.Unmarshal(data, &specs); err != nil {
+    return nil, err
+  }
+
+  faults := []*SyscallFault{}
+  for _, spec := range specs {
+    if _, ok := syscallNumbers[spec.Syscall]; ! ok {
+      return nil, errUnknownSyscall
+    }
+    f := &SyscallFault{Syscall: spec.Syscall, Args: spec.Args, Every: spec.Every,
+                       Return: spec.Return}
+    if spec.Error != "" {
+      if f.Errno, err = parseErrno(spec.Error); err != nil {
+        return nil, err
+      }
+    }
+    faults = append(faults, f)
+  }
+  return faults, nil
+}
+
+// maxErrno is the largest error a system call can return
+const maxErrno = 4095
+
+// parseErrno takes an error name like "EIO", or a number.
+func parseErrno(s string) (syscall.Errno, error) {
+  if errno, ok := errnoNames[s]; ok {
+    return errno, nil
+  }
+  if n, err := strconv.Atoi(s); err == nil && n > 0 && n <= maxErrno {
+    return syscall.Errno(n), nil
+  }
+  return 0, errUnknownErrno
+}
+
+// InjectFault puts f in place. Running threads take it up the next time they
+// stop.
+func (p *Process) InjectFault(f *SyscallFault) error {
+  nr, ok := syscallNumbers[f.Syscall]
+  if ! ok {
+    return errUnknownSyscall
+  }
+  f.number = nr
+  p.faults = append(p.faults, f)
+  return nil
+}
+
+// RemoveFault takes f out again.
+func (p *Process) RemoveFault(f *SyscallFault) error {
+  for i, g := range p.faults {
+    if g == f {
+      p.faults = append(p.faults[:i], p.faults[i+1:]...)
+      return nil
+    }
+  }
+  return errNoFault
+}
+
+// traceSyscalls reports whether t has to be resumed with PTRACE_SYSCALL.
+func (p *Process) traceSyscalls(t *Thread) bool {
+  return len(p.faults) > 0 || t.faulted || (p.recorder != nil && p.recorder.opts.Syscalls)
+}
+
+// matches reports whether a call with args counts towards f.
+func (f *SyscallFault) matches(nr int, args [6]uint64) bool {
+  if nr != f.number {
+    return false
+  }
+  for i, want := range f.Args {
+    if i < 0 || i >= len(args) || args[i] != want {
+      return false
+    }
+  }
+  return true
+}
+
+// result is what a call f makes fail returns.
+func (f *SyscallFault) result() uint64 {
+  if f.Errno != 0 {
+    return uint64(-int64(f.Errno))
+  }
+  return uint64(f.Return)
+}
+
+// syscallStopped handles a system call stop of thread t, on its way into the
+// kernel or back out.
+func (p *Process) syscallStopped(t *Thread) error {
+  entering, err := syscallEntry(t.Tid)
+  if err != nil {
+    return err
+  }
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return err
+  }
+
+  if ! entering {
+    if ! t.faulted {
+      p.recorder.syscallExited(t.Tid, regs.Rax)
+      return nil
+    }
+    t.faulted = false
+    regs.Rax = t.faultResult
+    p.recorder.syscallExited(t.Tid, regs.Rax)
+    return p.backend().setRegisters(t.Tid, regs)
+  }
+
+  ctx := &SyscallContext{Process: p, Thread: t, Number: int(regs.Orig_rax),
+    Args: [6]uint64{regs.Rdi, regs.Rsi, regs.Rdx, regs.R10, regs.R8, regs.R9}}
+  p.recorder.syscallEntered(t.Tid, ctx.Number, ctx.Args)
+  for _, f := range p.faults {
+    if ! f.matches(ctx.Number, ctx.Args) {
+      continue
+    }
+    f.Calls++
+    if f.Every > 1 && f.Calls % f.Every != 0 {
+      continue
+    }
+    if f.Predicate != nil && ! f.Predicate(ctx) {
+      continue
+    }
+
+    f.Injected++
+    t.faulted = true
+    t.faultResult = f.result()
+    regs.Orig_rax = ^uint64(0)
+    return p.backend().setRegisters(t.Tid, regs)
+  }
+  return nil
+}
+
+// PTRACE_GET_SYSCALL_INFO and what it says about a stop
+const (
+  ptraceGetSyscallInfo = 0x420e
+  syscallInfoEntry     = 1
+)
+
+// syscallEntry reports whether tid's system call stop is on the way into the
+// kernel rather than back out.
+func syscallEntry(tid int) (bool, error) {
+  var raw [88]byte
+  _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, ptraceGetSyscallInfo,
+                                  uintptr(tid), uintptr(len(raw)),
+                                  uintptr(unsafe.Pointer(&raw[0])), 0, 0)
+  if errno != 0 {
+    return false, errno
+  }
+  return raw[0] == syscallInfoEntry, nil
+}
@@ -0,0 +1,127 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "os"
+  "path/filepath"
+  "syscall"
+  "testing"
+)
+
+func loadFaultString(t *testing.T, data string) ([]*SyscallFault, error) {
+  path := filepath.Join(t.TempDir(), "faults.json")
+  if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return LoadFaults(path)
+}
+
+func TestLoadFaults(t *testing.T) {
+  faults, err := loadFaultString(t, `[
+    {"syscall": "write", "args": {"0": 5}, "every": 3, "error": "EIO"},
+    {"syscall": "connect", "error": "111"},
+    {"syscall": "getpid", "return": -1}
+  ]`)
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := []SyscallFault{
+    {Syscall: "write", Args: map[int]uint64{0: 5}, Every: 3, Errno: syscall.EIO},
+    {Syscall: "connect", Errno: syscall.ECONNREFUSED},
+    {Syscall: "getpid", Return: -1},
+  }
+  if len(faults) != len(want) {
+    t.Fatalf("got %d faults, want %d", len(faults), len(want))
+  }
+  for i, f := range faults {
+    w := want[i]
+    if f.Syscall != w.Syscall || f.Every != w.Every || f.Errno != w.Errno ||
+       f.Return != w.Return || len(f.Args) != len(w.Args) {
+      t.Errorf("fault %d = %+v, want %+v", i, *f, w)
+    }
+    for n, v := range w.Args {
+      if f.Args[n] != v {
+        t.Errorf("fault %d arg %d = %d, want %d", i, n, f.Args[n], v)
+      }
+    }
+  }
+}
+
+func TestLoadFaultsErrors(t *testing.T) {
+  tests := []struct {
+    data  string
+    err   error
+  }{
+    {`[{"syscall": "frobnicate", "error": "EIO"}]`, errUnknownSyscall},
+    {`[{"error": "EIO"}]`, errUnknownSyscall},
+    {`[{"syscall": "write", "error": "EWHATEVER"}]`, errUnknownErrno},
+    {`[{"syscall": "write", "error": "0"}]`, errUnknownErrno},
+    {`[{"syscall": "write", "error": "-5"}]`, errUnknownErrno},
+    {`[{"syscall": "write", "error": "4096"}]`, errUnknownErrno},
+    {`[{"syscall": "write"}, {"syscall": "read", "error": "eio"}]`, errUnknownErrno},
+  }
+  for _, test := range tests {
+    faults, err := loadFaultString(t, test.data)
+    if err != test.err || faults != nil {
+      t.Errorf("LoadFaults(%s) = %v, %v, want %v", test.data, faults, err, test.err)
+    }
+  }
+
+  if _, err := loadFaultString(t, `{"syscall": "write"}`); err == nil {
+    t.Errorf("LoadFaults accepted an object instead of a list")
+  }
+  if _, err := LoadFaults(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+    t.Errorf("LoadFaults accepted a missing file")
+  }
+}
+
+func TestParseErrno(t *testing.T) {
+  tests := []struct {
+    in     string
+    errno  syscall.Errno
+    err    error
+  }{
+    {"EIO", syscall.EIO, nil},
+    {"ENOSPC", syscall.ENOSPC, nil},
+    {"5", syscall.EIO, nil},
+    {"4095", 4095, nil},
+    {"", 0, errUnknownErrno},
+    {"EIO ", 0, errUnknownErrno},
+    {"0x5", 0, errUnknownErrno},
+  }
+  for _, test := range tests {
+    errno, err := parseErrno(test.in)
+    if errno != test.errno || err != test.err {
+      t.Errorf("parseErrno(%q) = %v, %v, want %v, %v", test.in, errno, err,
+               test.errno, test.err)
+    }
+  }
+}
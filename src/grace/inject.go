@@ -0,0 +1,156 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "debug/elf"
+  "path/filepath"
+  "syscall"
+)
+
+// Loading shared libraries into the target, by having it call dlopen
+
+const (
+  errNotDynamic = TracerError("the target isn't dynamically linked")
+  errNoDlopen   = TracerError("there's no dlopen in the target yet; libc may not be loaded")
+  errNotLoaded  = TracerError("the library was loaded but isn't mapped")
+)
+
+// rtldNow is dlopen's RTLD_NOW, and rtldDlopen the flag __libc_dlopen_mode
+// needs to behave like dlopen
+const (
+  rtldNow    = 0x2
+  rtldDlopen = 0x80000000
+)
+
+// DlopenError is a failed dlopen, with what dlerror said about it.
+type DlopenError struct {
+  Path    string
+  Message string
+}
+
+func (e *DlopenError) Error() string {
+  if e.Message == "" {
+    return "dlopen " + e.Path + " failed"
+  }
+  return "dlopen " + e.Path + ": " + e.Message
+}
+
+// LoadLibrary makes the target dlopen the shared library at path and returns
+// its module, with the symbols already read, so LookupSymbol and
+// SetBreakpoint see them straight away. The library's constructors run on the
+// thread whose stop is being handled, or the main thread. The target has to
+// be dynamically linked, and far enough along to have loaded libc.
+func (p *Process) LoadLibrary(path string) (*Module, error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  abs, err := filepath.Abs(path)
+  if err != nil {
+    return nil, err
+  }
+  if real, err := filepath.EvalSymlinks(abs); err == nil {
+    abs = real
+  }
+  if ! p.dynamicallyLinked() {
+    return nil, errNotDynamic
+  }
+
+  p.Memory.Refresh()
+  dlopen, flags := uint64(0), uint64(rtldNow)
+  if addr, err := p.LookupSymbol("dlopen"); err == nil {
+    dlopen = addr
+  } else if addr, err := p.LookupSymbol("__libc_dlopen_mode"); err == nil {
+    // What older glibcs without libdl have
+    dlopen, flags = addr, rtldNow | rtldDlopen
+  } else {
+    return nil, errNoDlopen
+  }
+  t, err := p.callThread()
+  if err != nil {
+    return nil, err
+  }
+
+  name := append([]byte(abs), 0)
+  buf, err := p.Mmap(uint64(len(name)), syscall.PROT_READ | syscall.PROT_WRITE)
+  if err != nil {
+    return nil, err
+  }
+  defer p.Munmap(buf, uint64(len(name)))
+  if _, err := p.WriteMemory(buf, name); err != nil {
+    return nil, err
+  }
+
+  handle, err := p.callFunction(t, dlopen, buf, flags)
+  if err != nil {
+    return nil, err
+  }
+  if handle == 0 {
+    return nil, &DlopenError{Path: abs, Message: p.dlerror(t)}
+  }
+
+  p.Memory.Refresh()
+  for _, m := range p.Modules() {
+    if m.Path == abs {
+      m.loadSymbols()
+      return m, nil
+    }
+  }
+  return nil, errNotLoaded
+}
+
+// dlerror returns what dlerror has to say in the target, if it can be asked.
+func (p *Process) dlerror(t *Thread) string {
+  fun, err := p.LookupSymbol("dlerror")
+  if err != nil {
+    return ""
+  }
+  msg, err := p.callFunction(t, fun)
+  if err != nil || msg == 0 {
+    return ""
+  }
+  s, _ := p.ReadCString(msg, 4096)
+  return s
+}
+
+// dynamicallyLinked reports whether the executable asks for a dynamic loader.
+func (p *Process) dynamicallyLinked() bool {
+  f, err := elf.Open(p.Filename)
+  if err != nil {
+    return false
+  }
+  defer f.Close()
+  for _, prog := range f.Progs {
+    if prog.Type == elf.PT_INTERP {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,456 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "syscall"
+  "time"
+)
+
+// Instrumentation by inline hooking. The first instructions of a function
+// are replaced with a jump to a trampoline in a page mapped into the target,
+// which counts the hit in target memory, traps to the tracer only if there's
+// a handler, then runs the displaced instructions and jumps back. Counting a
+// hit costs no context switches, and a handler two fewer than a breakpoint.
+
+const (
+  errInstrumentExists = TracerError("there already is an instrument at that address")
+  errNoInstrument     = TracerError("no such instrument")
+  errInstrumentBusy   = TracerError("a thread is in the middle of the instructions to move")
+  errCantRelocate     = TracerError("the instructions at that address can't be moved")
+  errInstrumented     = TracerError("that address is in the middle of an instrumented function")
+  errNoNearbyMemory   = TracerError("no free memory within reach of that address")
+)
+
+const (
+  // jumpSize is the size of the jmp rel32 put over the function
+  jumpSize = 5
+  // trampolineSize is the room a trampoline takes, with its counter in the
+  // last 8 bytes
+  trampolineSize = 128
+  codePageSize = 0x10000
+)
+
+// Instrument is a function hooked by AddInstrument.
+type Instrument struct {
+  Address    uint64
+  // Handler, if set, is called on every hit
+  Handler    BreakpointHandler
+
+  proc       *Process
+  trampoline uint64
+  trap       uint64    // the int3 in the trampoline, if there's a handler
+  saved      []byte    // what the jump overwrote
+  length     int       // the length of the instructions that were moved
+}
+
+// codePage is memory mapped into the target for trampolines
+type codePage struct {
+  addr, used uint64
+}
+
+// Hits returns how many times the function has been entered.
+func (in *Instrument) Hits() (uint64, error) {
+  buf := make([]byte, 8)
+  if _, err := in.proc.ReadMemory(in.counter(), buf); err != nil {
+    return 0, err
+  }
+  return in.proc.byteOrder().Uint64(buf), nil
+}
+
+func (in *Instrument) counter() uint64 {
+  return in.trampoline + trampolineSize - 8
+}
+
+// AddInstrument hooks the function at where, counting each time it's
+// entered. With a handler, the thread also traps so the handler can see and
+// change its registers, which show the PC at where. The context's
+// Breakpoint is nil and Instrument is set instead. Returning REMOVE
+// takes the instrument out, and STOP, DETACH and KILL_TARGET work as they do
+// for breakpoints. The flags and the red zone are preserved, so where
+// doesn't have to be the start of a function, but nothing may jump into the
+// instructions moved to the trampoline.
+func (p *Process) AddInstrument(where string, h BreakpointHandler) (*Instrument, error) {
+  addr, err := p.resolveSymbol(where)
+  if err != nil {
+    return nil, err
+  }
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  if p.instrumentAt(addr) != nil {
+    return nil, errInstrumentExists
+  }
+
+  // Nothing may run the code while it's rewritten
+  stopped := p.stopAll()
+  defer p.resumeStopped(stopped)
+
+  insts, err := p.Disassemble(addr, jumpSize)
+  if err != nil {
+    return nil, err
+  }
+  length := 0
+  for n, inst := range insts {
+    if inst.Mnemonic == "(bad)" {
+      return nil, errCantRelocate
+    }
+    length += inst.Len()
+    if length >= jumpSize {
+      insts = insts[:n+1]
+      break
+    }
+    switch inst.Flow {
+    case FlowJump, FlowReturn, FlowTrap:
+      // The function ends before there's room for the jump
+      return nil, errCantRelocate
+    }
+  }
+  if length < jumpSize {
+    return nil, errCantRelocate
+  }
+  if err := p.checkMovable(addr, length); err != nil {
+    return nil, err
+  }
+
+  p.coverageDisarm(addr, addr + uint64(length))
+  tramp, err := p.allocCode(addr, trampolineSize)
+  if err != nil {
+    return nil, err
+  }
+  in := &Instrument{Address: addr, Handler: h, proc: p, trampoline: tramp,
+                    length: length}
+
+  code := counterCode(tramp, in.counter())
+  if h != nil {
+    in.trap = tramp + uint64(len(code))
+    code = append(code, INT3)
+  }
+  for _, inst := range insts {
+    moved, err := relocate(inst, tramp + uint64(len(code)), addr, length)
+    if err != nil {
+      return nil, err
+    }
+    code = append(code, moved...)
+  }
+  code = append(code, jumpTo(tramp + uint64(len(code)), addr + uint64(length))...)
+  if len(code) > trampolineSize - 8 {
+    return nil, errCantRelocate
+  }
+  code = append(code, make([]byte, trampolineSize - len(code))...)
+  if _, err := p.WriteMemory(tramp, code); err != nil {
+    return nil, err
+  }
+
+  in.saved = jumpTo(addr, tramp)
+  if err := p.SwapBytesText(addr, in.saved); err != nil {
+    return nil, err
+  }
+  p.Instruments = append(p.Instruments, in)
+  return in, nil
+}
+
+// checkMovable makes sure the length bytes at addr can be moved: no
+// breakpoint is in the way and no thread is stopped in their midst.
+func (p *Process) checkMovable(addr uint64, length int) error {
+  end := addr + uint64(length)
+  for _, bp := range p.Breakpoints {
+    if bp.Active && bp.Address >= addr && bp.Address < end {
+      return errBreakpointExists
+    }
+  }
+  for _, t := range p.Threads {
+    regs, err := p.backend().getRegisters(t.Tid)
+    if err == nil && regs.PC() > addr && regs.PC() < end {
+      return errInstrumentBusy
+    }
+  }
+  return nil
+}
+
+// RemoveInstrument puts the function back as it was. A thread that is in the
+// trampoline meanwhile finishes going through it, and the trampoline stays
+// mapped for it, but won't trap any more.
+func (p *Process) RemoveInstrument(in *Instrument) error {
+  for i, other := range p.Instruments {
+    if other != in {
+      continue
+    }
+    stopped := p.stopAll()
+    defer p.resumeStopped(stopped)
+    if err := p.unhook(in); err != nil {
+      return err
+    }
+    p.Instruments = append(p.Instruments[:i], p.Instruments[i+1:]...)
+    return nil
+  }
+  return errNoInstrument
+}
+
+// unhook writes back what the jump to in's trampoline replaced, and turns its
+// trap into a nop.
+func (p *Process) unhook(in *Instrument) error {
+  if err := p.SwapBytesText(in.Address, in.saved); err != nil {
+    return err
+  }
+  if in.trap != 0 {
+    if _, err := p.WriteMemory(in.trap, []byte{0x90}); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// instrumentAt returns the instrument for addr.
+func (p *Process) instrumentAt(addr uint64) *Instrument {
+  for _, in := range p.Instruments {
+    if in.Address == addr {
+      return in
+    }
+  }
+  return nil
+}
+
+// instrumentedWithin returns the instrument whose moved instructions addr
+// falls in the middle of.
+func (p *Process) instrumentedWithin(addr uint64) *Instrument {
+  for _, in := range p.Instruments {
+    if addr > in.Address && addr < in.Address + uint64(in.length) {
+      return in
+    }
+  }
+  return nil
+}
+
+// hideInstruments puts the original instructions back into buf, which holds
+// target memory read from addr, wherever a jump to a trampoline replaced
+// them.
+func (p *Process) hideInstruments(addr uint64, buf []byte) {
+  end := addr + uint64(len(buf))
+  for _, in := range p.Instruments {
+    lo, hi := in.Address, in.Address + uint64(len(in.saved))
+    if lo < addr {
+      lo = addr
+    }
+    if hi > end {
+      hi = end
+    }
+    if lo < hi {
+      copy(buf[lo-addr:hi-addr], in.saved[lo-in.Address:])
+    }
+  }
+}
+
+// InInstrument reports whether the current thread has stopped on the trap of
+// an instrument's trampoline.
+func (p *Process) InInstrument() (*Instrument, bool) {
+  regs, err := p.GetRegisters()
+  if err != nil {
+    return nil, false
+  }
+  in := p.instrumentTrap(regs.PC() - 1)
+  return in, in != nil
+}
+
+// instrumentTrap returns the instrument whose trap is at addr.
+func (p *Process) instrumentTrap(addr uint64) *Instrument {
+  for _, in := range p.Instruments {
+    if in.trap != 0 && in.trap == addr {
+      return in
+    }
+  }
+  return nil
+}
+
+// handleInstrument runs the handler of in for the current thread, which has
+// trapped in its trampoline, and returns what it asked for. If the handler
+// moved the PC away from the instrumented address, the thread goes there
+// instead of on through the trampoline.
+func (p *Process) handleInstrument(in *Instrument) Action {
+  regs, err := p.GetRegisters()
+  if err != nil {
+    return CONTINUE
+  }
+  next := regs.PC()
+  regs.SetPC(in.Address)
+  before := *regs
+  result := in.Handler(&BreakpointContext{Process: p, Thread: p.current, Instrument: in,
+                                          Regs: regs, Time: time.Now()})
+  if *regs != before {
+    if regs.PC() == in.Address {
+      regs.SetPC(next)
+    }
+    p.SetRegisters(regs)
+  }
+  if result == REMOVE {
+    p.RemoveInstrument(in)
+  }
+  return result
+}
+
+// relocate returns the bytes of inst, moved to to. Relative branches and
+// RIP-relative operands are adjusted, with short jumps made near ones. The
+// instruction is one of those moved from the length bytes at from, which
+// nothing may branch back into.
+func relocate(inst *Instruction, to, from uint64, length int) ([]byte, error) {
+  code := append([]byte{}, inst.Bytes...)
+  if inst.relOffset == 0 && inst.ripOffset == 0 {
+    return code, nil
+  }
+  if inst.relOffset != 0 && inst.Target > from && inst.Target < from + uint64(length) {
+    return nil, errCantRelocate
+  }
+
+  if inst.relSize == 1 {
+    if inst.relOffset != 1 {
+      return nil, errCantRelocate
+    }
+    switch op := code[0]; {
+    case op == 0xeb:
+      code = []byte{0xe9, 0, 0, 0, 0}
+    case op >= 0x70 && op <= 0x7f:
+      code = []byte{0x0f, 0x80 + op - 0x70, 0, 0, 0, 0}
+    default:
+      // loop and jrcxz only come short
+      return nil, errCantRelocate
+    }
+  }
+
+  at := inst.ripOffset
+  if inst.relOffset != 0 {
+    at = len(code) - 4
+    if inst.relSize == 4 {
+      at = inst.relOffset
+    }
+  }
+  disp := int64(inst.Target) - int64(to + uint64(len(code)))
+  if disp != int64(int32(disp)) {
+    return nil, errCantRelocate
+  }
+  code[at] = byte(disp)
+  code[at+1] = byte(disp >> 8)
+  code[at+2] = byte(disp >> 16)
+  code[at+3] = byte(disp >> 24)
+  return code, nil
+}
+
+// counterCode returns the start of a trampoline at tramp, which adds one to
+// the counter without touching the flags or the red zone.
+func counterCode(tramp, counter uint64) []byte {
+  code := []byte{
+    0x48, 0x8d, 0xa4, 0x24, 0x80, 0xff, 0xff, 0xff, // lea rsp, [rsp-0x80]
+    0x9c,                                           // pushfq
+    0xf0, 0x48, 0xff, 0x05, 0, 0, 0, 0,             // lock inc qword [rip+counter]
+    0x9d,                                           // popfq
+    0x48, 0x8d, 0xa4, 0x24, 0x80, 0x00, 0x00, 0x00, // lea rsp, [rsp+0x80]
+  }
+  disp := uint32(counter - (tramp + 17))
+  code[13], code[14], code[15], code[16] = byte(disp), byte(disp >> 8), byte(disp >> 16),
+                                           byte(disp >> 24)
+  return code
+}
+
+// jumpTo returns a jmp rel32 at from to to.
+func jumpTo(from, to uint64) []byte {
+  disp := uint32(to - (from + jumpSize))
+  return []byte{0xe9, byte(disp), byte(disp >> 8), byte(disp >> 16), byte(disp >> 24)}
+}
+
+// allocCode finds size bytes of executable memory in the target within reach
+// of a rel32 jump from near, mapping more if there's none left.
+func (p *Process) allocCode(near, size uint64) (uint64, error) {
+  for _, page := range p.codePages {
+    if page.used + size <= codePageSize && reachable(near, page.addr + page.used) {
+      addr := page.addr + page.used
+      page.used += size
+      return addr, nil
+    }
+  }
+
+  addr, err := p.mapNear(near, codePageSize)
+  if err != nil {
+    return 0, err
+  }
+  p.codePages = append(p.codePages, &codePage{addr: addr, used: size})
+  return addr, nil
+}
+
+// reachable reports whether a rel32 jump can go from a to a trampoline at b,
+// and back.
+func reachable(a, b uint64) bool {
+  return distance(a, b) < 1 << 31 - codePageSize
+}
+
+// mapNear maps size bytes of memory that can be written and run in the
+// target, in the free gap of the address space closest to near.
+func (p *Process) mapNear(near, size uint64) (uint64, error) {
+  p.Memory.Refresh()
+  best, found := uint64(0), false
+  consider := func(addr uint64) {
+    if reachable(near, addr) && reachable(near, addr + size) &&
+       (! found || distance(near, addr) < distance(near, best)) {
+      best, found = addr, true
+    }
+  }
+  // Below 64k is off limits to mmap
+  prev := uint64(0x10000)
+  for _, r := range p.Memory.Regions {
+    if r.Address >= prev + size {
+      consider(prev)
+      consider(r.Address - size)
+    }
+    if r.Address + r.Size > prev {
+      prev = r.Address + r.Size
+    }
+  }
+  if ! found {
+    return 0, errNoNearbyMemory
+  }
+
+  const mapFixedNoReplace = 0x100000
+  addr, err := p.mmap(best, size, syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC,
+                      syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS | mapFixedNoReplace)
+  if err != nil {
+    return 0, err
+  }
+  if addr != best {
+    // Only a hint to kernels before 4.17
+    p.Munmap(addr, size)
+    return 0, errNoNearbyMemory
+  }
+  return addr, nil
+}
+
+func distance(a, b uint64) uint64 {
+  if a > b {
+    return a - b
+  }
+  return b - a
+}
@@ -0,0 +1,120 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import "testing"
+
+func TestRelocate(t *testing.T) {
+  const from, to = 0x1000, 0x40000000
+  tests := []struct {
+    name      string
+    code      string
+    length    int
+    to        uint64
+    mnemonic  string
+    size      int
+    err       bool
+  }{
+    {"no displacement", "55", 5, to, "push", 1, false},
+    {"short jump", "eb 10", 5, to, "jmp", 5, false},
+    {"short conditional", "74 10", 5, to, "je", 6, false},
+    {"near jump", "e9 00 01 00 00", 5, to, "jmp", 5, false},
+    {"call", "e8 00 01 00 00", 5, to, "call", 5, false},
+    {"near conditional", "0f 85 00 01 00 00", 6, to, "jne", 6, false},
+    {"RIP-relative load", "48 8b 05 10 00 00 00", 7, to, "mov", 7, false},
+    {"RIP-relative with immediate", "c7 05 10 00 00 00 01 00 00 00", 10, to, "mov", 10, false},
+    {"backwards", "e9 00 f0 ff ff", 5, to, "jmp", 5, false},
+    {"to the start", "eb fe", 5, to, "jmp", 5, false},
+    {"into the moved bytes", "eb 01", 5, to, "", 0, true},
+    {"loop", "e2 10", 5, to, "", 0, true},
+    {"jrcxz", "e3 10", 5, to, "", 0, true},
+    {"out of reach", "e9 00 01 00 00", 5, 0x200000000, "", 0, true},
+    {"RIP-relative out of reach", "48 8b 05 10 00 00 00", 7, 0x200000000, "", 0, true},
+  }
+
+  for _, test := range tests {
+    inst, err := decodeHex(t, test.code, from)
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    code, err := relocate(inst, test.to, from, test.length)
+    if (err != nil) != test.err {
+      t.Errorf("%s: error %v", test.name, err)
+      continue
+    }
+    if test.err {
+      continue
+    }
+
+    moved, err := Decode(code, test.to)
+    if err != nil || moved.Len() != len(code) {
+      t.Errorf("%s: relocated to % x, which decodes as %v, %v", test.name, code, moved, err)
+      continue
+    }
+    if moved.Mnemonic != test.mnemonic || moved.Len() != test.size {
+      t.Errorf("%s: relocated to %v, %d bytes", test.name, moved, moved.Len())
+    }
+    if moved.HasTarget != inst.HasTarget || moved.Target != inst.Target {
+      t.Errorf("%s: target 0x%x, want 0x%x", test.name, moved.Target, inst.Target)
+    }
+  }
+}
+
+func TestJumpTo(t *testing.T) {
+  for _, test := range [][2]uint64{{0x1000, 0x2000}, {0x40000000, 0x1000}, {0x1000, 0x1005}} {
+    code := jumpTo(test[0], test[1])
+    inst, err := Decode(code, test[0])
+    if err != nil || inst.Mnemonic != "jmp" || inst.Len() != jumpSize || inst.Target != test[1] {
+      t.Errorf("jump from 0x%x to 0x%x: % x decodes as %v, %v", test[0], test[1], code, inst, err)
+    }
+  }
+}
+
+func TestCounterCode(t *testing.T) {
+  for _, tramp := range []uint64{0x1000, 0x7f0000010000} {
+    counter := tramp + trampolineSize - 8
+    code := counterCode(tramp, counter)
+    incremented := false
+    for off := 0; off < len(code); {
+      inst, err := Decode(code[off:], tramp + uint64(off))
+      if err != nil {
+        t.Fatalf("0x%x: % x at %d: %v", tramp, code[off:], off, err)
+      }
+      if inst.Mnemonic == "inc" {
+        incremented = inst.Prefix == "lock" && inst.HasTarget && inst.Target == counter &&
+                      inst.MemWrite
+      }
+      off += inst.Len()
+    }
+    if ! incremented {
+      t.Errorf("0x%x: no lock inc of the counter at 0x%x", tramp, counter)
+    }
+  }
+}
@@ -0,0 +1,213 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "debug/dwarf"
+  "sort"
+)
+
+// lineRow is one row of a DWARF line number program, at its link-time
+// address. A row covers the addresses up to the next one.
+type lineRow struct {
+  Address      uint64
+  File         string
+  Line         int
+  // Stmt marks the recommended place to stop for a line
+  Stmt         bool
+  PrologueEnd  bool
+  // End marks the first address past a sequence of rows
+  End          bool
+}
+
+// lineTable maps addresses to source lines for a module, sorted by address.
+type lineTable struct {
+  rows  []lineRow
+}
+
+// lineTable returns the module's line number information, reading it on
+// first use. It's empty if the module has no DWARF.
+func (m *Module) lineTable() *lineTable {
+  if m.lines != nil {
+    return m.lines
+  }
+  m.lines = &lineTable{}
+
+  f, err := m.open()
+  if err != nil {
+    return m.lines
+  }
+  defer f.Close()
+
+  d, err := f.DWARF()
+  if err != nil {
+    return m.lines
+  }
+
+  rows := []lineRow{}
+  reader := d.Reader()
+  for {
+    entry, err := reader.Next()
+    if entry == nil || err != nil {
+      break
+    }
+    if entry.Tag != dwarf.TagCompileUnit {
+      reader.SkipChildren()
+      continue
+    }
+    lr, err := d.LineReader(entry)
+    reader.SkipChildren()
+    if lr == nil || err != nil {
+      continue
+    }
+
+    // Sequences at address zero belong to code the linker threw away
+    var le dwarf.LineEntry
+    discard, start := false, true
+    for lr.Next(&le) == nil {
+      if start {
+        discard = le.Address == 0
+      }
+      start = le.EndSequence
+      if discard {
+        continue
+      }
+      row := lineRow{Address: le.Address, Line: le.Line, Stmt: le.IsStmt,
+                     PrologueEnd: le.PrologueEnd, End: le.EndSequence}
+      if le.File != nil {
+        row.File = le.File.Name
+      }
+      rows = append(rows, row)
+    }
+  }
+
+  // Where one sequence ends at the address another starts, the end goes
+  // first so that lookups find the start.
+  sort.SliceStable(rows, func(i, j int) bool {
+    if rows[i].Address != rows[j].Address {
+      return rows[i].Address < rows[j].Address
+    }
+    return rows[i].End && ! rows[j].End
+  })
+  m.lines.rows = rows
+  return m.lines
+}
+
+// find returns the index of the row covering the link-time address addr.
+func (t *lineTable) find(addr uint64) (int, bool) {
+  i := sort.Search(len(t.rows), func(i int) bool {
+    return t.rows[i].Address > addr
+  }) - 1
+  if i < 0 || t.rows[i].End {
+    return 0, false
+  }
+  return i, true
+}
+
+// end returns the first address past row i.
+func (t *lineTable) end(i int) uint64 {
+  for j := i + 1; j < len(t.rows); j++ {
+    if t.rows[j].Address > t.rows[i].Address {
+      return t.rows[j].Address
+    }
+  }
+  return t.rows[i].Address + 1
+}
+
+// sourceLine is a row of a module's line table at its load address, along
+// with the range of addresses it covers.
+type sourceLine struct {
+  lineRow
+  End  uint64
+}
+
+// lineAt returns the line table row covering addr.
+func (p *Process) lineAt(addr uint64) (line sourceLine, ok bool) {
+  m := p.ModuleAt(addr)
+  if m == nil {
+    return line, false
+  }
+  t := m.lineTable()
+  i, ok := t.find(addr - m.Bias)
+  if ! ok {
+    return line, false
+  }
+  line.lineRow = t.rows[i]
+  line.Address += m.Bias
+  line.End = t.end(i) + m.Bias
+  return line, true
+}
+
+// LineAt returns the source file and line the code at addr was compiled
+// from, if its module has DWARF line information.
+func (p *Process) LineAt(addr uint64) (file string, line int, ok bool) {
+  row, ok := p.lineAt(addr)
+  if ! ok || row.Line == 0 {
+    return "", 0, false
+  }
+  return row.File, row.Line, true
+}
+
+// prologueEnd returns where the function starting at entry is done setting
+// up its frame: the row marked as the end of the prologue, or else the
+// first row for a later address. It's entry itself when there's no telling.
+func (p *Process) prologueEnd(entry uint64) uint64 {
+  m := p.ModuleAt(entry)
+  if m == nil {
+    return entry
+  }
+  t := m.lineTable()
+  i, ok := t.find(entry - m.Bias)
+  if ! ok || t.rows[i].Address != entry - m.Bias {
+    return entry
+  }
+
+  limit := ^uint64(0)
+  if sym, _, ok := m.SymbolAt(entry); ok && sym.Size > 0 {
+    limit = sym.Address + sym.Size - m.Bias
+  }
+  next := uint64(0)
+  for j := i + 1; j < len(t.rows) && t.rows[j].Address < limit; j++ {
+    row := t.rows[j]
+    if row.End {
+      break
+    }
+    if row.PrologueEnd {
+      return row.Address + m.Bias
+    }
+    if next == 0 && row.Address > t.rows[i].Address && row.Line != 0 {
+      next = row.Address
+    }
+  }
+  if next == 0 {
+    return entry
+  }
+  return next + m.Bias
+}
@@ -0,0 +1,268 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "os"
+  "fmt"
+  "syscall"
+  "unsafe"
+)
+
+// Syscall numbers for process_vm_readv(2) and process_vm_writev(2) on x86-64,
+// which the syscall package predates.
+const (
+  sysProcessVMReadv  = 310
+  sysProcessVMWritev = 311
+)
+
+// bulkThreshold is the transfer size below which memory is accessed a word at
+// a time with ptrace; anything smaller isn't worth the extra setup.
+const bulkThreshold = 64
+
+// memoryBackend moves bytes between the tracer and the target's address
+// space. A backend may stop short of the full length, e.g. at a page it can't
+// access; whatever is left over is handed to the next backend in line.
+type memoryBackend interface {
+  readAt(addr uint64, buf []byte) (int, error)
+  writeAt(addr uint64, buf []byte) (int, error)
+}
+
+// ptraceBackend goes through PTRACE_PEEKTEXT/POKETEXT. It is slow, but it
+// works on any page the target has mapped, writable or not, and reports
+// exactly which address failed.
+type ptraceBackend struct {
+  proc *Process
+}
+
+func (b *ptraceBackend) readAt(addr uint64, buf []byte) (count int, err error) {
+  word := make([]byte, wordSize)
+  aligned := addr &^ uint64(wordSize-1)
+  skip := int(addr - aligned)
+
+  for count < len(buf) {
+    if err := peekWord(b.proc.stoppedTid(), aligned, word); err != nil {
+      return count, err
+    }
+    count += copy(buf[count:], word[skip:])
+    aligned += uint64(wordSize)
+    skip = 0
+  }
+
+  return count, nil
+}
+
+func (b *ptraceBackend) writeAt(addr uint64, buf []byte) (count int, err error) {
+  word := make([]byte, wordSize)
+  aligned := addr &^ uint64(wordSize-1)
+  skip := int(addr - aligned)
+
+  for count < len(buf) {
+    // Merge with the existing contents unless the word is entirely replaced
+    if skip != 0 || len(buf)-count < wordSize {
+      if err := peekWord(b.proc.stoppedTid(), aligned, word); err != nil {
+        return count, err
+      }
+    }
+    n := copy(word[skip:], buf[count:])
+    if err := pokeWord(b.proc.stoppedTid(), aligned, word); err != nil {
+      return count, err
+    }
+    count += n
+    aligned += uint64(wordSize)
+    skip = 0
+  }
+
+  return count, nil
+}
+
+// peekWord reads the wordsize-aligned word containing addr into word.
+func peekWord(pid int, addr uint64, word []byte) error {
+  cnt, err := syscall.PtracePeekText(pid, uintptr(addr), word)
+  if err == nil && cnt != wordSize {
+    err = syscall.EIO
+  }
+  return err
+}
+
+// pokeWord writes a full word to the wordsize-aligned address addr.
+func pokeWord(pid int, addr uint64, word []byte) error {
+  cnt, err := syscall.PtracePokeText(pid, uintptr(addr), word)
+  if err == nil && cnt != wordSize {
+    err = syscall.EIO
+  }
+  return err
+}
+
+// remoteIovec is an iovec describing memory in the target, whose addresses
+// can't be expressed as Go pointers.
+type remoteIovec struct {
+  base   uint64
+  length uint64
+}
+
+// vmBackend uses process_vm_readv/writev, which copy straight between the two
+// address spaces in one syscall. Writes honor page protections, so read-only
+// text has to go through one of the other backends.
+type vmBackend struct {
+  pid       int
+  disabled  bool
+}
+
+func (b *vmBackend) transfer(trap uintptr, addr uint64, buf []byte) (int, error) {
+  if b.disabled || len(buf) == 0 {
+    return 0, syscall.ENOSYS
+  }
+
+  local := syscall.Iovec{Base: &buf[0], Len: uint64(len(buf))}
+  remote := remoteIovec{addr, uint64(len(buf))}
+  n, _, errno := syscall.Syscall6(trap, uintptr(b.pid),
+                                  uintptr(unsafe.Pointer(&local)), 1,
+                                  uintptr(unsafe.Pointer(&remote)), 1, 0)
+  if errno != 0 {
+    // Don't bother again if the kernel or a seccomp policy won't allow it
+    if errno == syscall.ENOSYS || errno == syscall.EPERM {
+      b.disabled = true
+    }
+    return 0, errno
+  }
+  return int(n), nil
+}
+
+func (b *vmBackend) readAt(addr uint64, buf []byte) (int, error) {
+  return b.transfer(sysProcessVMReadv, addr, buf)
+}
+
+func (b *vmBackend) writeAt(addr uint64, buf []byte) (int, error) {
+  return b.transfer(sysProcessVMWritev, addr, buf)
+}
+
+// procMemBackend reads and writes /proc/pid/mem. Like ptrace, the kernel
+// forces writes through to read-only private mappings.
+type procMemBackend struct {
+  pid       int
+  file     *os.File
+  disabled  bool
+}
+
+func (b *procMemBackend) open() error {
+  if b.disabled {
+    return syscall.ENOSYS
+  }
+  if b.file == nil {
+    f, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", b.pid), os.O_RDWR, 0)
+    if err != nil {
+      b.disabled = true
+      return err
+    }
+    b.file = f
+  }
+  return nil
+}
+
+func (b *procMemBackend) readAt(addr uint64, buf []byte) (int, error) {
+  if err := b.open(); err != nil {
+    return 0, err
+  }
+  return b.file.ReadAt(buf, int64(addr))
+}
+
+func (b *procMemBackend) writeAt(addr uint64, buf []byte) (int, error) {
+  if err := b.open(); err != nil {
+    return 0, err
+  }
+  return b.file.WriteAt(buf, int64(addr))
+}
+
+func (b *procMemBackend) close() {
+  if b.file != nil {
+    b.file.Close()
+    b.file = nil
+  }
+}
+
+// memoryAccess holds the backends for one process, fastest first. The ptrace
+// backend always comes last so failures are reported at the exact address.
+type memoryAccess struct {
+  vm       *vmBackend
+  procMem  *procMemBackend
+  ptrace   *ptraceBackend
+}
+
+func newMemoryAccess(p *Process) *memoryAccess {
+  return &memoryAccess{
+    vm:      &vmBackend{pid: p.Pid},
+    procMem: &procMemBackend{pid: p.Pid},
+    ptrace:  &ptraceBackend{proc: p},
+  }
+}
+
+func (m *memoryAccess) chain(size int) []memoryBackend {
+  if size < bulkThreshold {
+    return []memoryBackend{m.ptrace}
+  }
+  return []memoryBackend{m.vm, m.procMem, m.ptrace}
+}
+
+func (m *memoryAccess) read(addr uint64, buf []byte) (count int, err error) {
+  for _, b := range m.chain(len(buf)) {
+    var n int
+    n, err = b.readAt(addr+uint64(count), buf[count:])
+    count += n
+    if count == len(buf) {
+      return count, nil
+    }
+  }
+  return count, err
+}
+
+func (m *memoryAccess) write(addr uint64, buf []byte) (count int, err error) {
+  for _, b := range m.chain(len(buf)) {
+    var n int
+    n, err = b.writeAt(addr+uint64(count), buf[count:])
+    count += n
+    if count == len(buf) {
+      return count, nil
+    }
+  }
+  return count, err
+}
+
+func (m *memoryAccess) close() {
+  m.procMem.close()
+}
+
+// memory returns the process' memory accessors, setting them up on first use.
+func (p *Process) memory() *memoryAccess {
+  if p.memAccess == nil {
+    p.memAccess = newMemoryAccess(p)
+  }
+  return p.memAccess
+}
@@ -35,68 +35,289 @@ import (
   "os"
   "fmt"
   "bufio"
-  "io"
+  "sort"
 )
 
+// Permissions are the access rights of a memory region
+type Permissions uint8
 const (
-  Anonymous = iota
-  File
+  PermRead Permissions = 1 << iota
+  PermWrite
+  PermExec
+  // PermShared is set for MAP_SHARED regions, clear for private ones
+  PermShared
 )
 
+// String formats the permissions the way /proc/pid/maps does, e.g. "r-xp".
+func (p Permissions) String() string {
+  b := []byte("---p")
+  if p&PermRead != 0 {
+    b[0] = 'r'
+  }
+  if p&PermWrite != 0 {
+    b[1] = 'w'
+  }
+  if p&PermExec != 0 {
+    b[2] = 'x'
+  }
+  if p&PermShared != 0 {
+    b[3] = 's'
+  }
+  return string(b)
+}
 
-func (m MemoryMap) findAddress(addr uint64) *MemoryRegion {
-  for a, m := range m {
-    if addr > a && addr < a + uint64(m.Size) {
-      return &m
+func parsePermissions(s string) (perms Permissions) {
+  for _, c := range s {
+    switch c {
+    case 'r': perms |= PermRead
+    case 'w': perms |= PermWrite
+    case 'x': perms |= PermExec
+    case 's': perms |= PermShared
     }
   }
+  return
+}
+
+// RegionKind classifies what backs a memory region
+type RegionKind int
+const (
+  Anonymous RegionKind = iota
+  File
+  Heap
+  Stack
+  Vdso
+  Vvar
+  Vsyscall
+  // Special is any other kernel-named pseudo region, e.g. [uprobes]
+  Special
+)
+
+func (k RegionKind) String() string {
+  switch k {
+  case Anonymous: return "anon"
+  case File: return "file"
+  case Heap: return "heap"
+  case Stack: return "stack"
+  case Vdso: return "vdso"
+  case Vvar: return "vvar"
+  case Vsyscall: return "vsyscall"
+  case Special: return "special"
+  }
+  return "unknown"
+}
+
+func regionKind(pathname string) RegionKind {
+  switch {
+  case pathname == "" || strings.HasPrefix(pathname, "[anon:"):
+    return Anonymous
+  case pathname == "[heap]":
+    return Heap
+  case pathname == "[stack]" || strings.HasPrefix(pathname, "[stack:"):
+    return Stack
+  case pathname == "[vdso]":
+    return Vdso
+  case strings.HasPrefix(pathname, "[vvar"):
+    return Vvar
+  case pathname == "[vsyscall]":
+    return Vsyscall
+  case strings.HasPrefix(pathname, "["):
+    return Special
+  }
+  return File
+}
+
+// End returns the address just past the region.
+func (r MemoryRegion) End() uint64 {
+  return r.Address + r.Size
+}
+
+// Contains reports whether addr falls inside the region.
+func (r MemoryRegion) Contains(addr uint64) bool {
+  return addr >= r.Address && addr < r.End()
+}
+
+func (r MemoryRegion) String() string {
+  return fmt.Sprintf("%016x-%016x %s %08x %02x:%02x %d %s", r.Address, r.End(),
+                     r.Perms, r.Offset, r.Major, r.Minor, r.Inode, r.Pathname)
+}
+
+// Find returns the region containing addr, or nil if it isn't mapped.
+func (m *MemoryMap) Find(addr uint64) *MemoryRegion {
+  i := sort.Search(len(m.Regions), func(i int) bool {
+    return m.Regions[i].End() > addr
+  })
+  if i < len(m.Regions) && m.Regions[i].Contains(addr) {
+    return &m.Regions[i]
+  }
   return nil
 }
 
-func parseMemoryRegion(mapping string) (uint64, MemoryRegion) {
+// FindFile returns the regions mapped from the file at pathname, in address
+// order.
+func (m *MemoryMap) FindFile(pathname string) []MemoryRegion {
+  regions := []MemoryRegion{}
+  for _, r := range m.Regions {
+    if r.Kind == File && r.Pathname == pathname {
+      regions = append(regions, r)
+    }
+  }
+  return regions
+}
+
+// MapDiff is the difference between two snapshots of a MemoryMap. Regions
+// that start at the same address but differ in size, permissions or backing
+// are reported as Changed.
+type MapDiff struct {
+  Added    []MemoryRegion
+  Removed  []MemoryRegion
+  Changed  []RegionChange
+}
+
+type RegionChange struct {
+  Old, New MemoryRegion
+}
+
+// Empty reports whether the two snapshots were identical.
+func (d *MapDiff) Empty() bool {
+  return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Refresh re-reads the map of the live process and returns how it differs
+// from the previous snapshot.
+func (m *MemoryMap) Refresh() (*MapDiff, error) {
+  if m.pid == 0 {
+    return nil, errNotLive
+  }
+  fresh, err := getMemoryMap(m.pid)
+  if err != nil {
+    return nil, err
+  }
+
+  diff := diffMemoryMaps(m.Regions, fresh.Regions)
+  m.Regions = fresh.Regions
+  if diff.files() {
+    m.files++
+  }
+  return diff, nil
+}
+
+// files reports whether any of the regions that changed are file mappings.
+func (d *MapDiff) files() bool {
+  mapped := func(r MemoryRegion) bool {
+    return r.Kind == File || r.Kind == Vdso
+  }
+  for _, r := range append(d.Added, d.Removed...) {
+    if mapped(r) {
+      return true
+    }
+  }
+  for _, c := range d.Changed {
+    if mapped(c.Old) || mapped(c.New) {
+      return true
+    }
+  }
+  return false
+}
+
+func diffMemoryMaps(old, fresh []MemoryRegion) *MapDiff {
+  diff := new(MapDiff)
+  i, j := 0, 0
+  for i < len(old) || j < len(fresh) {
+    switch {
+    case j == len(fresh) || (i < len(old) && old[i].Address < fresh[j].Address):
+      diff.Removed = append(diff.Removed, old[i])
+      i++
+    case i == len(old) || fresh[j].Address < old[i].Address:
+      diff.Added = append(diff.Added, fresh[j])
+      j++
+    default:
+      if old[i] != fresh[j] {
+        diff.Changed = append(diff.Changed, RegionChange{old[i], fresh[j]})
+      }
+      i++
+      j++
+    }
+  }
+  return diff
+}
+
+func parseMemoryRegion(mapping string) (region MemoryRegion, err error) {
+  // The pathname is the only field that may contain spaces, so split off
+  // the first five and keep whatever remains intact.
   fields := strings.Fields(mapping)
+  if len(fields) < 5 {
+    return region, fmt.Errorf("malformed maps line %q", mapping)
+  }
+  rest := mapping
+  for i := 0; i < 5; i++ {
+    rest = strings.TrimLeft(rest, " \t")
+    rest = rest[len(fields[i]):]
+  }
+  region.Pathname = strings.TrimLeft(rest, " \t")
 
   // Location
   addrs_str := strings.Split(fields[0], "-")
-  addr_start_ui, _ := strconv.ParseUint(addrs_str[0], 16, 64)
-  addr_end_ui, _   := strconv.ParseUint(addrs_str[1], 16, 64)
-  addr_start, addr_end := uint64(addr_start_ui), uint64(addr_end_ui)
-  
-  // Permissions
-  perms := fields[1]
+  if len(addrs_str) != 2 {
+    return region, fmt.Errorf("malformed address range %q", fields[0])
+  }
+  addr_start, err := strconv.ParseUint(addrs_str[0], 16, 64)
+  if err != nil {
+    return
+  }
+  addr_end, err := strconv.ParseUint(addrs_str[1], 16, 64)
+  if err != nil {
+    return
+  }
+  region.Address = addr_start
+  region.Size = addr_end - addr_start
+
+  region.Perms = parsePermissions(fields[1])
 
   // Offset into file
-  offset_ui, _ := strconv.ParseUint(fields[2], 16, 64)
-  offset := uint64(offset_ui)
+  if region.Offset, err = strconv.ParseUint(fields[2], 16, 64); err != nil {
+    return
+  }
 
-  // ignore dev/inode
-  file := ""
-  if len(fields) > 5 {
-    file = fields[5]
+  // Device, as major:minor in hex
+  dev := strings.Split(fields[3], ":")
+  if len(dev) == 2 {
+    major, _ := strconv.ParseUint(dev[0], 16, 32)
+    minor, _ := strconv.ParseUint(dev[1], 16, 32)
+    region.Major, region.Minor = uint32(major), uint32(minor)
   }
 
-  return addr_start, MemoryRegion { addr_start, offset, file,
-                        int(addr_end-addr_start), perms, }
+  if region.Inode, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+    return
+  }
 
+  region.Kind = regionKind(region.Pathname)
+  return region, nil
 }
 
-func getMemoryMap(pid int) (MemoryMap, error) {
+func getMemoryMap(pid int) (*MemoryMap, error) {
   maps, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
   if err != nil {
     return nil, err
   } 
   defer maps.Close()
 
-  memoryMap := make(MemoryMap)
-  mapreader := bufio.NewReader(maps)
-  for {
-    line, err := mapreader.ReadString('\n') 
-    if err == io.EOF {
-      break
+  memoryMap := &MemoryMap{pid: pid}
+  scanner := bufio.NewScanner(maps)
+  for scanner.Scan() {
+    entry, err := parseMemoryRegion(scanner.Text())
+    if err != nil {
+      return nil, err
     }
-    addr, entry := parseMemoryRegion(line[:len(line)-1])
-    memoryMap[addr] = entry
+    memoryMap.Regions = append(memoryMap.Regions, entry)
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
   }
 
-  return memoryMap, err
+  // The kernel already lists regions in order, but don't depend on it
+  sort.Slice(memoryMap.Regions, func(i, j int) bool {
+    return memoryMap.Regions[i].Address < memoryMap.Regions[j].Address
+  })
+
+  return memoryMap, nil
 }
@@ -0,0 +1,199 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "os"
+  "reflect"
+  "testing"
+)
+
+func TestParseMemoryRegion(t *testing.T) {
+  tests := []struct {
+    line    string
+    region  MemoryRegion
+  }{
+    {"55d0c0a00000-55d0c0a02000 r--p 00000000 08:01 1311 /usr/bin/cat",
+     MemoryRegion{Address: 0x55d0c0a00000, Size: 0x2000, Perms: PermRead, Major: 8,
+                  Minor: 1, Inode: 1311, Pathname: "/usr/bin/cat", Kind: File}},
+    {"7f0000000000-7f0000001000 r-xp 0001a000 fd:1f 42    /opt/my app/lib (deleted)",
+     MemoryRegion{Address: 0x7f0000000000, Size: 0x1000, Perms: PermRead | PermExec,
+                  Offset: 0x1a000, Major: 0xfd, Minor: 0x1f, Inode: 42,
+                  Pathname: "/opt/my app/lib (deleted)", Kind: File}},
+    {"7ffc00000000-7ffc00021000 rw-p 00000000 00:00 0                          [stack]",
+     MemoryRegion{Address: 0x7ffc00000000, Size: 0x21000, Perms: PermRead | PermWrite,
+                  Pathname: "[stack]", Kind: Stack}},
+    {"7f0000002000-7f0000003000 rw-s 00000000 00:05 7 /dev/zero",
+     MemoryRegion{Address: 0x7f0000002000, Size: 0x1000, Perms: PermRead | PermWrite | PermShared,
+                  Minor: 5, Inode: 7, Pathname: "/dev/zero", Kind: File}},
+    {"7f0000004000-7f0000005000 ---p 00000000 00:00 0",
+     MemoryRegion{Address: 0x7f0000004000, Size: 0x1000, Kind: Anonymous}},
+    {"7f0000006000-7f0000007000 rw-p 00000000 00:00 0 [anon:jit]",
+     MemoryRegion{Address: 0x7f0000006000, Size: 0x1000, Perms: PermRead | PermWrite,
+                  Pathname: "[anon:jit]", Kind: Anonymous}},
+    {"ffffffffff600000-ffffffffff601000 --xp 00000000 00:00 0 [vsyscall]",
+     MemoryRegion{Address: 0xffffffffff600000, Size: 0x1000, Perms: PermExec,
+                  Pathname: "[vsyscall]", Kind: Vsyscall}},
+  }
+  for _, test := range tests {
+    region, err := parseMemoryRegion(test.line)
+    if err != nil || region != test.region {
+      t.Errorf("parseMemoryRegion(%q) = %+v, %v, want %+v", test.line, region, err, test.region)
+    }
+  }
+
+  for _, line := range []string{
+    "",
+    "7f0000000000-7f0000001000 r-xp 00000000 08:01",
+    "7f0000000000 r-xp 00000000 08:01 1 /lib",
+    "7f000000zzzz-7f0000001000 r-xp 00000000 08:01 1 /lib",
+    "7f0000000000-7f0000001000 r-xp 0000000g 08:01 1 /lib",
+    "7f0000000000-7f0000001000 r-xp 00000000 08:01 x /lib",
+  } {
+    if _, err := parseMemoryRegion(line); err == nil {
+      t.Errorf("parseMemoryRegion(%q) succeeded", line)
+    }
+  }
+}
+
+func TestPermissionsString(t *testing.T) {
+  for _, s := range []string{"---p", "r--p", "rw-p", "r-xp", "rwxs", "--xs"} {
+    if got := parsePermissions(s).String(); got != s {
+      t.Errorf("%s comes back as %s", s, got)
+    }
+  }
+}
+
+func TestMemoryMapFind(t *testing.T) {
+  m := &MemoryMap{Regions: []MemoryRegion{
+    {Address: 0x1000, Size: 0x1000, Pathname: "/a", Kind: File},
+    {Address: 0x2000, Size: 0x2000, Pathname: "/b", Kind: File},
+    {Address: 0x8000, Size: 0x1000, Pathname: "/a", Kind: File},
+    {Address: 0x9000, Size: 0x1000, Kind: Anonymous},
+  }}
+  tests := []struct {
+    addr   uint64
+    start  uint64
+  }{
+    {0x0fff, 0},
+    {0x1000, 0x1000},
+    {0x1fff, 0x1000},
+    {0x2000, 0x2000},
+    {0x3fff, 0x2000},
+    {0x4000, 0},
+    {0x8800, 0x8000},
+    {0x9fff, 0x9000},
+    {0xa000, 0},
+  }
+  for _, test := range tests {
+    r := m.Find(test.addr)
+    switch {
+    case r == nil && test.start != 0:
+      t.Errorf("0x%x isn't found", test.addr)
+    case r != nil && r.Address != test.start:
+      t.Errorf("0x%x is found in the region at 0x%x, want 0x%x", test.addr, r.Address, test.start)
+    }
+  }
+  if r := (&MemoryMap{}).Find(0x1000); r != nil {
+    t.Errorf("found 0x1000 in an empty map")
+  }
+
+  files := m.FindFile("/a")
+  if len(files) != 2 || files[0].Address != 0x1000 || files[1].Address != 0x8000 {
+    t.Errorf("FindFile(/a) = %v", files)
+  }
+  if files := m.FindFile("/c"); len(files) != 0 {
+    t.Errorf("FindFile(/c) = %v", files)
+  }
+}
+
+func TestDiffMemoryMaps(t *testing.T) {
+  lib := MemoryRegion{Address: 0x1000, Size: 0x1000, Perms: PermRead, Pathname: "/lib", Kind: File}
+  heap := MemoryRegion{Address: 0x3000, Size: 0x1000, Perms: PermRead | PermWrite, Pathname: "[heap]", Kind: Heap}
+  bigger := heap
+  bigger.Size = 0x3000
+  anon := MemoryRegion{Address: 0x8000, Size: 0x1000, Kind: Anonymous}
+  writable := lib
+  writable.Perms |= PermWrite
+  other := MemoryRegion{Address: 0x9000, Size: 0x1000, Pathname: "/other", Kind: File}
+
+  tests := []struct {
+    old, fresh  []MemoryRegion
+    diff        MapDiff
+    files       bool
+  }{
+    {[]MemoryRegion{lib, heap}, []MemoryRegion{lib, heap}, MapDiff{}, false},
+    {[]MemoryRegion{lib, heap}, []MemoryRegion{lib, bigger},
+     MapDiff{Changed: []RegionChange{{heap, bigger}}}, false},
+    {[]MemoryRegion{lib, heap}, []MemoryRegion{lib, heap, anon},
+     MapDiff{Added: []MemoryRegion{anon}}, false},
+    {[]MemoryRegion{lib, heap, anon}, []MemoryRegion{heap},
+     MapDiff{Removed: []MemoryRegion{lib, anon}}, true},
+    {[]MemoryRegion{lib}, []MemoryRegion{writable},
+     MapDiff{Changed: []RegionChange{{lib, writable}}}, true},
+    {nil, []MemoryRegion{lib, other}, MapDiff{Added: []MemoryRegion{lib, other}}, true},
+    {[]MemoryRegion{heap, other}, []MemoryRegion{lib, anon},
+     MapDiff{Added: []MemoryRegion{lib, anon}, Removed: []MemoryRegion{heap, other}}, true},
+  }
+  for i, test := range tests {
+    diff := diffMemoryMaps(test.old, test.fresh)
+    if ! reflect.DeepEqual(*diff, test.diff) {
+      t.Errorf("%d: diff is %+v, want %+v", i, *diff, test.diff)
+    }
+    if diff.Empty() != reflect.DeepEqual(test.diff, MapDiff{}) {
+      t.Errorf("%d: Empty is %v", i, diff.Empty())
+    }
+    if diff.files() != test.files {
+      t.Errorf("%d: files is %v", i, diff.files())
+    }
+  }
+}
+
+func TestGetMemoryMap(t *testing.T) {
+  m, err := getMemoryMap(os.Getpid())
+  if err != nil {
+    t.Fatal(err)
+  }
+  for i := 1; i < len(m.Regions); i++ {
+    if m.Regions[i].Address < m.Regions[i-1].End() {
+      t.Fatalf("regions %v and %v are out of order", m.Regions[i-1], m.Regions[i])
+    }
+  }
+  exe, err := os.Executable()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(m.FindFile(exe)) == 0 {
+    t.Errorf("the test binary %s isn't mapped", exe)
+  }
+  if _, err := (&MemoryMap{}).Refresh(); err != errNotLive {
+    t.Errorf("Refresh of a map without a process = %v", err)
+  }
+}
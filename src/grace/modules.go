@@ -0,0 +1,339 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "debug/elf"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "syscall"
+)
+
+// Module is an ELF object mapped into the target: the executable, a shared
+// library or the vDSO. Its symbols are read the first time they're needed.
+type Module struct {
+  // Path is the file the module was mapped from
+  Path    string
+  // Start and End bound the module's mappings
+  Start   uint64
+  End     uint64
+  // Bias is the difference between where the module was loaded and the
+  // addresses it was linked at
+  Bias    uint64
+
+  image    []byte    // contents of modules that aren't files, like [vdso]
+  symbols  []Symbol  // sorted by address, link-time addresses
+  loaded   bool
+  frames  *frameTable
+  lines   *lineTable
+}
+
+// Symbol is a function or object from a module's ELF symbol table
+type Symbol struct {
+  Name     string
+  Address  uint64
+  Size     uint64
+  Func     bool
+}
+
+// Name returns the module's base name, e.g. "libc.so.6".
+func (m *Module) Name() string {
+  return filepath.Base(m.Path)
+}
+
+// Contains reports whether addr lies within the module.
+func (m *Module) Contains(addr uint64) bool {
+  return addr >= m.Start && addr < m.End
+}
+
+func (m *Module) open() (*elf.File, error) {
+  if m.image != nil {
+    return elf.NewFile(bytes.NewReader(m.image))
+  }
+  return elf.Open(m.Path)
+}
+
+// loadSymbols reads the module's .symtab, or .dynsym if it has been
+// stripped.
+func (m *Module) loadSymbols() {
+  if m.loaded {
+    return
+  }
+  m.loaded = true
+
+  f, err := m.open()
+  if err != nil {
+    return
+  }
+  defer f.Close()
+
+  syms, err := f.Symbols()
+  if err != nil || len(syms) == 0 {
+    syms, _ = f.DynamicSymbols()
+  }
+  for _, s := range syms {
+    kind := elf.ST_TYPE(s.Info)
+    if s.Section == elf.SHN_UNDEF || s.Value == 0 || s.Name == "" {
+      continue
+    }
+    if kind != elf.STT_FUNC && kind != elf.STT_GNU_IFUNC && kind != elf.STT_OBJECT {
+      continue
+    }
+    m.symbols = append(m.symbols, Symbol{s.Name, s.Value, s.Size, kind != elf.STT_OBJECT})
+  }
+  sort.SliceStable(m.symbols, func(i, j int) bool {
+    return m.symbols[i].Address < m.symbols[j].Address
+  })
+}
+
+// Symbols returns the functions and objects defined by the module, at the
+// addresses they were loaded at.
+func (m *Module) Symbols() []Symbol {
+  m.loadSymbols()
+  syms := make([]Symbol, len(m.symbols))
+  for i, s := range m.symbols {
+    syms[i] = s
+    syms[i].Address += m.Bias
+  }
+  return syms
+}
+
+// SymbolAt returns the symbol covering addr and how far into it addr is. A
+// symbol without a size is taken to extend to the next one.
+func (m *Module) SymbolAt(addr uint64) (sym Symbol, offset uint64, ok bool) {
+  m.loadSymbols()
+  link := addr - m.Bias
+  i := sort.Search(len(m.symbols), func(i int) bool {
+    return m.symbols[i].Address > link
+  }) - 1
+  if i < 0 {
+    return Symbol{}, 0, false
+  }
+
+  // Several symbols can share an address; take the first, preferring
+  // functions
+  start := m.symbols[i].Address
+  for i > 0 && m.symbols[i-1].Address == start {
+    i--
+  }
+  sym = m.symbols[i]
+  for j := i; j < len(m.symbols) && m.symbols[j].Address == start; j++ {
+    if m.symbols[j].Func && ! sym.Func {
+      sym = m.symbols[j]
+    }
+  }
+
+  if sym.Size != 0 && link >= sym.Address + sym.Size {
+    return Symbol{}, 0, false
+  }
+  sym.Address += m.Bias
+  return sym, addr - sym.Address, true
+}
+
+// Lookup returns the loaded address of the symbol called name.
+func (m *Module) Lookup(name string) (uint64, bool) {
+  m.loadSymbols()
+  for _, s := range m.symbols {
+    if s.Name == name {
+      return s.Address + m.Bias, true
+    }
+  }
+  return 0, false
+}
+
+// moduleBias works out the load bias of f from one of its mappings.
+func moduleBias(f *elf.File, r MemoryRegion) (uint64, bool) {
+  for _, prog := range f.Progs {
+    if prog.Type != elf.PT_LOAD {
+      continue
+    }
+    if prog.Off &^ (pageSize-1) == r.Offset {
+      return r.Address - (prog.Vaddr &^ (pageSize-1)), true
+    }
+  }
+  return 0, false
+}
+
+// Modules returns the ELF objects mapped into the target, in address order.
+// The list follows the memory map, so Refresh that first to pick up
+// libraries loaded since.
+func (p *Process) Modules() []*Module {
+  if p.modules != nil && p.modulesMap == p.Memory && p.modulesFiles == p.Memory.files {
+    return p.modules
+  }
+
+  previous := make(map[string]*Module)
+  for _, m := range p.modules {
+    previous[fmt.Sprintf("%s@%x", m.Path, m.Start)] = m
+  }
+
+  modules := []*Module{}
+  var last *Module
+  for _, r := range p.Memory.Regions {
+    if r.Kind != File && r.Kind != Vdso {
+      last = nil
+      continue
+    }
+    if last != nil && last.Path == r.Pathname {
+      last.End = r.End()
+      continue
+    }
+
+    m := &Module{Path: r.Pathname, Start: r.Address, End: r.End()}
+    if r.Kind == Vdso {
+      m.image = make([]byte, r.Size)
+      if _, err := p.ReadMemory(r.Address, m.image); err != nil {
+        continue
+      }
+    }
+    f, err := m.open()
+    if err != nil {
+      continue
+    }
+    bias, ok := moduleBias(f, r)
+    f.Close()
+    if ! ok {
+      continue
+    }
+    m.Bias = bias
+
+    if old, ok := previous[fmt.Sprintf("%s@%x", m.Path, m.Start)]; ok {
+      old.End = m.End
+      m = old
+    }
+    modules = append(modules, m)
+    last = m
+  }
+
+  p.modules, p.modulesMap, p.modulesFiles = modules, p.Memory, p.Memory.files
+  return modules
+}
+
+// ModuleAt returns the module mapped at addr, or nil.
+func (p *Process) ModuleAt(addr uint64) *Module {
+  for _, m := range p.Modules() {
+    if m.Contains(addr) {
+      return m
+    }
+  }
+  return nil
+}
+
+// FindModule returns the module loaded from name, given as a full path or a
+// base name such as "libc.so.6".
+func (p *Process) FindModule(name string) *Module {
+  for _, m := range p.Modules() {
+    if m.Path == name || m.Name() == name {
+      return m
+    }
+  }
+  return nil
+}
+
+// MainModule returns the module of the executable itself.
+func (p *Process) MainModule() *Module {
+  modules := p.Modules()
+
+  // Match by inode first, since the name the program was started under may
+  // be relative or a symlink
+  if info, err := os.Stat(p.Filename); err == nil {
+    if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+      for _, r := range p.Memory.Regions {
+        if r.Kind == File && r.Inode != 0 && r.Inode == stat.Ino {
+          if m := p.ModuleAt(r.Address); m != nil {
+            return m
+          }
+        }
+      }
+    }
+  }
+
+  abs, _ := filepath.Abs(p.Filename)
+  for _, m := range modules {
+    if m.Path == abs || m.Path == p.Filename {
+      return m
+    }
+  }
+  for _, m := range modules {
+    if m.Name() == filepath.Base(p.Filename) {
+      return m
+    }
+  }
+  return nil
+}
+
+// loadBias returns how far the executable was relocated from its link-time
+// addresses, which is zero unless it's position independent.
+func (p *Process) loadBias() uint64 {
+  if m := p.MainModule(); m != nil {
+    return m.Bias
+  }
+  return 0
+}
+
+// LookupSymbol returns the address of the function or object called name,
+// looking in the executable first and then in every other module.
+func (p *Process) LookupSymbol(name string) (uint64, error) {
+  main := p.MainModule()
+  if main != nil {
+    if addr, ok := main.Lookup(name); ok {
+      return addr, nil
+    }
+  }
+  for _, m := range p.Modules() {
+    if m == main {
+      continue
+    }
+    if addr, ok := m.Lookup(name); ok {
+      return addr, nil
+    }
+  }
+  return 0, symbolNotFound
+}
+
+// Symbolize describes addr as symbol+offset along with the module it's in,
+// e.g. "malloc+0x1a (libc.so.6)".
+func (p *Process) Symbolize(addr uint64) string {
+  m := p.ModuleAt(addr)
+  if m == nil {
+    return fmt.Sprintf("0x%x", addr)
+  }
+  sym, off, ok := m.SymbolAt(addr)
+  if ! ok {
+    return fmt.Sprintf("0x%x (%s)", addr, m.Name())
+  }
+  if off == 0 {
+    return fmt.Sprintf("%s (%s)", sym.Name, m.Name())
+  }
+  return fmt.Sprintf("%s+0x%x (%s)", sym.Name, off, m.Name())
+}
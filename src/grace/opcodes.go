@@ -0,0 +1,715 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+// Opcode tables for the x86-64 decoder. Operands are given in the notation of
+// the Intel manuals' opcode maps: a letter for the addressing method followed
+// by the operand size, e.g. Ev is a register or memory operand of the
+// current operand size. Lowercase operands name fixed registers.
+
+// opcode describes one instruction form
+type opcode struct {
+  mn     string
+  args   string
+  flags  int
+}
+
+const (
+  // opRead marks instructions whose first operand is only read, such as cmp
+  opRead = 1 << iota
+  // opStore marks instructions whose first operand is only written
+  opStore
+  // opWrite marks single-operand instructions that write their operand
+  opWrite
+  // opNoMem marks instructions that compute an address without accessing it
+  opNoMem
+  // opDefault64 marks instructions whose operand size defaults to 64 bits
+  opDefault64
+  // opNoVex marks VEX encoded instructions that don't get a "v" prefix
+  opNoVex
+)
+
+var conditions = []string{"o", "no", "b", "ae", "e", "ne", "be", "a", "s", "ns",
+                          "p", "np", "l", "ge", "le", "g"}
+
+var oneByte = map[byte]opcode{
+  0x63: {"movsxd", "Gv,Ed", 0},
+  0x68: {"push", "Iz", opDefault64},
+  0x69: {"imul", "Gv,Ev,Iz", 0},
+  0x6a: {"push", "Ibs", opDefault64},
+  0x6b: {"imul", "Gv,Ev,Ibs", 0},
+  0x6c: {"ins", "Yb,dx", opStore},
+  0x6d: {"ins", "Yz,dx", opStore},
+  0x6e: {"outs", "dx,Xb", opRead},
+  0x6f: {"outs", "dx,Xz", opRead},
+  0x84: {"test", "Eb,Gb", opRead},
+  0x85: {"test", "Ev,Gv", opRead},
+  0x86: {"xchg", "Eb,Gb", 0},
+  0x87: {"xchg", "Ev,Gv", 0},
+  0x88: {"mov", "Eb,Gb", opStore},
+  0x89: {"mov", "Ev,Gv", opStore},
+  0x8a: {"mov", "Gb,Eb", 0},
+  0x8b: {"mov", "Gv,Ev", 0},
+  0x8c: {"mov", "Ev,Sw", opStore},
+  0x8d: {"lea", "Gv,M", opNoMem},
+  0x8e: {"mov", "Sw,Ew", 0},
+  0x90: {"nop", "", 0},
+  0x98: {"cwde", "", 0},
+  0x99: {"cdq", "", 0},
+  0x9b: {"fwait", "", 0},
+  0x9c: {"pushf", "", opDefault64},
+  0x9d: {"popf", "", opDefault64},
+  0x9e: {"sahf", "", 0},
+  0x9f: {"lahf", "", 0},
+  0xa0: {"movabs", "al,Ob", 0},
+  0xa1: {"movabs", "rAX,Ov", 0},
+  0xa2: {"movabs", "Ob,al", opStore},
+  0xa3: {"movabs", "Ov,rAX", opStore},
+  0xa4: {"movs", "Yb,Xb", opStore},
+  0xa5: {"movs", "Yv,Xv", opStore},
+  0xa6: {"cmps", "Xb,Yb", opRead},
+  0xa7: {"cmps", "Xv,Yv", opRead},
+  0xa8: {"test", "al,Ib", opRead},
+  0xa9: {"test", "rAX,Iz", opRead},
+  0xaa: {"stos", "Yb,al", opStore},
+  0xab: {"stos", "Yv,rAX", opStore},
+  0xac: {"lods", "al,Xb", 0},
+  0xad: {"lods", "rAX,Xv", 0},
+  0xae: {"scas", "al,Yb", opRead},
+  0xaf: {"scas", "rAX,Yv", opRead},
+  0xc2: {"ret", "Iw", 0},
+  0xc3: {"ret", "", 0},
+  0xc8: {"enter", "Iw,Ib", 0},
+  0xc9: {"leave", "", 0},
+  0xca: {"retf", "Iw", 0},
+  0xcb: {"retf", "", 0},
+  0xcc: {"int3", "", 0},
+  0xcd: {"int", "Ib", 0},
+  0xcf: {"iret", "", 0},
+  0xd7: {"xlat", "", 0},
+  0xe0: {"loopne", "Jb", 0},
+  0xe1: {"loope", "Jb", 0},
+  0xe2: {"loop", "Jb", 0},
+  0xe3: {"jrcxz", "Jb", 0},
+  0xe4: {"in", "al,Ib", 0},
+  0xe5: {"in", "eAX,Ib", 0},
+  0xe6: {"out", "Ib,al", 0},
+  0xe7: {"out", "Ib,eAX", 0},
+  0xe8: {"call", "Jz", opDefault64},
+  0xe9: {"jmp", "Jz", 0},
+  0xeb: {"jmp", "Jb", 0},
+  0xec: {"in", "al,dx", 0},
+  0xed: {"in", "eAX,dx", 0},
+  0xee: {"out", "dx,al", 0},
+  0xef: {"out", "dx,eAX", 0},
+  0xf1: {"int1", "", 0},
+  0xf4: {"hlt", "", 0},
+  0xf5: {"cmc", "", 0},
+  0xf8: {"clc", "", 0},
+  0xf9: {"stc", "", 0},
+  0xfa: {"cli", "", 0},
+  0xfb: {"sti", "", 0},
+  0xfc: {"cld", "", 0},
+  0xfd: {"std", "", 0},
+}
+
+var twoByte = map[byte]opcode{
+  0x02: {"lar", "Gv,Ew", 0},
+  0x03: {"lsl", "Gv,Ew", 0},
+  0x05: {"syscall", "", 0},
+  0x06: {"clts", "", 0},
+  0x07: {"sysret", "", 0},
+  0x08: {"invd", "", 0},
+  0x09: {"wbinvd", "", 0},
+  0x0b: {"ud2", "", 0},
+  0x0e: {"femms", "", 0},
+  0x19: {"nop", "Ev", opNoMem},
+  0x1a: {"nop", "Ev", opNoMem},
+  0x1b: {"nop", "Ev", opNoMem},
+  0x1c: {"nop", "Ev", opNoMem},
+  0x1d: {"nop", "Ev", opNoMem},
+  0x1e: {"nop", "Ev", opNoMem},
+  0x1f: {"nop", "Ev", opNoMem},
+  0x20: {"mov", "Rq,Cq", 0},
+  0x21: {"mov", "Rq,Dq", 0},
+  0x22: {"mov", "Cq,Rq", 0},
+  0x23: {"mov", "Dq,Rq", 0},
+  0x30: {"wrmsr", "", 0},
+  0x31: {"rdtsc", "", 0},
+  0x32: {"rdmsr", "", 0},
+  0x33: {"rdpmc", "", 0},
+  0x34: {"sysenter", "", 0},
+  0x35: {"sysexit", "", 0},
+  0x37: {"getsec", "", 0},
+  0x78: {"vmread", "Eq,Gq", opStore},
+  0x79: {"vmwrite", "Gq,Eq", 0},
+  0xa0: {"push", "fs", 0},
+  0xa1: {"pop", "fs", 0},
+  0xa2: {"cpuid", "", 0},
+  0xa3: {"bt", "Ev,Gv", opRead},
+  0xa4: {"shld", "Ev,Gv,Ib", 0},
+  0xa5: {"shld", "Ev,Gv,cl", 0},
+  0xa8: {"push", "gs", 0},
+  0xa9: {"pop", "gs", 0},
+  0xaa: {"rsm", "", 0},
+  0xab: {"bts", "Ev,Gv", 0},
+  0xac: {"shrd", "Ev,Gv,Ib", 0},
+  0xad: {"shrd", "Ev,Gv,cl", 0},
+  0xaf: {"imul", "Gv,Ev", 0},
+  0xb0: {"cmpxchg", "Eb,Gb", 0},
+  0xb1: {"cmpxchg", "Ev,Gv", 0},
+  0xb2: {"lss", "Gv,Mp", 0},
+  0xb3: {"btr", "Ev,Gv", 0},
+  0xb4: {"lfs", "Gv,Mp", 0},
+  0xb5: {"lgs", "Gv,Mp", 0},
+  0xb6: {"movzx", "Gv,Eb", 0},
+  0xb7: {"movzx", "Gv,Ew", 0},
+  0xb9: {"ud1", "Gv,Ev", 0},
+  0xbb: {"btc", "Ev,Gv", 0},
+  0xbe: {"movsx", "Gv,Eb", 0},
+  0xbf: {"movsx", "Gv,Ew", 0},
+  0xc0: {"xadd", "Eb,Gb", 0},
+  0xc1: {"xadd", "Ev,Gv", 0},
+  0xc3: {"movnti", "My,Gy", opStore},
+  0xff: {"ud0", "Gd,Ed", 0},
+}
+
+// sseOps are the instructions whose meaning depends on a mandatory 66, F3
+// or F2 prefix, in that order after the unprefixed form.
+var sseOps = map[byte][4]opcode{
+  0x10: {{"movups", "Vx,Wx", 0}, {"movupd", "Vx,Wx", 0}, {"movss", "Vx,Wss", 0},
+         {"movsd", "Vx,Wsd", 0}},
+  0x11: {{"movups", "Wx,Vx", opStore}, {"movupd", "Wx,Vx", opStore},
+         {"movss", "Wss,Vx", opStore}, {"movsd", "Wsd,Vx", opStore}},
+  0x12: {{"movlps", "Vx,Wq", 0}, {"movlpd", "Vx,Mq", 0}, {"movsldup", "Vx,Wx", 0},
+         {"movddup", "Vx,Wsd", 0}},
+  0x13: {{"movlps", "Mq,Vx", opStore}, {"movlpd", "Mq,Vx", opStore}},
+  0x14: {{"unpcklps", "Vx,Wx", 0}, {"unpcklpd", "Vx,Wx", 0}},
+  0x15: {{"unpckhps", "Vx,Wx", 0}, {"unpckhpd", "Vx,Wx", 0}},
+  0x16: {{"movhps", "Vx,Wq", 0}, {"movhpd", "Vx,Mq", 0}, {"movshdup", "Vx,Wx", 0}},
+  0x17: {{"movhps", "Mq,Vx", opStore}, {"movhpd", "Mq,Vx", opStore}},
+  0x28: {{"movaps", "Vx,Wx", 0}, {"movapd", "Vx,Wx", 0}},
+  0x29: {{"movaps", "Wx,Vx", opStore}, {"movapd", "Wx,Vx", opStore}},
+  0x2a: {{"cvtpi2ps", "Vx,Qq", 0}, {"cvtpi2pd", "Vx,Qq", 0},
+         {"cvtsi2ss", "Vx,Ey", 0}, {"cvtsi2sd", "Vx,Ey", 0}},
+  0x2b: {{"movntps", "Mx,Vx", opStore}, {"movntpd", "Mx,Vx", opStore}},
+  0x2c: {{"cvttps2pi", "Pq,Wq", 0}, {"cvttpd2pi", "Pq,Wx", 0},
+         {"cvttss2si", "Gy,Wss", 0}, {"cvttsd2si", "Gy,Wsd", 0}},
+  0x2d: {{"cvtps2pi", "Pq,Wq", 0}, {"cvtpd2pi", "Pq,Wx", 0},
+         {"cvtss2si", "Gy,Wss", 0}, {"cvtsd2si", "Gy,Wsd", 0}},
+  0x2e: {{"ucomiss", "Vx,Wss", opRead}, {"ucomisd", "Vx,Wsd", opRead}},
+  0x2f: {{"comiss", "Vx,Wss", opRead}, {"comisd", "Vx,Wsd", opRead}},
+  0x50: {{"movmskps", "Gd,Ux", 0}, {"movmskpd", "Gd,Ux", 0}},
+  0x51: {{"sqrtps", "Vx,Wx", 0}, {"sqrtpd", "Vx,Wx", 0}, {"sqrtss", "Vx,Wss", 0},
+         {"sqrtsd", "Vx,Wsd", 0}},
+  0x52: {{"rsqrtps", "Vx,Wx", 0}, {}, {"rsqrtss", "Vx,Wss", 0}},
+  0x53: {{"rcpps", "Vx,Wx", 0}, {}, {"rcpss", "Vx,Wss", 0}},
+  0x54: {{"andps", "Vx,Wx", 0}, {"andpd", "Vx,Wx", 0}},
+  0x55: {{"andnps", "Vx,Wx", 0}, {"andnpd", "Vx,Wx", 0}},
+  0x56: {{"orps", "Vx,Wx", 0}, {"orpd", "Vx,Wx", 0}},
+  0x57: {{"xorps", "Vx,Wx", 0}, {"xorpd", "Vx,Wx", 0}},
+  0x5a: {{"cvtps2pd", "Vx,Wq", 0}, {"cvtpd2ps", "Vx,Wx", 0},
+         {"cvtss2sd", "Vx,Wss", 0}, {"cvtsd2ss", "Vx,Wsd", 0}},
+  0x5b: {{"cvtdq2ps", "Vx,Wx", 0}, {"cvtps2dq", "Vx,Wx", 0},
+         {"cvttps2dq", "Vx,Wx", 0}},
+  0x6e: {{"movd|movq", "Pq,Ey", 0}, {"movd|movq", "Vx,Ey", 0}},
+  0x6f: {{"movq", "Pq,Qq", 0}, {"movdqa", "Vx,Wx", 0}, {"movdqu", "Vx,Wx", 0}},
+  0x70: {{"pshufw", "Pq,Qq,Ib", 0}, {"pshufd", "Vx,Wx,Ib", 0},
+         {"pshufhw", "Vx,Wx,Ib", 0}, {"pshuflw", "Vx,Wx,Ib", 0}},
+  0x77: {{"emms", "", 0}},
+  0x7c: {{}, {"haddpd", "Vx,Wx", 0}, {}, {"haddps", "Vx,Wx", 0}},
+  0x7d: {{}, {"hsubpd", "Vx,Wx", 0}, {}, {"hsubps", "Vx,Wx", 0}},
+  0x7e: {{"movd|movq", "Ey,Pq", opStore}, {"movd|movq", "Ey,Vx", opStore},
+         {"movq", "Vx,Wq", 0}},
+  0x7f: {{"movq", "Qq,Pq", opStore}, {"movdqa", "Wx,Vx", opStore},
+         {"movdqu", "Wx,Vx", opStore}},
+  0xb8: {{}, {}, {"popcnt", "Gv,Ev", 0}},
+  0xbc: {{"bsf", "Gv,Ev", 0}, {}, {"tzcnt", "Gv,Ev", 0}},
+  0xbd: {{"bsr", "Gv,Ev", 0}, {}, {"lzcnt", "Gv,Ev", 0}},
+  0xc2: {{"cmpps", "Vx,Wx,Ib", 0}, {"cmppd", "Vx,Wx,Ib", 0},
+         {"cmpss", "Vx,Wss,Ib", 0}, {"cmpsd", "Vx,Wsd,Ib", 0}},
+  0xc4: {{"pinsrw", "Pq,Ewd,Ib", 0}, {"pinsrw", "Vx,Ewd,Ib", 0}},
+  0xc5: {{"pextrw", "Gd,Nq,Ib", 0}, {"pextrw", "Gd,Ux,Ib", 0}},
+  0xc6: {{"shufps", "Vx,Wx,Ib", 0}, {"shufpd", "Vx,Wx,Ib", 0}},
+  0xd0: {{}, {"addsubpd", "Vx,Wx", 0}, {}, {"addsubps", "Vx,Wx", 0}},
+  0xd6: {{}, {"movq", "Wq,Vx", opStore}, {"movq2dq", "Vx,Nq", 0},
+         {"movdq2q", "Pq,Ux", 0}},
+  0xd7: {{"pmovmskb", "Gd,Nq", 0}, {"pmovmskb", "Gd,Ux", 0}},
+  0xe6: {{}, {"cvttpd2dq", "Vx,Wx", 0}, {"cvtdq2pd", "Vx,Wq", 0},
+         {"cvtpd2dq", "Vx,Wx", 0}},
+  0xe7: {{"movntq", "Mq,Pq", opStore}, {"movntdq", "Mx,Vx", opStore}},
+  0xf0: {{}, {}, {}, {"lddqu", "Vx,Mx", 0}},
+  0xf7: {{"maskmovq", "Pq,Nq", 0}, {"maskmovdqu", "Vx,Ux", 0}},
+}
+
+// packedOps are the integer SIMD instructions that exist both for MMX
+// registers and, with a 66 prefix, for XMM registers
+var packedOps = map[byte]string{
+  0x60: "punpcklbw", 0x61: "punpcklwd", 0x62: "punpckldq", 0x63: "packsswb",
+  0x64: "pcmpgtb", 0x65: "pcmpgtw", 0x66: "pcmpgtd", 0x67: "packuswb",
+  0x68: "punpckhbw", 0x69: "punpckhwd", 0x6a: "punpckhdq", 0x6b: "packssdw",
+  0x74: "pcmpeqb", 0x75: "pcmpeqw", 0x76: "pcmpeqd",
+  0xd1: "psrlw", 0xd2: "psrld", 0xd3: "psrlq", 0xd4: "paddq", 0xd5: "pmullw",
+  0xd8: "psubusb", 0xd9: "psubusw", 0xda: "pminub", 0xdb: "pand",
+  0xdc: "paddusb", 0xdd: "paddusw", 0xde: "pmaxub", 0xdf: "pandn",
+  0xe0: "pavgb", 0xe1: "psraw", 0xe2: "psrad", 0xe3: "pavgw", 0xe4: "pmulhuw",
+  0xe5: "pmulhw", 0xe8: "psubsb", 0xe9: "psubsw", 0xea: "pminsw", 0xeb: "por",
+  0xec: "paddsb", 0xed: "paddsw", 0xee: "pmaxsw", 0xef: "pxor",
+  0xf1: "psllw", 0xf2: "pslld", 0xf3: "psllq", 0xf4: "pmuludq",
+  0xf5: "pmaddwd", 0xf6: "psadbw", 0xf8: "psubb", 0xf9: "psubw", 0xfa: "psubd",
+  0xfb: "psubq", 0xfc: "paddb", 0xfd: "paddw", 0xfe: "paddd",
+}
+
+// The 0F 38 map. Entries taking MMX registers without a prefix are listed in
+// packed38; the rest need a 66 prefix unless given in sse38.
+var packed38 = map[byte]string{
+  0x00: "pshufb", 0x01: "phaddw", 0x02: "phaddd", 0x03: "phaddsw",
+  0x04: "pmaddubsw", 0x05: "phsubw", 0x06: "phsubd", 0x07: "phsubsw",
+  0x08: "psignb", 0x09: "psignw", 0x0a: "psignd", 0x0b: "pmulhrsw",
+  0x1c: "pabsb", 0x1d: "pabsw", 0x1e: "pabsd",
+}
+
+var map38 = map[byte]opcode{
+  0x0c: {"permilps", "Vx,Wx", 0},
+  0x0d: {"permilpd", "Vx,Wx", 0},
+  0x10: {"pblendvb", "Vx,Wx,xmm0", 0},
+  0x14: {"blendvps", "Vx,Wx,xmm0", 0},
+  0x15: {"blendvpd", "Vx,Wx,xmm0", 0},
+  0x16: {"permps", "Vx,Wx", 0},
+  0x17: {"ptest", "Vx,Wx", opRead},
+  0x18: {"broadcastss", "Vx,Wd", 0},
+  0x19: {"broadcastsd", "Vx,Wq", 0},
+  0x1a: {"broadcastf128", "Vx,Mdq", 0},
+  0x20: {"pmovsxbw", "Vx,Wq", 0},
+  0x21: {"pmovsxbd", "Vx,Wd", 0},
+  0x22: {"pmovsxbq", "Vx,Ww", 0},
+  0x23: {"pmovsxwd", "Vx,Wq", 0},
+  0x24: {"pmovsxwq", "Vx,Wd", 0},
+  0x25: {"pmovsxdq", "Vx,Wq", 0},
+  0x28: {"pmuldq", "Vx,Wx", 0},
+  0x29: {"pcmpeqq", "Vx,Wx", 0},
+  0x2a: {"movntdqa", "Vx,Mx", 0},
+  0x2b: {"packusdw", "Vx,Wx", 0},
+  0x30: {"pmovzxbw", "Vx,Wq", 0},
+  0x31: {"pmovzxbd", "Vx,Wd", 0},
+  0x32: {"pmovzxbq", "Vx,Ww", 0},
+  0x33: {"pmovzxwd", "Vx,Wq", 0},
+  0x34: {"pmovzxwq", "Vx,Wd", 0},
+  0x35: {"pmovzxdq", "Vx,Wq", 0},
+  0x36: {"permd", "Vx,Wx", 0},
+  0x37: {"pcmpgtq", "Vx,Wx", 0},
+  0x38: {"pminsb", "Vx,Wx", 0},
+  0x39: {"pminsd", "Vx,Wx", 0},
+  0x3a: {"pminuw", "Vx,Wx", 0},
+  0x3b: {"pminud", "Vx,Wx", 0},
+  0x3c: {"pmaxsb", "Vx,Wx", 0},
+  0x3d: {"pmaxsd", "Vx,Wx", 0},
+  0x3e: {"pmaxuw", "Vx,Wx", 0},
+  0x3f: {"pmaxud", "Vx,Wx", 0},
+  0x40: {"pmulld", "Vx,Wx", 0},
+  0x41: {"phminposuw", "Vx,Wx", 0},
+  0x45: {"psrlvd|psrlvq", "Vx,Wx", 0},
+  0x46: {"psravd", "Vx,Wx", 0},
+  0x47: {"psllvd|psllvq", "Vx,Wx", 0},
+  0x58: {"pbroadcastd", "Vx,Wd", 0},
+  0x59: {"pbroadcastq", "Vx,Wq", 0},
+  0x5a: {"broadcasti128", "Vx,Mdq", 0},
+  0x78: {"pbroadcastb", "Vx,Wb", 0},
+  0x79: {"pbroadcastw", "Vx,Ww", 0},
+  0x8c: {"pmaskmovd|pmaskmovq", "Vx,Mx", 0},
+  0x8e: {"pmaskmovd|pmaskmovq", "Mx,Vx", opStore},
+  0xdb: {"aesimc", "Vx,Wx", 0},
+  0xdc: {"aesenc", "Vx,Wx", 0},
+  0xdd: {"aesenclast", "Vx,Wx", 0},
+  0xde: {"aesdec", "Vx,Wx", 0},
+  0xdf: {"aesdeclast", "Vx,Wx", 0},
+}
+
+// sse38 are the 0F 38 instructions that don't take a 66 prefix, indexed like
+// sseOps
+var sse38 = map[byte][4]opcode{
+  0xf0: {{"movbe", "Gv,Mv", 0}, {"movbe", "Gv,Mv", 0}, {},
+         {"crc32", "Gy,Eb", 0}},
+  0xf1: {{"movbe", "Mv,Gv", opStore}, {"movbe", "Mv,Gv", opStore}, {},
+         {"crc32", "Gy,Ev", 0}},
+  0xf6: {{}, {"adcx", "Gy,Ey", 0}, {"adox", "Gy,Ey", 0}},
+  0xc8: {{"sha1nexte", "Vx,Wx", 0}},
+  0xc9: {{"sha1msg1", "Vx,Wx", 0}},
+  0xca: {{"sha1msg2", "Vx,Wx", 0}},
+  0xcb: {{"sha256rnds2", "Vx,Wx,xmm0", 0}},
+  0xcc: {{"sha256msg1", "Vx,Wx", 0}},
+  0xcd: {{"sha256msg2", "Vx,Wx", 0}},
+}
+
+// bmiOps are the VEX encoded general purpose instructions of the 0F 38 map,
+// indexed like sseOps
+var bmiOps = map[byte][4]opcode{
+  0xf2: {{"andn", "Gy,By,Ey", opNoVex}},
+  0xf5: {{"bzhi", "Gy,Ey,By", opNoVex}, {}, {"pext", "Gy,By,Ey", opNoVex},
+         {"pdep", "Gy,By,Ey", opNoVex}},
+  0xf6: {{}, {}, {}, {"mulx", "Gy,By,Ey", opNoVex}},
+  0xf7: {{"bextr", "Gy,Ey,By", opNoVex}, {"shlx", "Gy,Ey,By", opNoVex},
+         {"sarx", "Gy,Ey,By", opNoVex}, {"shrx", "Gy,Ey,By", opNoVex}},
+}
+
+// The 0F 3A map, all of which take an immediate byte and, apart from
+// palignr, a 66 prefix
+var map3a = map[byte]opcode{
+  0x00: {"permq", "Vx,Wx,Ib", 0},
+  0x01: {"permpd", "Vx,Wx,Ib", 0},
+  0x02: {"pblendd", "Vx,Wx,Ib", 0},
+  0x04: {"permilps", "Vx,Wx,Ib", 0},
+  0x05: {"permilpd", "Vx,Wx,Ib", 0},
+  0x06: {"perm2f128", "Vx,Wx,Ib", 0},
+  0x08: {"roundps", "Vx,Wx,Ib", 0},
+  0x09: {"roundpd", "Vx,Wx,Ib", 0},
+  0x0a: {"roundss", "Vx,Wss,Ib", 0},
+  0x0b: {"roundsd", "Vx,Wsd,Ib", 0},
+  0x0c: {"blendps", "Vx,Wx,Ib", 0},
+  0x0d: {"blendpd", "Vx,Wx,Ib", 0},
+  0x0e: {"pblendw", "Vx,Wx,Ib", 0},
+  0x0f: {"palignr", "Vx,Wx,Ib", 0},
+  0x14: {"pextrb", "Ebd,Vx,Ib", opStore},
+  0x15: {"pextrw", "Ewd,Vx,Ib", opStore},
+  0x16: {"pextrd|pextrq", "Ey,Vx,Ib", opStore},
+  0x17: {"extractps", "Ed,Vx,Ib", opStore},
+  0x18: {"insertf128", "Vx,Wdq,Ib", 0},
+  0x19: {"extractf128", "Wdq,Vx,Ib", opStore},
+  0x20: {"pinsrb", "Vx,Ebd,Ib", 0},
+  0x21: {"insertps", "Vx,Wd,Ib", 0},
+  0x22: {"pinsrd|pinsrq", "Vx,Ey,Ib", 0},
+  0x38: {"inserti128", "Vx,Wdq,Ib", 0},
+  0x39: {"extracti128", "Wdq,Vx,Ib", opStore},
+  0x40: {"dpps", "Vx,Wx,Ib", 0},
+  0x41: {"dppd", "Vx,Wx,Ib", 0},
+  0x42: {"mpsadbw", "Vx,Wx,Ib", 0},
+  0x44: {"pclmulqdq", "Vx,Wx,Ib", 0},
+  0x46: {"perm2i128", "Vx,Wx,Ib", 0},
+  0x4a: {"blendvps", "Vx,Wx,Lx", 0},
+  0x4b: {"blendvpd", "Vx,Wx,Lx", 0},
+  0x4c: {"pblendvb", "Vx,Wx,Lx", 0},
+  0x60: {"pcmpestrm", "Vx,Wx,Ib", opRead},
+  0x61: {"pcmpestri", "Vx,Wx,Ib", opRead},
+  0x62: {"pcmpistrm", "Vx,Wx,Ib", opRead},
+  0x63: {"pcmpistri", "Vx,Wx,Ib", opRead},
+  0xcc: {"sha1rnds4", "Vx,Wx,Ib", 0},
+  0xdf: {"aeskeygenassist", "Vx,Wx,Ib", 0},
+  0xf0: {"rorx", "Gy,Ey,Ib", opNoVex},
+}
+
+// EVEX only instructions, keyed by map and opcode and indexed like sseOps
+var evexOps = map[int][4]opcode{
+  0x0164: {{}, {"vpcmpgtb", "KG,Hx,Wx", 0}},
+  0x0165: {{}, {"vpcmpgtw", "KG,Hx,Wx", 0}},
+  0x0166: {{}, {"vpcmpgtd", "KG,Hx,Wx", 0}},
+  0x016f: {{}, {"vmovdqa32|vmovdqa64", "Vx,Wx", 0},
+           {"vmovdqu32|vmovdqu64", "Vx,Wx", 0},
+           {"vmovdqu8|vmovdqu16", "Vx,Wx", 0}},
+  0x0174: {{}, {"vpcmpeqb", "KG,Hx,Wx", 0}},
+  0x0175: {{}, {"vpcmpeqw", "KG,Hx,Wx", 0}},
+  0x0176: {{}, {"vpcmpeqd", "KG,Hx,Wx", 0}},
+  0x01db: {{}, {"vpandd|vpandq", "Vx,Hx,Wx", 0}},
+  0x01df: {{}, {"vpandnd|vpandnq", "Vx,Hx,Wx", 0}},
+  0x01eb: {{}, {"vpord|vporq", "Vx,Hx,Wx", 0}},
+  0x01ef: {{}, {"vpxord|vpxorq", "Vx,Hx,Wx", 0}},
+  0x017f: {{}, {"vmovdqa32|vmovdqa64", "Wx,Vx", opStore},
+           {"vmovdqu32|vmovdqu64", "Wx,Vx", opStore},
+           {"vmovdqu8|vmovdqu16", "Wx,Vx", opStore}},
+  0x0226: {{}, {"vptestmb|vptestmw", "KG,Hx,Wx", 0}, {"vptestnmb|vptestnmw", "KG,Hx,Wx", 0}},
+  0x0227: {{}, {"vptestmd|vptestmq", "KG,Hx,Wx", 0}, {"vptestnmd|vptestnmq", "KG,Hx,Wx", 0}},
+  0x0229: {{}, {"vpcmpeqq", "KG,Hx,Wx", 0}},
+  0x0264: {{}, {"vpblendmd|vpblendmq", "Vx,Hx,Wx", 0}},
+  0x0266: {{}, {"vpblendmb|vpblendmw", "Vx,Hx,Wx", 0}},
+  0x027a: {{}, {"vpbroadcastb", "Vx,Rd", 0}},
+  0x027b: {{}, {"vpbroadcastw", "Vx,Rd", 0}},
+  0x027c: {{}, {"vpbroadcastd|vpbroadcastq", "Vx,Ry", 0}},
+  0x031e: {{}, {"vpcmpud|vpcmpuq", "KG,Hx,Wx,Ib", 0}},
+  0x031f: {{}, {"vpcmpd|vpcmpq", "KG,Hx,Wx,Ib", 0}},
+  0x0325: {{}, {"vpternlogd|vpternlogq", "Vx,Hx,Wx,Ib", 0}},
+  0x02b4: {{}, {"vpmadd52luq", "Vx,Hx,Wx", 0}},
+  0x02b5: {{}, {"vpmadd52huq", "Vx,Hx,Wx", 0}},
+  0x0303: {{}, {"valignd|valignq", "Vx,Hx,Wx,Ib", 0}},
+  0x033b: {{}, {"vextracti32x8|vextracti64x4", "Wqq,Vx,Ib", opStore}},
+  0x0343: {{}, {"vshufi32x4|vshufi64x2", "Vx,Hx,Wx,Ib", 0}},
+  0x033e: {{}, {"vpcmpub|vpcmpuw", "KG,Hx,Wx,Ib", 0}},
+  0x033f: {{}, {"vpcmpb|vpcmpw", "KG,Hx,Wx,Ib", 0}},
+}
+
+// maskOps are the VEX encoded opmask instructions of the 0F map
+var maskOps = map[byte]opcode{
+  0x41: {"kand", "KG,KH,KE", 0},
+  0x42: {"kandn", "KG,KH,KE", 0},
+  0x44: {"knot", "KG,KE", 0},
+  0x45: {"kor", "KG,KH,KE", 0},
+  0x46: {"kxnor", "KG,KH,KE", 0},
+  0x47: {"kxor", "KG,KH,KE", 0},
+  0x4a: {"kadd", "KG,KH,KE", 0},
+  0x4b: {"kunpck", "KG,KH,KE", 0},
+  0x90: {"kmov", "KG,KE", 0},
+  0x91: {"kmov", "M,KG", opStore},
+  0x92: {"kmov", "KG,Ry", 0},
+  0x93: {"kmov", "Gy,KE", 0},
+  0x98: {"kortest", "KG,KE", 0},
+  0x99: {"ktest", "KG,KE", 0},
+}
+
+// noVvvv lists, by map and opcode, the VEX instructions that leave VEX.vvvv
+// unused rather than taking it as an extra source operand
+var noVvvv = map[int]bool{
+  0x0110: true, 0x0111: true, 0x0113: true, 0x0117: true, 0x0128: true,
+  0x0129: true, 0x012b: true, 0x012c: true, 0x012d: true, 0x012e: true,
+  0x012f: true, 0x0150: true, 0x015b: true, 0x016e: true, 0x016f: true,
+  0x0170: true, 0x017e: true, 0x017f: true, 0x01c5: true, 0x01d6: true,
+  0x01d7: true, 0x01e6: true, 0x01e7: true, 0x01f0: true, 0x01f7: true,
+  0x0217: true, 0x0218: true, 0x0219: true, 0x021a: true, 0x021c: true,
+  0x021d: true, 0x021e: true, 0x0220: true, 0x0221: true, 0x0222: true,
+  0x0223: true, 0x0224: true, 0x0225: true, 0x022a: true, 0x0230: true,
+  0x0231: true, 0x0232: true, 0x0233: true, 0x0234: true, 0x0235: true,
+  0x0258: true, 0x0259: true, 0x025a: true, 0x0278: true, 0x0279: true,
+  0x027a: true, 0x027b: true, 0x027c: true, 0x02db: true,
+  0x0300: true, 0x0301: true, 0x0304: true, 0x0305: true, 0x0308: true,
+  0x0309: true, 0x0314: true, 0x0315: true, 0x0316: true, 0x0317: true,
+  0x0319: true, 0x031d: true, 0x0339: true, 0x0360: true, 0x0361: true,
+  0x0362: true, 0x0363: true, 0x03df: true,
+}
+
+// Groups select the instruction with the reg field of the ModRM byte. They
+// are keyed by map and opcode.
+var groups = map[int][8]opcode{
+  0x008f: {{"pop", "Ev", opStore|opWrite|opDefault64}},
+  0x00c6: {{"mov", "Eb,Ib", opStore}},
+  0x00c7: {{"mov", "Ev,Iz", opStore}},
+  0x00f6: {{"test", "Eb,Ib", opRead}, {"test", "Eb,Ib", opRead},
+           {"not", "Eb", opWrite}, {"neg", "Eb", opWrite}, {"mul", "Eb", 0},
+           {"imul", "Eb", 0}, {"div", "Eb", 0}, {"idiv", "Eb", 0}},
+  0x00f7: {{"test", "Ev,Iz", opRead}, {"test", "Ev,Iz", opRead},
+           {"not", "Ev", opWrite}, {"neg", "Ev", opWrite}, {"mul", "Ev", 0},
+           {"imul", "Ev", 0}, {"div", "Ev", 0}, {"idiv", "Ev", 0}},
+  0x00fe: {{"inc", "Eb", opWrite}, {"dec", "Eb", opWrite}},
+  0x00ff: {{"inc", "Ev", opWrite}, {"dec", "Ev", opWrite},
+           {"call", "Ev", opDefault64}, {"call", "Mp", 0},
+           {"jmp", "Ev", opDefault64}, {"jmp", "Mp", 0},
+           {"push", "Ev", opDefault64}},
+  0x0f00: {{"sldt", "Ew", opStore}, {"str", "Ew", opStore}, {"lldt", "Ew", 0},
+           {"ltr", "Ew", 0}, {"verr", "Ew", 0}, {"verw", "Ew", 0}},
+  0x0f01: {{"sgdt", "M", opStore|opWrite}, {"sidt", "M", opStore|opWrite}, {"lgdt", "M", 0},
+           {"lidt", "M", 0}, {"smsw", "Ew", opStore}, {}, {"lmsw", "Ew", 0},
+           {"invlpg", "Mb", opNoMem}},
+  0x0f0d: {{"prefetch", "Mb", opNoMem}, {"prefetchw", "Mb", opNoMem},
+           {"prefetchwt1", "Mb", opNoMem}},
+  0x0f18: {{"prefetchnta", "Mb", opNoMem}, {"prefetcht0", "Mb", opNoMem},
+           {"prefetcht1", "Mb", opNoMem}, {"prefetcht2", "Mb", opNoMem},
+           {"nop", "Ev", opNoMem}, {"nop", "Ev", opNoMem},
+           {"nop", "Ev", opNoMem}, {"nop", "Ev", opNoMem}},
+  0x0f71: {{}, {}, {"psrlw", "Nx,Ib", 0}, {}, {"psraw", "Nx,Ib", 0}, {},
+           {"psllw", "Nx,Ib", 0}},
+  0x0f72: {{}, {}, {"psrld", "Nx,Ib", 0}, {}, {"psrad", "Nx,Ib", 0}, {},
+           {"pslld", "Nx,Ib", 0}},
+  0x0f73: {{}, {}, {"psrlq", "Nx,Ib", 0}, {"psrldq", "Nx,Ib", 0}, {}, {},
+           {"psllq", "Nx,Ib", 0}, {"pslldq", "Nx,Ib", 0}},
+  0x0fae: {{"fxsave", "M", opStore|opWrite}, {"fxrstor", "M", 0},
+           {"ldmxcsr", "Md", 0}, {"stmxcsr", "Md", opStore|opWrite},
+           {"xsave", "M", opStore|opWrite}, {"xrstor", "M", 0},
+           {"xsaveopt", "M", opStore|opWrite}, {"clflush", "Mb", opNoMem}},
+  0x0fba: {{}, {}, {}, {}, {"bt", "Ev,Ib", opRead}, {"bts", "Ev,Ib", 0},
+           {"btr", "Ev,Ib", 0}, {"btc", "Ev,Ib", 0}},
+  0x0fc7: {{}, {"cmpxchg8b|cmpxchg16b", "Mq", opWrite}, {}, {"xrstors|xrstors64", "M", 0},
+           {"xsavec|xsavec64", "M", opStore|opWrite}, {"xsaves|xsaves64", "M", opStore|opWrite},
+           {"rdrand", "Rv", 0}, {"rdseed", "Rv", 0}},
+  0x38f3: {{}, {"blsr", "By,Ey", opNoVex}, {"blsmsk", "By,Ey", opNoVex},
+           {"blsi", "By,Ey", opNoVex}},
+}
+
+// Register forms of 0F 01, by ModRM byte
+var system01 = map[byte]string{
+  0xc8: "monitor", 0xc9: "mwait", 0xca: "clac", 0xcb: "stac", 0xd0: "xgetbv",
+  0xd1: "xsetbv", 0xd5: "xend", 0xd6: "xtest", 0xee: "rdpkru", 0xef: "wrpkru",
+  0xf8: "swapgs", 0xf9: "rdtscp",
+}
+
+// x87 instructions with a memory operand, by opcode and reg field, with the
+// size of the operand
+var x87Memory = [8][8]struct {
+  mn    string
+  size  string
+}{
+  {{"fadd", "d"}, {"fmul", "d"}, {"fcom", "d"}, {"fcomp", "d"}, {"fsub", "d"},
+   {"fsubr", "d"}, {"fdiv", "d"}, {"fdivr", "d"}},
+  {{"fld", "d"}, {}, {"fst", "d"}, {"fstp", "d"}, {"fldenv", ""},
+   {"fldcw", "w"}, {"fnstenv", ""}, {"fnstcw", "w"}},
+  {{"fiadd", "d"}, {"fimul", "d"}, {"ficom", "d"}, {"ficomp", "d"},
+   {"fisub", "d"}, {"fisubr", "d"}, {"fidiv", "d"}, {"fidivr", "d"}},
+  {{"fild", "d"}, {"fisttp", "d"}, {"fist", "d"}, {"fistp", "d"}, {},
+   {"fld", "t"}, {}, {"fstp", "t"}},
+  {{"fadd", "q"}, {"fmul", "q"}, {"fcom", "q"}, {"fcomp", "q"}, {"fsub", "q"},
+   {"fsubr", "q"}, {"fdiv", "q"}, {"fdivr", "q"}},
+  {{"fld", "q"}, {"fisttp", "q"}, {"fst", "q"}, {"fstp", "q"},
+   {"frstor", ""}, {}, {"fnsave", ""}, {"fnstsw", "w"}},
+  {{"fiadd", "w"}, {"fimul", "w"}, {"ficom", "w"}, {"ficomp", "w"},
+   {"fisub", "w"}, {"fisubr", "w"}, {"fidiv", "w"}, {"fidivr", "w"}},
+  {{"fild", "w"}, {"fisttp", "w"}, {"fist", "w"}, {"fistp", "w"},
+   {"fbld", "t"}, {"fild", "q"}, {"fbstp", "t"}, {"fistp", "q"}},
+}
+
+// x87 instructions on registers, by opcode and reg field. A leading "st,"
+// or trailing ",st" in the operands is combined with st(i).
+var x87Register = [8][8]opcode{
+  {{"fadd", "st,sti", 0}, {"fmul", "st,sti", 0}, {"fcom", "sti", 0},
+   {"fcomp", "sti", 0}, {"fsub", "st,sti", 0}, {"fsubr", "st,sti", 0},
+   {"fdiv", "st,sti", 0}, {"fdivr", "st,sti", 0}},
+  {{"fld", "sti", 0}, {"fxch", "sti", 0}},
+  {{"fcmovb", "st,sti", 0}, {"fcmove", "st,sti", 0}, {"fcmovbe", "st,sti", 0},
+   {"fcmovu", "st,sti", 0}},
+  {{"fcmovnb", "st,sti", 0}, {"fcmovne", "st,sti", 0},
+   {"fcmovnbe", "st,sti", 0}, {"fcmovnu", "st,sti", 0}, {},
+   {"fucomi", "st,sti", 0}, {"fcomi", "st,sti", 0}},
+  {{"fadd", "sti,st", 0}, {"fmul", "sti,st", 0}, {}, {},
+   {"fsubr", "sti,st", 0}, {"fsub", "sti,st", 0}, {"fdivr", "sti,st", 0},
+   {"fdiv", "sti,st", 0}},
+  {{"ffree", "sti", 0}, {}, {"fst", "sti", 0}, {"fstp", "sti", 0},
+   {"fucom", "sti", 0}, {"fucomp", "sti", 0}},
+  {{"faddp", "sti,st", 0}, {"fmulp", "sti,st", 0}, {}, {},
+   {"fsubrp", "sti,st", 0}, {"fsubp", "sti,st", 0}, {"fdivrp", "sti,st", 0},
+   {"fdivp", "sti,st", 0}},
+  {{"ffreep", "sti", 0}, {}, {}, {}, {}, {"fucomip", "st,sti", 0},
+   {"fcomip", "st,sti", 0}},
+}
+
+// x87 instructions without operands, by their second byte
+var x87Fixed = map[uint16]string{
+  0xd9d0: "fnop", 0xd9e0: "fchs", 0xd9e1: "fabs", 0xd9e4: "ftst",
+  0xd9e5: "fxam", 0xd9e8: "fld1", 0xd9e9: "fldl2t", 0xd9ea: "fldl2e",
+  0xd9eb: "fldpi", 0xd9ec: "fldlg2", 0xd9ed: "fldln2", 0xd9ee: "fldz",
+  0xd9f0: "f2xm1", 0xd9f1: "fyl2x", 0xd9f2: "fptan", 0xd9f3: "fpatan",
+  0xd9f4: "fxtract", 0xd9f5: "fprem1", 0xd9f6: "fdecstp", 0xd9f7: "fincstp",
+  0xd9f8: "fprem", 0xd9f9: "fyl2xp1", 0xd9fa: "fsqrt", 0xd9fb: "fsincos",
+  0xd9fc: "frndint", 0xd9fd: "fscale", 0xd9fe: "fsin", 0xd9ff: "fcos",
+  0xdae9: "fucompp", 0xdbe2: "fnclex", 0xdbe3: "fninit", 0xded9: "fcompp",
+  0xdfe0: "fnstsw",
+}
+
+func init() {
+  alu := []string{"add", "or", "adc", "sbb", "and", "sub", "xor", "cmp"}
+  grp1b, grp1v, grp1s := [8]opcode{}, [8]opcode{}, [8]opcode{}
+  for i, mn := range alu {
+    flags := 0
+    if mn == "cmp" {
+      flags = opRead
+    }
+    base := byte(i * 8)
+    oneByte[base] = opcode{mn, "Eb,Gb", flags}
+    oneByte[base+1] = opcode{mn, "Ev,Gv", flags}
+    oneByte[base+2] = opcode{mn, "Gb,Eb", flags}
+    oneByte[base+3] = opcode{mn, "Gv,Ev", flags}
+    oneByte[base+4] = opcode{mn, "al,Ib", flags}
+    oneByte[base+5] = opcode{mn, "rAX,Iz", flags}
+    grp1b[i] = opcode{mn, "Eb,Ib", flags}
+    grp1v[i] = opcode{mn, "Ev,Iz", flags}
+    grp1s[i] = opcode{mn, "Ev,Ibs", flags}
+  }
+  groups[0x80], groups[0x81], groups[0x83] = grp1b, grp1v, grp1s
+
+  shifts := []string{"rol", "ror", "rcl", "rcr", "shl", "shr", "sal", "sar"}
+  for i, mn := range shifts {
+    for op, args := range map[int]string{0xc0: "Eb,Ib", 0xc1: "Ev,Ib",
+                                         0xd0: "Eb,1", 0xd1: "Ev,1",
+                                         0xd2: "Eb,cl", 0xd3: "Ev,cl"} {
+      g := groups[op]
+      g[i] = opcode{mn, args, 0}
+      groups[op] = g
+    }
+  }
+
+  for i := byte(0); i < 8; i++ {
+    oneByte[0x50+i] = opcode{"push", "Zv", opDefault64}
+    oneByte[0x58+i] = opcode{"pop", "Zv", opDefault64}
+    oneByte[0xb0+i] = opcode{"mov", "Zb,Ib", 0}
+    oneByte[0xb8+i] = opcode{"mov", "Zv,Iv", 0}
+    twoByte[0xc8+i] = opcode{"bswap", "Zy", 0}
+    if i > 0 {
+      oneByte[0x90+i] = opcode{"xchg", "Zv,rAX", 0}
+    }
+  }
+
+  for i, cc := range conditions {
+    oneByte[0x70+byte(i)] = opcode{"j" + cc, "Jb", 0}
+    twoByte[0x80+byte(i)] = opcode{"j" + cc, "Jz", 0}
+    twoByte[0x40+byte(i)] = opcode{"cmov" + cc, "Gv,Ev", 0}
+    twoByte[0x90+byte(i)] = opcode{"set" + cc, "Eb", opStore|opWrite}
+  }
+
+  arith := map[byte]string{0x58: "add", 0x59: "mul", 0x5c: "sub", 0x5d: "min",
+                            0x5e: "div", 0x5f: "max"}
+  for op, mn := range arith {
+    sseOps[op] = [4]opcode{{mn + "ps", "Vx,Wx", 0}, {mn + "pd", "Vx,Wx", 0},
+                           {mn + "ss", "Vx,Wss", 0}, {mn + "sd", "Vx,Wsd", 0}}
+  }
+
+  // FMA3 comes in three operand orders, and FMA4 takes its fourth operand
+  // from an immediate
+  fma := []string{"fmaddsub", "fmsubadd", "fmadd", "fmadd", "fmsub", "fmsub",
+                  "fnmadd", "fnmadd", "fnmsub", "fnmsub"}
+  for i, mn := range fma {
+    forms := []string{"ps|", "pd", "Vx,Hx,Wx"}
+    if i >= 2 && i & 1 == 1 {
+      forms = []string{"ss|", "sd", "Vdq,Hdq,Wy"}
+    }
+    for j, order := range []string{"132", "213", "231"} {
+      name := "v" + mn + order + forms[0] + "v" + mn + order + forms[1]
+      map38[byte(0x96 + 0x10*j + i)] = opcode{name, forms[2], opNoVex}
+    }
+  }
+  for i, mn := range []string{"fmaddsub", "fmsubadd", "fmadd", "fmsub", "fnmadd", "fnmsub"} {
+    op := byte(0x5c + 2*i)
+    if k := i - 2; k >= 0 {
+      op = byte(0x68 + 4*k + 8*(k/2))
+    }
+    map3a[op] = opcode{"v" + mn + "ps", "Vx,Hx,Wx,Lx", opNoVex}
+    map3a[op+1] = opcode{"v" + mn + "pd", "Vx,Hx,Wx,Lx", opNoVex}
+    if i >= 2 {
+      map3a[op+2] = opcode{"v" + mn + "ss", "Vdq,Hdq,Wd,Ldq", opNoVex}
+      map3a[op+3] = opcode{"v" + mn + "sd", "Vdq,Hdq,Wq,Ldq", opNoVex}
+    }
+  }
+
+  for op, mn := range packedOps {
+    sseOps[op] = [4]opcode{{mn, "Pq,Qq", 0}, {mn, "Vx,Wx", 0}}
+  }
+  sseOps[0x6c] = [4]opcode{{}, {"punpcklqdq", "Vx,Wx", 0}}
+  sseOps[0x6d] = [4]opcode{{}, {"punpckhqdq", "Vx,Wx", 0}}
+  for op, mn := range packed38 {
+    sse38[op] = [4]opcode{{mn, "Pq,Qq", 0}, {mn, "Vx,Wx", 0}}
+  }
+  for op, entry := range map38 {
+    if _, ok := sse38[op]; ! ok {
+      sse38[op] = [4]opcode{{}, entry}
+    }
+  }
+}
@@ -0,0 +1,104 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import "syscall"
+
+// Making functions fail on purpose, to exercise error paths
+
+const errNoErrno = TracerError("can't find __errno_location in the target")
+
+// Predicate picks the calls an override applies to
+type Predicate func(*BreakpointContext) bool
+
+// NthCall is a Predicate for the nth call only, counting from 1.
+func NthCall(n uint64) Predicate {
+  return func(ctx *BreakpointContext) bool {
+    return ctx.Breakpoint.HitCount == n
+  }
+}
+
+// OverrideReturn makes the function at symbol return value as soon as it's
+// called, without running any of it, whenever predicate holds. A nil
+// predicate means every call. The returned breakpoint can be passed to
+// RemoveBreakpoint to undo it. For a function from a shared library, this has
+// to wait until the library is loaded, e.g. until main is reached.
+//
+//   proc.OverrideReturn("malloc", 0, grace.NthCall(5))
+func (p *Process) OverrideReturn(symbol string, value uint64, predicate Predicate) (*Breakpoint, error) {
+  return p.setOverride(symbol, overrideHandler(value, nil, predicate))
+}
+
+// OverrideErrno is OverrideReturn for libc functions that report failure
+// through errno, which it sets to errno in the calling thread.
+//
+//   proc.OverrideErrno("open", ^uint64(0), syscall.EACCES, nil)
+func (p *Process) OverrideErrno(symbol string, value uint64, errno syscall.Errno, predicate Predicate) (*Breakpoint, error) {
+  return p.setOverride(symbol, overrideHandler(value, &errno, predicate))
+}
+
+func (p *Process) setOverride(symbol string, h BreakpointHandler) (*Breakpoint, error) {
+  addr, err := p.resolveLoaded(symbol)
+  if err != nil {
+    return nil, err
+  }
+  return p.setBreakpointAt(addr, h, false)
+}
+
+func overrideHandler(value uint64, errno *syscall.Errno, predicate Predicate) BreakpointHandler {
+  return func(ctx *BreakpointContext) Action {
+    if predicate != nil && ! predicate(ctx) {
+      return CONTINUE
+    }
+    if errno != nil {
+      if err := ctx.Process.setErrno(ctx.Thread, *errno); err != nil {
+        return CONTINUE
+      }
+    }
+    ctx.Return = value
+    return SKIP_FUNCTION
+  }
+}
+
+// setErrno sets errno in thread t, by asking libc where that thread keeps it.
+func (p *Process) setErrno(t *Thread, errno syscall.Errno) error {
+  fun, err := p.LookupSymbol("__errno_location")
+  if err != nil {
+    return errNoErrno
+  }
+  addr, err := p.callFunction(t, fun)
+  if err != nil {
+    return err
+  }
+  buf := make([]byte, 4)
+  p.byteOrder().PutUint32(buf, uint32(errno))
+  _, err = p.WriteMemory(addr, buf)
+  return err
+}
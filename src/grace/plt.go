@@ -0,0 +1,381 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bufio"
+  "debug/elf"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "strings"
+  "time"
+)
+
+// Tracing the library calls a module makes through its PLT. Each stub gets a
+// breakpoint, found from the GOT slot it jumps through and the relocation
+// that fills that slot in. That works whether the slot is bound lazily or up
+// front with -z now. Calls made straight through the GOT, as with -fno-plt,
+// aren't seen.
+
+const errNoPLT = TracerError("the module has no PLT entries")
+
+// pltEntry is a PLT stub and the function it calls
+type pltEntry struct {
+  Address  uint64
+  Name     string
+}
+
+// prototype says how to show a function's arguments and return value. Each
+// is one of:
+//
+//   i  int            l  long            u  unsigned long
+//   p  pointer        s  C string        x  hex
+//   o  octal          c  char            v  nothing (return value only)
+//   .  the rest are variadic
+type prototype struct {
+  ret   byte
+  args  string
+}
+
+// prototypes are the library functions whose arguments can be shown
+var prototypes = map[string]prototype{
+  "malloc": {'p', "u"}, "calloc": {'p', "uu"}, "realloc": {'p', "pu"}, "free": {'v', "p"},
+  "strlen": {'u', "s"}, "strcmp": {'i', "ss"}, "strncmp": {'i', "ssu"},
+  "strcpy": {'p', "ps"}, "strncpy": {'p', "psu"}, "strcat": {'p', "ps"},
+  "strdup": {'p', "s"}, "strchr": {'p', "sc"}, "strrchr": {'p', "sc"}, "strstr": {'p', "ss"},
+  "memcpy": {'p', "ppu"}, "memmove": {'p', "ppu"}, "memset": {'p', "pcu"}, "memcmp": {'i', "ppu"},
+  "puts": {'i', "s"}, "putchar": {'i', "c"}, "getchar": {'i', ""},
+  "printf": {'i', "s."}, "fprintf": {'i', "ps."}, "sprintf": {'i', "ps."},
+  "snprintf": {'i', "pus."}, "__printf_chk": {'i', "is."}, "__fprintf_chk": {'i', "pis."},
+  "fputs": {'i', "sp"}, "fwrite": {'u', "puup"}, "fread": {'u', "puup"},
+  "fopen": {'p', "ss"}, "fclose": {'i', "p"}, "fflush": {'i', "p"},
+  "open": {'i', "sxo"}, "open64": {'i', "sxo"}, "openat": {'i', "isxo"}, "close": {'i', "i"},
+  "read": {'l', "ipu"}, "write": {'l', "ipu"}, "lseek": {'l', "ili"},
+  "socket": {'i', "iii"}, "connect": {'i', "ipi"}, "bind": {'i', "ipi"}, "listen": {'i', "ii"},
+  "accept": {'i', "ipp"}, "send": {'l', "ipux"}, "recv": {'l', "ipux"},
+  "getenv": {'s', "s"}, "setenv": {'i', "ssi"}, "atoi": {'i', "s"}, "strtol": {'l', "spi"},
+  "exit": {'v', "i"}, "_exit": {'v', "i"}, "abort": {'v', ""}, "perror": {'v', "s"},
+  "strerror": {'s', "i"}, "time": {'l', "p"}, "sleep": {'u', "u"}, "usleep": {'i', "u"},
+  "getpid": {'i', ""}, "fork": {'i', ""}, "execve": {'i', "spp"}, "waitpid": {'i', "ipx"},
+  "kill": {'i', "ii"}, "raise": {'i', "i"}, "system": {'i', "s"},
+  "signal": {'p', "ip"}, "sigaction": {'i', "ipp"}, "setitimer": {'i', "ipp"},
+  "mmap": {'p', "puxxil"}, "munmap": {'i', "pu"}, "mprotect": {'i', "pux"},
+  "dlopen": {'p', "sx"}, "dlsym": {'p', "ps"}, "qsort": {'v', "puup"},
+  "pthread_create": {'i', "pppp"}, "pthread_join": {'i', "pp"},
+  "pthread_mutex_lock": {'i', "p"}, "pthread_mutex_unlock": {'i', "p"},
+  "gettimeofday": {'i', "pp"}, "clock_gettime": {'i', "ip"},
+  "__memcpy_chk": {'p', "ppuu"}, "__strcpy_chk": {'p', "psu"}, "__stack_chk_fail": {'v', ""},
+  "__cxa_finalize": {'v', "p"},
+}
+
+// noReturn are the functions whose calls are reported on entry, since they
+// don't come back
+var noReturn = map[string]bool{
+  "exit": true, "_exit": true, "abort": true, "__stack_chk_fail": true,
+  "pthread_exit": true, "longjmp": true, "siglongjmp": true, "__assert_fail": true,
+}
+
+// LibraryCall is a call through the PLT.
+type LibraryCall struct {
+  Thread    int
+  Name      string
+  // Caller is where the call returns to
+  Caller    uint64
+  Args      [6]uint64
+  Return    uint64
+  Returned  bool
+  Time      time.Time
+  Duration  time.Duration
+
+  args      string    // the arguments as shown, read on entry
+  ret       string    // a string return value, read on return
+}
+
+// String shows the call as name(args) = result.
+func (c *LibraryCall) String() string {
+  s := c.Name + "(" + c.args + ")"
+  proto, known := prototypes[c.Name]
+  switch {
+  case ! c.Returned:
+    if ! noReturn[c.Name] {
+      s += " = ?"
+    }
+  case known && proto.ret == 'v':
+  case c.ret != "":
+    s += " = " + c.ret
+  case known:
+    s += " = " + formatValue(proto.ret, c.Return)
+  default:
+    s += fmt.Sprintf(" = 0x%x", c.Return)
+  }
+  return s
+}
+
+// LibraryTrace is the calls traced by TraceLibraryCalls.
+type LibraryTrace struct {
+  // Calls are in the order they were made
+  Calls     []*LibraryCall
+
+  callTracker
+  callback  func(*LibraryCall)
+  names     map[uint64]string
+}
+
+// TraceLibraryCalls traces the calls that the module named, given as a path
+// or a base name, makes through its PLT. With an empty name it's the
+// executable. callback, if set, gets each call once it has returned, or on
+// entry for functions like exit that don't.
+func (p *Process) TraceLibraryCalls(module string, callback func(*LibraryCall)) (*LibraryTrace, error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  p.Memory.Refresh()
+  m := p.MainModule()
+  if module != "" {
+    m = p.FindModule(module)
+  }
+  if m == nil {
+    return nil, errNoModule
+  }
+  entries, err := m.pltEntries()
+  if err != nil {
+    return nil, err
+  }
+  if len(entries) == 0 {
+    return nil, errNoPLT
+  }
+
+  lt := &LibraryTrace{callTracker: newCallTracker(p), callback: callback,
+                      names: make(map[uint64]string)}
+  for _, e := range entries {
+    if lt.setBreakpoint(e.Address, lt.entered) == nil {
+      lt.names[e.Address] = e.Name
+    }
+  }
+  return lt, nil
+}
+
+// Write writes each call on a line, with its thread and where it was made
+// from.
+func (lt *LibraryTrace) Write(w io.Writer) error {
+  bw := bufio.NewWriter(w)
+  for _, c := range lt.Calls {
+    fmt.Fprintf(bw, "[%d] %s: %s\n", c.Thread, lt.proc.Symbolize(c.Caller), c)
+  }
+  return bw.Flush()
+}
+
+func (lt *LibraryTrace) entered(ctx *BreakpointContext) Action {
+  p, regs := ctx.Process, ctx.Regs
+  ret, err := p.ReadU64(regs.Rsp)
+  if err != nil {
+    return CONTINUE
+  }
+  c := &LibraryCall{Thread: ctx.Thread.Tid, Name: lt.names[ctx.Breakpoint.Address],
+                    Caller: ret, Time: ctx.Time,
+                    Args: [6]uint64{regs.Rdi, regs.Rsi, regs.Rdx, regs.Rcx, regs.R8, regs.R9}}
+  c.args = c.formatArgs(p)
+  lt.Calls = append(lt.Calls, c)
+
+  if noReturn[c.Name] {
+    p.recorder.instant(c.Thread, c.Name, "library", c.Time, map[string]interface{}{"call": c.String()})
+    if lt.callback != nil {
+      lt.callback(c)
+    }
+    return CONTINUE
+  }
+  // Library calls don't tail call back into the module, so a call whose
+  // return address was where this one's is has been left by longjmp
+  stack := lt.unwind(c.Thread, regs.Rsp)
+  if n := len(stack); n > 0 && stack[n-1].sp == regs.Rsp {
+    lt.stacks[c.Thread] = stack[:n-1]
+  }
+  lt.push(c.Thread, regs.Rsp, ret, c, lt.returned)
+  return CONTINUE
+}
+
+func (lt *LibraryTrace) returned(ctx *BreakpointContext) Action {
+  tid, sp := ctx.Thread.Tid, ctx.Regs.Rsp
+  for _, frame := range lt.pop(tid, sp) {
+    if frame.sp + 8 != sp {
+      // Left by longjmp
+      continue
+    }
+    c := frame.call.(*LibraryCall)
+    c.Return, c.Returned = ctx.Regs.Rax, true
+    if prototypes[c.Name].ret == 's' {
+      c.ret = formatString(ctx.Process, c.Return)
+    }
+    c.Duration = ctx.Time.Sub(c.Time)
+    ctx.Process.recorder.span(tid, c.Name, "library", c.Time, ctx.Time,
+                              map[string]interface{}{"call": c.String()})
+    if lt.callback != nil {
+      lt.callback(c)
+    }
+  }
+  return CONTINUE
+}
+
+// formatArgs shows the arguments as the prototype says, or not at all if
+// there's none.
+func (c *LibraryCall) formatArgs(p *Process) string {
+  proto, ok := prototypes[c.Name]
+  if ! ok {
+    return "..."
+  }
+  args := []string{}
+  for i, kind := range []byte(proto.args) {
+    if kind == '.' {
+      args = append(args, "...")
+      break
+    }
+    if kind == 's' {
+      args = append(args, formatString(p, c.Args[i]))
+      continue
+    }
+    args = append(args, formatValue(kind, c.Args[i]))
+  }
+  return strings.Join(args, ", ")
+}
+
+// formatValue shows v as a value of the given prototype kind. Strings have to
+// be read while they're valid, so they're left to formatString.
+func formatValue(kind byte, v uint64) string {
+  switch kind {
+  case 'i':
+    return fmt.Sprint(int32(v))
+  case 'l':
+    return fmt.Sprint(int64(v))
+  case 'u':
+    return fmt.Sprint(v)
+  case 'o':
+    return fmt.Sprintf("0%o", v)
+  case 'c':
+    return fmt.Sprintf("%q", rune(byte(v)))
+  case 'p', 's':
+    if v == 0 {
+      return "NULL"
+    }
+  }
+  return fmt.Sprintf("0x%x", v)
+}
+
+// formatString shows the C string at addr, cut short if it's long.
+func formatString(p *Process, addr uint64) string {
+  if addr == 0 {
+    return "NULL"
+  }
+  const max = 64
+  s, err := p.ReadCString(addr, max + 1)
+  if err != nil {
+    return fmt.Sprintf("0x%x", addr)
+  }
+  if len(s) > max {
+    return fmt.Sprintf("%q...", s[:max])
+  }
+  return fmt.Sprintf("%q", s)
+}
+
+// pltEntries finds the module's PLT stubs that jump through a GOT slot with a
+// symbol's relocation, in .plt, .plt.sec and .plt.got.
+func (m *Module) pltEntries() ([]pltEntry, error) {
+  f, err := m.open()
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  slots := gotSlots(f)
+  entries := []pltEntry{}
+  for _, name := range []string{".plt", ".plt.sec", ".plt.got"} {
+    sec := f.Section(name)
+    if sec == nil {
+      continue
+    }
+    code, err := sec.Data()
+    if err != nil {
+      continue
+    }
+    size := sec.Entsize
+    if size == 0 {
+      size = 16
+    }
+    for off := 0; off < len(code); {
+      inst, err := Decode(code[off:], sec.Addr + uint64(off))
+      if err != nil {
+        off++
+        continue
+      }
+      if inst.Flow == FlowJump && inst.Indirect && inst.ripOffset != 0 {
+        if name, ok := slots[inst.Target]; ok {
+          stub := sec.Addr + uint64(off) / size * size
+          entries = append(entries, pltEntry{stub + m.Bias, name})
+        }
+      }
+      off += inst.Len()
+    }
+  }
+  return entries, nil
+}
+
+// gotSlots maps the GOT slots that the dynamic loader fills in with the
+// address of a function to its name.
+func gotSlots(f *elf.File) map[uint64]string {
+  slots := make(map[uint64]string)
+  syms, err := f.DynamicSymbols()
+  if err != nil {
+    return slots
+  }
+  for _, name := range []string{".rela.plt", ".rela.dyn"} {
+    sec := f.Section(name)
+    if sec == nil {
+      continue
+    }
+    data, err := sec.Data()
+    if err != nil {
+      continue
+    }
+    for off := 0; off + 24 <= len(data); off += 24 {
+      offset := binary.LittleEndian.Uint64(data[off:])
+      info := binary.LittleEndian.Uint64(data[off+8:])
+      typ, sym := elf.R_X86_64(info & 0xffffffff), int(info >> 32)
+      if typ != elf.R_X86_64_JMP_SLOT && typ != elf.R_X86_64_GLOB_DAT {
+        continue
+      }
+      // DynamicSymbols leaves out the null symbol
+      if sym == 0 || sym > len(syms) || syms[sym-1].Name == "" {
+        continue
+      }
+      slots[offset] = syms[sym-1].Name
+    }
+  }
+  return slots
+}
@@ -0,0 +1,306 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "debug/elf"
+  "encoding/binary"
+  "strings"
+  "testing"
+)
+
+// testSection is a section of an ELF image built by elfImage
+type testSection struct {
+  name     string
+  typ      elf.SectionType
+  addr     uint64
+  entsize  uint64
+  link     uint32
+  data   []byte
+}
+
+// elfImage builds an x86-64 shared object from sections, which follow a null
+// one and come before .shstrtab.
+func elfImage(sections []testSection) []byte {
+  le := binary.LittleEndian
+  shstrtab := []byte{0}
+  headers := []elf.Section64{{}}
+  var body bytes.Buffer
+  sections = append(sections, testSection{name: ".shstrtab", typ: elf.SHT_STRTAB})
+  for i, s := range sections {
+    name := uint32(len(shstrtab))
+    shstrtab = append(append(shstrtab, s.name...), 0)
+    if i == len(sections) - 1 {
+      s.data = shstrtab
+    }
+    headers = append(headers, elf.Section64{Name: name, Type: uint32(s.typ), Addr: s.addr,
+                                            Off: uint64(64 + body.Len()), Size: uint64(len(s.data)),
+                                            Link: s.link, Addralign: 1, Entsize: s.entsize})
+    body.Write(s.data)
+  }
+
+  header := elf.Header64{Type: uint16(elf.ET_DYN), Machine: uint16(elf.EM_X86_64),
+                         Version: uint32(elf.EV_CURRENT), Shoff: uint64(64 + body.Len()),
+                         Ehsize: 64, Shentsize: 64, Shnum: uint16(len(headers)),
+                         Shstrndx: uint16(len(headers) - 1)}
+  copy(header.Ident[:], elf.ELFMAG)
+  header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+  header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+  header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+  var buf bytes.Buffer
+  binary.Write(&buf, le, &header)
+  buf.Write(body.Bytes())
+  binary.Write(&buf, le, headers)
+  return buf.Bytes()
+}
+
+// dynamicSymbols returns .dynsym and .dynstr sections for functions named
+// names, at indexes 1 and 2 of the image.
+func dynamicSymbols(names ...string) []testSection {
+  strtab := []byte{0}
+  syms := []elf.Sym64{{}}
+  for _, name := range names {
+    syms = append(syms, elf.Sym64{Name: uint32(len(strtab)),
+                                  Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)})
+    strtab = append(append(strtab, name...), 0)
+  }
+  var symtab bytes.Buffer
+  binary.Write(&symtab, binary.LittleEndian, syms)
+  return []testSection{
+    {name: ".dynsym", typ: elf.SHT_DYNSYM, entsize: 24, link: 2, data: symtab.Bytes()},
+    {name: ".dynstr", typ: elf.SHT_STRTAB, data: strtab},
+  }
+}
+
+func relocations(relas ...elf.Rela64) []byte {
+  var buf bytes.Buffer
+  binary.Write(&buf, binary.LittleEndian, relas)
+  return buf.Bytes()
+}
+
+func rela(offset uint64, sym uint32, typ elf.R_X86_64) elf.Rela64 {
+  return elf.Rela64{Off: offset, Info: elf.R_INFO(sym, uint32(typ))}
+}
+
+// jumpThrough returns an indirect jmp at addr through the GOT slot, with
+// prefix before the opcode
+func jumpThrough(addr, slot uint64, prefix ...byte) []byte {
+  code := append(prefix, 0xff, 0x25, 0, 0, 0, 0)
+  binary.LittleEndian.PutUint32(code[len(code)-4:], uint32(slot - (addr + uint64(len(code)))))
+  return code
+}
+
+// pltImage is a module whose calls to puts go through .plt with lazy
+// binding, to malloc through .plt.sec as with -fcf-protection, and to
+// __cxa_finalize through .plt.got.
+func pltImage() []byte {
+  const plt, pltSec, pltGot = 0x1000, 0x1100, 0x1200
+  lazy := append([]byte{0xff, 0x35, 0, 0, 0, 0}, jumpThrough(plt + 6, 0x3010)...)
+  lazy = append(lazy, 0x0f, 0x1f, 0x40, 0x00)                            // PLT0
+  lazy = append(lazy, jumpThrough(plt + 16, 0x3018)...)                  // puts
+  lazy = append(lazy, 0x68, 0, 0, 0, 0, 0xe9, 0xdb, 0xff, 0xff, 0xff)
+  lazy = append(lazy, jumpThrough(plt + 32, 0x3040)...)                  // no relocation
+  lazy = append(lazy, 0x68, 1, 0, 0, 0, 0xe9, 0xcb, 0xff, 0xff, 0xff)
+
+  ibt := append([]byte{0xf3, 0x0f, 0x1e, 0xfa}, jumpThrough(pltSec + 4, 0x3020, 0xf2)...)
+  ibt = append(ibt, 0x0f, 0x1f, 0x44, 0x00, 0x00)                        // malloc
+
+  got := append(jumpThrough(pltGot, 0x3ff0), 0x66, 0x90)                 // __cxa_finalize
+
+  sections := dynamicSymbols("puts", "malloc", "__cxa_finalize")
+  sections = append(sections,
+    testSection{name: ".rela.dyn", typ: elf.SHT_RELA, entsize: 24, link: 1,
+                data: relocations(rela(0x3ff0, 3, elf.R_X86_64_GLOB_DAT),
+                                  rela(0x3f00, 0, elf.R_X86_64_RELATIVE))},
+    testSection{name: ".rela.plt", typ: elf.SHT_RELA, entsize: 24, link: 1,
+                data: relocations(rela(0x3018, 1, elf.R_X86_64_JMP_SLOT),
+                                  rela(0x3020, 2, elf.R_X86_64_JMP_SLOT),
+                                  rela(0x3028, 9, elf.R_X86_64_JMP_SLOT))},
+    testSection{name: ".plt", typ: elf.SHT_PROGBITS, addr: plt, entsize: 16, data: lazy},
+    testSection{name: ".plt.sec", typ: elf.SHT_PROGBITS, addr: pltSec, entsize: 16, data: ibt},
+    testSection{name: ".plt.got", typ: elf.SHT_PROGBITS, addr: pltGot, entsize: 8, data: got},
+  )
+  return elfImage(sections)
+}
+
+func TestGotSlots(t *testing.T) {
+  f, err := elf.NewFile(bytes.NewReader(pltImage()))
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := map[uint64]string{0x3018: "puts", 0x3020: "malloc", 0x3ff0: "__cxa_finalize"}
+  slots := gotSlots(f)
+  if len(slots) != len(want) {
+    t.Errorf("got %v, want %v", slots, want)
+  }
+  for slot, name := range want {
+    if slots[slot] != name {
+      t.Errorf("slot 0x%x is %q, want %q", slot, slots[slot], name)
+    }
+  }
+
+  // Without dynamic symbols there's nothing to name the slots with
+  f, err = elf.NewFile(bytes.NewReader(elfImage(nil)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if slots := gotSlots(f); len(slots) != 0 {
+    t.Errorf("no symbols: got %v", slots)
+  }
+}
+
+func TestPltEntries(t *testing.T) {
+  const bias = 0x555555554000
+  m := &Module{Path: "app", Bias: bias, image: pltImage()}
+  entries, err := m.pltEntries()
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := []pltEntry{{bias + 0x1010, "puts"}, {bias + 0x1100, "malloc"},
+                     {bias + 0x1200, "__cxa_finalize"}}
+  if len(entries) != len(want) {
+    t.Fatalf("got %v, want %v", entries, want)
+  }
+  for i := range want {
+    if entries[i] != want[i] {
+      t.Errorf("entry %d is %v, want %v", i, entries[i], want[i])
+    }
+  }
+
+  m = &Module{Path: "app", image: elfImage(dynamicSymbols("puts"))}
+  if entries, err := m.pltEntries(); err != nil || len(entries) != 0 {
+    t.Errorf("no PLT: got %v, %v", entries, err)
+  }
+}
+
+func TestFormatValue(t *testing.T) {
+  tests := []struct {
+    kind  byte
+    v     uint64
+    want  string
+  }{
+    {'i', 0xffffffff, "-1"},
+    {'i', 0x100000002, "2"},
+    {'l', ^uint64(0), "-1"},
+    {'u', ^uint64(0), "18446744073709551615"},
+    {'o', 0644, "0644"},
+    {'c', 'A', "'A'"},
+    {'c', '\n', "'\\n'"},
+    {'p', 0, "NULL"},
+    {'p', 0x7fff0000, "0x7fff0000"},
+    {'s', 0, "NULL"},
+    {'x', 255, "0xff"},
+  }
+  for _, test := range tests {
+    if got := formatValue(test.kind, test.v); got != test.want {
+      t.Errorf("%c 0x%x: got %s, want %s", test.kind, test.v, got, test.want)
+    }
+  }
+}
+
+func TestLibraryCallString(t *testing.T) {
+  const base = 0x7000
+  data := make([]byte, 0x100)
+  copy(data, "hello\x00")
+  copy(data[0x10:], strings.Repeat("x", 70) + "\x00")
+  p := &Process{Memory: &MemoryMap{}, target: &memBackend{base, data}}
+
+  tests := []struct {
+    name      string
+    args      [6]uint64
+    ret       uint64
+    returned  bool
+    want      string
+  }{
+    {"puts", [6]uint64{base}, 6, true, `puts("hello") = 6`},
+    {"strlen", [6]uint64{base + 0x10}, 70, true, `strlen("` + strings.Repeat("x", 64) + `"...) = 70`},
+    {"strlen", [6]uint64{0x9000}, 0, false, "strlen(0x9000) = ?"},
+    {"malloc", [6]uint64{32}, 0, true, "malloc(32) = NULL"},
+    {"free", [6]uint64{0x7000}, 0, true, "free(0x7000)"},
+    {"open", [6]uint64{base, 0x241, 0644}, ^uint64(0), true, `open("hello", 0x241, 0644) = -1`},
+    {"printf", [6]uint64{base, 1, 2}, 5, true, `printf("hello", ...) = 5`},
+    {"memset", [6]uint64{base, 'a', 4}, base, true, "memset(0x7000, 'a', 4) = 0x7000"},
+    {"exit", [6]uint64{1}, 0, false, "exit(1)"},
+    {"frobnicate", [6]uint64{1}, 0x2a, true, "frobnicate(...) = 0x2a"},
+  }
+  for _, test := range tests {
+    c := &LibraryCall{Name: test.name, Args: test.args}
+    c.args = c.formatArgs(p)
+    c.Return, c.Returned = test.ret, test.returned
+    if got := c.String(); got != test.want {
+      t.Errorf("got %s, want %s", got, test.want)
+    }
+  }
+
+  // A string return value is read when the call returns
+  c := &LibraryCall{Name: "getenv", Args: [6]uint64{base}, Return: base, Returned: true}
+  c.args = c.formatArgs(p)
+  c.ret = formatString(p, c.Return)
+  if got := c.String(); got != `getenv("hello") = "hello"` {
+    t.Errorf("got %s", got)
+  }
+}
+
+func TestLibraryTraceReturns(t *testing.T) {
+  const base, top = 0x7000, 0x7100
+  p := &Process{Memory: &MemoryMap{}, target: &memBackend{base, make([]byte, 0x100)}}
+  returned := []string{}
+  lt := &LibraryTrace{callTracker: newCallTracker(p), names: map[uint64]string{
+                        0x1010: "getpid", 0x1020: "setjmp", 0x1030: "malloc"},
+                      callback: func(c *LibraryCall) { returned = append(returned, c.String()) }}
+
+  thread := &Thread{Tid: 1}
+  call := func(fn, sp uint64) {
+    binary.LittleEndian.PutUint64(p.target.(*memBackend).data[sp-base:], 0x400000 + fn)
+    lt.entered(&BreakpointContext{Process: p, Thread: thread, Breakpoint: &Breakpoint{Address: fn},
+                                  Regs: &RegisterState{Rsp: sp}})
+  }
+  ret := func(sp, rax uint64) {
+    lt.returned(&BreakpointContext{Process: p, Thread: thread, Regs: &RegisterState{Rsp: sp, Rax: rax}})
+  }
+
+  call(0x1010, top - 8)
+  ret(top, 42)
+  // setjmp's second return comes by longjmp, with malloc's return address
+  // where setjmp's was
+  call(0x1020, top - 8)
+  call(0x1030, top - 8)
+  ret(top, 0x9000)
+
+  want := []string{"getpid() = 42", "malloc(0) = 0x9000"}
+  if strings.Join(returned, "; ") != strings.Join(want, "; ") {
+    t.Errorf("returned %q, want %q", returned, want)
+  }
+  if len(lt.Calls) != 3 || lt.Calls[1].Returned {
+    t.Errorf("calls %v", lt.Calls)
+  }
+}
@@ -0,0 +1,523 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bufio"
+  "compress/gzip"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
+)
+
+// Sampling profiling. A goroutine sends a thread SIGSTOP at the sampling
+// frequency, and when the event loop sees it, all threads are stopped and
+// their stacks unwound and counted. Only one tick is out at a time, and only
+// a SIGSTOP of the thread it went to is taken for it, so one sent to the
+// target by anything else still gets through.
+
+const errProfiling = TracerError("the process is already being profiled")
+
+// ProfileOptions say how to profile.
+type ProfileOptions struct {
+  // Frequency is how many samples to take a second, 99 if zero
+  Frequency  int
+  // OnCPU leaves out threads that are blocked in a system call
+  OnCPU      bool
+}
+
+// Profile is a sampling profile of a process.
+type Profile struct {
+  Start     time.Time
+  // Duration is set by Stop
+  Duration  time.Duration
+  Period    time.Duration
+  // Samples is how many times the threads were sampled
+  Samples   int
+
+  proc      *Process
+  opts      ProfileOptions
+  stacks    map[string]*profileStack
+  running   int32
+  quit      chan struct{}
+  done      chan struct{}
+
+  // mu guards the thread ticks go to, and the one a tick is out to, if any
+  mu        sync.Mutex
+  target    int
+  ticking   int
+}
+
+// profileStack is a stack that was seen, and how often.
+type profileStack struct {
+  thread  int
+  frames  []Frame
+  count   int64
+}
+
+// StartProfile starts sampling the stacks of all threads until Stop is
+// called. The samples are taken while the event loop runs.
+func (p *Process) StartProfile(opts ProfileOptions) (*Profile, error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+  if p.profile != nil && atomic.LoadInt32(&p.profile.running) != 0 {
+    return nil, errProfiling
+  }
+  if opts.Frequency <= 0 {
+    opts.Frequency = 99
+  }
+
+  pr := &Profile{Start: time.Now(), Period: time.Second / time.Duration(opts.Frequency),
+                 proc: p, opts: opts, stacks: make(map[string]*profileStack),
+                 running: 1, quit: make(chan struct{}), done: make(chan struct{}),
+                 target: p.Pid}
+  p.profile = pr
+  go pr.tick()
+  return pr, nil
+}
+
+// Stop stops sampling. What was sampled can still be written.
+func (pr *Profile) Stop() {
+  if ! atomic.CompareAndSwapInt32(&pr.running, 1, 0) {
+    return
+  }
+  close(pr.quit)
+  <-pr.done
+  pr.Duration = time.Since(pr.Start)
+}
+
+// tick interrupts the target at the sampling frequency.
+func (pr *Profile) tick() {
+  defer close(pr.done)
+  ticker := time.NewTicker(pr.Period)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-pr.quit:
+      return
+    case <-ticker.C:
+      pr.mu.Lock()
+      if pr.ticking == 0 && pr.target != 0 {
+        if err := syscall.Tgkill(pr.proc.Pid, pr.target, syscall.SIGSTOP); err == nil {
+          pr.ticking = pr.target
+        }
+        // Otherwise the thread has exited, and another is picked when the
+        // event loop sees it go
+      }
+      pr.mu.Unlock()
+    }
+  }
+}
+
+// tickStop reports whether a SIGSTOP of thread t is the profiler's, and takes
+// the tick.
+func (pr *Profile) tickStop(t *Thread) bool {
+  if pr == nil {
+    return false
+  }
+  pr.mu.Lock()
+  defer pr.mu.Unlock()
+  if pr.ticking != t.Tid {
+    return false
+  }
+  pr.ticking = 0
+  return true
+}
+
+// merged is called when thread t is in a SIGSTOP that stopAll sent. If a
+// tick went to t as well and no other SIGSTOP is on its way, the two were
+// folded into one, and the tick is taken.
+func (pr *Profile) merged(t *Thread) {
+  if pr == nil {
+    return
+  }
+  pr.mu.Lock()
+  defer pr.mu.Unlock()
+  if pr.ticking == t.Tid && ! stopPending(pr.proc.Pid, t.Tid) {
+    pr.ticking = 0
+  }
+}
+
+// threadExited moves the ticks off thread tid, which has gone away.
+func (pr *Profile) threadExited(tid int) {
+  if pr == nil {
+    return
+  }
+  pr.mu.Lock()
+  defer pr.mu.Unlock()
+  if pr.ticking == tid {
+    pr.ticking = 0
+  }
+  if pr.target != tid {
+    return
+  }
+  pr.target = 0
+  for other := range pr.proc.Threads {
+    if pr.target == 0 || other < pr.target {
+      pr.target = other
+    }
+  }
+}
+
+// dropTick forgets the tick that's out, if any, and returns the thread it
+// went to.
+func (pr *Profile) dropTick() int {
+  if pr == nil {
+    return 0
+  }
+  pr.mu.Lock()
+  defer pr.mu.Unlock()
+  tid := pr.ticking
+  pr.ticking = 0
+  return tid
+}
+
+// sample stops all threads, t being stopped already, and counts their
+// stacks.
+func (pr *Profile) sample(t *Thread) {
+  if atomic.LoadInt32(&pr.running) == 0 {
+    return
+  }
+  p := pr.proc
+  pr.mu.Lock()
+  pr.target = t.Tid
+  pr.mu.Unlock()
+  stopped := p.stopAll()
+  defer p.resumeStopped(stopped)
+
+  pr.Samples++
+  refreshed := false
+  for _, th := range p.Threads {
+    if ! th.stopped {
+      continue
+    }
+    if pr.opts.OnCPU && blocked(p, th) {
+      continue
+    }
+    frames, err := p.Backtrace(th.Tid)
+    if ! refreshed && unmapped(frames) {
+      // Libraries have been loaded since the map was read
+      p.Memory.Refresh()
+      refreshed = true
+      frames, err = p.Backtrace(th.Tid)
+    }
+    if err != nil || len(frames) == 0 {
+      continue
+    }
+    key := stackKey(th.Tid, frames)
+    s, ok := pr.stacks[key]
+    if ! ok {
+      s = &profileStack{thread: th.Tid, frames: frames}
+      pr.stacks[key] = s
+    }
+    s.count++
+  }
+}
+
+// blocked reports whether thread t was stopped in the middle of a system call
+// that's waiting, which is left to be restarted.
+func blocked(p *Process, t *Thread) bool {
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil || int64(regs.Orig_rax) < 0 {
+    return false
+  }
+  switch -int64(regs.Rax) {
+  case 4, 512, 513, 514, 516:
+    // EINTR and the kernel's ERESTART codes
+    return true
+  }
+  return false
+}
+
+// unmapped reports whether any of the frames is outside the modules known.
+func unmapped(frames []Frame) bool {
+  for _, f := range frames {
+    if f.Module == "" {
+      return true
+    }
+  }
+  return false
+}
+
+func stackKey(tid int, frames []Frame) string {
+  var b strings.Builder
+  fmt.Fprintf(&b, "%d", tid)
+  for _, f := range frames {
+    fmt.Fprintf(&b, ":%x", f.PC)
+  }
+  return b.String()
+}
+
+// sortedStacks returns the stacks in a stable order.
+func (pr *Profile) sortedStacks() []*profileStack {
+  keys := make([]string, 0, len(pr.stacks))
+  for key := range pr.stacks {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  stacks := make([]*profileStack, len(keys))
+  for i, key := range keys {
+    stacks[i] = pr.stacks[key]
+  }
+  return stacks
+}
+
+// frameName is what to call a frame in a profile.
+func frameName(f Frame) string {
+  switch {
+  case f.Function != "":
+    return f.Function
+  case f.Module != "":
+    return fmt.Sprintf("%s+0x%x", f.Module, f.ModulePC)
+  }
+  return fmt.Sprintf("0x%x", f.PC)
+}
+
+// WriteFolded writes the stacks in the folded format of flamegraph.pl, the
+// outermost frame first, summed over threads.
+func (pr *Profile) WriteFolded(w io.Writer) error {
+  counts := make(map[string]int64)
+  for _, s := range pr.stacks {
+    names := make([]string, len(s.frames))
+    for i, f := range s.frames {
+      names[len(names)-1-i] = strings.Replace(frameName(f), ";", ":", -1)
+    }
+    counts[strings.Join(names, ";")] += s.count
+  }
+  lines := make([]string, 0, len(counts))
+  for stack := range counts {
+    lines = append(lines, stack)
+  }
+  sort.Strings(lines)
+
+  bw := bufio.NewWriter(w)
+  for _, stack := range lines {
+    fmt.Fprintf(bw, "%s %d\n", stack, counts[stack])
+  }
+  return bw.Flush()
+}
+
+// WritePprof writes the profile as a gzipped pprof protobuf, for go tool
+// pprof. Samples are labelled with their thread.
+func (pr *Profile) WritePprof(w io.Writer) error {
+  p := pr.proc
+  b := &pprofBuilder{strings: map[string]int64{"": 0}, table: []string{""},
+                     functions: make(map[string]uint64), locations: make(map[uint64]uint64),
+                     mappings: make(map[*Module]uint64)}
+
+  var msg protoBuffer
+  msg.message(1, b.valueType("samples", "count"))
+  msg.message(1, b.valueType("cpu", "nanoseconds"))
+  for _, s := range pr.sortedStacks() {
+    var sample protoBuffer
+    ids := make([]uint64, len(s.frames))
+    for i, f := range s.frames {
+      ids[i] = b.location(p, f, i == 0 || s.frames[i-1].Signal)
+    }
+    sample.packed(1, ids)
+    sample.packed(2, []uint64{uint64(s.count), uint64(s.count * int64(pr.Period))})
+    var label protoBuffer
+    label.uint(1, uint64(b.str("thread")))
+    label.uint(3, uint64(s.thread))
+    sample.message(3, &label)
+    msg.message(2, &sample)
+  }
+  for _, m := range b.mappingList {
+    msg.message(3, m)
+  }
+  for _, l := range b.locationList {
+    msg.message(4, l)
+  }
+  for _, f := range b.functionList {
+    msg.message(5, f)
+  }
+  for _, s := range b.table {
+    msg.bytes(6, []byte(s))
+  }
+  msg.uint(9, uint64(pr.Start.UnixNano()))
+  duration := pr.Duration
+  if duration == 0 {
+    duration = time.Since(pr.Start)
+  }
+  msg.uint(10, uint64(duration))
+  msg.message(11, b.valueType("cpu", "nanoseconds"))
+  msg.uint(12, uint64(pr.Period))
+
+  zw := gzip.NewWriter(w)
+  if _, err := zw.Write(msg.data); err != nil {
+    return err
+  }
+  return zw.Close()
+}
+
+// pprofBuilder gives the strings, functions, locations and mappings of a
+// pprof profile their ids.
+type pprofBuilder struct {
+  strings       map[string]int64
+  table         []string
+  functions     map[string]uint64
+  functionList  []*protoBuffer
+  locations     map[uint64]uint64
+  locationList  []*protoBuffer
+  mappings      map[*Module]uint64
+  mappingList   []*protoBuffer
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+  if i, ok := b.strings[s]; ok {
+    return i
+  }
+  i := int64(len(b.table))
+  b.strings[s] = i
+  b.table = append(b.table, s)
+  return i
+}
+
+func (b *pprofBuilder) valueType(typ, unit string) *protoBuffer {
+  var v protoBuffer
+  v.uint(1, uint64(b.str(typ)))
+  v.uint(2, uint64(b.str(unit)))
+  return &v
+}
+
+// location returns the id of the location of frame f. exact is set when its
+// PC isn't a return address.
+func (b *pprofBuilder) location(p *Process, f Frame, exact bool) uint64 {
+  if id, ok := b.locations[f.PC]; ok {
+    return id
+  }
+  id := uint64(len(b.locationList) + 1)
+  b.locations[f.PC] = id
+
+  var l protoBuffer
+  l.uint(1, id)
+  if m := p.ModuleAt(f.PC); m != nil {
+    l.uint(2, b.mapping(m))
+  }
+  l.uint(3, f.PC)
+  lookup := f.PC
+  if ! exact {
+    lookup--
+  }
+  file, line, _ := p.LineAt(lookup)
+  var ln protoBuffer
+  ln.uint(1, b.function(frameName(f), file))
+  ln.uint(2, uint64(line))
+  l.message(4, &ln)
+  b.locationList = append(b.locationList, &l)
+  return id
+}
+
+func (b *pprofBuilder) function(name, file string) uint64 {
+  key := name + "\x00" + file
+  if id, ok := b.functions[key]; ok {
+    return id
+  }
+  id := uint64(len(b.functionList) + 1)
+  b.functions[key] = id
+
+  var f protoBuffer
+  f.uint(1, id)
+  f.uint(2, uint64(b.str(name)))
+  f.uint(3, uint64(b.str(name)))
+  f.uint(4, uint64(b.str(file)))
+  b.functionList = append(b.functionList, &f)
+  return id
+}
+
+func (b *pprofBuilder) mapping(m *Module) uint64 {
+  if id, ok := b.mappings[m]; ok {
+    return id
+  }
+  id := uint64(len(b.mappingList) + 1)
+  b.mappings[m] = id
+
+  var mp protoBuffer
+  mp.uint(1, id)
+  mp.uint(2, m.Start)
+  mp.uint(3, m.End)
+  mp.uint(5, uint64(b.str(m.Path)))
+  // The functions, files and lines are all there already
+  for field := 7; field <= 9; field++ {
+    mp.uint(field, 1)
+  }
+  b.mappingList = append(b.mappingList, &mp)
+  return id
+}
+
+// protoBuffer encodes a protobuf message, enough of the wire format for
+// pprof. Zero values are left out, as proto3 does.
+type protoBuffer struct {
+  data  []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+  for x >= 0x80 {
+    b.data = append(b.data, byte(x) | 0x80)
+    x >>= 7
+  }
+  b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+  b.varint(uint64(field) << 3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint(field int, x uint64) {
+  if x == 0 {
+    return
+  }
+  b.key(field, 0)
+  b.varint(x)
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+  b.key(field, 2)
+  b.varint(uint64(len(data)))
+  b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+  var inner protoBuffer
+  for _, x := range xs {
+    inner.varint(x)
+  }
+  b.bytes(field, inner.data)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+  b.bytes(field, m.data)
+}
@@ -0,0 +1,288 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "compress/gzip"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+)
+
+// protoField is a field of an encoded protobuf message, with its value as a
+// number or as bytes by wire type.
+type protoField struct {
+  num   int
+  x     uint64
+  data  []byte
+}
+
+func decodeProto(t *testing.T, data []byte) []protoField {
+  fields := []protoField{}
+  for len(data) > 0 {
+    key, n := binary.Uvarint(data)
+    if n <= 0 {
+      t.Fatalf("bad key at %x", data)
+    }
+    data = data[n:]
+    f := protoField{num: int(key >> 3)}
+    switch key & 7 {
+    case 0:
+      if f.x, n = binary.Uvarint(data); n <= 0 {
+        t.Fatalf("bad varint in field %d", f.num)
+      }
+      data = data[n:]
+    case 2:
+      size, n := binary.Uvarint(data)
+      if n <= 0 || uint64(len(data) - n) < size {
+        t.Fatalf("bad length in field %d", f.num)
+      }
+      f.data = data[n:n + int(size)]
+      data = data[n + int(size):]
+    default:
+      t.Fatalf("unexpected wire type %d in field %d", key & 7, f.num)
+    }
+    fields = append(fields, f)
+  }
+  return fields
+}
+
+func decodePacked(t *testing.T, data []byte) []uint64 {
+  xs := []uint64{}
+  for len(data) > 0 {
+    x, n := binary.Uvarint(data)
+    if n <= 0 {
+      t.Fatalf("bad packed varint")
+    }
+    xs = append(xs, x)
+    data = data[n:]
+  }
+  return xs
+}
+
+// protoValues returns the numbers in fields, by field number.
+func protoValues(fields []protoField) map[int]uint64 {
+  values := make(map[int]uint64)
+  for _, f := range fields {
+    values[f.num] = f.x
+  }
+  return values
+}
+
+func TestWritePprof(t *testing.T) {
+  m := &Module{Path: "/bin/app", Start: 0x400000, End: 0x401000, Bias: 0x400000}
+  m.lines = &lineTable{rows: []lineRow{
+    {Address: 0x100, File: "app.c", Line: 10},
+    {Address: 0x110, File: "app.c", Line: 20},
+    {Address: 0x120, End: true},
+  }}
+  memory := &MemoryMap{}
+  p := &Process{Memory: memory, modules: []*Module{m}, modulesMap: memory}
+
+  hot := Frame{PC: 0x400105, Module: "app", Function: "hot"}
+  main := Frame{PC: 0x400115, Module: "app", Function: "main"}
+  unknown := Frame{PC: 0x7f0000001000}
+  pr := &Profile{Start: time.Unix(1000, 0), Duration: 2 * time.Second,
+                 Period: 10 * time.Millisecond, proc: p,
+                 stacks: make(map[string]*profileStack)}
+  for _, s := range []*profileStack{
+    {thread: 100, frames: []Frame{hot, main}, count: 3},
+    {thread: 101, frames: []Frame{hot, unknown}, count: 2},
+    {thread: 100, frames: []Frame{main}, count: 1},
+  } {
+    pr.stacks[stackKey(s.thread, s.frames)] = s
+  }
+
+  var buf bytes.Buffer
+  if err := pr.WritePprof(&buf); err != nil {
+    t.Fatal(err)
+  }
+  zr, err := gzip.NewReader(&buf)
+  if err != nil {
+    t.Fatal(err)
+  }
+  data, err := io.ReadAll(zr)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  fields := decodeProto(t, data)
+  table := []string{}
+  for _, f := range fields {
+    if f.num == 6 {
+      table = append(table, string(f.data))
+    }
+  }
+  if len(table) == 0 || table[0] != "" {
+    t.Fatalf("string table %q doesn't start with the empty string", table)
+  }
+  str := func(i uint64) string {
+    if i >= uint64(len(table)) {
+      t.Fatalf("string %d is past the end of the table", i)
+    }
+    return table[i]
+  }
+
+  // Functions and mappings first, as locations refer to them
+  functions := make(map[uint64]string)
+  mappings := make(map[uint64]string)
+  for _, f := range fields {
+    switch f.num {
+    case 5:
+      v := protoValues(decodeProto(t, f.data))
+      if v[1] == 0 || functions[v[1]] != "" {
+        t.Errorf("function id %d is zero or taken", v[1])
+      }
+      functions[v[1]] = str(v[2]) + "@" + str(v[4])
+    case 3:
+      v := protoValues(decodeProto(t, f.data))
+      if v[1] == 0 || mappings[v[1]] != "" {
+        t.Errorf("mapping id %d is zero or taken", v[1])
+      }
+      mappings[v[1]] = fmt.Sprintf("%s %x-%x", str(v[5]), v[2], v[3])
+    }
+  }
+
+  // A location is its function, line and mapping
+  locations := make(map[uint64]string)
+  for _, f := range fields {
+    if f.num != 4 {
+      continue
+    }
+    var id, mapping, addr uint64
+    var line string
+    for _, lf := range decodeProto(t, f.data) {
+      switch lf.num {
+      case 1:
+        id = lf.x
+      case 2:
+        mapping = lf.x
+      case 3:
+        addr = lf.x
+      case 4:
+        v := protoValues(decodeProto(t, lf.data))
+        fn, ok := functions[v[1]]
+        if ! ok {
+          t.Errorf("location %d refers to missing function %d", id, v[1])
+        }
+        line = fmt.Sprintf("%s:%d", fn, v[2])
+      }
+    }
+    if id == 0 || locations[id] != "" {
+      t.Errorf("location id %d is zero or taken", id)
+    }
+    s := fmt.Sprintf("%x %s", addr, line)
+    if mapping != 0 {
+      mp, ok := mappings[mapping]
+      if ! ok {
+        t.Errorf("location %d refers to missing mapping %d", id, mapping)
+      }
+      s += " in " + mp
+    }
+    locations[id] = s
+  }
+
+  wantLocations := []string{
+    "400105 hot@app.c:10 in /bin/app 400000-401000",
+    "400115 main@app.c:20 in /bin/app 400000-401000",
+    "7f0000001000 0x7f0000001000@:0",
+  }
+  gotLocations := []string{}
+  for _, l := range locations {
+    gotLocations = append(gotLocations, l)
+  }
+  sort.Strings(gotLocations)
+  if strings.Join(gotLocations, "\n") != strings.Join(wantLocations, "\n") {
+    t.Errorf("locations are\n%s\nwant\n%s", strings.Join(gotLocations, "\n"),
+             strings.Join(wantLocations, "\n"))
+  }
+
+  // Samples, as thread:stack, innermost first
+  samples := make(map[string][]uint64)
+  types := []string{}
+  v := protoValues(fields)
+  for _, f := range fields {
+    switch f.num {
+    case 1:
+      st := protoValues(decodeProto(t, f.data))
+      types = append(types, str(st[1]) + "/" + str(st[2]))
+    case 2:
+      var names []string
+      var values []uint64
+      thread := ""
+      for _, sf := range decodeProto(t, f.data) {
+        switch sf.num {
+        case 1:
+          for _, id := range decodePacked(t, sf.data) {
+            l, ok := locations[id]
+            if ! ok {
+              t.Errorf("sample refers to missing location %d", id)
+            }
+            names = append(names, strings.Fields(l)[1])
+          }
+        case 2:
+          values = decodePacked(t, sf.data)
+        case 3:
+          label := protoValues(decodeProto(t, sf.data))
+          thread = fmt.Sprintf("%s=%d", str(label[1]), label[3])
+        }
+      }
+      samples[thread + ":" + strings.Join(names, ";")] = values
+    }
+  }
+
+  if strings.Join(types, ",") != "samples/count,cpu/nanoseconds" {
+    t.Errorf("sample types are %v", types)
+  }
+  period := uint64(10 * time.Millisecond)
+  wantSamples := map[string][]uint64{
+    "thread=100:hot@app.c:10;main@app.c:20": {3, 3 * period},
+    "thread=101:hot@app.c:10;0x7f0000001000@:0": {2, 2 * period},
+    "thread=100:main@app.c:20": {1, period},
+  }
+  if len(samples) != len(wantSamples) {
+    t.Errorf("got %d samples, want %d: %v", len(samples), len(wantSamples), samples)
+  }
+  for key, want := range wantSamples {
+    if got := samples[key]; fmt.Sprint(got) != fmt.Sprint(want) {
+      t.Errorf("sample %s has values %v, want %v", key, got, want)
+    }
+  }
+
+  if v[9] != uint64(pr.Start.UnixNano()) || v[10] != uint64(2 * time.Second) ||
+     v[12] != period {
+    t.Errorf("time %d, duration %d, period %d", v[9], v[10], v[12])
+  }
+}
@@ -0,0 +1,343 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "unicode/utf16"
+)
+
+// searchChunk is how much of a region is read at a time while searching, so
+// scanning a large heap never holds more than this in memory.
+const searchChunk = 1 << 20
+
+// Pattern is a byte sequence to look for in the target. Where Mask is set,
+// only the bits set in the corresponding mask byte have to match; a nil Mask
+// means every byte must match exactly.
+type Pattern struct {
+  Bytes  []byte
+  Mask   []byte
+}
+
+// ExactPattern matches b byte for byte.
+func ExactPattern(b []byte) *Pattern {
+  return &Pattern{Bytes: b}
+}
+
+// StringPattern matches the UTF-8 encoding of s, without a terminator.
+func StringPattern(s string) *Pattern {
+  return &Pattern{Bytes: []byte(s)}
+}
+
+// UTF16Pattern matches the UTF-16 encoding of s in the given byte order,
+// without a terminator.
+func UTF16Pattern(s string, order binary.ByteOrder) *Pattern {
+  units := utf16.Encode([]rune(s))
+  b := make([]byte, 2*len(units))
+  for i, u := range units {
+    order.PutUint16(b[2*i:], u)
+  }
+  return &Pattern{Bytes: b}
+}
+
+// IntegerPattern matches v stored as a size-byte integer (1, 2, 4 or 8) in
+// the given byte order.
+func IntegerPattern(v uint64, size int, order binary.ByteOrder) (*Pattern, error) {
+  b := make([]byte, 8)
+  switch size {
+  case 1: b[0] = uint8(v)
+  case 2: order.PutUint16(b, uint16(v))
+  case 4: order.PutUint32(b, uint32(v))
+  case 8: order.PutUint64(b, v)
+  default:
+    return nil, fmt.Errorf("unsupported integer size %d", size)
+  }
+  return &Pattern{Bytes: b[:size]}, nil
+}
+
+// ParseSignature parses an IDA-style byte signature such as "48 8b ?? ?? 00".
+// Each token is two hex digits; "??" (or "?") matches any byte, and a single
+// '?' digit, as in "4?", matches any value of that nibble.
+func ParseSignature(sig string) (*Pattern, error) {
+  tokens := strings.Fields(sig)
+  if len(tokens) == 0 {
+    return nil, errors.New("empty signature")
+  }
+
+  pat := &Pattern{make([]byte, len(tokens)), make([]byte, len(tokens))}
+  for i, tok := range tokens {
+    if tok == "?" {
+      tok = "??"
+    }
+    if len(tok) != 2 {
+      return nil, fmt.Errorf("bad signature byte %q", tok)
+    }
+    var value, mask byte
+    for _, c := range tok {
+      value, mask = value<<4, mask<<4
+      if c == '?' {
+        continue
+      }
+      nibble, err := strconv.ParseUint(string(c), 16, 8)
+      if err != nil {
+        return nil, fmt.Errorf("bad signature byte %q", tok)
+      }
+      value |= byte(nibble)
+      mask |= 0xf
+    }
+    pat.Bytes[i], pat.Mask[i] = value, mask
+  }
+  return pat, nil
+}
+
+func (pat *Pattern) matchAt(buf []byte) bool {
+  for i, b := range pat.Bytes {
+    if (buf[i] ^ b) & pat.Mask[i] != 0 {
+      return false
+    }
+  }
+  return true
+}
+
+// index returns the offset of the first match in buf, or -1.
+func (pat *Pattern) index(buf []byte) int {
+  if pat.Mask == nil {
+    return bytes.Index(buf, pat.Bytes)
+  }
+
+  // Use the first fully specified byte to skip ahead quickly
+  anchor := -1
+  for i, m := range pat.Mask {
+    if m == 0xff {
+      anchor = i
+      break
+    }
+  }
+
+  n := len(pat.Bytes)
+  for i := 0; i+n <= len(buf); i++ {
+    if anchor >= 0 {
+      j := bytes.IndexByte(buf[i+anchor:len(buf)-n+anchor+1], pat.Bytes[anchor])
+      if j < 0 {
+        return -1
+      }
+      i += j
+    }
+    if pat.matchAt(buf[i:]) {
+      return i
+    }
+  }
+  return -1
+}
+
+// SearchOptions restricts which memory a search looks at. The zero value
+// searches every readable region.
+type SearchOptions struct {
+  // Perms lists permissions a region must have; PermRead is always implied
+  Perms     Permissions
+  // Pathname limits the search to regions mapped from this file, given as
+  // a full path or a base name
+  Pathname  string
+  // Regions, when set, is searched instead of the process' memory map
+  Regions   []MemoryRegion
+  // Align only reports matches at addresses that are a multiple of it
+  Align     int
+  // Limit stops the search after that many matches
+  Limit     int
+}
+
+func (opts *SearchOptions) selects(r MemoryRegion) bool {
+  want := opts.Perms | PermRead
+  if r.Perms & want != want {
+    return false
+  }
+  if opts.Pathname != "" && r.Pathname != opts.Pathname &&
+     filepath.Base(r.Pathname) != opts.Pathname {
+    return false
+  }
+  return true
+}
+
+// SearchMatch is a single search hit
+type SearchMatch struct {
+  Address  uint64
+  Region   MemoryRegion
+}
+
+// SearchScanner walks the target's memory one chunk at a time, yielding each
+// match as it's found. Use it like a bufio.Scanner:
+//
+//   s := p.Search(pat, nil)
+//   for s.Next() {
+//     fmt.Printf("%x\n", s.Match().Address)
+//   }
+//   if s.Err() != nil { ... }
+//
+// Regions that turn out to be unreadable, such as guard pages, are skipped.
+type SearchScanner struct {
+  proc     *Process
+  pattern  *Pattern
+  opts      SearchOptions
+  regions []MemoryRegion
+  region    int       // index into regions of the region being read
+  next      uint64    // next address to read from that region
+  buf     []byte      // current window of target memory
+  base      uint64    // address of buf[0]
+  pos       int       // offset in buf to resume matching from
+  match     SearchMatch
+  found     int
+  err       error
+}
+
+// Search starts a search for pattern. opts may be nil. The process must stay
+// stopped while the scanner is in use.
+func (p *Process) Search(pattern *Pattern, opts *SearchOptions) *SearchScanner {
+  s := &SearchScanner{proc: p, pattern: pattern}
+  if opts != nil {
+    s.opts = *opts
+  }
+
+  if pattern == nil || len(pattern.Bytes) == 0 {
+    s.err = errors.New("empty search pattern")
+    return s
+  }
+  if pattern.Mask != nil && len(pattern.Mask) != len(pattern.Bytes) {
+    s.err = errors.New("search pattern mask doesn't match its length")
+    return s
+  }
+
+  candidates := s.opts.Regions
+  if candidates == nil {
+    candidates = p.Memory.Regions
+  }
+  for _, r := range candidates {
+    if s.opts.selects(r) {
+      s.regions = append(s.regions, r)
+    }
+  }
+  if len(s.regions) > 0 {
+    s.next = s.regions[0].Address
+  }
+  return s
+}
+
+// Next advances to the next match, returning false when the search is over
+// or has failed.
+func (s *SearchScanner) Next() bool {
+  if s.err != nil || (s.opts.Limit > 0 && s.found >= s.opts.Limit) {
+    return false
+  }
+
+  for {
+    if i := s.pattern.index(s.buf[s.pos:]); i >= 0 {
+      addr := s.base + uint64(s.pos+i)
+      s.pos += i + 1
+      if s.opts.Align > 1 && addr % uint64(s.opts.Align) != 0 {
+        continue
+      }
+      s.match = SearchMatch{addr, s.regions[s.region]}
+      s.found++
+      return true
+    }
+    if ! s.fill() {
+      return false
+    }
+  }
+}
+
+// fill reads the next chunk of memory into the window, keeping the tail of
+// the previous chunk so matches straddling the two are still found.
+func (s *SearchScanner) fill() bool {
+  for s.region < len(s.regions) {
+    r := s.regions[s.region]
+    if s.next >= r.End() {
+      s.region++
+      s.buf, s.pos = nil, 0
+      if s.region < len(s.regions) {
+        s.next = s.regions[s.region].Address
+      }
+      continue
+    }
+
+    keep := len(s.buf) - (len(s.pattern.Bytes) - 1)
+    if keep < s.pos {
+      keep = s.pos
+    }
+    if keep > len(s.buf) {
+      keep = len(s.buf)
+    }
+    tail := s.buf[keep:]
+
+    start := s.next
+    size := r.End() - start
+    if size > searchChunk {
+      size = searchChunk
+    }
+    buf := make([]byte, len(tail) + int(size))
+    copy(buf, tail)
+    n, err := s.proc.ReadMemory(start, buf[len(tail):])
+    s.next = start + size
+    if err != nil {
+      var merr *MemoryError
+      if errors.As(err, &merr) && merr.Err == errRunning {
+        s.err = err
+        return false
+      }
+      // Give up on the rest of an unreadable region
+      s.next = r.End()
+    }
+
+    if len(tail) > 0 {
+      s.base += uint64(keep)
+    } else {
+      s.base = start
+    }
+    s.buf = buf[:len(tail)+n]
+    s.pos = 0
+    return true
+  }
+  return false
+}
+
+// Match returns the most recent match found by Next.
+func (s *SearchScanner) Match() SearchMatch {
+  return s.match
+}
+
+// Err returns the error that ended the search, if any.
+func (s *SearchScanner) Err() error {
+  return s.err
+}
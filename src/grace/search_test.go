@@ -0,0 +1,236 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/binary"
+  "syscall"
+  "testing"
+)
+
+// memBackend is a target whose memory is a single buffer at base.
+type memBackend struct {
+  base  uint64
+  data  []byte
+}
+
+func (b *memBackend) readMemory(addr uint64, buf []byte) (int, error) {
+  if addr < b.base || addr >= b.base + uint64(len(b.data)) {
+    return 0, syscall.EFAULT
+  }
+  n := copy(buf, b.data[addr-b.base:])
+  if n < len(buf) {
+    return n, syscall.EFAULT
+  }
+  return n, nil
+}
+
+func (b *memBackend) writeMemory(addr uint64, buf []byte) (int, error) {
+  return 0, errReadOnly
+}
+
+func (b *memBackend) getRegisters(tid int) (*RegisterState, error) {
+  return nil, syscall.ESRCH
+}
+
+func (b *memBackend) setRegisters(tid int, regs *RegisterState) error {
+  return errReadOnly
+}
+
+func (b *memBackend) live() bool {
+  return false
+}
+
+func (b *memBackend) close() {
+}
+
+func TestParseSignature(t *testing.T) {
+  tests := []struct {
+    sig    string
+    bytes  []byte
+    mask   []byte
+  }{
+    {"48 8b ?? ?? 00", []byte{0x48, 0x8b, 0, 0, 0}, []byte{0xff, 0xff, 0, 0, 0xff}},
+    {"E8 ? ? ? ?", []byte{0xe8, 0, 0, 0, 0}, []byte{0xff, 0, 0, 0, 0}},
+    {"4? ?f", []byte{0x40, 0x0f}, []byte{0xf0, 0x0f}},
+    {"  c3\t", []byte{0xc3}, []byte{0xff}},
+  }
+  for _, test := range tests {
+    pat, err := ParseSignature(test.sig)
+    if err != nil {
+      t.Errorf("ParseSignature(%q): %v", test.sig, err)
+      continue
+    }
+    if ! bytes.Equal(pat.Bytes, test.bytes) || ! bytes.Equal(pat.Mask, test.mask) {
+      t.Errorf("ParseSignature(%q) = % x / % x, want % x / % x", test.sig,
+               pat.Bytes, pat.Mask, test.bytes, test.mask)
+    }
+  }
+
+  for _, sig := range []string{"", "   ", "4", "123", "zz", "4g", "48 8b ???", "0x48"} {
+    if _, err := ParseSignature(sig); err == nil {
+      t.Errorf("ParseSignature(%q) succeeded", sig)
+    }
+  }
+}
+
+func TestPatternIndex(t *testing.T) {
+  buf := []byte{0x00, 0x48, 0x89, 0xe5, 0x48, 0x8b, 0x45, 0x10, 0x4c, 0x8b, 0x05}
+  tests := []struct {
+    sig   string
+    want  int
+  }{
+    {"48 8b", 4},
+    {"48 ?? 45", 4},
+    {"4? 8b", 4},
+    {"?? 8b 05", 8},
+    {"?? ?? e5", 1},
+    {"?c 8b", 8},
+    {"48 8b 46", -1},
+    {"05 ??", -1},
+    {"??", 0},
+  }
+  for _, test := range tests {
+    pat, err := ParseSignature(test.sig)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if got := pat.index(buf); got != test.want {
+      t.Errorf("index(%q) = %d, want %d", test.sig, got, test.want)
+    }
+  }
+
+  if got := ExactPattern([]byte{0x45, 0x10}).index(buf); got != 6 {
+    t.Errorf("exact index = %d, want 6", got)
+  }
+}
+
+func TestUTF16Pattern(t *testing.T) {
+  pat := UTF16Pattern("hé\U0001f600", binary.LittleEndian)
+  want := []byte{'h', 0, 0xe9, 0, 0x3d, 0xd8, 0x00, 0xde}
+  if ! bytes.Equal(pat.Bytes, want) {
+    t.Errorf("little endian = % x, want % x", pat.Bytes, want)
+  }
+  pat = UTF16Pattern("hi", binary.BigEndian)
+  if want := []byte{0, 'h', 0, 'i'}; ! bytes.Equal(pat.Bytes, want) {
+    t.Errorf("big endian = % x, want % x", pat.Bytes, want)
+  }
+}
+
+func TestIntegerPattern(t *testing.T) {
+  tests := []struct {
+    size   int
+    order  binary.ByteOrder
+    want   []byte
+  }{
+    {1, binary.LittleEndian, []byte{0x08}},
+    {2, binary.LittleEndian, []byte{0x08, 0x07}},
+    {4, binary.BigEndian, []byte{0x06, 0x05, 0x07, 0x08}},
+    {8, binary.LittleEndian, []byte{0x08, 0x07, 0x05, 0x06, 0x04, 0x03, 0x02, 0x01}},
+  }
+  for _, test := range tests {
+    pat, err := IntegerPattern(0x0102030406050708, test.size, test.order)
+    if err != nil {
+      t.Errorf("size %d: %v", test.size, err)
+      continue
+    }
+    if ! bytes.Equal(pat.Bytes, test.want) {
+      t.Errorf("size %d = % x, want % x", test.size, pat.Bytes, test.want)
+    }
+  }
+  for _, size := range []int{0, 3, 16} {
+    if _, err := IntegerPattern(1, size, binary.LittleEndian); err == nil {
+      t.Errorf("size %d succeeded", size)
+    }
+  }
+}
+
+func TestSearchChunkBoundary(t *testing.T) {
+  const base = 0x10000
+  data := make([]byte, 3*searchChunk)
+  needle := []byte{0xde, 0xad, 0xbe, 0xef}
+  want := []uint64{base + searchChunk - 2, base + 2*searchChunk - 1, base + 3*searchChunk - 4}
+  for _, addr := range want {
+    copy(data[addr-base:], needle)
+  }
+  p := &Process{target: &memBackend{base, data}}
+  regions := []MemoryRegion{{Address: base, Size: uint64(len(data)), Perms: PermRead}}
+
+  masked, err := ParseSignature("de ?? be ef")
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, pat := range []*Pattern{ExactPattern(needle), masked} {
+    s := p.Search(pat, &SearchOptions{Regions: regions})
+    var got []uint64
+    for s.Next() {
+      got = append(got, s.Match().Address)
+    }
+    if s.Err() != nil {
+      t.Fatal(s.Err())
+    }
+    if len(got) != len(want) {
+      t.Fatalf("found %x, want %x", got, want)
+    }
+    for i := range got {
+      if got[i] != want[i] {
+        t.Errorf("match %d at 0x%x, want 0x%x", i, got[i], want[i])
+      }
+    }
+  }
+
+  s := p.Search(ExactPattern(needle), &SearchOptions{Regions: regions, Align: 2, Limit: 1})
+  if ! s.Next() || s.Match().Address != want[0] {
+    t.Errorf("aligned search found 0x%x, want 0x%x", s.Match().Address, want[0])
+  }
+  if s.Next() {
+    t.Errorf("search went past its limit, to 0x%x", s.Match().Address)
+  }
+}
+
+func TestSearchUnreadable(t *testing.T) {
+  const base = 0x10000
+  data := make([]byte, 0x2000)
+  copy(data[0x1800:], "needle")
+  p := &Process{target: &memBackend{base, data}}
+  regions := []MemoryRegion{
+    {Address: 0x1000, Size: 0x1000, Perms: PermRead},
+    {Address: base, Size: uint64(len(data)), Perms: PermRead},
+    {Address: base + 0x4000, Size: 0x1000},
+  }
+  s := p.Search(StringPattern("needle"), &SearchOptions{Regions: regions})
+  if ! s.Next() || s.Match().Address != base + 0x1800 {
+    t.Errorf("found 0x%x, want 0x%x", s.Match().Address, base + 0x1800)
+  }
+  if s.Next() || s.Err() != nil {
+    t.Errorf("unexpected match 0x%x or error %v", s.Match().Address, s.Err())
+  }
+}
@@ -0,0 +1,277 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "compress/gzip"
+  "encoding/gob"
+  "errors"
+  "fmt"
+  "os"
+  "sort"
+  "time"
+)
+
+// Snapshot holds the contents of a set of memory regions at one point in
+// time. Snapshots can be saved to disk and compared later, possibly against
+// one taken in another run of the same binary.
+type Snapshot struct {
+  Pid       int
+  // Filename and Bias identify the executable and where it was loaded, so
+  // that changes can be matched against its debug symbols
+  Filename  string
+  Bias      uint64
+  Time      time.Time
+  Regions []SnapshotRegion
+  // Skipped are the regions asked for that nothing could be read from
+  Skipped []MemoryRegion
+}
+
+// snapshotChunk is how much of a region is read at a time, so a large
+// mapping that can't be read in full costs no more than what's there.
+const snapshotChunk = 1 << 20
+
+// SnapshotRegion is a region and the bytes it held. Data can be shorter than
+// the region if only part of it was readable.
+type SnapshotRegion struct {
+  MemoryRegion
+  Data  []byte
+}
+
+// MemoryChange is a range of bytes that differ between two snapshots. For a
+// region that only exists in one of them, Old or New is nil.
+type MemoryChange struct {
+  Address  uint64
+  Old      []byte
+  New      []byte
+  // Symbol names the DWARF variable covering Address, e.g. "counter+0x4",
+  // or is empty if there isn't one
+  Symbol   string
+}
+
+func (c MemoryChange) String() string {
+  size := len(c.New)
+  if size == 0 {
+    size = len(c.Old)
+  }
+  where := fmt.Sprintf("0x%x", c.Address)
+  if c.Symbol != "" {
+    where += " <" + c.Symbol + ">"
+  }
+  return fmt.Sprintf("%s (%d bytes): % x -> % x", where, size, c.Old, c.New)
+}
+
+// Snapshot captures the contents of the given regions. Without arguments it
+// captures every readable, writable region, which is where a function's state
+// would live. A region is captured up to the first byte that can't be read,
+// and one that can't be read at all is listed in Skipped.
+func (p *Process) Snapshot(regions ...MemoryRegion) (*Snapshot, error) {
+  if len(regions) == 0 {
+    for _, r := range p.Memory.Regions {
+      if r.Perms & (PermRead|PermWrite) == PermRead|PermWrite && r.Kind != Vvar {
+        regions = append(regions, r)
+      }
+    }
+  }
+
+  snap := &Snapshot{
+    Pid:      p.Pid,
+    Filename: p.Filename,
+    Bias:     p.loadBias(),
+    Time:     time.Now(),
+  }
+  for _, r := range regions {
+    data, err := p.readRegion(r)
+    if err != nil {
+      return nil, err
+    }
+    if len(data) == 0 {
+      snap.Skipped = append(snap.Skipped, r)
+      continue
+    }
+    snap.Regions = append(snap.Regions, SnapshotRegion{r, data})
+  }
+  return snap, nil
+}
+
+// readRegion reads r a chunk at a time until the end or the first byte that
+// can't be read. The only error is the process running.
+func (p *Process) readRegion(r MemoryRegion) ([]byte, error) {
+  var data []byte
+  chunk := make([]byte, snapshotChunk)
+  for addr := r.Address; addr < r.End(); {
+    size := r.End() - addr
+    if size > snapshotChunk {
+      size = snapshotChunk
+    }
+    n, err := p.ReadMemory(addr, chunk[:size])
+    data = append(data, chunk[:n]...)
+    addr += uint64(n)
+    if err != nil {
+      var merr *MemoryError
+      if errors.As(err, &merr) && merr.Err == errRunning {
+        return nil, err
+      }
+      break
+    }
+  }
+  return data, nil
+}
+
+// Save writes the snapshot to path in a compressed binary format that
+// LoadSnapshot understands.
+func (s *Snapshot) Save(path string) error {
+  f, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  z := gzip.NewWriter(f)
+  if err := gob.NewEncoder(z).Encode(s); err != nil {
+    return err
+  }
+  if err := z.Close(); err != nil {
+    return err
+  }
+  return f.Close()
+}
+
+// LoadSnapshot reads a snapshot written by Save.
+func LoadSnapshot(path string) (*Snapshot, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+
+  z, err := gzip.NewReader(f)
+  if err != nil {
+    return nil, err
+  }
+  snap := new(Snapshot)
+  if err := gob.NewDecoder(z).Decode(snap); err != nil {
+    return nil, err
+  }
+  return snap, nil
+}
+
+// Diff reports the byte ranges that differ between snapshots a and b, in
+// address order. Regions are paired up by start address. Changed bytes less
+// than a word apart are reported as one range. If syms is not nil, each
+// change is labelled with the variable that covers it, relocated by b's load
+// bias.
+func Diff(a, b *Snapshot, syms *SymbolTable) []MemoryChange {
+  changes := []MemoryChange{}
+
+  old := make(map[uint64]SnapshotRegion)
+  for _, r := range a.Regions {
+    old[r.Address] = r
+  }
+  seen := make(map[uint64]bool)
+
+  for _, r := range b.Regions {
+    seen[r.Address] = true
+    prev, ok := old[r.Address]
+    if ! ok {
+      changes = append(changes, MemoryChange{Address: r.Address, New: r.Data})
+      continue
+    }
+    changes = append(changes, diffBytes(r.Address, prev.Data, r.Data)...)
+  }
+  for _, r := range a.Regions {
+    if ! seen[r.Address] {
+      changes = append(changes, MemoryChange{Address: r.Address, Old: r.Data})
+    }
+  }
+
+  sort.Slice(changes, func(i, j int) bool {
+    return changes[i].Address < changes[j].Address
+  })
+  if syms != nil {
+    for i := range changes {
+      changes[i].Symbol = symbolizeData(syms, changes[i].Address - b.Bias)
+    }
+  }
+  return changes
+}
+
+// diffBytes compares two copies of the same region. Whatever one has past the
+// end of the other counts as changed.
+func diffBytes(base uint64, old, fresh []byte) []MemoryChange {
+  changes := []MemoryChange{}
+  n := len(old)
+  if len(fresh) < n {
+    n = len(fresh)
+  }
+
+  for i := 0; i < n; {
+    if old[i] == fresh[i] {
+      i++
+      continue
+    }
+    // Extend the run until a word's worth of bytes match again
+    end, same := i+1, 0
+    for j := i+1; j < n && same < wordSize; j++ {
+      if old[j] == fresh[j] {
+        same++
+      } else {
+        end, same = j+1, 0
+      }
+    }
+    changes = append(changes, MemoryChange{
+      Address: base + uint64(i),
+      Old:     old[i:end],
+      New:     fresh[i:end],
+    })
+    i = end
+  }
+
+  if len(old) != len(fresh) {
+    changes = append(changes, MemoryChange{
+      Address: base + uint64(n),
+      Old:     old[n:],
+      New:     fresh[n:],
+    })
+  }
+  return changes
+}
+
+// symbolizeData names the variable covering the link-time address addr.
+func symbolizeData(syms *SymbolTable, addr uint64) string {
+  v, ok := syms.VariableAt(addr)
+  if ! ok {
+    return ""
+  }
+  if addr == v.Address {
+    return v.Name
+  }
+  return fmt.Sprintf("%s+0x%x", v.Name, addr - v.Address)
+}
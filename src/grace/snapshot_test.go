@@ -0,0 +1,61 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "testing"
+)
+
+func TestSnapshotUnreadable(t *testing.T) {
+  const base = 0x100000
+  data := make([]byte, snapshotChunk + 0x1000)
+  for i := range data {
+    data[i] = byte(i)
+  }
+  p := &Process{Memory: &MemoryMap{}, target: &memBackend{base, data}}
+
+  whole := MemoryRegion{Address: base, Size: uint64(len(data)), Perms: PermRead}
+  partial := MemoryRegion{Address: base + 0x1000, Size: uint64(len(data)), Perms: PermRead}
+  reserved := MemoryRegion{Address: 0x40000000, Size: 1 << 40}
+  snap, err := p.Snapshot(whole, partial, reserved)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(snap.Regions) != 2 || len(snap.Skipped) != 1 || snap.Skipped[0] != reserved {
+    t.Fatalf("got %d regions, skipped %v", len(snap.Regions), snap.Skipped)
+  }
+  if ! bytes.Equal(snap.Regions[0].Data, data) {
+    t.Errorf("whole region read %d bytes, want %d", len(snap.Regions[0].Data), len(data))
+  }
+  if ! bytes.Equal(snap.Regions[1].Data, data[0x1000:]) {
+    t.Errorf("partial region read %d bytes, want %d", len(snap.Regions[1].Data), len(data) - 0x1000)
+  }
+}
@@ -0,0 +1,543 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import "syscall"
+
+// StepReason says why a step ended
+type StepReason int
+
+const (
+  // StepDone is a step that got where it was going
+  StepDone StepReason = iota
+  // StepBreakpoint is a step that ran into a breakpoint. The thread is left
+  // at the breakpoint's address, so its callback runs once the process is
+  // continued.
+  StepBreakpoint
+  // StepSignal is a step cut short by a fatal signal, which stays queued for
+  // the event loop to handle
+  StepSignal
+  // StepExited is a step during which the thread, or the whole process,
+  // went away
+  StepExited
+)
+
+func (r StepReason) String() string {
+  switch r {
+  case StepDone:
+    return "done"
+  case StepBreakpoint:
+    return "breakpoint"
+  case StepSignal:
+    return "signal"
+  case StepExited:
+    return "exited"
+  }
+  return "unknown"
+}
+
+// StepResult describes where a step ended up.
+type StepResult struct {
+  Reason      StepReason
+  // Thread is the thread that stopped, which is the stepping one unless
+  // another thread hit a breakpoint or got a fatal signal
+  Thread      int
+  PC          uint64
+  // File and Line are where PC is in the source, if that's known
+  File        string
+  Line        int
+  Breakpoint *Breakpoint
+  // Signal is the fatal signal, or the one that killed the process
+  Signal      syscall.Signal
+  ExitStatus  int
+}
+
+const errPendingStop = TracerError("thread has a stop waiting to be handled")
+const errNoCaller = TracerError("no caller to return to")
+
+type stepKind int
+
+const (
+  stepInto stepKind = iota
+  stepOver
+  stepOut
+)
+
+// StepInto runs the current thread to the start of the next source line,
+// following calls into functions that have DWARF line information and
+// stopping once they've set up their frame. Functions without it, like PLT
+// stubs and most of libc, are run through. Other threads run freely while
+// calls are stepped over, and everything is stopped when the step ends.
+// Signals that arrive during the step are delivered and their handlers run
+// to completion. A fatal one ends the step, as does a breakpoint hit by any
+// thread.
+func (p *Process) StepInto() (*StepResult, error) {
+  return p.step(stepInto)
+}
+
+// StepOver runs the current thread to the start of the next source line in
+// the same function, or in its caller once it returns. Calls are run to
+// completion with a temporary breakpoint at the return address.
+func (p *Process) StepOver() (*StepResult, error) {
+  return p.step(stepOver)
+}
+
+// StepOut runs the current thread until the current function returns,
+// stopping at the return address in its caller.
+func (p *Process) StepOut() (*StepResult, error) {
+  return p.step(stepOut)
+}
+
+func (p *Process) step(kind stepKind) (res *StepResult, err error) {
+  if ! p.IsLive() {
+    return nil, errNotLive
+  }
+
+  // Called from a breakpoint callback, the other threads are still running
+  running := p.stopAll()
+  t := p.current
+  if t == nil {
+    t = p.Threads[p.Pid]
+  }
+  switch {
+  case t == nil:
+    err = errNotLive
+  case p.hasPending(t):
+    err = errPendingStop
+  case kind == stepOut:
+    t.resumeOver = nil
+    res, err = p.returnToCaller(t)
+  default:
+    t.resumeOver = nil
+    res, err = p.stepLine(t, kind == stepInto)
+  }
+
+  if err == nil {
+    if res == nil {
+      res = &StepResult{Reason: StepDone, Thread: t.Tid}
+    }
+    p.finishStep(res)
+  }
+  for _, th := range running {
+    if p.Threads[th.Tid] == th && th.stopped && ! p.hasPending(th) {
+      p.resumeThread(th, 0)
+    }
+  }
+  return res, err
+}
+
+// finishStep makes the thread a step ended in the current one and fills in
+// where it is.
+func (p *Process) finishStep(res *StepResult) {
+  t, ok := p.Threads[res.Thread]
+  if ! ok {
+    return
+  }
+  p.current = t
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return
+  }
+  res.PC = regs.PC()
+  res.File, res.Line, _ = p.LineAt(res.PC)
+}
+
+// stepLine steps thread t an instruction at a time until it's at the start
+// of a different source line, or has returned to its caller.
+func (p *Process) stepLine(t *Thread, into bool) (*StepResult, error) {
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return nil, err
+  }
+  start, ok := p.lineAt(regs.PC())
+  if ! ok || start.Line == 0 {
+    return p.returnToSource(t)
+  }
+
+  low, high := start.Address, start.End
+  for {
+    inst, res, err := p.stepInstruction(t, ! into)
+    if res != nil || err != nil {
+      return res, err
+    }
+    regs, err := p.backend().getRegisters(t.Tid)
+    if err != nil {
+      return nil, err
+    }
+    pc := regs.PC()
+
+    next := inst.Address + uint64(inst.Len())
+    if inst.Flow == FlowCall && pc != next {
+      if line, ok := p.lineAt(pc); ok && line.Line != 0 {
+        return p.skipPrologue(t, pc)
+      }
+      // The return address has just been pushed
+      if res, err := p.runTo(t, next, regs.Rsp + 8, 0); res != nil || err != nil {
+        return res, err
+      }
+      pc = next
+    }
+    if bp := p.breakpointAt(pc); bp != nil {
+      return &StepResult{Reason: StepBreakpoint, Thread: t.Tid, Breakpoint: bp}, nil
+    }
+
+    line, ok := p.lineAt(pc)
+    switch {
+    case ! ok:
+      return p.returnToSource(t)
+    case inst.Flow == FlowReturn:
+      return nil, nil
+    case pc >= low && pc < high:
+      continue
+    case line.Line != 0 && line.Stmt && pc == line.Address &&
+         (line.Line != start.Line || line.File != start.File):
+      return nil, nil
+    }
+    // In the middle of a line, or another part of the one we started on
+    low, high = line.Address, line.End
+  }
+}
+
+// skipPrologue steps thread t, which has just entered the function at entry,
+// past the code that sets up its frame.
+func (p *Process) skipPrologue(t *Thread, entry uint64) (*StepResult, error) {
+  end := p.prologueEnd(entry)
+  for pc := entry; ; {
+    if bp := p.breakpointAt(pc); bp != nil {
+      return &StepResult{Reason: StepBreakpoint, Thread: t.Tid, Breakpoint: bp}, nil
+    }
+    if pc == end || pc < entry || pc > end {
+      return nil, nil
+    }
+    if _, res, err := p.stepInstruction(t, true); res != nil || err != nil {
+      return res, err
+    }
+    regs, err := p.backend().getRegisters(t.Tid)
+    if err != nil {
+      return nil, err
+    }
+    pc = regs.PC()
+  }
+}
+
+// returnToCaller runs thread t until the function it's in returns.
+func (p *Process) returnToCaller(t *Thread) (*StepResult, error) {
+  // Libraries may have been loaded since the map was read
+  p.Memory.Refresh()
+  frames, err := p.Backtrace(t.Tid)
+  if err != nil {
+    return nil, err
+  }
+  if len(frames) < 2 || frames[1].PC == 0 {
+    return nil, errNoCaller
+  }
+  return p.runTo(t, frames[1].PC, frames[1].SP, 0)
+}
+
+// returnToSource runs thread t out of functions without line information
+// until it's back in one that has some. In the outermost frame, which has no
+// caller, it steps over one instruction at a time instead.
+func (p *Process) returnToSource(t *Thread) (*StepResult, error) {
+  for {
+    res, err := p.returnToCaller(t)
+    if err == errNoCaller {
+      _, res, err = p.stepInstruction(t, true)
+    }
+    if res != nil || err != nil {
+      return res, err
+    }
+    regs, err := p.backend().getRegisters(t.Tid)
+    if err != nil {
+      return nil, err
+    }
+    if line, ok := p.lineAt(regs.PC()); ok && line.Line != 0 {
+      return nil, nil
+    }
+  }
+}
+
+// stepInstruction moves thread t past one instruction, or past a whole call
+// if over is set. A signal that interrupts it is delivered and its handler
+// run before carrying on. The result is set when something else ended the
+// step.
+func (p *Process) stepInstruction(t *Thread, over bool) (*Instruction, *StepResult, error) {
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return nil, nil, err
+  }
+  pc := regs.PC()
+  insts, err := p.Disassemble(pc, 1)
+  if err != nil {
+    return nil, nil, err
+  }
+  inst := insts[0]
+
+  if over && inst.Flow == FlowCall {
+    res, err := p.runTo(t, pc + uint64(inst.Len()), regs.Rsp, 0)
+    return inst, res, err
+  }
+
+  for {
+    status, err := p.stepThread(t)
+    if err != nil {
+      return inst, nil, err
+    }
+    if status.Exited() || status.Signaled() {
+      return inst, p.exited(t, t, status), nil
+    }
+
+    sig := status.StopSignal()
+    switch {
+    case sig == syscall.SIGTRAP:
+      return inst, nil, nil
+    case sig == syscall.SIGSTOP && (p.ownStop(t) || p.profile.tickStop(t)):
+      // Sent by stopAll while the thread was stopped for something else, or
+      // a sample that can't be taken mid-step
+      continue
+    case fatalSignal(sig):
+      p.pending = append(p.pending, threadEvent{t.Tid, status})
+      return inst, &StepResult{Reason: StepSignal, Thread: t.Tid, Signal: sig}, nil
+    }
+
+    // Let the handler run and come back to where it was interrupted, which
+    // is past the instruction if it was a system call
+    at, err := p.backend().getRegisters(t.Tid)
+    if err != nil {
+      return inst, nil, err
+    }
+    p.recorder.signal(t.Tid, sig)
+    if res, err := p.runTo(t, at.PC(), at.Rsp, sig); res != nil || err != nil {
+      return inst, res, err
+    }
+    if at.PC() != pc {
+      return inst, nil, nil
+    }
+  }
+}
+
+// stepThread single-steps thread t while the others stay where they are,
+// lifting any breakpoint at its PC for the duration, and waits for it.
+func (p *Process) stepThread(t *Thread) (status syscall.WaitStatus, err error) {
+  regs, err := p.backend().getRegisters(t.Tid)
+  if err != nil {
+    return status, err
+  }
+  p.coverageReached(regs.PC())
+  if bp := p.breakpointAt(regs.PC()); bp != nil && p.ToggleBreakpoint(bp) {
+    defer p.ToggleBreakpoint(bp)
+  }
+
+  for {
+    if err = syscall.PtraceSingleStep(t.Tid); err != nil {
+      return status, err
+    }
+    if _, err = syscall.Wait4(t.Tid, &status, syscall.WALL, nil); err != nil {
+      return status, err
+    }
+    if status.Stopped() && status.StopSignal() == syscall.SIGTRAP &&
+       status.TrapCause() == syscall.PTRACE_EVENT_CLONE {
+      p.cloned(t)
+      continue
+    }
+    return status, nil
+  }
+}
+
+// runTo lets the process run until thread t gets to addr with its stack
+// pointer at or above sp, which tells a return to this frame apart from one
+// into a recursive call. A temporary breakpoint is placed at addr and other
+// threads that reach it are stepped past. Breakpoint hits and fatal signals
+// in other threads end the step, unless p.holdStops is set, in which case
+// they're left queued for the event loop. The result is set when something
+// else ended the step. All threads are stopped when it returns.
+func (p *Process) runTo(t *Thread, addr, sp uint64, sig syscall.Signal) (*StepResult, error) {
+  // A breakpoint that's already there will do
+  temp := p.breakpointAt(addr)
+  if temp == nil {
+    saved := []byte{INT3}
+    if err := p.SwapBytesText(addr, saved); err != nil {
+      return nil, err
+    }
+    temp = &Breakpoint{Address: addr, savedInstr: saved, Active: true}
+    defer func() {
+      if _, ok := p.Threads[p.Pid]; ok {
+        p.ToggleBreakpoint(temp)
+      }
+    }()
+  }
+  defer p.stopAll()
+
+  // Stops left for the event loop are only queued at the end, or they'd be
+  // taken straight back off the queue
+  held := []threadEvent{}
+  defer func() {
+    p.pending = append(p.pending, held...)
+  }()
+
+  if err := p.resumeThread(t, sig); err != nil {
+    return nil, err
+  }
+  p.Continue()
+
+  for {
+    ev, err := p.waitEvent()
+    if err != nil {
+      return nil, err
+    }
+    status := ev.status
+    th, known := p.Threads[ev.tid]
+    if ! known {
+      th = p.addThread(ev.tid)
+    }
+
+    if status.Exited() || status.Signaled() {
+      if res := p.exited(t, th, status); res != nil {
+        return res, nil
+      }
+      continue
+    }
+    if ! status.Stopped() {
+      continue
+    }
+    th.stopped = true
+    p.isRunning = false
+
+    var deliver syscall.Signal
+    switch s := status.StopSignal(); {
+    case s == syscall.SIGTRAP && status.TrapCause() == syscall.PTRACE_EVENT_CLONE:
+      p.cloned(th)
+
+    case s == syscall.SIGTRAP:
+      regs, err := p.backend().getRegisters(th.Tid)
+      if err != nil {
+        return nil, err
+      }
+      at := regs.PC() - 1
+      if at != addr && p.coverageTrap(th) {
+        break
+      }
+      if in := p.instrumentTrap(at); in != nil {
+        // Callbacks can't wait until the step is over
+        current := p.current
+        p.current = th
+        p.handleInstrument(in)
+        p.current = current
+        break
+      }
+      bp := p.breakpointAt(at)
+      if at != addr && bp == nil {
+        break
+      }
+      if bp != nil && th != t && p.holdStops {
+        held = append(held, ev)
+        continue
+      }
+      regs.SetPC(at)
+      if err := p.backend().setRegisters(th.Tid, regs); err != nil {
+        return nil, err
+      }
+      if at == addr && th == t && regs.Rsp >= sp {
+        return nil, nil
+      }
+      if bp != nil {
+        return &StepResult{Reason: StepBreakpoint, Thread: th.Tid, Breakpoint: bp}, nil
+      }
+
+      // Another thread, or a deeper call, got there first
+      p.stopAll()
+      p.ToggleBreakpoint(temp)
+      status, err := p.stepThread(th)
+      p.ToggleBreakpoint(temp)
+      if err != nil {
+        return nil, err
+      }
+      if ! status.Stopped() || status.StopSignal() != syscall.SIGTRAP {
+        p.pending = append(p.pending, threadEvent{th.Tid, status})
+      }
+      for _, o := range p.Threads {
+        if o.stopped && ! p.hasPending(o) && ! holds(held, o) {
+          p.resumeThread(o, 0)
+        }
+      }
+      continue
+
+    case s == syscallStop:
+      p.syscallStopped(th)
+
+    case s == syscall.SIGSTOP && (p.ownStop(th) || ! known || p.profile.tickStop(th)):
+
+    case fatalSignal(s):
+      if th != t && p.holdStops {
+        held = append(held, ev)
+        continue
+      }
+      p.pending = append(p.pending, ev)
+      return &StepResult{Reason: StepSignal, Thread: th.Tid, Signal: s}, nil
+
+    default:
+      deliver = s
+      p.recorder.signal(th.Tid, s)
+    }
+    p.resumeThread(th, deliver)
+  }
+}
+
+// exited forgets thread th, which has gone away. The result is set if that
+// ends the step of thread t. The exit of the whole process is also queued, so
+// the event loop sees it.
+func (p *Process) exited(t, th *Thread, status syscall.WaitStatus) *StepResult {
+  delete(p.Threads, th.Tid)
+  p.profile.threadExited(th.Tid)
+  if p.current == th {
+    p.current = nil
+  }
+  if th.Tid == p.Pid {
+    p.pending = append(p.pending, threadEvent{th.Tid, status})
+    p.backend().close()
+  } else if th != t {
+    return nil
+  }
+
+  res := &StepResult{Reason: StepExited, Thread: th.Tid, ExitStatus: status.ExitStatus()}
+  if status.Signaled() {
+    res.Signal = status.Signal()
+  }
+  return res
+}
+
+// breakpointAt returns the active breakpoint at addr, if there is one.
+func (p *Process) breakpointAt(addr uint64) *Breakpoint {
+  for _, bp := range p.Breakpoints {
+    if bp.Active && bp.Address == addr {
+      return bp
+    }
+  }
+  return nil
+}
@@ -1,6 +1,7 @@
 package grace
 
 import (
+  "encoding/binary"
   "debug/elf"
   "debug/dwarf"
   "strconv"
@@ -32,8 +33,8 @@ func extractTextSectionOffset(file *elf.File) uint64 {
 }
 
 // ExtractSymbolTable attempts to parse the DWARF section of a binary and return
-// a symbol table. This currently just supports file names, and function 
-// definitions
+// a symbol table. This currently just supports file names, function
+// definitions and variables with static storage
 func ExtractSymbolTable(binary string, offset uint64) (*SymbolTable, error) {
   files := make(SymbolTable)
 
@@ -48,6 +49,10 @@ func ExtractSymbolTable(binary string, offset uint64) (*SymbolTable, error) {
     return nil, err
   }
 
+  // Entries for functions and variables follow the compile unit they belong
+  // to, so remember which file we're in as we go.
+  var current string
+
   dwarfReader := dwarfs.Reader()
   for {
     entry, _ := dwarfReader.Next()
@@ -56,30 +61,33 @@ func ExtractSymbolTable(binary string, offset uint64) (*SymbolTable, error) {
     }
 
     /* TODO: This is all by value, make this references */
-    // For now, all we need are files and functions
+    // For now, all we need are files, functions and globals
     switch entry.Tag {
 
     case dwarf.TagCompileUnit:
       file := extractFile(entry)
       // file.Lowpc += offset
       // file.Highpc += offset
-      name := file.Filename
+      current = file.Filename
 
-      if name == "" {
+      if current == "" {
         continue
       }
 
-      files[name] = file
+      files[current] = file
 
-    /* TODO: Stupid inefficient */
     case dwarf.TagSubprogram:
       fun := extractFunction(entry)
       // fun.Highpc += offset
       // fun.Lowpc += offset
-      for _, v := range files {
-        if contains(v, fun) {
-          v.Functions[fun.Name] = fun
-        }
+      if file, ok := files[current]; ok && fun.Lowpc != 0 {
+        file.Functions[fun.Name] = fun
+      }
+
+    case dwarf.TagVariable:
+      variable, ok := extractVariable(dwarfs, entry)
+      if file, known := files[current]; ok && known {
+        file.Variables[variable.Name] = variable
       }
     }
   }
@@ -88,21 +96,37 @@ func ExtractSymbolTable(binary string, offset uint64) (*SymbolTable, error) {
 
 }
 
+// highpc returns DW_AT_high_pc as an address. Since DWARF 4 it is usually
+// encoded as a length relative to DW_AT_low_pc.
+func highpc(field dwarf.Field, lowpc uint64) uint64 {
+  switch val := field.Val.(type) {
+  case uint64:
+    return val
+  case int64:
+    return lowpc + uint64(val)
+  }
+  return 0
+}
+
 // extractFunction Turns a DWARF function entry to a grace.CompiledFunction
 func extractFunction(entry *dwarf.Entry) (fun CompiledFunction) {
   fun = CompiledFunction { }
-  for _,field := range entry.Field {
+  var high *dwarf.Field
+  for i, field := range entry.Field {
     switch field.Attr {
     case dwarf.AttrName:
-      fun.Name = field.Val.(string)
+      fun.Name, _ = field.Val.(string)
     case dwarf.AttrDeclLine:
       fun.Lineno = int(field.Val.(int64))
     case dwarf.AttrHighpc:
-      fun.Highpc = field.Val.(uint64)
+      high = &entry.Field[i]
     case dwarf.AttrLowpc:
-      fun.Lowpc = field.Val.(uint64)
+      fun.Lowpc, _ = field.Val.(uint64)
     }
   }
+  if high != nil {
+    fun.Highpc = highpc(*high, fun.Lowpc)
+  }
   return
 }
 
@@ -110,20 +134,64 @@ func extractFunction(entry *dwarf.Entry) (fun CompiledFunction) {
 func extractFile(entry *dwarf.Entry) (file CompiledFile) {
   file = CompiledFile { 
     Functions: make(map[string]CompiledFunction),
+    Variables: make(map[string]CompiledVariable),
   }
-  for _,field := range entry.Field {
+  var high *dwarf.Field
+  for i, field := range entry.Field {
     switch field.Attr {
     case dwarf.AttrName:
-      file.Filename = field.Val.(string)
+      file.Filename, _ = field.Val.(string)
     case dwarf.AttrLowpc:
-      file.Lowpc = field.Val.(uint64)
+      file.Lowpc, _ = field.Val.(uint64)
     case dwarf.AttrHighpc:
-      file.Highpc = field.Val.(uint64)
+      high = &entry.Field[i]
     }
   }
+  if high != nil {
+    file.Highpc = highpc(*high, file.Lowpc)
+  }
   return
 }
 
+// extractVariable turns a DWARF variable entry into a grace.CompiledVariable.
+// Only variables at a fixed address (a location of just DW_OP_addr) are of
+// interest; locals and declarations are rejected.
+func extractVariable(d *dwarf.Data, entry *dwarf.Entry) (v CompiledVariable, ok bool) {
+  const opAddr = 0x03
+
+  loc, _ := entry.Val(dwarf.AttrLocation).([]byte)
+  if len(loc) != 9 || loc[0] != opAddr {
+    return v, false
+  }
+  v.Address = binary.LittleEndian.Uint64(loc[1:])
+  v.Name, _ = entry.Val(dwarf.AttrName).(string)
+  if v.Name == "" {
+    return v, false
+  }
+  if line, ok := entry.Val(dwarf.AttrDeclLine).(int64); ok {
+    v.Lineno = int(line)
+  }
+  if off, ok := entry.Val(dwarf.AttrType).(dwarf.Offset); ok {
+    if t, err := d.Type(off); err == nil && t.Size() > 0 {
+      v.Size = uint64(t.Size())
+    }
+  }
+  return v, true
+}
+
+// VariableAt returns the variable whose storage covers addr, given as an
+// unrelocated (link-time) address.
+func (s *SymbolTable) VariableAt(addr uint64) (CompiledVariable, bool) {
+  for _, file := range *s {
+    for _, v := range file.Variables {
+      if addr >= v.Address && addr < v.Address + v.Size {
+        return v, true
+      }
+    }
+  }
+  return CompiledVariable{}, false
+}
+
 type symbolPath struct {
   file, function string
   line int
@@ -228,6 +296,9 @@ func symstringToLoc(symstring string) (*symbolLocation, error) {
   loc := new(symbolLocation)
 
   tokens, mode := symstringToTokens(symstring)
+  if len(tokens) == 0 {
+    return nil, formatError
+  }
 
   // Reverse the tokens to make popping off the stack easier
   reverseSlice(tokens)
@@ -235,6 +306,9 @@ func symstringToLoc(symstring string) (*symbolLocation, error) {
   // If last thing was numeric, it's likely a line number and the first is a
   // filename. 
   if isAlnum(tokens[0]) {
+    if len(tokens) < 2 {
+      return nil, formatError
+    }
     loc.lineNumber, _ = strconv.Atoi(tokens[0])
     loc.fileName = tokens[1]
 
@@ -245,6 +319,11 @@ func symstringToLoc(symstring string) (*symbolLocation, error) {
   loc.funcName = tokens[0]
   tokens = tokens[1:]
 
+  // A bare function name
+  if len(tokens) == 0 {
+    return loc, nil
+  }
+
   // If parsing a C++ reference, get the class+namespace
   if mode == modeCpp {
     loc.className = tokens[0]
@@ -284,27 +363,64 @@ func locToOffset(p *Process, loc *symbolLocation) (uint64, error) {
     return proc.Lowpc, nil
   }
 
+  // Without a file, any compile unit defining the function will do
+  if loc.funcName != "" && loc.className == "" {
+    for _, file := range *p.DebugSymbols {
+      if proc, ok := file.Functions[loc.funcName]; ok {
+        return proc.Lowpc, nil
+      }
+    }
+  }
+
   return 0, symbolNotFound
 }
 
 // resolveSymbol attempts to take a fuzzy human-readable definition of a place
 // in a binary and resolve that to an actual address. The following are intended
 // to be supported: "0x08004014", "file.c:functionFoo",
-// "CppNs::CppClass::CppFunc"
+// "CppNs::CppClass::CppFunc" and plain "functionFoo". Names DWARF doesn't
+// know about are looked up in the ELF symbol tables of the loaded modules.
 func (p *Process) resolveSymbol(sym string) (uint64, error) {
 
   /* Just an address */
   if isAlnum(sym) {
-    return strconv.ParseUint(sym, 0, 64)
+    if addr, err := strconv.ParseUint(sym, 0, 64); err == nil {
+      return addr, nil
+    }
   }
 
-  if p.DebugSymbols == nil {
-    return 0, missingDWARF
+  loc, err := symstringToLoc(sym)
+  if err != nil {
+    return 0, err
   }
 
-  loc, _ := symstringToLoc(sym)
+  if p.DebugSymbols == nil {
+    err = missingDWARF
+  } else {
+    var addr uint64
+    if addr, err = locToOffset(p, loc); err == nil {
+      return addr + p.loadBias(), nil
+    }
+  }
 
-  addr, err := locToOffset(p, loc)
+  if loc.fileName == "" && loc.lineNumber == 0 {
+    if addr, e := p.LookupSymbol(sym); e == nil {
+      return addr, nil
+    }
+  }
+  return 0, err
+}
 
-  return addr, err
+// resolveLoaded is resolveSymbol for a symbol that may be in a library
+// loaded since the memory map was last read. The map is only re-read when
+// the symbol isn't found.
+func (p *Process) resolveLoaded(sym string) (uint64, error) {
+  addr, err := p.resolveSymbol(sym)
+  if err == nil {
+    return addr, nil
+  }
+  if diff, e := p.Memory.Refresh(); e != nil || ! diff.files() {
+    return 0, err
+  }
+  return p.resolveSymbol(sym)
 }
@@ -0,0 +1,389 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "debug/elf"
+  "encoding/binary"
+  "os"
+  "sort"
+  "syscall"
+)
+
+// errNotLive is returned by anything that needs a running program when the
+// target is a core file.
+const errNotLive = TracerError("target is not a live process")
+
+// errReadOnly is returned when writing to a core file target.
+const errReadOnly = TracerError("target is read-only")
+
+// targetBackend is how a Process gets at the program's state. A live process
+// is accessed with ptrace and friends; a core file is read from disk. All the
+// inspection code (memory accessors, search, symbols, backtraces) goes
+// through this, so it works the same on both.
+type targetBackend interface {
+  readMemory(addr uint64, buf []byte) (int, error)
+  writeMemory(addr uint64, buf []byte) (int, error)
+  getRegisters(tid int) (*RegisterState, error)
+  setRegisters(tid int, regs *RegisterState) error
+  live() bool
+  close()
+}
+
+// liveBackend accesses a traced process.
+type liveBackend struct {
+  proc *Process
+}
+
+func (b *liveBackend) readMemory(addr uint64, buf []byte) (int, error) {
+  return b.proc.memory().read(addr, buf)
+}
+
+func (b *liveBackend) writeMemory(addr uint64, buf []byte) (int, error) {
+  return b.proc.memory().write(addr, buf)
+}
+
+func (b *liveBackend) getRegisters(tid int) (*RegisterState, error) {
+  registers := &RegisterState{}
+  if err := syscall.PtraceGetRegs(tid, &registers.PtraceRegs); err != nil {
+    return nil, err
+  }
+  return registers, nil
+}
+
+func (b *liveBackend) setRegisters(tid int, regs *RegisterState) error {
+  return syscall.PtraceSetRegs(tid, &regs.PtraceRegs)
+}
+
+func (b *liveBackend) live() bool {
+  return true
+}
+
+func (b *liveBackend) close() {
+  b.proc.memory().close()
+}
+
+// backend returns the process' target backend, which is a live one unless
+// the process was opened from a core file.
+func (p *Process) backend() targetBackend {
+  if p.target == nil {
+    p.target = &liveBackend{p}
+  }
+  return p.target
+}
+
+// IsLive reports whether p is a running process, as opposed to a core file.
+func (p *Process) IsLive() bool {
+  return p.backend().live()
+}
+
+// coreSegment is a PT_LOAD segment of a core file
+type coreSegment struct {
+  vaddr, memsz, filesz, off uint64
+  flags elf.ProgFlag
+}
+
+// coreMapping is an entry of the NT_FILE note: a range of memory that was
+// mapped from a file.
+type coreMapping struct {
+  start, end, offset uint64
+  path string
+}
+
+// coreBackend reads the state of a dead process from an ELF core file.
+// Memory the kernel chose not to dump, such as program text, is read from the
+// mapped files instead, which must still be where they were.
+type coreBackend struct {
+  core      *os.File
+  segments []coreSegment
+  mappings []coreMapping
+  tids     []int
+  regs      map[int]*RegisterState
+  fpregs    map[int][]byte
+  auxv     []byte
+  pid       int
+  files     map[string]*os.File
+}
+
+func (b *coreBackend) live() bool {
+  return false
+}
+
+func (b *coreBackend) close() {
+  b.core.Close()
+  for _, f := range b.files {
+    f.Close()
+  }
+  b.files = make(map[string]*os.File)
+}
+
+func (b *coreBackend) writeMemory(addr uint64, buf []byte) (int, error) {
+  return 0, errReadOnly
+}
+
+func (b *coreBackend) getRegisters(tid int) (*RegisterState, error) {
+  regs, ok := b.regs[tid]
+  if ! ok {
+    return nil, syscall.ESRCH
+  }
+  copied := *regs
+  return &copied, nil
+}
+
+func (b *coreBackend) setRegisters(tid int, regs *RegisterState) error {
+  return errReadOnly
+}
+
+func (b *coreBackend) file(path string) (*os.File, error) {
+  if f, ok := b.files[path]; ok {
+    return f, nil
+  }
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  b.files[path] = f
+  return f, nil
+}
+
+// readAt fills buf from addr, which must lie in seg.
+func (b *coreBackend) readAt(seg *coreSegment, addr uint64, buf []byte) (int, error) {
+  rel := addr - seg.vaddr
+  if rel < seg.filesz {
+    if left := seg.filesz - rel; uint64(len(buf)) > left {
+      buf = buf[:left]
+    }
+    return b.core.ReadAt(buf, int64(seg.off + rel))
+  }
+
+  // Not dumped: read it from the file it was mapped from, if any
+  if left := seg.vaddr + seg.memsz - addr; uint64(len(buf)) > left {
+    buf = buf[:left]
+  }
+  for _, m := range b.mappings {
+    if addr < m.start || addr >= m.end {
+      continue
+    }
+    f, err := b.file(m.path)
+    if err != nil {
+      return 0, err
+    }
+    n, err := f.ReadAt(buf, int64(m.offset + addr - m.start))
+    if n > 0 {
+      // Past the end of the file, a mapping reads as zeroes
+      err = nil
+    }
+    return n, err
+  }
+  return 0, syscall.EIO
+}
+
+func (b *coreBackend) readMemory(addr uint64, buf []byte) (count int, err error) {
+  for count < len(buf) {
+    where := addr + uint64(count)
+    i := sort.Search(len(b.segments), func(i int) bool {
+      return b.segments[i].vaddr + b.segments[i].memsz > where
+    })
+    if i == len(b.segments) || b.segments[i].vaddr > where {
+      return count, syscall.EFAULT
+    }
+    n, err := b.readAt(&b.segments[i], where, buf[count:])
+    count += n
+    if err != nil {
+      return count, err
+    }
+    if n == 0 {
+      return count, syscall.EIO
+    }
+  }
+  return count, nil
+}
+
+// parseNotes picks the thread registers and process information out of the
+// PT_NOTE segments of a core file.
+func (b *coreBackend) parseNotes(data []byte) {
+  le := binary.LittleEndian
+  for len(data) >= 12 {
+    namesz, descsz, kind := le.Uint32(data), le.Uint32(data[4:]), le.Uint32(data[8:])
+    off := 12 + int((namesz + 3) &^ 3)
+    end := off + int(descsz)
+    if end > len(data) {
+      return
+    }
+    desc := data[off:end]
+
+    switch kind {
+    case ntPrstatus:
+      if len(desc) < 328 {
+        break
+      }
+      tid := int(le.Uint32(desc[32:]))
+      regs := &RegisterState{}
+      binary.Read(bytes.NewReader(desc[112:328]), le, &regs.PtraceRegs)
+      b.regs[tid] = regs
+      b.tids = append(b.tids, tid)
+    case ntFpregset:
+      // Belongs to the thread whose NT_PRSTATUS came before it
+      if len(b.tids) > 0 {
+        b.fpregs[b.tids[len(b.tids)-1]] = desc
+      }
+    case ntPrpsinfo:
+      if len(desc) >= 28 {
+        b.pid = int(le.Uint32(desc[24:]))
+      }
+    case ntAuxv:
+      b.auxv = desc
+    case ntFile:
+      b.mappings = parseFileNote(desc)
+    }
+
+    if end = (end + 3) &^ 3; end > len(data) {
+      return
+    }
+    data = data[end:]
+  }
+}
+
+// parseFileNote decodes an NT_FILE note as written by the kernel or
+// fileNote.
+func parseFileNote(desc []byte) []coreMapping {
+  le := binary.LittleEndian
+  if len(desc) < 16 {
+    return nil
+  }
+  count, pagesz := le.Uint64(desc), le.Uint64(desc[8:])
+  if count > uint64(len(desc) - 16) / 24 {
+    return nil
+  }
+
+  mappings := make([]coreMapping, count)
+  names := desc[16 + 24*count:]
+  for i := range mappings {
+    e := desc[16 + 24*i:]
+    mappings[i] = coreMapping{le.Uint64(e), le.Uint64(e[8:]), le.Uint64(e[16:]) * pagesz, ""}
+    if j := bytes.IndexByte(names, 0); j >= 0 {
+      mappings[i].path = string(names[:j])
+      names = names[j+1:]
+    }
+  }
+  return mappings
+}
+
+// memoryMap describes the core's segments as a MemoryMap. Regions holding a
+// thread's stack pointer are marked as stacks.
+func (b *coreBackend) memoryMap() *MemoryMap {
+  m := &MemoryMap{}
+  for _, seg := range b.segments {
+    r := MemoryRegion{Address: seg.vaddr, Size: seg.memsz}
+    if seg.flags & elf.PF_R != 0 {
+      r.Perms |= PermRead
+    }
+    if seg.flags & elf.PF_W != 0 {
+      r.Perms |= PermWrite
+    }
+    if seg.flags & elf.PF_X != 0 {
+      r.Perms |= PermExec
+    }
+    for _, mapping := range b.mappings {
+      if mapping.start == seg.vaddr {
+        r.Pathname, r.Offset = mapping.path, mapping.offset
+      }
+    }
+    r.Kind = regionKind(r.Pathname)
+    for _, regs := range b.regs {
+      if r.Kind == Anonymous && r.Contains(regs.Rsp) {
+        r.Kind = Stack
+      }
+    }
+    m.Regions = append(m.Regions, r)
+  }
+  return m
+}
+
+// OpenCore opens an ELF core file of a process that ran executable as a
+// read-only target. Everything that inspects a Process, such as reading
+// memory and registers, symbol lookups and backtraces, works on it; anything
+// that would make it run fails.
+func OpenCore(corePath, executable string) (proc *Process, err error) {
+  f, err := elf.Open(corePath)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  if f.Type != elf.ET_CORE {
+    return nil, &os.PathError{Op: "OpenCore", Path: corePath, Err: TracerError("not a core file")}
+  }
+
+  core, err := os.Open(corePath)
+  if err != nil {
+    return nil, err
+  }
+
+  b := &coreBackend{
+    core:   core,
+    regs:   make(map[int]*RegisterState),
+    fpregs: make(map[int][]byte),
+    files:  make(map[string]*os.File),
+  }
+  for _, prog := range f.Progs {
+    switch prog.Type {
+    case elf.PT_LOAD:
+      b.segments = append(b.segments, coreSegment{prog.Vaddr, prog.Memsz,
+                                                  prog.Filesz, prog.Off, prog.Flags})
+    case elf.PT_NOTE:
+      data := make([]byte, prog.Filesz)
+      if _, err := prog.ReadAt(data, 0); err == nil {
+        b.parseNotes(data)
+      }
+    }
+  }
+  sort.Slice(b.segments, func(i, j int) bool {
+    return b.segments[i].vaddr < b.segments[j].vaddr
+  })
+
+  if len(b.tids) == 0 {
+    b.close()
+    return nil, &os.PathError{Op: "OpenCore", Path: corePath, Err: TracerError("core has no threads")}
+  }
+  if b.pid == 0 {
+    b.pid = b.tids[0]
+  }
+
+  proc = &Process{Pid: b.pid, Threads: make(map[int]*Thread), target: b}
+  for _, tid := range b.tids {
+    proc.addThread(tid).stopped = true
+  }
+  // The thread that took the fatal signal comes first
+  proc.current = proc.Threads[b.tids[0]]
+  proc.Memory = b.memoryMap()
+  err = proc.load(executable)
+  return proc, err
+}
@@ -0,0 +1,180 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "debug/elf"
+  "encoding/binary"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "testing"
+)
+
+func TestParseFileNote(t *testing.T) {
+  regions := []MemoryRegion{
+    {Address: 0x400000, Size: 0x1000, Pathname: "/bin/app", Kind: File},
+    {Address: 0x600000, Size: 0x2000, Kind: Heap},
+    {Address: 0x7f0000, Size: 0x3000, Offset: 0x2000, Pathname: "/lib/libc.so.6", Kind: File},
+  }
+  good := fileNote(regions)
+
+  overflow := make([]byte, 40)
+  binary.LittleEndian.PutUint64(overflow, 0xaaaaaaaaaaaaaaab)
+  binary.LittleEndian.PutUint64(overflow[8:], pageSize)
+
+  tests := []struct {
+    name      string
+    desc    []byte
+    mappings []coreMapping
+  }{
+    {"written", good, []coreMapping{{0x400000, 0x401000, 0, "/bin/app"},
+                                    {0x7f0000, 0x7f3000, 0x2000, "/lib/libc.so.6"}}},
+    {"no names", good[:16+48], []coreMapping{{0x400000, 0x401000, 0, ""},
+                                             {0x7f0000, 0x7f3000, 0x2000, ""}}},
+    {"truncated entries", good[:16+40], nil},
+    {"short", good[:8], nil},
+    {"count overflows", overflow, nil},
+  }
+
+  for _, test := range tests {
+    mappings := parseFileNote(test.desc)
+    if len(mappings) != len(test.mappings) {
+      t.Errorf("%s: got %v, want %v", test.name, mappings, test.mappings)
+      continue
+    }
+    for i := range mappings {
+      if mappings[i] != test.mappings[i] {
+        t.Errorf("%s: got %v, want %v", test.name, mappings, test.mappings)
+        break
+      }
+    }
+  }
+}
+
+// buildTarget compiles a C program with debug information, skipping the
+// test when there's no compiler.
+func buildTarget(t *testing.T, source string) string {
+  dir := t.TempDir()
+  src, exe := filepath.Join(dir, "target.c"), filepath.Join(dir, "target")
+  if err := os.WriteFile(src, []byte(source), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if out, err := exec.Command("cc", "-g", "-o", exe, src).CombinedOutput(); err != nil {
+    t.Skipf("cc: %v\n%s", err, out)
+  }
+  return exe
+}
+
+// writeTestCore writes an ELF core with the given notes and a single
+// segment holding data at addr.
+func writeTestCore(t *testing.T, notes []byte, addr uint64, data []byte) string {
+  header, _ := coreHeader(2)
+  notesOff := uint64(64 + 56*2)
+  progs := []elf.Prog64{
+    {Type: uint32(elf.PT_NOTE), Off: notesOff, Filesz: uint64(len(notes)), Align: 4},
+    {Type: uint32(elf.PT_LOAD), Off: notesOff + uint64(len(notes)), Vaddr: addr,
+     Filesz: uint64(len(data)), Memsz: uint64(len(data)), Flags: uint32(elf.PF_R)},
+  }
+
+  var buf bytes.Buffer
+  binary.Write(&buf, binary.LittleEndian, &header)
+  binary.Write(&buf, binary.LittleEndian, progs)
+  buf.Write(notes)
+  buf.Write(data)
+  path := filepath.Join(t.TempDir(), "core")
+  if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return path
+}
+
+func TestOpenCore(t *testing.T) {
+  regs := &RegisterState{}
+  regs.Rip, regs.Rsp = 0x401000, 0x7000
+  thread := func(tid int) []byte {
+    var notes bytes.Buffer
+    appendNote(&notes, ntPrstatus, prstatus(0, tid, regs, false))
+    return notes.Bytes()
+  }
+  var unpadded bytes.Buffer
+  unpadded.Write(thread(42))
+  binary.Write(&unpadded, binary.LittleEndian, [3]uint32{0, 1, 1})
+  unpadded.WriteByte(0)
+
+  tests := []struct {
+    name     string
+    notes  []byte
+    tids   []int
+  }{
+    {"one thread", thread(42), []int{42}},
+    {"two threads", append(thread(42), thread(43)...), []int{42, 43}},
+    {"no threads", nil, nil},
+    {"truncated note", thread(42)[:200], nil},
+    {"unpadded note", unpadded.Bytes(), []int{42}},
+  }
+
+  exe := buildTarget(t, "int main(void) { return 0; }\n")
+  data := []byte("core memory")
+  for _, test := range tests {
+    p, err := OpenCore(writeTestCore(t, test.notes, 0x7000, data), exe)
+    if test.tids == nil {
+      if err == nil {
+        t.Errorf("%s: opened", test.name)
+        p.Detach()
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+
+    if p.IsLive() || p.Pid != test.tids[0] || len(p.Threads) != len(test.tids) {
+      t.Errorf("%s: live %v, pid %d, %d threads", test.name, p.IsLive(), p.Pid, len(p.Threads))
+    }
+    if r, err := p.GetRegisters(); err != nil || r.Rip != regs.Rip || r.Rsp != regs.Rsp {
+      t.Errorf("%s: registers %v, %v", test.name, r, err)
+    }
+    buf := make([]byte, len(data))
+    if _, err := p.ReadMemory(0x7000, buf); err != nil || ! bytes.Equal(buf, data) {
+      t.Errorf("%s: read %q, %v", test.name, buf, err)
+    }
+    if _, err := p.WriteMemory(0x7000, buf); err == nil {
+      t.Errorf("%s: wrote to a core", test.name)
+    }
+    p.Detach()
+  }
+
+  if _, err := OpenCore(exe, exe); err == nil {
+    t.Errorf("opened an executable as a core")
+  }
+}
@@ -0,0 +1,410 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "fmt"
+  "os"
+  "runtime"
+  "strconv"
+  "syscall"
+)
+
+// traceOptions are set on every thread we trace, so that new threads are
+// traced as well, and system call stops can be told from breakpoints.
+const traceOptions = syscall.PTRACE_O_TRACECLONE | syscall.PTRACE_O_TRACESYSGOOD
+
+// addThread starts tracking tid, if it isn't already.
+func (p *Process) addThread(tid int) *Thread {
+  if t, ok := p.Threads[tid]; ok {
+    return t
+  }
+  t := &Thread{Tid: tid}
+  p.Threads[tid] = t
+  return t
+}
+
+// cloned starts tracking the thread t has just created. Its first stop is a
+// SIGSTOP that mustn't be delivered, unless it has been seen already.
+func (p *Process) cloned(t *Thread) {
+  msg, err := syscall.PtraceGetEventMsg(t.Tid)
+  if err != nil {
+    return
+  }
+  if _, ok := p.Threads[int(msg)]; ! ok {
+    p.addThread(int(msg)).expectStop = true
+  }
+}
+
+// tid returns the thread register and memory accesses should go to: the one
+// whose stop is being handled, or else the main thread.
+func (p *Process) tid() int {
+  if p.current != nil {
+    return p.current.Tid
+  }
+  return p.Pid
+}
+
+// stoppedTid returns a thread to send ptrace requests that only concern the
+// address space to. Those need a stopped thread, but any one will do.
+func (p *Process) stoppedTid() int {
+  if p.current != nil && p.current.stopped {
+    return p.current.Tid
+  }
+  if t, ok := p.Threads[p.Pid]; ok && t.stopped {
+    return t.Tid
+  }
+  for _, t := range p.Threads {
+    if t.stopped {
+      return t.Tid
+    }
+  }
+  return p.tid()
+}
+
+// threadList returns the thread group leader, followed by the other threads.
+func (p *Process) threadList() []*Thread {
+  threads := []*Thread{}
+  if t, ok := p.Threads[p.Pid]; ok {
+    threads = append(threads, t)
+  }
+  for tid, t := range p.Threads {
+    if tid != p.Pid {
+      threads = append(threads, t)
+    }
+  }
+  return threads
+}
+
+func (p *Process) updateRunning() {
+  p.isRunning = true
+  for _, t := range p.Threads {
+    if t.stopped {
+      p.isRunning = false
+    }
+  }
+}
+
+// resumeThread continues a stopped thread, delivering sig to it unless it is
+// zero.
+func (p *Process) resumeThread(t *Thread, sig syscall.Signal) error {
+  if ! p.IsLive() {
+    return errNotLive
+  }
+  var err error
+  if p.traceSyscalls(t) {
+    err = syscall.PtraceSyscall(t.Tid, int(sig))
+  } else {
+    err = syscall.PtraceCont(t.Tid, int(sig))
+  }
+  if err == nil {
+    t.stopped = false
+    if p.current == t {
+      p.current = nil
+    }
+  }
+  p.updateRunning()
+  return err
+}
+
+// hasPending reports whether a stop of t is queued for the event loop.
+func (p *Process) hasPending(t *Thread) bool {
+  return holds(p.pending, t)
+}
+
+// holds reports whether one of events is a stop of t.
+func holds(events []threadEvent, t *Thread) bool {
+  for _, ev := range events {
+    if ev.tid == t.Tid {
+      return true
+    }
+  }
+  return false
+}
+
+// waitEvent returns the next stop or exit of any traced thread, taking queued
+// ones first.
+func (p *Process) waitEvent() (threadEvent, error) {
+  if len(p.pending) > 0 {
+    ev := p.pending[0]
+    p.pending = p.pending[1:]
+    return ev, nil
+  }
+
+  var ev threadEvent
+  tid, err := syscall.Wait4(-1, &ev.status, syscall.WALL, nil)
+  ev.tid = tid
+  return ev, err
+}
+
+// stopAll brings every running thread to a halt with SIGSTOP, so the process
+// can be inspected as a whole. Threads that report some other stop first are
+// left stopped, with the stop queued for the event loop. It returns the
+// threads it stopped, to be handed to resumeStopped.
+func (p *Process) stopAll() []*Thread {
+  if ! p.IsLive() {
+    return nil
+  }
+  signalled := []*Thread{}
+  for _, t := range p.Threads {
+    if t.stopped || t.expectStop {
+      continue
+    }
+    if err := syscall.Tgkill(p.Pid, t.Tid, syscall.SIGSTOP); err != nil {
+      continue
+    }
+    t.expectStop = true
+    signalled = append(signalled, t)
+  }
+
+  stopped := []*Thread{}
+  for _, t := range signalled {
+    var status syscall.WaitStatus
+    if _, err := syscall.Wait4(t.Tid, &status, syscall.WALL, nil); err != nil {
+      delete(p.Threads, t.Tid)
+      p.profile.threadExited(t.Tid)
+      continue
+    }
+
+    t.stopped = true
+    if status.Stopped() && status.StopSignal() == syscall.SIGSTOP {
+      p.ownStop(t)
+      stopped = append(stopped, t)
+    } else {
+      p.pending = append(p.pending, threadEvent{t.Tid, status})
+    }
+  }
+
+  p.isRunning = false
+  return stopped
+}
+
+// ownStop reports whether the SIGSTOP thread t is in is one stopAll sent, and
+// takes it.
+func (p *Process) ownStop(t *Thread) bool {
+  if ! t.expectStop {
+    return false
+  }
+  t.expectStop = false
+  p.profile.merged(t)
+  return true
+}
+
+// stopPending reports whether a SIGSTOP is waiting to be delivered to thread
+// tid.
+func stopPending(pid, tid int) bool {
+  status := readProcStatus(fmt.Sprintf("/proc/%d/task/%d/status", pid, tid))
+  pending, err := strconv.ParseUint(status["SigPnd"], 16, 64)
+  return err == nil && pending & (1 << (syscall.SIGSTOP - 1)) != 0
+}
+
+// drainStops takes the SIGSTOPs that stopAll or the profiler sent and that
+// are still on their way, which would stop the process once it's detached.
+// All threads are stopped. Other signals seen meanwhile are queued.
+func (p *Process) drainStops() {
+  tick := p.profile.dropTick()
+  for _, t := range p.Threads {
+    if ! t.expectStop && t.Tid != tick {
+      continue
+    }
+    t.expectStop = false
+    for stopPending(p.Pid, t.Tid) {
+      // The thread stops for it as soon as it's let go
+      if err := syscall.PtraceCont(t.Tid, 0); err != nil {
+        break
+      }
+      var status syscall.WaitStatus
+      if _, err := syscall.Wait4(t.Tid, &status, syscall.WALL, nil); err != nil || ! status.Stopped() {
+        delete(p.Threads, t.Tid)
+        break
+      }
+      if status.StopSignal() == syscall.SIGSTOP {
+        break
+      }
+      p.pending = append(p.pending, threadEvent{t.Tid, status})
+    }
+  }
+}
+
+// resumeStopped undoes stopAll.
+func (p *Process) resumeStopped(threads []*Thread) {
+  for _, t := range threads {
+    p.resumeThread(t, 0)
+  }
+}
+
+// listTasks returns the thread ids of process pid.
+func listTasks(pid int) ([]int, error) {
+  dir, err := os.Open(fmt.Sprintf("/proc/%d/task", pid))
+  if err != nil {
+    return nil, err
+  }
+  defer dir.Close()
+
+  names, err := dir.Readdirnames(-1)
+  if err != nil {
+    return nil, err
+  }
+  tids := []int{}
+  for _, name := range names {
+    if tid, err := strconv.Atoi(name); err == nil {
+      tids = append(tids, tid)
+    }
+  }
+  return tids, nil
+}
+
+// Attach starts tracing the already-running process pid and all of its
+// threads, which are left stopped. Call StartProcess to let it continue, or
+// Detach to let it go.
+func Attach(pid int) (proc *Process, err error) {
+  runtime.LockOSThread()
+
+  exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+  if err != nil {
+    return nil, err
+  }
+
+  proc = &Process{Pid: pid, Threads: make(map[int]*Thread)}
+
+  // Threads can be created while we're attaching to the others, so keep
+  // going until a pass turns up nothing new.
+  for found := true; found; {
+    found = false
+    tids, err := listTasks(pid)
+    if err != nil {
+      proc.Detach()
+      return nil, err
+    }
+    for _, tid := range tids {
+      if _, ok := proc.Threads[tid]; ok {
+        continue
+      }
+      if err := syscall.PtraceAttach(tid); err != nil {
+        // It may have exited in the meantime
+        continue
+      }
+      var status syscall.WaitStatus
+      if _, err := syscall.Wait4(tid, &status, syscall.WALL, nil); err != nil {
+        continue
+      }
+      syscall.PtraceSetOptions(tid, traceOptions)
+      t := proc.addThread(tid)
+      t.stopped = true
+      if status.StopSignal() != syscall.SIGSTOP {
+        proc.pending = append(proc.pending, threadEvent{tid, status})
+      }
+      found = true
+    }
+  }
+
+  if len(proc.Threads) == 0 {
+    return nil, &os.SyscallError{Syscall: "ptrace", Err: syscall.ESRCH}
+  }
+
+  if proc.Memory, err = getMemoryMap(pid); err != nil {
+    proc.Memory = &MemoryMap{pid: pid}
+  }
+  err = proc.load(exe)
+  return proc, err
+}
+
+// Detach removes all breakpoints and stops tracing the process, which keeps
+// running on its own. Signals that were waiting to be handled are delivered.
+func (p *Process) Detach() error {
+  if ! p.IsLive() {
+    p.backend().close()
+    return nil
+  }
+  if p.profile != nil {
+    p.profile.Stop()
+  }
+  p.stopAll()
+  p.drainStops()
+
+  for _, bp := range p.Breakpoints {
+    if bp.Active {
+      p.ToggleBreakpoint(bp)
+    }
+  }
+  for _, in := range p.Instruments {
+    p.unhook(in)
+  }
+  p.Instruments = nil
+  if p.coverage != nil {
+    p.coverage.Stop()
+  }
+
+  var firstErr error
+  for _, t := range p.Threads {
+    sig := 0
+    for _, ev := range p.pending {
+      if ev.tid != t.Tid || ! ev.status.Stopped() {
+        continue
+      }
+      switch s := ev.status.StopSignal(); s {
+      case syscall.SIGTRAP:
+        // Back up over a breakpoint that has just been removed
+        p.current = t
+        if regs, err := p.GetRegisters(); err == nil {
+          for _, bp := range p.Breakpoints {
+            if bp.Address+1 == regs.PC() {
+              regs.SetPC(bp.Address)
+              p.SetRegisters(regs)
+            }
+          }
+        }
+        p.current = nil
+      case syscall.SIGSTOP, syscallStop:
+      default:
+        sig = int(s)
+      }
+    }
+    if err := ptraceDetach(t.Tid, sig); err != nil && firstErr == nil {
+      firstErr = err
+    }
+  }
+
+  p.Threads = make(map[int]*Thread)
+  p.pending = nil
+  p.backend().close()
+  return firstErr
+}
+
+// ptraceDetach is PTRACE_DETACH with a signal to deliver on the way out,
+// which syscall.PtraceDetach can't pass.
+func ptraceDetach(tid int, sig int) error {
+  _, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, syscall.PTRACE_DETACH,
+                                  uintptr(tid), 0, uintptr(sig), 0, 0)
+  if errno != 0 {
+    return errno
+  }
+  return nil
+}
@@ -31,30 +31,50 @@ package grace
 
 import "os"
 import "syscall"
+import "runtime"
+import "debug/elf"
+import "encoding/binary"
 
 func (t TracerError) Error() string {
   return string(t)
 }
 
 func (p *Process) FindTextSection() uint64 {
-  for _, v := range p.Memory {
-    if v.File == p.Filename && v.Permissions == "r-xp" {
+  for _, v := range p.Memory.Regions {
+    if v.Pathname == p.Filename && v.Perms == PermRead|PermExec {
       return v.Address
     }
   }
   return 0
 }
 
-func (p *Process) Continue() error {
-  err := syscall.PtraceCont(p.Pid, 0)
-  if err == nil {
-    p.isRunning = true
+// Continue resumes every stopped thread, except those with a stop still
+// waiting to be handled.
+func (p *Process) Continue() (err error) {
+  if ! p.IsLive() {
+    return errNotLive
+  }
+
+  // A thread left on a breakpoint by STOP goes past it first
+  for _, t := range p.threadList() {
+    bp := t.resumeOver
+    t.resumeOver = nil
+    if bp == nil || ! t.stopped || p.hasPending(t) {
+      continue
+    }
+    if regs, e := p.backend().getRegisters(t.Tid); e == nil && regs.PC() == bp.Address && bp.Active {
+      p.stepPast(t)
+    }
   }
-  return err
-}
 
-func (p *Process) AddInstrument(where string, callback BpCallback) bool{
-  return true
+  for _, t := range p.Threads {
+    if t.stopped && ! p.hasPending(t) {
+      if e := p.resumeThread(t, 0); e != nil && err == nil {
+        err = e
+      }
+    }
+  }
+  return err
 }
 
 func (p *Process) InBreakpoint() (*Breakpoint, bool) {
@@ -73,75 +93,179 @@ func (p *Process) InBreakpoint() (*Breakpoint, bool) {
   return nil, false
 }
 
+// What StartProcess returns when a breakpoint handler ended tracing
+const (
+  // StatusStopped means a breakpoint handler returned STOP
+  StatusStopped = -2
+  // StatusDetached means a breakpoint handler returned DETACH
+  StatusDetached = -3
+  // StatusKilled means a breakpoint handler returned KILL_TARGET or ABORT,
+  // and the process is gone
+  StatusKilled = -4
+)
+
 // StartProcess kicks off the event loop and forever waits for signals from
 // the traced process. This is currently done in a super-silly fashion and will
-// hopefully benefit from Go channels/goroutines in the future.
+// hopefully benefit from Go channels/goroutines in the future. It returns the
+// exit status of the process, -1 on error, or StatusStopped, StatusDetached
+// or StatusKilled when a breakpoint handler asked for it.
 func (p *Process) StartProcess() (ret int) {
-  var status syscall.WaitStatus
+  if err := p.Continue(); err == errNotLive {
+    return -1
+  }
 
-  L: for {
-    _, err := syscall.Wait4(/*p.Pid*/-1, &status, 0, nil)
-    p.isRunning = false
+  killed := false
+  for {
+    ev, err := p.waitEvent()
+    if err != nil {
+      p.backend().close()
+      return -1
+    }
+    status := ev.status
+
+    t, known := p.Threads[ev.tid]
+    if ! known {
+      // A new thread can report its first stop before its parent reports
+      // creating it
+      t = p.addThread(ev.tid)
+    }
 
     switch {
-    // status == 0  means terminated??
-    case status.Exited() || status == 0 || err != nil:
-      ret = status.ExitStatus()
-      break L
+    case status.Exited() || status.Signaled():
+      delete(p.Threads, ev.tid)
+      p.profile.threadExited(ev.tid)
+      if ev.tid == p.Pid {
+        ret = status.ExitStatus()
+        if killed {
+          ret = StatusKilled
+        }
+        p.backend().close()
+        return
+      }
+      continue
+
     case status.Stopped():
-      if bp, hit := p.InBreakpoint(); hit {
-        p.handleBreakpoint(bp)
+      t.stopped = true
+      p.isRunning = false
+      p.current = t
+
+      var deliver syscall.Signal
+      switch sig := status.StopSignal(); {
+      case sig == syscall.SIGTRAP && status.TrapCause() == syscall.PTRACE_EVENT_CLONE:
+        p.cloned(t)
+      case sig == syscall.SIGTRAP:
+        action := Action(CONTINUE)
+        if in, hit := p.InInstrument(); hit {
+          action = p.handleInstrument(in)
+        } else if bp, hit := p.InBreakpoint(); hit {
+          action = p.handleBreakpoint(bp)
+        } else {
+          p.coverageTrap(t)
+        }
+        switch action {
+        case STOP:
+          p.stopAll()
+          return StatusStopped
+        case DETACH:
+          p.Detach()
+          return StatusDetached
+        case KILL_TARGET, ABORT:
+          p.Kill()
+          killed = true
+        }
+      case sig == syscallStop:
+        p.syscallStopped(t)
+      case sig == syscall.SIGSTOP && (p.ownStop(t) || ! known):
+      case sig == syscall.SIGSTOP && p.profile.tickStop(t):
+        p.profile.sample(t)
+      default:
+        deliver = sig
+        p.recorder.signal(t.Tid, sig)
+        if p.crashHandler != nil && fatalSignal(sig) {
+          p.crashHandler(p.crashReport(t, sig))
+        }
+      }
+
+      // Stepping over a breakpoint can leave a stop of its own to handle
+      if ! p.hasPending(t) {
+        p.resumeThread(t, deliver)
       }
 
     //case status.Continued():
     //case status.CoreDump():
-    //case status.Signaled():
-    //case status.ExitStatus():
-    //case status.StopSignal():
-    //case status.TrapCause():
     default:
       // fmt.Printf("Got status: %v\n", status)
     }
+  }
+}
 
-    p.Continue()
+// dataLayout returns the byte order and pointer size of an ELF binary,
+// assuming a little-endian 64-bit target if it can't be read.
+func dataLayout(binaryName string) (binary.ByteOrder, int) {
+  f, err := elf.Open(binaryName)
+  if err != nil {
+    return binary.LittleEndian, 8
+  }
+  defer f.Close()
 
+  if f.Class == elf.ELFCLASS32 {
+    return f.ByteOrder, 4
   }
-  return
+  return f.ByteOrder, 8
 }
 
 /* ----- public interface ----------- */
-func Attach(pid int) (proc *Process, err error) {
-  return nil, nil
-}
 
 // LoadExecutable opens binaryName, passing it args and attempts to exec it.
 // Note, the process does not begin executing main() until after StartExecutable
 // is called.
 func LoadExecutable(binaryName string, args []string) (proc *Process, err error) {
   if _, ok := os.Stat(binaryName); ok != nil {
-    proc, err = nil, &os.PathError{"LoadExecutable", binaryName, ok}
+    proc, err = nil, &os.PathError{Op: "LoadExecutable", Path: binaryName, Err: ok}
     return
   }
 
+  // ptrace requests are only honored when they come from the thread that
+  // started the tracee, so keep this goroutine on it for good.
+  runtime.LockOSThread()
+
   var started *os.Process
   attr := &os.ProcAttr{
     Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
     Sys: &syscall.SysProcAttr{ Ptrace: true, },
   }
   if p, ok := os.StartProcess(binaryName, args, attr); ok != nil {
-    proc, err = nil, &os.PathError{"LoadExecutable", binaryName, ok}
+    proc, err = nil, &os.PathError{Op: "LoadExecutable", Path: binaryName, Err: ok}
     return
   } else {
     started = p
   }
 
-  proc = new(Process)
-  proc.Pid = started.Pid
-  proc.Memory, _ = getMemoryMap(proc.Pid)
+  // Wait for the stop at exec so memory can be inspected and breakpoints
+  // placed before StartProcess lets the target run.
+  var status syscall.WaitStatus
+  if _, ok := syscall.Wait4(started.Pid, &status, 0, nil); ok != nil {
+    proc, err = nil, &os.PathError{Op: "LoadExecutable", Path: binaryName, Err: ok}
+    return
+  }
+
+  proc = &Process{Pid: started.Pid, Threads: make(map[int]*Thread)}
+  proc.addThread(proc.Pid).stopped = true
+  syscall.PtraceSetOptions(proc.Pid, traceOptions)
+  if proc.Memory, err = getMemoryMap(proc.Pid); err != nil {
+    proc.Memory = &MemoryMap{pid: proc.Pid}
+  }
+  err = proc.load(binaryName)
+
+  return
+}
+
+// load reads what there is to know about the process from its binary.
+func (proc *Process) load(binaryName string) (err error) {
   proc.Filename = binaryName
+  proc.ByteOrder, proc.PointerSize = dataLayout(binaryName)
   proc.DebugSymbols, err = ExtractSymbolTable(binaryName, 0)
   proc.Breakpoints = []*Breakpoint{}
 
   return
 }
-
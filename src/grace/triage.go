@@ -0,0 +1,422 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "crypto/sha1"
+  "encoding/hex"
+  "fmt"
+  "strings"
+  "syscall"
+)
+
+// HashFrames is how many frames of the crashing thread go into Triage.Hash
+const HashFrames = 5
+
+// nullPage bounds the addresses considered a NULL dereference, and how far
+// below the stack pointer a fault still counts as running off the stack.
+const (
+  nullPage    = 64 << 10
+  stackSlack  = 64 << 10
+)
+
+// AccessType is what the faulting instruction tried to do with memory
+type AccessType int
+const (
+  AccessUnknown AccessType = iota
+  AccessRead
+  AccessWrite
+  AccessExec
+)
+
+func (a AccessType) String() string {
+  switch a {
+  case AccessRead: return "read"
+  case AccessWrite: return "write"
+  case AccessExec: return "exec"
+  }
+  return "unknown"
+}
+
+// AddressClass says where a faulting address lies
+type AddressClass int
+const (
+  AddrUnknown AddressClass = iota
+  AddrNull
+  AddrStack
+  AddrHeap
+  AddrModule
+  AddrAnonymous
+  AddrUnmapped
+  AddrNonCanonical
+)
+
+func (c AddressClass) String() string {
+  switch c {
+  case AddrNull: return "null"
+  case AddrStack: return "stack"
+  case AddrHeap: return "heap"
+  case AddrModule: return "module"
+  case AddrAnonymous: return "anonymous"
+  case AddrUnmapped: return "unmapped"
+  case AddrNonCanonical: return "non-canonical"
+  }
+  return "unknown"
+}
+
+// Exploitability rates a crash, in the categories used by !exploitable
+type Exploitability int
+const (
+  RatingUnknown Exploitability = iota
+  NotExploitable
+  ProbablyNotExploitable
+  ProbablyExploitable
+  Exploitable
+)
+
+func (e Exploitability) String() string {
+  switch e {
+  case NotExploitable: return "NOT_EXPLOITABLE"
+  case ProbablyNotExploitable: return "PROBABLY_NOT_EXPLOITABLE"
+  case ProbablyExploitable: return "PROBABLY_EXPLOITABLE"
+  case Exploitable: return "EXPLOITABLE"
+  }
+  return "UNKNOWN"
+}
+
+// Triage is the verdict on a crash
+type Triage struct {
+  // Bucket is a short name for the kind of crash, e.g. WriteAVNearNull
+  Bucket       string
+  Rating       Exploitability
+  Description  string
+  Access       AccessType
+  Address      AddressClass
+  // BadPC is set when the program counter isn't in executable memory
+  BadPC        bool
+  // Instruction is the faulting instruction, when it could be decoded
+  Instruction  string `json:",omitempty"`
+  // Hash identifies the crash by the top HashFrames frames of the crashing
+  // thread, for deduplication
+  Hash         string
+}
+
+func (t *Triage) String() string {
+  hash := t.Hash
+  if len(hash) > 16 {
+    hash = hash[:16]
+  }
+  return fmt.Sprintf("%s %s (%s) %s", hash, t.Bucket, t.Rating, t.Description)
+}
+
+// region returns the region of the report's memory map that holds addr.
+func (r *CrashReport) region(addr uint64) *CrashRegion {
+  for i := range r.Memory {
+    if addr >= r.Memory[i].Start && addr < r.Memory[i].End {
+      return &r.Memory[i]
+    }
+  }
+  return nil
+}
+
+// classifyAddress works out what kind of memory addr is, given the stack
+// pointer of the thread that touched it.
+func (r *CrashReport) classifyAddress(addr, sp uint64) AddressClass {
+  if addr < nullPage {
+    return AddrNull
+  }
+  if addr >= 1 << 47 && addr < 0xffff800000000000 {
+    return AddrNonCanonical
+  }
+
+  region := r.region(addr)
+  spRegion := r.region(sp)
+  switch {
+  case region == nil && nearStack(addr, sp):
+    return AddrStack
+  case region == nil:
+    return AddrUnmapped
+  case region.Kind == "stack" || region == spRegion:
+    return AddrStack
+  case region.Kind == "heap":
+    return AddrHeap
+  case region.Path != "" && region.Kind == "file":
+    return AddrModule
+  }
+
+  // Thread stacks are anonymous mappings, with a guard page below
+  if spRegion != nil && addr < spRegion.Start && spRegion.Start - addr <= stackSlack {
+    return AddrStack
+  }
+  return AddrAnonymous
+}
+
+// nearStack tells whether addr is close enough to the stack pointer sp to be
+// part of the same frame or the next one.
+func nearStack(addr, sp uint64) bool {
+  if addr <= sp {
+    return sp - addr < stackSlack
+  }
+  return addr - sp < stackSlack
+}
+
+// faultingInstruction returns the decoded instruction at the PC, if any.
+func (r *CrashReport) faultingInstruction() *Instruction {
+  for _, inst := range r.Disassembly {
+    if inst.Address == r.PC {
+      return inst
+    }
+  }
+  if r.PC < r.CodeAddress || r.PC >= r.CodeAddress + uint64(len(r.CodeBytes)) {
+    return nil
+  }
+  inst, _ := Decode(r.CodeBytes[r.PC - r.CodeAddress:], r.PC)
+  return inst
+}
+
+// accessType infers what the faulting instruction was doing, given the stack
+// pointer sp. Faults on executing are told by the PC, the rest by decoding
+// the instruction. When that's not possible, permission faults on memory that
+// can be read must have been writes.
+func (r *CrashReport) accessType(sp uint64) AccessType {
+  if ! r.FromKernel {
+    return AccessUnknown
+  }
+  if r.FaultAddress == r.PC {
+    return AccessExec
+  }
+
+  region := r.region(r.FaultAddress)
+  readOnly := region != nil && strings.HasPrefix(region.Perms, "r") &&
+              region.Perms[1] != 'w'
+  // push and call write just below the stack pointer
+  stackWrite := r.FaultAddress < sp && sp - r.FaultAddress <= 16
+
+  inst := r.faultingInstruction()
+  switch {
+  case inst == nil:
+  case inst.MemRead && inst.MemWrite:
+    // The read comes first, so only memory that can be read faults on the
+    // write
+    if r.Code == "SEGV_ACCERR" && readOnly {
+      return AccessWrite
+    }
+    return AccessRead
+  case inst.MemWrite:
+    return AccessWrite
+  case (inst.Mnemonic == "push" || inst.Mnemonic == "call") && stackWrite:
+    return AccessWrite
+  case inst.MemRead:
+    return AccessRead
+  }
+  if inst != nil {
+    switch inst.Mnemonic {
+    case "push", "call", "enter":
+      return AccessWrite
+    case "pop", "ret", "leave", "iretq":
+      return AccessRead
+    }
+  }
+
+  if r.Code == "SEGV_ACCERR" && readOnly {
+    return AccessWrite
+  }
+  return AccessUnknown
+}
+
+// controlFlowFault tells whether the fault happened reading the target of an
+// indirect call or jump.
+func (r *CrashReport) controlFlowFault() bool {
+  inst := r.faultingInstruction()
+  return inst != nil && inst.Indirect && inst.MemRead
+}
+
+// allocatorFunctions are where heap corruption is noticed; an abort from
+// within them means the allocator's consistency checks failed.
+var allocatorFunctions = []string{"malloc_printerr", "malloc", "free", "realloc",
+                                  "calloc", "cfree", "memalign",
+                                  "posix_memalign", "_int_malloc", "_int_free",
+                                  "__libc_malloc", "__libc_free",
+                                  "__libc_realloc"}
+
+// guarded tells whether addr can't be accessed at all, like the unmapped
+// space or guard page a stack runs into.
+func (r *CrashReport) guarded(addr uint64) bool {
+  region := r.region(addr)
+  return region == nil || region.Perms[:3] == "---"
+}
+
+// inFrames tells whether any frame of the crashing thread is in one of the
+// named functions.
+func (r *CrashReport) inFrames(names ...string) bool {
+  if len(r.Threads) == 0 {
+    return false
+  }
+  for _, f := range r.Threads[0].Frames {
+    for _, name := range names {
+      if f.Function == name {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// recursing tells whether the crashing thread's stack is full of one
+// function calling itself, as it is after a runaway recursion.
+func (r *CrashReport) recursing() bool {
+  if len(r.Threads) == 0 {
+    return false
+  }
+  frames := r.Threads[0].Frames
+  if len(frames) < maxFrames / 2 {
+    return false
+  }
+  seen := make(map[uint64]int)
+  for _, f := range frames {
+    seen[f.PC]++
+  }
+  for _, n := range seen {
+    if n > len(frames) / 8 {
+      return true
+    }
+  }
+  return false
+}
+
+// CrashHash returns a stable identifier for the top n frames of the crashing
+// thread. Frames are named by function and offset, or by module and link-time
+// address when there's no symbol, so the hash survives address space
+// randomization.
+func CrashHash(r *CrashReport, n int) string {
+  h := sha1.New()
+  if len(r.Threads) > 0 {
+    frames := r.Threads[0].Frames
+    if len(frames) > n {
+      frames = frames[:n]
+    }
+    for _, f := range frames {
+      switch {
+      case f.Function != "":
+        fmt.Fprintf(h, "%s!%s+0x%x\n", f.Module, f.Function, f.Offset)
+      case f.Module != "":
+        fmt.Fprintf(h, "%s+0x%x\n", f.Module, f.ModulePC)
+      default:
+        fmt.Fprintf(h, "0x%x\n", f.PC)
+      }
+    }
+  }
+  return hex.EncodeToString(h.Sum(nil))
+}
+
+// Classify triages a crash report in the spirit of !exploitable, looking at
+// the signal, the faulting access and address and the state of the PC.
+func Classify(r *CrashReport) *Triage {
+  t := &Triage{Hash: CrashHash(r, HashFrames)}
+  sig := syscall.Signal(r.SignalNumber)
+
+  var sp uint64
+  if r.Registers != nil {
+    sp = r.Registers.Rsp
+  }
+  if r.FromKernel && (sig == syscall.SIGSEGV || sig == syscall.SIGBUS) {
+    t.Access = r.accessType(sp)
+    t.Address = r.classifyAddress(r.FaultAddress, sp)
+  }
+  if inst := r.faultingInstruction(); inst != nil {
+    t.Instruction = inst.String()
+  }
+  if region := r.region(r.PC); region == nil || ! strings.Contains(region.Perms, "x") {
+    t.BadPC = true
+  }
+
+  set := func(bucket string, rating Exploitability, desc string) {
+    t.Bucket, t.Rating, t.Description = bucket, rating, desc
+  }
+
+  switch {
+  case t.BadPC && r.PC < nullPage:
+    set("BranchAVNearNull", ProbablyNotExploitable,
+        "Call or jump through a NULL function pointer")
+  case t.BadPC:
+    set("BranchAV", Exploitable,
+        "Execution of memory that isn't code; the PC is likely attacker controlled")
+
+  case sig == syscall.SIGABRT && r.inFrames("__stack_chk_fail", "__fortify_fail"):
+    set("StackBufferOverrun", Exploitable, "A stack cookie check or FORTIFY check failed")
+  case sig == syscall.SIGABRT && r.inFrames(allocatorFunctions...):
+    set("HeapCorruption", Exploitable, "The allocator detected heap corruption")
+  case sig == syscall.SIGABRT:
+    set("AbortSignal", NotExploitable, "The program aborted, e.g. on a failed assertion")
+
+  case sig == syscall.SIGFPE:
+    set("DivideByZero", NotExploitable, "Integer division by zero or overflow")
+  case sig == syscall.SIGILL && r.Code == "ILL_PRVOPC":
+    set("PrivilegedInstruction", ProbablyExploitable,
+        "Execution of a privileged instruction")
+  case sig == syscall.SIGILL:
+    set("IllegalInstruction", ProbablyExploitable,
+        "Execution of an invalid instruction, possibly misaligned or corrupt code")
+
+  case sig != syscall.SIGSEGV && sig != syscall.SIGBUS:
+    set("Signal", RatingUnknown, "Fatal signal " + r.Signal)
+  case r.Code == "SI_KERNEL":
+    // A general protection fault: the address was non-canonical, which the
+    // kernel doesn't report
+    t.Address = AddrNonCanonical
+    set("GeneralProtection", ProbablyExploitable,
+        "Access to a non-canonical address, typically a wild or corrupt pointer")
+  case ! r.FromKernel:
+    set("Signal", NotExploitable, r.Signal + " sent by a process")
+
+  case t.Address == AddrStack && (r.guarded(r.FaultAddress) || r.recursing()):
+    set("StackExhaustion", NotExploitable,
+        "The stack overflowed, likely through unbounded recursion")
+  case t.Access == AccessExec:
+    set("DEPViolation", Exploitable, "Execution of non-executable memory")
+  case t.Access == AccessWrite && t.Address == AddrNull:
+    set("WriteAVNearNull", ProbablyExploitable, "Write to an address near NULL")
+  case t.Access == AccessWrite:
+    set("WriteAV", Exploitable, "Write to an invalid address")
+  case t.Access == AccessRead && t.Address != AddrNull && r.controlFlowFault():
+    set("ReadAVOnControlFlow", Exploitable,
+        "Read of a call or jump target from an invalid address")
+  case t.Address == AddrNull:
+    set("ReadAVNearNull", ProbablyNotExploitable, "Read from an address near NULL")
+  case sig == syscall.SIGBUS:
+    set("BusError", ProbablyNotExploitable,
+        "Misaligned access or access past the end of a mapped file")
+  case t.Access == AccessRead:
+    set("ReadAV", RatingUnknown, "Read from an invalid address")
+  default:
+    set("AccessViolation", RatingUnknown, "Access to an invalid address")
+  }
+  return t
+}
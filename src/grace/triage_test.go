@@ -0,0 +1,168 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "syscall"
+  "testing"
+)
+
+// crashFrames is the stack of a crash in a PIE executable, loaded at bias.
+func crashFrames(bias uint64) []Frame {
+  return []Frame{
+    {PC: bias + 0x1149, Module: "crash", ModulePC: 0x1149, Function: "store", Offset: 0x10},
+    {PC: bias + 0x1190, Module: "crash", ModulePC: 0x1190, Function: "main", Offset: 0x25},
+    {PC: 0x7f0000029d90, Module: "libc.so.6", ModulePC: 0x29d90},
+    {PC: 0x7f0000029e40, Module: "libc.so.6", ModulePC: 0x29e40,
+     Function: "__libc_start_main", Offset: 0x80},
+    {PC: bias + 0x1065, Module: "crash", ModulePC: 0x1065, Function: "_start", Offset: 0x25},
+    {PC: 0xdeadbeef},
+  }
+}
+
+func TestCrashHash(t *testing.T) {
+  r := &CrashReport{Threads: []ThreadReport{{Tid: 1, Frames: crashFrames(0x555555554000)}}}
+  const want = "26daa956a7d4d85444e3ae243fe64311e75073b5"
+  if got := CrashHash(r, HashFrames); got != want {
+    t.Errorf("CrashHash = %s, want %s", got, want)
+  }
+
+  // The load address and frames past the first n don't matter
+  moved := &CrashReport{Threads: []ThreadReport{{Tid: 1, Frames: crashFrames(0x562a3c6f1000)}}}
+  moved.Threads[0].Frames[5].PC = 0x1234
+  if got := CrashHash(moved, HashFrames); got != want {
+    t.Errorf("CrashHash after a move = %s, want %s", got, want)
+  }
+
+  if CrashHash(r, 1) == CrashHash(r, 2) {
+    t.Errorf("CrashHash ignores the second frame")
+  }
+  if got := CrashHash(&CrashReport{}, HashFrames); got != "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+    t.Errorf("CrashHash of no frames = %s", got)
+  }
+}
+
+func TestClassify(t *testing.T) {
+  const (
+    text  = 0x555555555000
+    heap  = 0x555555559000
+    stack = 0x7ffffffde000
+    sp    = stack + 0x1000
+  )
+  memory := []CrashRegion{
+    {text, text + 0x1000, "r-xp", "file", "/tmp/crash"},
+    {heap, heap + 0x21000, "rw-p", "heap", "[heap]"},
+    {stack, stack + 0x21000, "rw-p", "stack", "[stack]"},
+  }
+  tests := []struct {
+    name    string
+    sig     syscall.Signal
+    code    string
+    kernel  bool
+    fault   uint64
+    pc      uint64
+    insn    []byte
+    frames  []string
+    bucket  string
+    rating  Exploitability
+  }{
+    {"null read", syscall.SIGSEGV, "SEGV_MAPERR", true, 0x10, text, []byte{0x48, 0x8b, 0x40, 0x10},
+     nil, "ReadAVNearNull", ProbablyNotExploitable},
+    {"null write", syscall.SIGSEGV, "SEGV_MAPERR", true, 0x10, text, []byte{0x48, 0x89, 0x40, 0x10},
+     nil, "WriteAVNearNull", ProbablyExploitable},
+    {"wild write", syscall.SIGSEGV, "SEGV_MAPERR", true, 0x41414141, text, []byte{0x48, 0x89, 0x00},
+     nil, "WriteAV", Exploitable},
+    {"wild read", syscall.SIGSEGV, "SEGV_MAPERR", true, 0x41414141, text, []byte{0x48, 0x8b, 0x00},
+     nil, "ReadAV", RatingUnknown},
+    {"call through wild pointer", syscall.SIGSEGV, "SEGV_MAPERR", true, 0x41414141, text,
+     []byte{0xff, 0x10}, nil, "ReadAVOnControlFlow", Exploitable},
+    {"write to text", syscall.SIGSEGV, "SEGV_ACCERR", true, text + 0x10, text, []byte{0x48, 0x89, 0x00},
+     nil, "WriteAV", Exploitable},
+    {"stack overflow", syscall.SIGSEGV, "SEGV_MAPERR", true, stack - 8, text, []byte{0x55},
+     nil, "StackExhaustion", NotExploitable},
+    {"jump to null", syscall.SIGSEGV, "SEGV_MAPERR", true, 0, 0, nil,
+     nil, "BranchAVNearNull", ProbablyNotExploitable},
+    {"jump to heap", syscall.SIGSEGV, "SEGV_ACCERR", true, heap + 0x100, heap + 0x100, nil,
+     nil, "BranchAV", Exploitable},
+    {"general protection", syscall.SIGSEGV, "SI_KERNEL", true, 0, text, []byte{0x48, 0x8b, 0x00},
+     nil, "GeneralProtection", ProbablyExploitable},
+    {"kill -SEGV", syscall.SIGSEGV, "SI_USER", false, 0, text, nil,
+     nil, "Signal", NotExploitable},
+    {"stack smashing", syscall.SIGABRT, "SI_TKILL", false, 0, text, nil,
+     []string{"raise", "abort", "__fortify_fail", "__stack_chk_fail", "main"},
+     "StackBufferOverrun", Exploitable},
+    {"heap corruption", syscall.SIGABRT, "SI_TKILL", false, 0, text, nil,
+     []string{"raise", "abort", "malloc_printerr", "_int_free", "main"}, "HeapCorruption", Exploitable},
+    {"assertion", syscall.SIGABRT, "SI_TKILL", false, 0, text, nil,
+     []string{"raise", "abort", "__assert_fail", "main"}, "AbortSignal", NotExploitable},
+    {"division", syscall.SIGFPE, "FPE_INTDIV", true, text, text, []byte{0x48, 0xf7, 0xf9},
+     nil, "DivideByZero", NotExploitable},
+    {"illegal instruction", syscall.SIGILL, "ILL_ILLOPN", true, text, text, []byte{0x0f, 0x0b},
+     nil, "IllegalInstruction", ProbablyExploitable},
+    {"bus error", syscall.SIGBUS, "BUS_ADRERR", true, heap + 0x100, text, []byte{0x48, 0x8b, 0x00},
+     nil, "BusError", ProbablyNotExploitable},
+  }
+  for _, test := range tests {
+    r := &CrashReport{Signal: signalName(test.sig), SignalNumber: int(test.sig), Code: test.code,
+                      FromKernel: test.kernel, FaultAddress: test.fault, PC: test.pc,
+                      Registers: &RegisterState{}, CodeAddress: test.pc, CodeBytes: test.insn,
+                      Memory: memory}
+    r.Registers.Rsp = sp
+    frames := []Frame{}
+    for _, name := range test.frames {
+      frames = append(frames, Frame{Function: name})
+    }
+    r.Threads = []ThreadReport{{Frames: frames}}
+
+    got := Classify(r)
+    if got.Bucket != test.bucket || got.Rating != test.rating {
+      t.Errorf("%s: classified as %s (%s), want %s (%s)", test.name, got.Bucket, got.Rating,
+               test.bucket, test.rating)
+    }
+  }
+}
+
+func TestTriageString(t *testing.T) {
+  tests := []struct {
+    triage  Triage
+    want    string
+  }{
+    {Triage{Bucket: "WriteAV", Rating: Exploitable, Description: "write to 0x41414141",
+            Hash: "26daa956a7d4d85444e3ae243fe64311e75073b5"},
+     "26daa956a7d4d854 WriteAV (EXPLOITABLE) write to 0x41414141"},
+    {Triage{Bucket: "AbortSignal", Hash: "26daa9"}, "26daa9 AbortSignal (UNKNOWN) "},
+    {Triage{}, "  (UNKNOWN) "},
+  }
+  for _, test := range tests {
+    if got := test.triage.String(); got != test.want {
+      t.Errorf("got %q, want %q", got, test.want)
+    }
+  }
+}
@@ -31,6 +31,8 @@ package grace
 
 import "syscall"
 import "os"
+import "encoding/binary"
+import "time"
 
 // Process represents a currently-executing process
 type Process struct {
@@ -40,12 +42,66 @@ type Process struct {
   // DebugSymbols is the symbol table in case the binary has debugging symbols
   // compiled in. If not, it's empty.
   DebugSymbols   *SymbolTable
-  Memory          MemoryMap
+  Memory         *MemoryMap
   Files        []*os.File
   Breakpoints  []*Breakpoint
+  Instruments  []*Instrument
   Registers      *RegisterState
+  // Threads holds every task of the process, keyed by thread id
+  Threads         map[int]*Thread
+  // ByteOrder and PointerSize describe the target's data layout, taken from
+  // the ELF header of Filename
+  ByteOrder       binary.ByteOrder
+  PointerSize     int
 
   isRunning       bool      
+  memAccess      *memoryAccess
+  target          targetBackend
+  modules       []*Module
+  // modulesMap and modulesFiles are the memory map modules was built from
+  // and its files count then
+  modulesMap     *MemoryMap
+  modulesFiles    int
+  // current is the thread whose stop is being handled
+  current        *Thread
+  // pending holds stops collected while stopping all threads, which the
+  // event loop handles before waiting for new ones
+  pending       []threadEvent
+  // holdStops makes a step leave the stops of other threads queued rather
+  // than end on them
+  holdStops       bool
+  crashHandler    func(*CrashReport)
+  // faults are the system call faults put in place with InjectFault
+  faults        []*SyscallFault
+  // codePages hold the trampolines of Instruments
+  codePages     []*codePage
+  // coverage is what StartCoverage is collecting
+  coverage       *Coverage
+  // recorder is the TraceRecorder recording events, if any
+  recorder       *TraceRecorder
+  // profile is the last Profile started
+  profile        *Profile
+}
+
+// Thread is a single task (LWP) of the traced process
+type Thread struct {
+  Tid         int
+  stopped     bool
+  // expectStop is set while a SIGSTOP sent by the tracer hasn't been seen
+  // yet, so that it's swallowed rather than delivered
+  expectStop  bool
+  // resumeOver is a breakpoint the thread was left on after its handler
+  // returned STOP, to be stepped over rather than hit again on resuming
+  resumeOver *Breakpoint
+  // faulted is set while the thread is in a system call that a
+  // SyscallFault made fail, which is to return faultResult
+  faulted     bool
+  faultResult uint64
+}
+
+type threadEvent struct {
+  tid     int
+  status  syscall.WaitStatus
 }
 
 type RegisterState struct {
@@ -53,29 +109,80 @@ type RegisterState struct {
 }
 
 const INT3 = 0xcc
+// BpCallback is the original form of breakpoint callback, which only gets the
+// registers. CallbackHandler turns one into a BreakpointHandler.
 type BpCallback func (*RegisterState) Action
 type Breakpoint struct {
   Address    uint64
   savedInstr []byte
   Active     bool
+  // Callback is what AddBreakpoint sets, and is run when there's no Handler.
+  //
+  // Deprecated: use Handler, which gets the whole BreakpointContext.
   Callback   BpCallback
+  Handler    BreakpointHandler
   HitCount   uint64
+  // quiet breakpoints are the tracer's own and their hits aren't recorded
+  quiet      bool
+}
+
+// BreakpointContext is what a BreakpointHandler gets to work with when its
+// breakpoint is hit.
+type BreakpointContext struct {
+  Process     *Process
+  // Thread is the thread that hit the breakpoint, which is also the current
+  // one for GetRegisters, SetRegisters and Backtrace
+  Thread      *Thread
+  Breakpoint  *Breakpoint
+  // Instrument is set instead of Breakpoint for the handler of an
+  // instrument
+  Instrument  *Instrument
+  // Regs are the thread's registers, with the PC on the breakpoint. Changes
+  // to them are written back when the handler returns.
+  Regs        *RegisterState
+  // Time is when the hit was seen
+  Time         time.Time
+  // Stepping is set when the handler is called after an instruction in
+  // SINGLE_STEP_MODE, rather than for a hit
+  Stepping     bool
+  // Return is the value the function returns when the handler returns
+  // SKIP_FUNCTION
+  Return       uint64
 }
 
+// BreakpointHandler is invoked every time its breakpoint is hit.
+type BreakpointHandler func (*BreakpointContext) Action
+
 type TracerError string
+// MemoryRegion is a single line of /proc/pid/maps
 type MemoryRegion struct {
-  Address uint64
-  Offset uint64
-  File string
-  Size int
-  Permissions string // TODO: proper bitmask?
+  Address   uint64
+  Size      uint64
+  // Offset is the offset into the backing file, if any
+  Offset    uint64
+  Perms     Permissions
+  // Major, Minor and Inode identify the backing file
+  Major     uint32
+  Minor     uint32
+  Inode     uint64
+  Pathname  string
+  Kind      RegionKind
 }
 
-type MemoryMap map[uint64]MemoryRegion
+// MemoryMap is the target's address space layout, sorted by address. It is
+// read when the process is loaded; Refresh re-reads it from the live process.
+type MemoryMap struct {
+  Regions []MemoryRegion
+  pid     int
+  // files counts the refreshes that changed the file mappings, so what's
+  // derived from them can tell when it's stale
+  files   int
+}
 type CompiledFile struct {
   Filename string
   Lowpc, Highpc  uint64
   Functions map[string]CompiledFunction
+  Variables map[string]CompiledVariable
 }
 
 type SymbolTable map[string]CompiledFile
@@ -89,6 +196,13 @@ func (c CompiledFunction) Address() uint64 {
   return c.Lowpc
 }
 
+// CompiledVariable is a global or static variable with a fixed address
+type CompiledVariable struct {
+  Name string
+  Address, Size uint64
+  Lineno  int
+}
+
 type InstantiatedRange interface {
   High() uint64
   Low() uint64
@@ -107,8 +221,34 @@ func (c CompiledFunction) Low() uint64 {
   return c.Lowpc
 }
 
+// Action is what a breakpoint handler wants done once it returns
 type Action int
 const (
+  // CONTINUE resumes the thread
   CONTINUE = iota
+  // ABORT kills the target, as KILL_TARGET does
   ABORT
+  // REMOVE deletes the breakpoint and resumes the thread
+  REMOVE
+  // DISABLE takes the breakpoint out of the code until EnableBreakpoint is
+  // called, and resumes the thread
+  DISABLE
+  // STOP makes StartProcess return StatusStopped, with every thread
+  // stopped, so the caller can take over. Calling StartProcess again
+  // carries on from the breakpoint without hitting it again.
+  STOP
+  // DETACH removes every breakpoint and lets the process go, and makes
+  // StartProcess return StatusDetached
+  DETACH
+  // KILL_TARGET kills the process with SIGKILL. StartProcess returns
+  // StatusKilled once it's gone.
+  KILL_TARGET
+  // SKIP_FUNCTION returns from the function straight away, with the
+  // context's Return as the return value. It's meant for breakpoints on the
+  // first instruction of a function.
+  SKIP_FUNCTION
+  // SINGLE_STEP_MODE single-steps the thread, calling the handler again
+  // after every instruction, until it returns something else or the thread
+  // gets to a breakpoint
+  SINGLE_STEP_MODE
 )
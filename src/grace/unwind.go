@@ -0,0 +1,893 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "encoding/binary"
+  "fmt"
+  "sort"
+)
+
+// DWARF register numbers on x86-64, which is how call frame information
+// refers to registers
+const (
+  dwRax = iota
+  dwRdx
+  dwRcx
+  dwRbx
+  dwRsi
+  dwRdi
+  dwRbp
+  dwRsp
+  dwR8
+  dwR9
+  dwR10
+  dwR11
+  dwR12
+  dwR13
+  dwR14
+  dwR15
+  dwRip
+  dwRegs
+)
+
+// maxFrames bounds a backtrace, in case the stack is corrupt and unwinding
+// goes round in circles.
+const maxFrames = 256
+
+// Frame is one level of a backtrace
+type Frame struct {
+  PC        uint64
+  SP        uint64
+  Module    string
+  // ModulePC is PC at the module's link-time address, which stays the same
+  // from run to run
+  ModulePC  uint64
+  Function  string
+  // Offset is how far PC is into Function
+  Offset    uint64
+  // Signal is set for the frame of a signal handler trampoline
+  Signal    bool
+}
+
+func (f Frame) String() string {
+  s := fmt.Sprintf("0x%016x", f.PC)
+  if f.Function != "" {
+    s += " in " + f.Function
+    if f.Offset != 0 {
+      s += fmt.Sprintf("+0x%x", f.Offset)
+    }
+  }
+  if f.Module != "" {
+    s += " (" + f.Module + ")"
+  }
+  return s
+}
+
+// unwindRegs is a register set during unwinding, indexed by DWARF number.
+// Registers whose value can't be recovered in a caller's frame aren't ok.
+type unwindRegs struct {
+  val  [dwRegs]uint64
+  ok   [dwRegs]bool
+}
+
+func unwindRegsFrom(r *RegisterState) (u unwindRegs) {
+  u.val = [dwRegs]uint64{r.Rax, r.Rdx, r.Rcx, r.Rbx, r.Rsi, r.Rdi, r.Rbp, r.Rsp,
+                         r.R8, r.R9, r.R10, r.R11, r.R12, r.R13, r.R14, r.R15,
+                         r.Rip}
+  for i := range u.ok {
+    u.ok[i] = true
+  }
+  return
+}
+
+// dwReader decodes the encodings used in .eh_frame and DWARF expressions.
+// Reading past the end yields zeroes and sets bad.
+type dwReader struct {
+  data  []byte
+  off   int
+  bad   bool
+}
+
+func (r *dwReader) bytes(n int) []byte {
+  if n < 0 || r.off < 0 || r.off + n > len(r.data) {
+    r.bad = true
+    r.off = len(r.data)
+    return make([]byte, n & 0xff)
+  }
+  b := r.data[r.off:r.off+n]
+  r.off += n
+  return b
+}
+
+func (r *dwReader) u8() uint8 {
+  return r.bytes(1)[0]
+}
+
+func (r *dwReader) u16() uint16 {
+  return binary.LittleEndian.Uint16(r.bytes(2))
+}
+
+func (r *dwReader) u32() uint32 {
+  return binary.LittleEndian.Uint32(r.bytes(4))
+}
+
+func (r *dwReader) u64() uint64 {
+  return binary.LittleEndian.Uint64(r.bytes(8))
+}
+
+func (r *dwReader) uleb() (v uint64) {
+  for shift := uint(0); ; shift += 7 {
+    b := r.u8()
+    if shift < 64 {
+      v |= uint64(b & 0x7f) << shift
+    }
+    if b & 0x80 == 0 || r.bad {
+      return
+    }
+  }
+}
+
+func (r *dwReader) sleb() (v int64) {
+  var shift uint
+  var b byte
+  for {
+    b = r.u8()
+    if shift < 64 {
+      v |= int64(b & 0x7f) << shift
+    }
+    shift += 7
+    if b & 0x80 == 0 || r.bad {
+      break
+    }
+  }
+  if shift < 64 && b & 0x40 != 0 {
+    v |= -1 << shift
+  }
+  return
+}
+
+func (r *dwReader) cstring() string {
+  start := r.off
+  for r.off < len(r.data) && r.data[r.off] != 0 {
+    r.off++
+  }
+  s := string(r.data[start:r.off])
+  r.off++
+  return s
+}
+
+// pointer reads a pointer in one of the DW_EH_PE encodings. base is the
+// address data[0] is loaded at, for pc-relative values.
+func (r *dwReader) pointer(enc byte, base uint64) (v uint64) {
+  const omit = 0xff
+  if enc == omit {
+    return 0
+  }
+  pos := base + uint64(r.off)
+  switch enc & 0x0f {
+  case 0x00, 0x04, 0x0c: v = r.u64()
+  case 0x01: v = r.uleb()
+  case 0x02: v = uint64(r.u16())
+  case 0x03: v = uint64(r.u32())
+  case 0x09: v = uint64(r.sleb())
+  case 0x0a: v = uint64(int64(int16(r.u16())))
+  case 0x0b: v = uint64(int64(int32(r.u32())))
+  default:
+    r.bad = true
+  }
+  if enc & 0x70 == 0x10 {
+    v += pos
+  }
+  return v
+}
+
+// cie is a Common Information Entry of .eh_frame
+type cie struct {
+  codeAlign  uint64
+  dataAlign  int64
+  raReg      uint64
+  fdeEnc     byte
+  augmented  bool
+  signal     bool
+  initial  []byte
+}
+
+// fde is a Frame Description Entry: the unwind rules for one function
+type fde struct {
+  begin, end  uint64
+  cie        *cie
+  insns     []byte
+}
+
+// frameTable holds the parsed .eh_frame section of a module. Addresses are
+// link-time ones.
+type frameTable struct {
+  addr   uint64
+  fdes []fde
+}
+
+func parseCIE(data []byte, start int, addr uint64) *cie {
+  r := &dwReader{data: data, off: start}
+  length := uint64(r.u32())
+  if length == 0xffffffff {
+    length = r.u64()
+  }
+  end := r.off + int(length)
+  if r.bad || end > len(data) || end < r.off {
+    return nil
+  }
+  r.data = data[:end]
+  r.u32() // CIE id
+
+  c := &cie{}
+  version := r.u8()
+  aug := r.cstring()
+  if len(aug) >= 2 && aug[:2] == "eh" {
+    r.u64()
+  }
+  c.codeAlign = r.uleb()
+  c.dataAlign = r.sleb()
+  if version == 1 {
+    c.raReg = uint64(r.u8())
+  } else {
+    c.raReg = r.uleb()
+  }
+
+  if len(aug) > 0 && aug[0] == 'z' {
+    c.augmented = true
+    augEnd := int(r.uleb()) + r.off
+    for _, ch := range aug[1:] {
+      switch ch {
+      case 'L':
+        r.u8()
+      case 'P':
+        r.pointer(r.u8() &^ 0x80, addr)
+      case 'R':
+        c.fdeEnc = r.u8()
+      case 'S':
+        c.signal = true
+      }
+    }
+    r.off = augEnd
+  }
+  if r.bad || r.off < 0 || r.off > end {
+    return nil
+  }
+  c.initial = data[r.off:end]
+  return c
+}
+
+// parseEhFrame indexes the FDEs of an .eh_frame section loaded at addr.
+func parseEhFrame(data []byte, addr uint64) *frameTable {
+  t := &frameTable{addr: addr}
+  cies := make(map[int]*cie)
+
+  for off := 0; off + 4 <= len(data); {
+    r := &dwReader{data: data, off: off}
+    length := uint64(r.u32())
+    if length == 0 {
+      break
+    }
+    if length == 0xffffffff {
+      length = r.u64()
+    }
+    end := r.off + int(length)
+    if end > len(data) || end <= r.off {
+      break
+    }
+    off = end
+
+    idPos := r.off
+    id := r.u32()
+    if id == 0 {
+      continue
+    }
+
+    ciePos := idPos - int(id)
+    c, ok := cies[ciePos]
+    if ! ok {
+      c = parseCIE(data, ciePos, addr)
+      cies[ciePos] = c
+    }
+    if c == nil {
+      continue
+    }
+
+    r.data = data[:end]
+    begin := r.pointer(c.fdeEnc, addr)
+    size := r.pointer(c.fdeEnc & 0x0f, addr)
+    if c.augmented {
+      r.off += int(r.uleb())
+    }
+    if r.bad || r.off < 0 || r.off > end {
+      continue
+    }
+    t.fdes = append(t.fdes, fde{begin, begin + size, c, data[r.off:end]})
+  }
+
+  sort.Slice(t.fdes, func(i, j int) bool {
+    return t.fdes[i].begin < t.fdes[j].begin
+  })
+  return t
+}
+
+// find returns the FDE covering the link-time address pc.
+func (t *frameTable) find(pc uint64) *fde {
+  i := sort.Search(len(t.fdes), func(i int) bool {
+    return t.fdes[i].end > pc
+  })
+  if i < len(t.fdes) && t.fdes[i].begin <= pc {
+    return &t.fdes[i]
+  }
+  return nil
+}
+
+// frameTable returns the module's unwind information, reading it on first
+// use. It's nil if the module has no .eh_frame.
+func (m *Module) frameTable() *frameTable {
+  if m.frames != nil {
+    return m.frames
+  }
+  m.frames = &frameTable{}
+
+  f, err := m.open()
+  if err != nil {
+    return m.frames
+  }
+  defer f.Close()
+
+  section := f.Section(".eh_frame")
+  if section == nil {
+    return m.frames
+  }
+  data, err := section.Data()
+  if err != nil {
+    return m.frames
+  }
+  m.frames = parseEhFrame(data, section.Addr)
+  return m.frames
+}
+
+type ruleKind uint8
+const (
+  ruleSame ruleKind = iota
+  ruleUndefined
+  ruleOffset
+  ruleValOffset
+  ruleRegister
+  ruleExpression
+  ruleValExpression
+)
+
+// regRule says how to recover a register of the calling frame
+type regRule struct {
+  kind    ruleKind
+  offset  int64
+  reg     uint64
+  expr  []byte
+}
+
+// unwindRow is the result of running the CFA program up to some address:
+// how to find the CFA, and every saved register relative to it.
+type unwindRow struct {
+  cfaReg     uint64
+  cfaOffset  int64
+  cfaExpr  []byte
+  rules      [dwRegs]regRule
+}
+
+func (row *unwindRow) set(reg uint64, rule regRule) {
+  if reg < dwRegs {
+    row.rules[reg] = rule
+  }
+}
+
+// execute runs CFA instructions for the code starting at loc, stopping once
+// they describe an address past target. initial is the row after the CIE's
+// instructions, for DW_CFA_restore.
+func (c *cie) execute(insns []byte, loc, target, base uint64, row *unwindRow,
+                      initial *unwindRow) error {
+  r := &dwReader{data: insns}
+  stack := []unwindRow{}
+
+  restore := func(reg uint64) {
+    if initial != nil && reg < dwRegs {
+      row.rules[reg] = initial.rules[reg]
+    }
+  }
+  advance := func(delta uint64) bool {
+    loc += delta * c.codeAlign
+    return loc > target
+  }
+
+  for r.off < len(insns) && ! r.bad {
+    op := r.u8()
+    switch op >> 6 {
+    case 1:
+      if advance(uint64(op & 0x3f)) {
+        return nil
+      }
+      continue
+    case 2:
+      row.set(uint64(op & 0x3f), regRule{kind: ruleOffset, offset: int64(r.uleb()) * c.dataAlign})
+      continue
+    case 3:
+      restore(uint64(op & 0x3f))
+      continue
+    }
+
+    switch op {
+    case 0x00: // nop
+    case 0x01: // set_loc
+      loc = r.pointer(c.fdeEnc, base)
+      if loc > target {
+        return nil
+      }
+    case 0x02:
+      if advance(uint64(r.u8())) {
+        return nil
+      }
+    case 0x03:
+      if advance(uint64(r.u16())) {
+        return nil
+      }
+    case 0x04:
+      if advance(uint64(r.u32())) {
+        return nil
+      }
+    case 0x05: // offset_extended
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleOffset, offset: int64(r.uleb()) * c.dataAlign})
+    case 0x06: // restore_extended
+      restore(r.uleb())
+    case 0x07: // undefined
+      row.set(r.uleb(), regRule{kind: ruleUndefined})
+    case 0x08: // same_value
+      row.set(r.uleb(), regRule{kind: ruleSame})
+    case 0x09: // register
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleRegister, reg: r.uleb()})
+    case 0x0a: // remember_state
+      stack = append(stack, *row)
+    case 0x0b: // restore_state
+      if len(stack) == 0 {
+        return fmt.Errorf("unbalanced DW_CFA_restore_state")
+      }
+      *row = stack[len(stack)-1]
+      stack = stack[:len(stack)-1]
+    case 0x0c: // def_cfa
+      row.cfaReg = r.uleb()
+      row.cfaOffset = int64(r.uleb())
+      row.cfaExpr = nil
+    case 0x0d: // def_cfa_register
+      row.cfaReg = r.uleb()
+      row.cfaExpr = nil
+    case 0x0e: // def_cfa_offset
+      row.cfaOffset = int64(r.uleb())
+    case 0x0f: // def_cfa_expression
+      row.cfaExpr = r.bytes(int(r.uleb()))
+    case 0x10: // expression
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleExpression, expr: r.bytes(int(r.uleb()))})
+    case 0x11: // offset_extended_sf
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleOffset, offset: r.sleb() * c.dataAlign})
+    case 0x12: // def_cfa_sf
+      row.cfaReg = r.uleb()
+      row.cfaOffset = r.sleb() * c.dataAlign
+      row.cfaExpr = nil
+    case 0x13: // def_cfa_offset_sf
+      row.cfaOffset = r.sleb() * c.dataAlign
+    case 0x14: // val_offset
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleValOffset, offset: int64(r.uleb()) * c.dataAlign})
+    case 0x15: // val_offset_sf
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleValOffset, offset: r.sleb() * c.dataAlign})
+    case 0x16: // val_expression
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleValExpression, expr: r.bytes(int(r.uleb()))})
+    case 0x2e: // GNU_args_size
+      r.uleb()
+    case 0x2f: // GNU_negative_offset_extended
+      reg := r.uleb()
+      row.set(reg, regRule{kind: ruleOffset, offset: -int64(r.uleb()) * c.dataAlign})
+    default:
+      return fmt.Errorf("unknown CFA instruction 0x%x", op)
+    }
+  }
+  if r.bad {
+    return fmt.Errorf("truncated CFA instructions")
+  }
+  return nil
+}
+
+// row computes the unwind rules in effect at the link-time address pc.
+func (t *frameTable) row(f *fde, pc uint64) (*unwindRow, error) {
+  row := &unwindRow{}
+  if err := f.cie.execute(f.cie.initial, f.begin, ^uint64(0), t.addr, row, nil); err != nil {
+    return nil, err
+  }
+  initial := *row
+  if err := f.cie.execute(f.insns, f.begin, pc, t.addr, row, &initial); err != nil {
+    return nil, err
+  }
+  return row, nil
+}
+
+// evalExpr runs a DWARF expression as found in call frame information,
+// with stack holding its initial contents.
+func (p *Process) evalExpr(expr []byte, regs *unwindRegs, stack ...uint64) (uint64, error) {
+  r := &dwReader{data: expr}
+  pop := func() uint64 {
+    if len(stack) == 0 {
+      r.bad = true
+      return 0
+    }
+    v := stack[len(stack)-1]
+    stack = stack[:len(stack)-1]
+    return v
+  }
+  push := func(v uint64) {
+    stack = append(stack, v)
+  }
+  reg := func(n uint64) uint64 {
+    if n >= dwRegs || ! regs.ok[n] {
+      r.bad = true
+      return 0
+    }
+    return regs.val[n]
+  }
+  boolean := func(b bool) uint64 {
+    if b {
+      return 1
+    }
+    return 0
+  }
+
+  for r.off < len(expr) && ! r.bad {
+    op := r.u8()
+    switch {
+    case op >= 0x30 && op <= 0x4f: // lit
+      push(uint64(op - 0x30))
+      continue
+    case op >= 0x50 && op <= 0x6f: // reg
+      push(reg(uint64(op - 0x50)))
+      continue
+    case op >= 0x70 && op <= 0x8f: // breg
+      push(reg(uint64(op - 0x70)) + uint64(r.sleb()))
+      continue
+    }
+
+    switch op {
+    case 0x03: push(r.u64())
+    case 0x06, 0x94: // deref, deref_size
+      size := 8
+      if op == 0x94 {
+        size = int(r.u8())
+        if size > 8 {
+          return 0, fmt.Errorf("DW_OP_deref_size of %d bytes", size)
+        }
+      }
+      buf := make([]byte, 8)
+      if _, err := p.ReadMemory(pop(), buf[:size]); err != nil {
+        return 0, err
+      }
+      push(binary.LittleEndian.Uint64(buf))
+    case 0x08: push(uint64(r.u8()))
+    case 0x09: push(uint64(int64(int8(r.u8()))))
+    case 0x0a: push(uint64(r.u16()))
+    case 0x0b: push(uint64(int64(int16(r.u16()))))
+    case 0x0c: push(uint64(r.u32()))
+    case 0x0d: push(uint64(int64(int32(r.u32()))))
+    case 0x0e, 0x0f: push(r.u64())
+    case 0x10: push(r.uleb())
+    case 0x11: push(uint64(r.sleb()))
+    case 0x12: // dup
+      v := pop()
+      push(v)
+      push(v)
+    case 0x13: pop()
+    case 0x14: // over
+      a, b := pop(), pop()
+      push(b)
+      push(a)
+      push(b)
+    case 0x15: // pick
+      i := int(r.u8())
+      if i >= len(stack) {
+        return 0, fmt.Errorf("DW_OP_pick out of range")
+      }
+      push(stack[len(stack)-1-i])
+    case 0x16: // swap
+      a, b := pop(), pop()
+      push(a)
+      push(b)
+    case 0x17: // rot
+      a, b, c := pop(), pop(), pop()
+      push(a)
+      push(c)
+      push(b)
+    case 0x19: // abs
+      v := int64(pop())
+      if v < 0 {
+        v = -v
+      }
+      push(uint64(v))
+    case 0x1a: b, a := pop(), pop(); push(a & b)
+    case 0x1b: // div
+      b, a := int64(pop()), int64(pop())
+      if b == 0 {
+        return 0, fmt.Errorf("division by zero in DWARF expression")
+      }
+      push(uint64(a / b))
+    case 0x1c: b, a := pop(), pop(); push(a - b)
+    case 0x1d: // mod
+      b, a := pop(), pop()
+      if b == 0 {
+        return 0, fmt.Errorf("division by zero in DWARF expression")
+      }
+      push(a % b)
+    case 0x1e: b, a := pop(), pop(); push(a * b)
+    case 0x1f: push(uint64(-int64(pop())))
+    case 0x20: push(^pop())
+    case 0x21: b, a := pop(), pop(); push(a | b)
+    case 0x22: b, a := pop(), pop(); push(a + b)
+    case 0x23: push(pop() + r.uleb())
+    case 0x24: b, a := pop(), pop(); push(a << b)
+    case 0x25: b, a := pop(), pop(); push(a >> b)
+    case 0x26: b, a := pop(), pop(); push(uint64(int64(a) >> b))
+    case 0x27: b, a := pop(), pop(); push(a ^ b)
+    case 0x28: // bra
+      off := int(int16(r.u16()))
+      if pop() != 0 {
+        r.off += off
+      }
+      if r.off < 0 {
+        r.bad = true
+      }
+    case 0x29: b, a := int64(pop()), int64(pop()); push(boolean(a == b))
+    case 0x2a: b, a := int64(pop()), int64(pop()); push(boolean(a >= b))
+    case 0x2b: b, a := int64(pop()), int64(pop()); push(boolean(a > b))
+    case 0x2c: b, a := int64(pop()), int64(pop()); push(boolean(a <= b))
+    case 0x2d: b, a := int64(pop()), int64(pop()); push(boolean(a < b))
+    case 0x2e: b, a := int64(pop()), int64(pop()); push(boolean(a != b))
+    case 0x2f: // skip
+      r.off += int(int16(r.u16()))
+      if r.off < 0 {
+        r.bad = true
+      }
+    case 0x90: push(reg(r.uleb()))
+    case 0x92:
+      n := r.uleb()
+      push(reg(n) + uint64(r.sleb()))
+    case 0x96: // nop
+    default:
+      return 0, fmt.Errorf("unsupported DWARF expression op 0x%x", op)
+    }
+  }
+
+  if r.bad || len(stack) == 0 {
+    return 0, fmt.Errorf("malformed DWARF expression")
+  }
+  return stack[len(stack)-1], nil
+}
+
+// unwindStep recovers the registers of the frame that called the one
+// described by regs. lookup is the address used to find the unwind rules;
+// for frames other than the innermost, it's one before the return address so
+// that it lands inside the call instruction. done is set at the outermost
+// frame.
+func (p *Process) unwindStep(regs *unwindRegs, lookup uint64) (next unwindRegs,
+                                                             signal, done bool,
+                                                             err error) {
+  var entry *fde
+  var table *frameTable
+  m := p.ModuleAt(lookup)
+  if m != nil {
+    table = m.frameTable()
+    entry = table.find(lookup - m.Bias)
+  }
+  if entry == nil {
+    return p.unwindFramePointer(regs)
+  }
+
+  row, err := table.row(entry, lookup - m.Bias)
+  if err != nil {
+    return next, false, true, err
+  }
+
+  var cfa uint64
+  if row.cfaExpr != nil {
+    if cfa, err = p.evalExpr(row.cfaExpr, regs); err != nil {
+      return next, false, true, err
+    }
+  } else {
+    if row.cfaReg >= dwRegs || ! regs.ok[row.cfaReg] {
+      return next, false, true, fmt.Errorf("CFA register %d not available", row.cfaReg)
+    }
+    cfa = regs.val[row.cfaReg] + uint64(row.cfaOffset)
+  }
+
+  // Registers without a rule keep their value; the stack pointer is the CFA
+  next = *regs
+  next.val[dwRsp], next.ok[dwRsp] = cfa, true
+
+  word := make([]byte, 8)
+  load := func(addr uint64) (uint64, bool) {
+    if _, err := p.ReadMemory(addr, word); err != nil {
+      return 0, false
+    }
+    return binary.LittleEndian.Uint64(word), true
+  }
+
+  for reg, rule := range row.rules {
+    var v uint64
+    ok := true
+    switch rule.kind {
+    case ruleSame:
+      continue
+    case ruleUndefined:
+      ok = false
+    case ruleOffset:
+      v, ok = load(cfa + uint64(rule.offset))
+    case ruleValOffset:
+      v = cfa + uint64(rule.offset)
+    case ruleRegister:
+      if rule.reg < dwRegs {
+        v, ok = regs.val[rule.reg], regs.ok[rule.reg]
+      } else {
+        ok = false
+      }
+    case ruleExpression:
+      var addr uint64
+      if addr, err = p.evalExpr(rule.expr, regs, cfa); err == nil {
+        v, ok = load(addr)
+      } else {
+        ok = false
+      }
+    case ruleValExpression:
+      v, err = p.evalExpr(rule.expr, regs, cfa)
+      ok = err == nil
+    }
+    next.val[reg], next.ok[reg] = v, ok
+  }
+
+  ra := entry.cie.raReg
+  if ra >= dwRegs || ! next.ok[ra] {
+    return next, entry.cie.signal, true, nil
+  }
+  next.val[dwRip], next.ok[dwRip] = next.val[ra], true
+  return next, entry.cie.signal, false, nil
+}
+
+// unwindFramePointer steps up the stack by following the saved frame
+// pointer, for code without unwind information.
+func (p *Process) unwindFramePointer(regs *unwindRegs) (next unwindRegs, signal,
+                                                        done bool, err error) {
+  next = *regs
+  rbp := regs.val[dwRbp]
+  if ! regs.ok[dwRbp] || rbp == 0 {
+    return next, false, true, nil
+  }
+
+  saved := make([]byte, 16)
+  if _, err := p.ReadMemory(rbp, saved); err != nil {
+    return next, false, true, err
+  }
+  next.val[dwRbp] = binary.LittleEndian.Uint64(saved)
+  next.val[dwRip] = binary.LittleEndian.Uint64(saved[8:])
+  next.val[dwRsp] = rbp + 16
+  return next, false, false, nil
+}
+
+// unwindCall steps out of a function that has only just been called.
+func (p *Process) unwindCall(regs *unwindRegs) (next unwindRegs, done bool,
+                                                err error) {
+  next = *regs
+  ra, err := p.ReadU64(regs.val[dwRsp])
+  if err != nil {
+    return next, true, err
+  }
+  next.val[dwRip] = ra
+  next.val[dwRsp] += 8
+  return next, false, nil
+}
+
+// symbolizeFrame fills in where a frame's code lives.
+func (p *Process) symbolizeFrame(f *Frame, lookup uint64) {
+  m := p.ModuleAt(lookup)
+  if m == nil {
+    return
+  }
+  f.Module = m.Name()
+  f.ModulePC = f.PC - m.Bias
+  if sym, _, ok := m.SymbolAt(lookup); ok {
+    f.Function = sym.Name
+    f.Offset = f.PC - sym.Address
+  }
+}
+
+// Backtrace unwinds the stack of thread tid, or of the current thread if tid
+// is zero, using the modules' .eh_frame information and falling back to the
+// frame pointer chain where there is none. The thread must be stopped. The
+// innermost frame comes first.
+func (p *Process) Backtrace(tid int) ([]Frame, error) {
+  if tid == 0 {
+    tid = p.tid()
+  }
+  state, err := p.backend().getRegisters(tid)
+  if err != nil {
+    return nil, err
+  }
+  regs := unwindRegsFrom(state)
+
+  frames := []Frame{}
+  inner, signal := true, false
+  for len(frames) < maxFrames {
+    pc, sp := regs.val[dwRip], regs.val[dwRsp]
+    if pc == 0 && ! inner {
+      break
+    }
+
+    // A return address is just past the call, which may be the last
+    // instruction of the function; look up the call itself instead. The
+    // exceptions are the innermost frame and frames interrupted by a signal,
+    // which are exactly where they say.
+    lookup := pc
+    if ! inner && ! signal {
+      lookup = pc - 1
+    }
+
+    f := Frame{PC: pc, SP: sp}
+    p.symbolizeFrame(&f, lookup)
+
+    var next unwindRegs
+    var sig, done bool
+    if region := p.Memory.Find(pc); inner && (region == nil || region.Perms&PermExec == 0) {
+      // A call through a bad pointer: nothing has run at the target, so the
+      // return address is still on top of the stack
+      next, done, err = p.unwindCall(&regs)
+    } else {
+      next, sig, done, err = p.unwindStep(&regs, lookup)
+    }
+    f.Signal = sig
+    frames = append(frames, f)
+    if done || err != nil {
+      break
+    }
+    if next.val[dwRip] == pc && next.val[dwRsp] == sp {
+      break
+    }
+    regs, inner, signal = next, false, sig
+  }
+  return frames, nil
+}
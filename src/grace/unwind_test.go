@@ -0,0 +1,362 @@
+/*  Copyright (c) 2012 Yan Ivnitskiy. All rights reserved.
+ *  
+ *  Redistribution and use in source and binary forms, with or without
+ *  modification, are permitted provided that the following conditions are
+ *  met:
+ *  
+ *     * Redistributions of source code must retain the above copyright
+ *  notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above
+ *  copyright notice, this list of conditions and the following disclaimer
+ *  in the documentation and/or other materials provided with the
+ *  distribution.
+ *     * Neither the name of grace nor the names of its
+ *  contributors may be used to endorse or promote products derived from
+ *  this software without specific prior written permission.
+ *  
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ *  "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+ *  LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+ *  A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+ *  OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+ *  SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+ *  LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+ *  DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+ *  THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+ *  (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ *  OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package grace
+
+import (
+  "bytes"
+  "encoding/binary"
+  "testing"
+)
+
+// ehAddr is where the test .eh_frame sections are linked
+const ehAddr = 0x2000
+
+// cieRecord assembles a CIE with a code alignment of 1 and a data alignment
+// of -8, as compilers emit for x86-64.
+func cieRecord(version byte, aug string, augData []byte, insns []byte) []byte {
+  body := []byte{0, 0, 0, 0, version}
+  body = append(body, aug...)
+  body = append(body, 0, 1, 0x78, dwRip)
+  if len(aug) > 0 && aug[0] == 'z' {
+    body = append(body, byte(len(augData)))
+    body = append(body, augData...)
+  }
+  body = append(body, insns...)
+  return withLength(body)
+}
+
+// fdeRecord assembles an FDE that goes at offset at of the section, for the
+// CIE at cieAt, with pc-relative sdata4 addresses.
+func fdeRecord(at, cieAt int, begin, size uint64, insns []byte) []byte {
+  body := make([]byte, 12)
+  binary.LittleEndian.PutUint32(body, uint32(at + 4 - cieAt))
+  binary.LittleEndian.PutUint32(body[4:], uint32(begin - (ehAddr + uint64(at) + 8)))
+  binary.LittleEndian.PutUint32(body[8:], uint32(size))
+  body = append(body, 0)
+  body = append(body, insns...)
+  return withLength(body)
+}
+
+func withLength(body []byte) []byte {
+  b := make([]byte, 4, 4 + len(body))
+  binary.LittleEndian.PutUint32(b, uint32(len(body)))
+  return append(b, body...)
+}
+
+// cieInitial sets up the CFA at a call; prologue follows a push of rbp and
+// a move of rsp into it
+var (
+  cieInitial = []byte{0x0c, dwRsp, 8, 0x80 | dwRip, 1}
+  prologue   = []byte{0x41, 0x0e, 0x10, 0x80 | dwRbp, 2, 0x43, 0x0d, dwRbp}
+)
+
+// ehSection lays out a CIE followed by an FDE running prologue for each of
+// the given [begin, end) ranges.
+func ehSection(ranges ...[2]uint64) []byte {
+  data := cieRecord(1, "zR", []byte{0x1b}, cieInitial)
+  for _, r := range ranges {
+    data = append(data, fdeRecord(len(data), 0, r[0], r[1] - r[0], prologue)...)
+  }
+  return data
+}
+
+func TestParseCIE(t *testing.T) {
+  personality := []byte{0x9b, 0, 0, 0, 0, 0x1b, 0x1b}
+  tests := []struct {
+    name      string
+    data    []byte
+    start     int
+    fdeEnc    byte
+    raReg     uint64
+    signal    bool
+    initial []byte
+    bad       bool
+  }{
+    {"zR", cieRecord(1, "zR", []byte{0x1b}, cieInitial), 0, 0x1b, dwRip, false, cieInitial, false},
+    {"signal frame", cieRecord(3, "zRS", []byte{0x03}, nil), 0, 0x03, dwRip, true, []byte{}, false},
+    {"personality", cieRecord(1, "zPLR", personality, []byte{0}), 0, 0x1b, dwRip, false, []byte{0}, false},
+    {"no augmentation", cieRecord(1, "", nil, cieInitial), 0, 0, dwRip, false, cieInitial, false},
+    {"eh", withLength(append([]byte{0, 0, 0, 0, 1, 'e', 'h', 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x78, dwRip},
+                             cieInitial...)),
+     0, 0, dwRip, false, cieInitial, false},
+    {"length past the end", cieRecord(1, "zR", []byte{0x1b}, cieInitial)[:10], 0, 0, 0, false, nil, true},
+    {"augmentation past the end", withLength([]byte{0, 0, 0, 0, 1, 'z', 'R', 0, 1, 0x78, dwRip, 0x7f, 0x1b}),
+     0, 0, 0, false, nil, true},
+    {"negative start", cieRecord(1, "zR", []byte{0x1b}, cieInitial), -4, 0, 0, false, nil, true},
+    {"start past the end", cieRecord(1, "zR", []byte{0x1b}, cieInitial), 100, 0, 0, false, nil, true},
+  }
+
+  for _, test := range tests {
+    c := parseCIE(test.data, test.start, ehAddr)
+    if test.bad {
+      if c != nil {
+        t.Errorf("%s: parsed %+v", test.name, *c)
+      }
+      continue
+    }
+    if c == nil {
+      t.Errorf("%s: not parsed", test.name)
+      continue
+    }
+    if c.codeAlign != 1 || c.dataAlign != -8 || c.fdeEnc != test.fdeEnc ||
+       c.raReg != test.raReg || c.signal != test.signal || ! bytes.Equal(c.initial, test.initial) {
+      t.Errorf("%s: got %+v", test.name, *c)
+    }
+  }
+}
+
+func TestParseEhFrame(t *testing.T) {
+  good := ehSection([2]uint64{0x1100, 0x1120}, [2]uint64{0x1000, 0x1010})
+  cie := cieRecord(1, "zR", []byte{0x1b}, cieInitial)
+  fde := fdeRecord(len(cie), 0, 0x1000, 0x10, prologue)
+
+  badCIE := fdeRecord(len(cie), -0x1000, 0x1000, 0x10, prologue)
+  longAug := fdeRecord(len(cie), 0, 0x1000, 0x10, nil)
+  longAug[16] = 0x7f
+  huge := append(append([]byte{}, cie...), 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0x80)
+
+  tests := []struct {
+    name    string
+    data  []byte
+    fdes  [][2]uint64
+  }{
+    {"sorted", good, [][2]uint64{{0x1000, 0x1010}, {0x1100, 0x1120}}},
+    {"terminator", append(append(append([]byte{}, cie...), 0, 0, 0, 0), fde...), nil},
+    {"truncated", append(append([]byte{}, cie...), fde[:len(fde)-3]...), nil},
+    {"CIE pointer out of range", append(append([]byte{}, cie...), badCIE...), nil},
+    {"augmentation past the end", append(append([]byte{}, cie...), longAug...), nil},
+    {"huge length", huge, nil},
+    {"empty", nil, nil},
+  }
+
+  for _, test := range tests {
+    table := parseEhFrame(test.data, ehAddr)
+    if len(table.fdes) != len(test.fdes) {
+      t.Errorf("%s: %d FDEs, want %d", test.name, len(table.fdes), len(test.fdes))
+      continue
+    }
+    for i, f := range table.fdes {
+      if f.begin != test.fdes[i][0] || f.end != test.fdes[i][1] {
+        t.Errorf("%s: FDE %d covers 0x%x-0x%x", test.name, i, f.begin, f.end)
+      }
+    }
+  }
+
+  table := parseEhFrame(good, ehAddr)
+  for pc, begin := range map[uint64]uint64{0x1000: 0x1000, 0x100f: 0x1000, 0x1010: 0,
+                                           0x1105: 0x1100, 0x1120: 0, 0xfff: 0} {
+    f := table.find(pc)
+    if (f == nil && begin != 0) || (f != nil && f.begin != begin) {
+      t.Errorf("find(0x%x) = %v, want FDE at 0x%x", pc, f, begin)
+    }
+  }
+}
+
+func TestCFAExecute(t *testing.T) {
+  c := &cie{codeAlign: 1, dataAlign: -8, raReg: dwRip}
+  initial := unwindRow{}
+  if err := c.execute(cieInitial, 0, ^uint64(0), 0, &initial, nil); err != nil {
+    t.Fatal(err)
+  }
+
+  offset := func(n int64) regRule {
+    return regRule{kind: ruleOffset, offset: n}
+  }
+  tests := []struct {
+    name      string
+    insns   []byte
+    target    uint64
+    cfaReg    uint64
+    cfaOffset int64
+    rbp       regRule
+    err       bool
+  }{
+    {"entry", prologue, 0x1000, dwRsp, 8, regRule{}, false},
+    {"after push", prologue, 0x1001, dwRsp, 16, offset(-16), false},
+    {"frame pointer", prologue, 0x1004, dwRbp, 16, offset(-16), false},
+    {"far past", prologue, 0x9000, dwRbp, 16, offset(-16), false},
+    {"remembered", []byte{0x0a, 0x0e, 0x20, 0x41, 0x0b}, 0x1000, dwRsp, 32, regRule{}, false},
+    {"restored state", []byte{0x0a, 0x0e, 0x20, 0x41, 0x0b}, 0x1001, dwRsp, 8, regRule{}, false},
+    {"restore", []byte{0x86, 0x02, 0x41, 0xc6}, 0x1001, dwRsp, 8, regRule{}, false},
+    {"advance_loc2 before", []byte{0x03, 0x00, 0x01, 0x0e, 0x18}, 0x10ff, dwRsp, 8, regRule{}, false},
+    {"advance_loc2 after", []byte{0x03, 0x00, 0x01, 0x0e, 0x18}, 0x1100, dwRsp, 24, regRule{}, false},
+    {"def_cfa_sf", []byte{0x12, dwRbp, 0x7e}, 0x1000, dwRbp, 16, regRule{}, false},
+    {"val_offset", []byte{0x14, dwRbp, 1}, 0x1000, dwRsp, 8, regRule{kind: ruleValOffset, offset: -8}, false},
+    {"register", []byte{0x09, dwRbp, dwRbx}, 0x1000, dwRsp, 8, regRule{kind: ruleRegister, reg: dwRbx}, false},
+    {"unbalanced restore_state", []byte{0x0b}, 0x1000, 0, 0, regRule{}, true},
+    {"unknown", []byte{0x3f}, 0x1000, 0, 0, regRule{}, true},
+    {"truncated", []byte{0x0c, dwRbp}, 0x1000, 0, 0, regRule{}, true},
+    {"expression past the end", []byte{0x0f, 0x10, 0x77}, 0x1000, 0, 0, regRule{}, true},
+  }
+
+  for _, test := range tests {
+    row := initial
+    err := c.execute(test.insns, 0x1000, test.target, 0, &row, &initial)
+    if (err != nil) != test.err {
+      t.Errorf("%s: error %v", test.name, err)
+      continue
+    }
+    if test.err {
+      continue
+    }
+    if row.cfaReg != test.cfaReg || row.cfaOffset != test.cfaOffset {
+      t.Errorf("%s: CFA is r%d%+d, want r%d%+d", test.name, row.cfaReg, row.cfaOffset,
+               test.cfaReg, test.cfaOffset)
+    }
+    if rule := row.rules[dwRbp]; rule.kind != test.rbp.kind || rule.offset != test.rbp.offset ||
+                                 rule.reg != test.rbp.reg {
+      t.Errorf("%s: rbp rule %+v, want %+v", test.name, rule, test.rbp)
+    }
+    if rule := row.rules[dwRip]; rule.kind != ruleOffset || rule.offset != -8 {
+      t.Errorf("%s: return address rule %+v", test.name, row.rules[dwRip])
+    }
+  }
+}
+
+func TestEvalExpr(t *testing.T) {
+  data := make([]byte, 16)
+  binary.LittleEndian.PutUint64(data, 0x1122334455667788)
+  p := &Process{Memory: &MemoryMap{}, target: &memBackend{0x7000, data}}
+  regs := unwindRegs{}
+  regs.val[dwRsp], regs.ok[dwRsp] = 0x7000, true
+
+  tests := []struct {
+    name    string
+    expr  []byte
+    stack []uint64
+    want    uint64
+    err     bool
+  }{
+    {"plus", []byte{0x35, 0x37, 0x22}, nil, 12, false},
+    {"minus", []byte{0x31, 0x33, 0x1c, 0x1f}, nil, 2, false},
+    {"initial stack", []byte{0x23, 0x04}, []uint64{0x10}, 0x14, false},
+    {"breg", []byte{0x70 + dwRsp, 0x08}, nil, 0x7008, false},
+    {"bregx", []byte{0x92, dwRsp, 0x78}, nil, 0x6ff8, false},
+    {"deref", []byte{0x70 + dwRsp, 0, 0x06}, nil, 0x1122334455667788, false},
+    {"deref_size", []byte{0x70 + dwRsp, 0, 0x94, 4}, nil, 0x55667788, false},
+    {"deref_size too big", []byte{0x70 + dwRsp, 0, 0x94, 9}, nil, 0, true},
+    {"deref unreadable", []byte{0x0c, 0, 0x90, 0, 0, 0x06}, nil, 0, true},
+    {"bra taken", []byte{0x35, 0x31, 0x28, 1, 0, 0x32}, nil, 5, false},
+    {"bra not taken", []byte{0x35, 0x30, 0x28, 1, 0, 0x32}, nil, 2, false},
+    {"bra before the start", []byte{0x31, 0x28, 0xf0, 0xff}, nil, 0, true},
+    {"skip", []byte{0x37, 0x2f, 1, 0, 0xff}, nil, 7, false},
+    {"skip before the start", []byte{0x2f, 0xf0, 0xff}, nil, 0, true},
+    {"register unavailable", []byte{0x50 + dwRbp}, nil, 0, true},
+    {"division by zero", []byte{0x31, 0x30, 0x1b}, nil, 0, true},
+    {"pick out of range", []byte{0x31, 0x15, 5}, nil, 0, true},
+    {"pick", []byte{0x31, 0x32, 0x15, 1}, nil, 1, false},
+    {"underflow", []byte{0x22}, nil, 0, true},
+    {"empty", nil, nil, 0, true},
+    {"unsupported", []byte{0xff}, nil, 0, true},
+    {"truncated", []byte{0x0c, 1}, nil, 0, true},
+  }
+
+  for _, test := range tests {
+    v, err := p.evalExpr(test.expr, &regs, test.stack...)
+    if (err != nil) != test.err {
+      t.Errorf("%s: error %v", test.name, err)
+    } else if v != test.want {
+      t.Errorf("%s: got 0x%x, want 0x%x", test.name, v, test.want)
+    }
+  }
+}
+
+// stackBackend is a memBackend with a single thread, stopped with regs
+type stackBackend struct {
+  memBackend
+  regs  RegisterState
+}
+
+func (b *stackBackend) getRegisters(tid int) (*RegisterState, error) {
+  regs := b.regs
+  return &regs, nil
+}
+
+func TestBacktrace(t *testing.T) {
+  // leaf has unwind information, main only a frame pointer; broken has
+  // a CFA expression that can't be evaluated
+  eh := ehSection([2]uint64{0x100, 0x120})
+  eh = append(eh, fdeRecord(len(eh), 0, 0x300, 0x10, []byte{0x0f, 4, 0x77, 0, 0x94, 9})...)
+  m := &Module{Path: "/bin/app", Start: 0x400000, End: 0x401000, Bias: 0x400000, loaded: true,
+               symbols: []Symbol{{"leaf", 0x100, 0x20, true}, {"main", 0x200, 0x40, true},
+                                 {"broken", 0x300, 0x10, true}},
+               frames: parseEhFrame(eh, ehAddr)}
+  memory := &MemoryMap{Regions: []MemoryRegion{
+    {Address: 0x7000, Size: 0x1000, Perms: PermRead | PermWrite},
+    {Address: 0x400000, Size: 0x1000, Perms: PermRead | PermExec},
+  }}
+
+  // leaf's frame at 0x7e00 holds main's frame pointer and return address;
+  // main's frame at 0x7f00 ends the chain
+  stack := make([]byte, 0x1000)
+  binary.LittleEndian.PutUint64(stack[0xe00:], 0x7f00)
+  binary.LittleEndian.PutUint64(stack[0xe08:], 0x400210)
+
+  type frame struct {
+    function  string
+    offset    uint64
+  }
+  tests := []struct {
+    name      string
+    rip, rsp, rbp  uint64
+    frames  []frame
+  }{
+    {"in body", 0x400108, 0x7e00, 0x7e00, []frame{{"leaf", 8}, {"main", 0x10}}},
+    {"at entry", 0x400100, 0x7e08, 0x7f00, []frame{{"leaf", 0}, {"main", 0x10}}},
+    {"bad call", 0xdead0000, 0x7e08, 0x7f00, []frame{{"", 0}, {"main", 0x10}}},
+    {"no unwind information", 0x400220, 0x7f00, 0x7f00, []frame{{"main", 0x20}}},
+    {"bad CFA expression", 0x400304, 0x7e00, 0x7e00, []frame{{"broken", 4}}},
+  }
+
+  for _, test := range tests {
+    backend := &stackBackend{memBackend{0x7000, stack},
+                             RegisterState{Rip: test.rip, Rsp: test.rsp, Rbp: test.rbp}}
+    p := &Process{Memory: memory, modules: []*Module{m}, modulesMap: memory, target: backend}
+    frames, err := p.Backtrace(1)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    got := []frame{}
+    for _, f := range frames {
+      got = append(got, frame{f.Function, f.Offset})
+    }
+    if len(got) != len(test.frames) {
+      t.Errorf("%s: got %v, want %v", test.name, got, test.frames)
+      continue
+    }
+    for i := range got {
+      if got[i] != test.frames[i] {
+        t.Errorf("%s: got %v, want %v", test.name, got, test.frames)
+        break
+      }
+    }
+  }
+}